@@ -67,6 +67,27 @@ func optionalVar(fs *pflag.FlagSet, value ssh.OptionalValue, name, usage string)
 	return value
 }
 
+// logGitProgress logs how the upstream's objects are coming along,
+// for clones and fetches that take long enough for it to look like
+// nothing's happening; every ten seconds, from ten seconds in.
+func logGitProgress(logger log.Logger) git.ProgressFunc {
+	const every = 10 * time.Second
+	var mu sync.Mutex
+	logged := map[git.Operation]time.Duration{}
+	return func(p git.Progress) {
+		if p.Remote || p.Elapsed < every {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if last, ok := logged[p.Op]; ok && p.Elapsed > last && p.Elapsed-last < every {
+			return
+		}
+		logged[p.Op] = p.Elapsed
+		logger.Log("progress", fmt.Sprintf("%s %d%% (%d/%d objects)", p.Op, p.Percent, p.Done, p.Total), "stage", p.Stage)
+	}
+}
+
 func main() {
 	// Flag domain.
 	fs := pflag.NewFlagSet("default", pflag.ContinueOnError)
@@ -92,17 +113,38 @@ func main() {
 		gitSetAuthor = fs.Bool("git-set-author", false, "if set, the author of git commits will reflect the user who initiated the commit and will differ from the git committer.")
 		gitLabel     = fs.String("git-label", "", "label to keep track of sync progress; overrides both --git-sync-tag and --git-notes-ref")
 		// Old git config; still used if --git-label is not supplied, but --git-label is preferred.
-		gitSyncTag     = fs.String("git-sync-tag", defaultGitSyncTag, "tag to use to mark sync progress for this cluster")
-		gitNotesRef    = fs.String("git-notes-ref", defaultGitNotesRef, "ref to use for keeping commit annotations in git notes")
-		gitSkip        = fs.Bool("git-ci-skip", false, `append "[ci skip]" to commit messages so that CI will skip builds`)
-		gitSkipMessage = fs.String("git-ci-skip-message", "", "additional text for commit messages, useful for skipping builds in CI. Use this to supply specific text, or set --git-ci-skip")
+		gitSyncTag       = fs.String("git-sync-tag", defaultGitSyncTag, "tag to use to mark sync progress for this cluster")
+		gitNotesRef      = fs.String("git-notes-ref", defaultGitNotesRef, "ref to use for keeping commit annotations in git notes")
+		gitSkip          = fs.Bool("git-ci-skip", false, `append "[ci skip]" to commit messages so that CI will skip builds`)
+		gitSkipMessage   = fs.String("git-ci-skip-message", "", "additional text for commit messages, useful for skipping builds in CI. Use this to supply specific text, or set --git-ci-skip")
+		gitForwardOnly   = fs.Bool("git-sync-tag-forward-only", false, "refuse to move the sync tag to a commit that doesn't have the one it's at in its history, e.g., after a force push to the branch")
+		gitSkipPlacement = fs.String("git-ci-skip-placement", string(git.SkipInline), "where the text from --git-ci-skip-message goes in commit messages: inline (appended to the message), newline (on a line of its own), trailer (after any trailers) or prefix (before the message)")
 
 		gitPollInterval = fs.Duration("git-poll-interval", 5*time.Minute, "period at which to poll git repo for new commits")
 		gitTimeout      = fs.Duration("git-timeout", 20*time.Second, "duration after which git operations time out")
+		gitLockTimeout  = fs.Duration("git-lock-timeout", 0, "give up on a git operation if it has waited this long for another to finish with the local copy of the repo, and report which it was; 0 means wait indefinitely")
+		gitGCEvery      = fs.Int("git-gc-every", 0, "garbage collect the local copy of the git repo after this many fetches; 0 means never")
+		gitMirrorURL    = fs.String("git-mirror-url", "", "URL of a repo to push all the refs of the git repo to after each sync, e.g., as a backup")
+		gitMaxRepoBytes = fs.Int64("git-max-repo-bytes", 0, "give up cloning the git repo if it takes more than this many bytes on disk; 0 means no limit")
+		gitKnownHosts   = fs.String("git-known-hosts-path", "", "path to a known_hosts file to check the git host's SSH key against, instead of that of the user")
+		gitCABundle     = fs.String("git-ca-bundle-path", "", "path to a file of PEM certificates to check the certificate of an HTTPS git host against, instead of the system's; e.g., for a private CA")
+		gitInsecureTLS  = fs.Bool("git-insecure-skip-tls-verify", false, "don't check the certificate of an HTTPS git host at all; insecure, and a last resort if there's no CA bundle to give with --git-ca-bundle-path")
+		gitSSHPersist   = fs.Duration("git-ssh-multiplex", 0, "keep SSH connections to the git host open for this long after they're last used, and share them between git operations; 0 means a new connection each time")
+		gitSubmodules   = fs.String("git-submodules", string(git.SubmodulesNone), "which submodules of the git repo to check out: none, shallow (the repo's own, at only the commits recorded for them), or recursive (all, with their history)")
+		gitAutoCRLF     = fs.String("git-autocrlf", "", "core.autocrlf for the git repo's working clones (true, false or input); if not given, git's default")
+		gitEOL          = fs.String("git-eol", "", "core.eol for the git repo's working clones (lf, crlf or native); if not given, git's default")
+		gitNormalizeEOL = fs.Bool("git-normalize-line-endings", false, "turn off git's conversion of line endings in working clones, and don't commit changes only to line endings; e.g., for repos with files committed with CRLF line endings")
+		gitBootstrap    = fs.Bool("git-allow-bootstrap", false, "create the git branch, starting with an empty commit, if it doesn't exist (e.g., because the repo is empty)")
+		gitHostKeys     = fs.String("git-host-key-verification", "", "how to check the git host's SSH key: strict (only known hosts), accept-new (remember new hosts, refuse changed keys), or insecure (don't check); if not given, ssh's own configuration is used")
+		gitPostBuffer   = fs.Int64("git-http-post-buffer", 0, "size in bytes above which pushes over HTTP(S) are sent in chunks (git's http.postBuffer); raise it if big pushes fail with \"the remote end hung up unexpectedly\". 0 means git's default, 1 MiB")
+		gitPackWindow   = fs.Int64("git-pack-window-memory", 0, "bytes git may use, per thread, looking for deltas when packing objects to push (git's pack.windowMemory); 0 means no limit")
+		gitLogCommands  = fs.Bool("git-log-commands", false, "log each git command run, with how long it took and any error (secrets are redacted); verbose, but useful for debugging problems with git")
+		gitPushOptions  = fs.StringSlice("git-push-option", nil, "push option to send when pushing commits, as with git push -o; e.g., merge_request.create for GitLab. Left out if the git host doesn't take push options. Can be given more than once")
 
 		// GPG commit signing
 		gitImportGPG  = fs.String("git-gpg-key-import", "", "keys at the path given (either a file or a directory) will be imported for use in signing commits")
-		gitSigningKey = fs.String("git-signing-key", "", "if set, commits will be signed with this GPG key")
+		gitSigningKey = fs.String("git-signing-key", "", "if set, commits will be signed with this GPG key (given by ID, fingerprint, or user ID e.g., email address)")
+		gitCheckSign  = fs.Bool("git-check-signing-config", false, "without --git-signing-key, refuse to commit if the git config has commit.gpgSign set, rather than let git try to sign with a key of its choosing")
 
 		// syncing
 		syncInterval = fs.Duration("sync-interval", 5*time.Minute, "apply config in git to cluster at least this often, even if there are no new commits")
@@ -207,6 +249,17 @@ func main() {
 		}
 	}
 
+	hostKeyVerification, err := git.ParseHostKeyVerification(*gitHostKeys)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	submodules, err := git.ParseSubmoduleMode(*gitSubmodules)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+
 	if *sshKeygenDir == "" {
 		logger.Log("info", fmt.Sprintf("SSH keygen dir (--ssh-keygen-dir) not provided, so using the deploy key volume (--k8s-secret-volume-mount-path=%s); this may cause problems if the deploy key volume is mounted read-only", *k8sSecretVolumeMountPath))
 		*sshKeygenDir = *k8sSecretVolumeMountPath
@@ -442,18 +495,42 @@ func main() {
 
 	gitRemote := git.Remote{URL: *gitURL}
 	gitConfig := git.Config{
-		Paths:       *gitPath,
-		Branch:      *gitBranch,
-		SyncTag:     *gitSyncTag,
-		NotesRef:    *gitNotesRef,
-		UserName:    *gitUser,
-		UserEmail:   *gitEmail,
-		SigningKey:  *gitSigningKey,
-		SetAuthor:   *gitSetAuthor,
-		SkipMessage: *gitSkipMessage,
+		Paths:                *gitPath,
+		Branch:               *gitBranch,
+		SyncTag:              *gitSyncTag,
+		NotesRef:             *gitNotesRef,
+		SyncTagForwardOnly:   *gitForwardOnly,
+		UserName:             *gitUser,
+		UserEmail:            *gitEmail,
+		SigningKey:           *gitSigningKey,
+		CheckSigningConfig:   *gitCheckSign,
+		SetAuthor:            *gitSetAuthor,
+		SkipMessage:          *gitSkipMessage,
+		SkipMessagePlacement: git.SkipPlacement(*gitSkipPlacement),
+		MaxRepoBytes:         *gitMaxRepoBytes,
+		AllowBootstrap:       *gitBootstrap,
+		Submodules:           submodules,
+		AutoCRLF:             *gitAutoCRLF,
+		EOL:                  *gitEOL,
+		NormalizeLineEndings: *gitNormalizeEOL,
+		PushOptions:          *gitPushOptions,
 	}
 
-	repo := git.NewRepo(gitRemote, git.PollInterval(*gitPollInterval), git.Timeout(*gitTimeout))
+	repoOptions := []git.Option{git.PollInterval(*gitPollInterval), git.Timeout(*gitTimeout), git.LockTimeout(*gitLockTimeout), git.GCEvery(*gitGCEvery), git.MaxRepoBytes(*gitMaxRepoBytes), git.HTTPPostBuffer(*gitPostBuffer), git.PackWindowMemory(*gitPackWindow), git.KnownHostsPath(*gitKnownHosts), hostKeyVerification, git.CABundlePath(*gitCABundle), git.InsecureSkipTLSVerify(*gitInsecureTLS), git.SSHMultiplexing(*gitSSHPersist), git.ObserveWith(daemon.GitObserver{}), logGitProgress(log.With(logger, "component", "git"))}
+	if *gitLogCommands {
+		repoOptions = append(repoOptions, git.LogWith(log.With(logger, "component", "git")))
+	} else if *gitInsecureTLS {
+		// otherwise the repo logs this itself
+		logger.Log("warning", git.ErrInsecureTLS)
+	}
+	repo := git.NewRepo(gitRemote, repoOptions...)
+	// Clear out any clones left behind by an earlier run, e.g., one
+	// that was killed mid-clone.
+	if removed, err := repo.CleanupStale(); err != nil {
+		logger.Log("component", "git", "info", "removing stale temporary directories", "err", err)
+	} else if len(removed) > 0 {
+		logger.Log("component", "git", "info", "removed stale temporary directories", "count", len(removed))
+	}
 	{
 		shutdownWg.Add(1)
 		go func() {
@@ -487,6 +564,7 @@ func main() {
 		ImageRefresh:   make(chan image.Name, 100), // size chosen by fair dice roll
 		Repo:           repo,
 		GitConfig:      gitConfig,
+		GitMirror:      git.Remote{URL: *gitMirrorURL},
 		Jobs:           jobs,
 		JobStatusCache: &job.StatusCache{Size: 100},
 		Logger:         log.With(logger, "component", "daemon"),
@@ -49,6 +49,7 @@ type Daemon struct {
 	ImageRefresh   chan image.Name
 	Repo           *git.Repo
 	GitConfig      git.Config
+	GitMirror      git.Remote // if it has a URL, the repo is pushed here after each sync
 	Jobs           *job.Queue
 	JobStatusCache *job.StatusCache
 	EventWriter    event.EventWriter
@@ -76,8 +77,11 @@ func (d *Daemon) getResources(ctx context.Context) (map[string]resource.Resource
 	var resources map[string]resource.Resource
 	var globalReadOnly v6.ReadOnlyReason
 	err := d.WithClone(ctx, func(checkout *git.Checkout) error {
-		var err error
-		resources, err = d.Manifests.LoadManifests(checkout.Dir(), checkout.ManifestDirs())
+		files, err := checkout.ManifestFiles(ctx)
+		if err != nil {
+			return err
+		}
+		resources, err = d.Manifests.LoadManifests(checkout.Dir(), files)
 		return err
 	})
 
@@ -376,6 +380,11 @@ func (d *Daemon) updatePolicy(spec update.Spec, updates policy.Updates) updateFu
 		// automation run straight ASAP.
 		var anythingAutomated bool
 
+		files, err := working.ManifestFiles(ctx)
+		if err != nil {
+			return result, err
+		}
+
 		for workloadID, u := range updates {
 			if d.Cluster.IsAllowedResource(workloadID) {
 				result.Result[workloadID] = update.WorkloadResult{
@@ -386,7 +395,7 @@ func (d *Daemon) updatePolicy(spec update.Spec, updates policy.Updates) updateFu
 				anythingAutomated = true
 			}
 			// find the workload manifest
-			err := cluster.UpdateManifest(d.Manifests, working.Dir(), working.ManifestDirs(), workloadID, func(def []byte) ([]byte, error) {
+			err := cluster.UpdateManifest(d.Manifests, working.Dir(), files, workloadID, func(def []byte) ([]byte, error) {
 				newDef, err := d.Manifests.UpdatePolicies(def, workloadID, u)
 				if err != nil {
 					result.Result[workloadID] = update.WorkloadResult{
@@ -431,7 +440,9 @@ func (d *Daemon) updatePolicy(spec update.Spec, updates policy.Updates) updateFu
 			Author:  commitAuthor,
 			Message: policyCommitMessage(updates, spec.Cause),
 		}
-		if err := working.CommitAndPush(ctx, commitAction, &note{JobID: jobID, Spec: spec}); err != nil {
+		// No changes means the policies were already as asked, which
+		// is not a failure.
+		if _, err := working.CommitAndPush(ctx, commitAction, &note{JobID: jobID, Spec: spec}); err != nil && err != git.ErrNoChanges {
 			// On the chance pushing failed because it was not
 			// possible to fast-forward, ask for a sync so the
 			// next attempt is more likely to succeed.
@@ -442,7 +453,6 @@ func (d *Daemon) updatePolicy(spec update.Spec, updates policy.Updates) updateFu
 			d.AskForImagePoll()
 		}
 
-		var err error
 		result.Revision, err = working.HeadRevision(ctx)
 		if err != nil {
 			return result, err
@@ -476,7 +486,7 @@ func (d *Daemon) release(spec update.Spec, c release.Changes) updateFunc {
 				Author:  commitAuthor,
 				Message: commitMsg,
 			}
-			if err := working.CommitAndPush(ctx, commitAction, &note{JobID: jobID, Spec: spec, Result: result}); err != nil {
+			if _, err := working.CommitAndPush(ctx, commitAction, &note{JobID: jobID, Spec: spec, Result: result}); err != nil && err != git.ErrNoChanges {
 				// On the chance pushing failed because it was not
 				// possible to fast-forward, ask the repo to fetch
 				// from upstream ASAP, so the next attempt is more
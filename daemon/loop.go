@@ -5,7 +5,6 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -88,6 +87,8 @@ func (d *Daemon) Loop(stop chan struct{}, wg *sync.WaitGroup, logger log.Logger)
 			}
 			if err := d.doSync(logger, &lastKnownSyncTagRev, &warnedAboutSyncTagChange); err != nil {
 				logger.Log("err", err)
+			} else if d.GitMirror.URL != "" {
+				go d.pushToMirror(logger)
 			}
 			syncTimer.Reset(d.SyncInterval)
 		case <-syncTimer.C:
@@ -182,7 +183,7 @@ func (d *Daemon) doSync(logger log.Logger, lastKnownSyncTagRev *string, warnedAb
 
 	// For comparison later.
 	oldTagRev, err := working.SyncRevision(ctx)
-	if err != nil && !isUnknownRevision(err) {
+	if _, notFound := err.(git.RefNotFoundError); err != nil && !notFound {
 		return err
 	}
 	// Check if something other than the current instance of fluxd changed the sync tag.
@@ -200,7 +201,11 @@ func (d *Daemon) doSync(logger log.Logger, lastKnownSyncTagRev *string, warnedAb
 	}
 
 	// Get a map of all resources defined in the repo
-	allResources, err := d.Manifests.LoadManifests(working.Dir(), working.ManifestDirs())
+	manifestFiles, err := working.ManifestFiles(ctx)
+	if err != nil {
+		return errors.Wrap(err, "finding manifest files in repo")
+	}
+	allResources, err := d.Manifests.LoadManifests(working.Dir(), manifestFiles)
 	if err != nil {
 		return errors.Wrap(err, "loading resources from repo")
 	}
@@ -430,6 +435,11 @@ func (d *Daemon) doSync(logger log.Logger, lastKnownSyncTagRev *string, warnedAb
 			tagAction := git.TagAction{
 				Revision: newTagRev,
 				Message:  "Sync pointer",
+				State: &git.SyncState{
+					Revision:    newTagRev,
+					Time:        time.Now().UTC(),
+					FluxVersion: d.V,
+				},
 			}
 			err := working.MoveSyncTagAndPush(ctx, tagAction)
 			cancel()
@@ -449,10 +459,16 @@ func (d *Daemon) doSync(logger log.Logger, lastKnownSyncTagRev *string, warnedAb
 	return nil
 }
 
-func isUnknownRevision(err error) bool {
-	return err != nil &&
-		(strings.Contains(err.Error(), "unknown revision or path not in the working tree.") ||
-			strings.Contains(err.Error(), "bad revision"))
+// pushToMirror brings the mirror repo, if there is one, up to date
+// with the repo. It's done in the background after a sync; failing
+// to update the mirror is logged, but doesn't count as the sync
+// failing.
+func (d *Daemon) pushToMirror(logger log.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.GitOpTimeout)
+	defer cancel()
+	if err := d.Repo.MirrorTo(ctx, d.GitMirror, nil); err != nil {
+		logger.Log("mirror", d.GitMirror.SafeURL(), "err", err)
+	}
 }
 
 func makeGitConfigHash(remote git.Remote, conf git.Config) string {
@@ -247,7 +247,7 @@ func TestDoSync_WithNewCommit(t *testing.T) {
 		}
 
 		commitAction := git.CommitAction{Author: "", Message: "test commit"}
-		err = checkout.CommitAndPush(ctx, commitAction, nil)
+		_, err = checkout.CommitAndPush(ctx, commitAction, nil)
 		if err != nil {
 			return err
 		}
@@ -1,9 +1,13 @@
 package daemon
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/go-kit/kit/metrics/prometheus"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 
+	"github.com/weaveworks/flux/git"
 	fluxmetrics "github.com/weaveworks/flux/metrics"
 )
 
@@ -44,4 +48,26 @@ var (
 		Name:      "queue_length_count",
 		Help:      "Count of jobs waiting in the queue to be run.",
 	}, []string{})
+
+	// Fetches and pushes are usually done in a second or two; clones
+	// of big repos can take much longer.
+	gitOperationDuration = prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Namespace: "flux",
+		Subsystem: "git",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of git operations (clone, fetch, commit, push, gc), in seconds.",
+		Buckets:   []float64{0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{fluxmetrics.LabelOperation, fluxmetrics.LabelURL, fluxmetrics.LabelSuccess})
 )
+
+// GitObserver records git operations as Prometheus metrics. Give it
+// to the repo with `git.ObserveWith`.
+type GitObserver struct{}
+
+func (GitObserver) ObserveOperation(op git.Operation, url string, took time.Duration, err error) {
+	gitOperationDuration.With(
+		fluxmetrics.LabelOperation, string(op),
+		fluxmetrics.LabelURL, url,
+		fluxmetrics.LabelSuccess, fmt.Sprint(err == nil),
+	).Observe(took.Seconds())
+}
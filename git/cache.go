@@ -0,0 +1,112 @@
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CacheDir is an Option giving a directory for keeping reference
+// clones in, one for each upstream URL, which the mirrors of Repos
+// with the same upstream borrow objects from (as with `git clone
+// --reference`) rather than each having their own copy; e.g., when
+// watching several branches of one upstream as separate Repos.
+//
+// A reference clone is brought up to date whenever a Repo using it
+// makes its mirror, and only ever gains objects, since the mirrors
+// borrowing them may still need them; it's never garbage collected.
+// Repos in the same process take turns with the cache, but it
+// mustn't be shared with other processes.
+type CacheDir string
+
+func (d CacheDir) apply(r *Repo) {
+	r.cacheDir = string(d)
+}
+
+// cacheLocks has a lock for each reference clone in use by this
+// process, so that only one Repo at a time fetches into it, or makes
+// a mirror from it.
+var cacheLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+func cacheLock(path string) *sync.Mutex {
+	cacheLocks.Lock()
+	defer cacheLocks.Unlock()
+	l, ok := cacheLocks.locks[path]
+	if !ok {
+		l = &sync.Mutex{}
+		cacheLocks.locks[path] = l
+	}
+	return l
+}
+
+// referencePath gives where in the cache directory given the
+// reference clone for the upstream URL given goes. The URL is hashed
+// to make the name, so that it's safe as a file name, and so any
+// credentials in it don't end up on disk.
+func referencePath(cacheDir, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:16])+".git")
+}
+
+// mirrorWithReference makes a mirror of the upstream as mirror does,
+// borrowing objects from the reference clone for the upstream in the
+// cache directory given. The reference clone is made first if it
+// doesn't exist yet, and otherwise brought up to date.
+func mirrorWithReference(ctx context.Context, gexec gitExec, workingDir, cacheDir, repoURL string, maxBytes int64, env []string, progress ProgressFunc) (string, error) {
+	reference := referencePath(cacheDir, repoURL)
+	l := cacheLock(reference)
+	l.Lock()
+	defer l.Unlock()
+	if err := updateReference(ctx, gexec, reference, repoURL, env, progress); err != nil {
+		return "", err
+	}
+	return mirror(ctx, gexec, workingDir, repoURL, maxBytes, env, reference, progress)
+}
+
+// updateReference makes the reference clone at the path given, or if
+// it's there already, fetches anything new into it. Most of what
+// there is to fetch for a new mirror is fetched here, so it's
+// reported as progress with the mirror's.
+func updateReference(ctx context.Context, gexec gitExec, reference, repoURL string, env []string, progress ProgressFunc) error {
+	if _, err := os.Stat(reference); err == nil {
+		// No --prune, since mirrors may borrow the objects of refs
+		// since deleted.
+		extra, progressOut := progressArgs(OpClone, progress)
+		args := append(append([]string{"fetch", "--no-auto-gc"}, extra...), repoURL, "+refs/*:refs/*")
+		if err := execGitCmd(ctx, args, gitCmdConfig{dir: reference, exec: gexec, env: env, errOut: progressOut}); err != nil {
+			return errors.Wrap(err, "updating reference clone")
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Clone to one side, so a failure part way through doesn't
+	// leave a reference clone that's missing things.
+	if err := os.MkdirAll(filepath.Dir(reference), 0700); err != nil {
+		return err
+	}
+	tmp := reference + ".new"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	extra, progressOut := progressArgs(OpClone, progress)
+	args := append(append([]string{"clone", "--mirror"}, extra...), repoURL, tmp)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: filepath.Dir(reference), exec: gexec, env: env, errOut: progressOut}); err != nil {
+		os.RemoveAll(tmp)
+		return errors.Wrap(err, "making reference clone")
+	}
+	if err := setConfig(ctx, gexec, tmp, "gc.auto", "0"); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, reference)
+}
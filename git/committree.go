@@ -0,0 +1,322 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CommitTree commits the files given, as paths (relative to the top
+// of the repo, with forward slashes) to their contents, and pushes
+// the commit, along with any extra data as a note. A path given with
+// nil contents is deleted; files not given are left as they are.
+//
+// Unlike CommitAndPush, it doesn't write to the working tree or the
+// index, and doesn't move HEAD: the tree is built directly in the
+// object database, on top of the branch as last fetched or pushed
+// (which is usually HEAD). PreCommit is not run, since there are no
+// files for it to look at. If the push is rejected and PushRetries
+// allows, the files are committed afresh on top of the upstream
+// branch, rather than rebased. Like CommitAndPush, it returns
+// ErrNoChanges if the files are already as given, unless AllowEmpty
+// is set.
+func (c *Checkout) CommitTree(ctx context.Context, files map[string][]byte, commitAction CommitAction, note interface{}) (_ PushResult, err error) {
+	defer zero(commitAction.GPGPassphrase)
+
+	if err := c.ensureOnBranch(ctx); err != nil {
+		return PushResult{}, err
+	}
+	if commitAction, err = c.prepareAction(ctx, commitAction); err != nil {
+		return PushResult{}, err
+	}
+	if commitAction.SigningKey, err = resolveSigningKey(ctx, commitAction.SigningKey, c.env); err != nil {
+		return PushResult{}, err
+	}
+	if err := c.checkSigningRequired(ctx, commitAction.SigningKey); err != nil {
+		return PushResult{}, err
+	}
+	branch := c.config.Branch
+	if commitAction.CommitBranch != "" {
+		branch = commitAction.CommitBranch
+	}
+
+	// Write all the blobs once, since they'll be the same however
+	// many times the commit is made.
+	blobs, err := writeBlobs(ctx, c.exec, c.dir, files)
+	if err != nil {
+		return PushResult{}, err
+	}
+
+	upstreamBranch := c.pushedRef(branch)
+	base := upstreamBranch
+	if ok, err := refExists(ctx, c.exec, c.dir, upstreamBranch); err != nil {
+		return PushResult{}, err
+	} else if !ok {
+		base = "HEAD"
+	}
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		rev, changes, err := c.commitTree(ctx, base, blobs, commitAction)
+		observe(c.observer, OpCommit, c.upstream, start, err)
+		if err != nil {
+			return PushResult{}, err
+		}
+		if err := checkOnlyPaths(changes, commitAction.OnlyPaths); err != nil {
+			return PushResult{}, err
+		}
+		if note != nil {
+			if err := addNote(ctx, c.exec, c.dir, rev, c.config.NotesRef, note); err != nil {
+				return PushResult{}, err
+			}
+		}
+
+		start = time.Now()
+		err = c.pushRevAndNotes(ctx, rev, branch)
+		observe(c.observer, OpPush, c.pushTo, start, err)
+		if err == nil {
+			if err := updateRef(ctx, c.exec, c.dir, upstreamBranch, rev); err != nil {
+				return PushResult{}, err
+			}
+			if c.config.PostPush != nil {
+				c.config.PostPush(ctx, c.dir, rev)
+			}
+			return PushResult{Revision: rev, Changes: changes}, nil
+		}
+		if errors.Cause(err) != errPushRejected || c.config.PushRetries == 0 {
+			return PushResult{}, PushError(c.pushTo.URL, err)
+		}
+		if attempt >= c.config.PushRetries {
+			return PushResult{}, PushRejectedError{Attempts: attempt + 1, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return PushResult{}, ctx.Err()
+		case <-time.After(pushRetryBackoff << uint(attempt)):
+		}
+
+		// Someone else got in first; start again from what's
+		// upstream now.
+		_, ok, err := c.fetchUpstreamBranch(ctx, branch)
+		if err != nil {
+			return PushResult{}, err
+		}
+		if err := c.renote(ctx); err != nil {
+			return PushResult{}, err
+		}
+		base = "HEAD"
+		if ok {
+			base = upstreamBranch
+		}
+	}
+}
+
+// commitTree makes a commit of the files given on top of the base
+// given, and returns its revision and what it changed.
+func (c *Checkout) commitTree(ctx context.Context, base string, blobs []treeEntry, commitAction CommitAction) (string, []FileChange, error) {
+	tree, err := buildTree(ctx, c.exec, c.dir, base, blobs)
+	if err != nil {
+		return "", nil, err
+	}
+	changes, err := diffFiles(ctx, c.exec, c.dir, base, tree, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(changes) == 0 && !commitAction.AllowEmpty {
+		return "", nil, ErrNoChanges
+	}
+	rev, err := commitTreeObject(ctx, c.exec, c.dir, tree, base, commitAction, c.env)
+	if err != nil {
+		return "", nil, err
+	}
+	return rev, changes, nil
+}
+
+// pushRevAndNotes pushes the revision given to the branch upstream,
+// along with the notes.
+func (c *Checkout) pushRevAndNotes(ctx context.Context, rev, branch string) error {
+	ctx, cancel := withTimeout(ctx, c.config.PushTimeout)
+	defer cancel()
+	notesRefs, err := c.existingNotesRefs(ctx)
+	if err != nil {
+		return err
+	}
+	refs := append([]string{rev + ":refs/heads/" + branch}, notesRefs...)
+	env, err := c.upstreamEnv(ctx, OpPush)
+	if err != nil {
+		return err
+	}
+	return push(ctx, c.exec, c.dir, c.pushTo.URL, refs, env)
+}
+
+// treeEntry is a file to put in a tree: its path, and the blob with
+// its contents, or no blob if it's to be removed.
+type treeEntry struct {
+	path string
+	blob string
+}
+
+// writeBlobs writes the contents of the files given to the object
+// database, all with one `git fast-import`, and returns the blobs
+// for them, sorted by path.
+func writeBlobs(ctx context.Context, gexec gitExec, workingDir string, files map[string][]byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for p := range files {
+		clean := path.Clean(p)
+		if clean != p || path.IsAbs(p) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+			return nil, fmt.Errorf("path %q is not a clean path relative to the top of the repo", p)
+		}
+		entries = append(entries, treeEntry{path: p})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	in := &bytes.Buffer{}
+	var marked []int
+	for i, entry := range entries {
+		contents := files[entry.path]
+		if contents == nil {
+			continue
+		}
+		marked = append(marked, i)
+		fmt.Fprintf(in, "blob\nmark :%d\ndata %d\n", len(marked), len(contents))
+		in.Write(contents)
+		in.WriteString("\n")
+	}
+	if len(marked) == 0 {
+		return entries, nil
+	}
+	in.WriteString("done\n")
+
+	marks, err := ioutil.TempFile(os.TempDir(), "flux-marks")
+	if err != nil {
+		return nil, err
+	}
+	marks.Close()
+	defer os.Remove(marks.Name())
+	args := []string{"fast-import", "--quiet", "--done", "--export-marks=" + marks.Name()}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, in: in}); err != nil {
+		return nil, errors.Wrap(err, "git fast-import")
+	}
+	out, err := ioutil.ReadFile(marks.Name())
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range splitList(string(out)) {
+		var mark int
+		var blob string
+		if _, err := fmt.Sscanf(line, ":%d %s", &mark, &blob); err != nil || mark < 1 || mark > len(marked) {
+			return nil, fmt.Errorf("unexpected line in git fast-import marks: %q", line)
+		}
+		entries[marked[mark-1]].blob = blob
+	}
+	return entries, nil
+}
+
+// buildTree writes a tree of the base given, with the entries given
+// added, replaced or removed, and returns the tree. A file replaced
+// keeps its mode in the base (e.g., being executable); one added is
+// a regular file. It uses a temporary index, so the checkout's own
+// is left as it is.
+func buildTree(ctx context.Context, gexec gitExec, workingDir, base string, entries []treeEntry) (string, error) {
+	tmpIndex, err := ioutil.TempFile(os.TempDir(), "flux-index")
+	if err != nil {
+		return "", err
+	}
+	tmpIndex.Close()
+	defer os.Remove(tmpIndex.Name())
+	// git won't read an empty file as an index
+	os.Remove(tmpIndex.Name())
+	env := []string{"GIT_INDEX_FILE=" + tmpIndex.Name()}
+
+	if err := execGitCmd(ctx, []string{"read-tree", base}, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return "", errors.Wrap(err, "git read-tree")
+	}
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.path)
+	}
+	modes, err := fileModes(ctx, gexec, workingDir, base, paths)
+	if err != nil {
+		return "", err
+	}
+	info := &bytes.Buffer{}
+	for _, entry := range entries {
+		if entry.blob == "" {
+			fmt.Fprintf(info, "0 %s\t%s\x00", strings.Repeat("0", 40), entry.path)
+			continue
+		}
+		mode, ok := modes[entry.path]
+		if !ok {
+			mode = "100644"
+		}
+		fmt.Fprintf(info, "%s %s\t%s\x00", mode, entry.blob, entry.path)
+	}
+	args := []string{"update-index", "-z", "--index-info"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, in: info}); err != nil {
+		return "", errors.Wrap(err, "git update-index")
+	}
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, []string{"write-tree"}, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		return "", errors.Wrap(err, "git write-tree")
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// fileModes gives the modes of those of the paths given that are
+// files in the tree of the revision given.
+func fileModes(ctx context.Context, gexec gitExec, workingDir, rev string, paths []string) (map[string]string, error) {
+	modes := map[string]string{}
+	if len(paths) == 0 {
+		return modes, nil
+	}
+	out := &bytes.Buffer{}
+	args := append([]string{"ls-tree", "-z", rev, "--"}, paths...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git ls-tree")
+	}
+	for _, line := range strings.Split(out.String(), "\x00") {
+		// <mode> SP <type> SP <object> TAB <path>
+		var mode, typ string
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			continue
+		}
+		if _, err := fmt.Sscanf(line[:tab], "%s %s", &mode, &typ); err != nil {
+			return nil, fmt.Errorf("unexpected line in git ls-tree output: %q", line)
+		}
+		if typ == "blob" {
+			modes[line[tab+1:]] = mode
+		}
+	}
+	return modes, nil
+}
+
+// commitTreeObject makes a commit of the tree given, with the parent
+// given, authored, dated and signed as for the commit action, and
+// returns its revision. It doesn't update any refs.
+func commitTreeObject(ctx context.Context, gexec gitExec, workingDir, tree, parent string, commitAction CommitAction, env []string) (string, error) {
+	gpgArgs, gpgEnv, err := gpgPassphraseArgs(commitAction.SigningKey, commitAction.GPGPassphrase, env)
+	if err != nil {
+		return "", err
+	}
+	env = append(append(gpgEnv, env...), authorEnv(commitAction)...)
+	env = append(env, dateEnv(commitAction.CommitDate)...)
+	args := append(gpgArgs, "commit-tree", tree, "-p", parent, "-m", commitAction.Message)
+	if commitAction.SigningKey != "" {
+		args = append(args, "--gpg-sign="+commitAction.SigningKey)
+	}
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		return "", errors.Wrap(err, "git commit-tree")
+	}
+	return strings.TrimSpace(out.String()), nil
+}
@@ -0,0 +1,212 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	httpsUsernameVar = "FLUX_GIT_HTTPS_USERNAME"
+	httpsPasswordVar = "FLUX_GIT_HTTPS_PASSWORD"
+)
+
+// askpass is supplied as GIT_ASKPASS, and answers git's prompts for a
+// username or password from the environment. This means the
+// credentials never appear in command lines or in the git config on
+// disk. It uses printf rather than echo, since some shells' echo
+// interprets backslashes.
+const askpass = `#!/bin/sh
+case "$1" in
+    Username*) printf '%s\n' "$` + httpsUsernameVar + `" ;;
+    *) printf '%s\n' "$` + httpsPasswordVar + `" ;;
+esac
+`
+
+// gpgProgram is supplied as git's gpg.program when signing with a
+// passphrase-protected key. It gives gpg (or the Config's GPGProgram)
+// the passphrase from the environment on a file descriptor, so it's
+// not in the gpg command line, and uses loopback pinentry so gpg
+// doesn't try to prompt.
+const gpgProgram = `#!/bin/sh
+exec 3<<EOF
+$` + gpgPassphraseVar + `
+EOF
+exec "${` + gpgProgramVar + `:-gpg}" --batch --no-tty --pinentry-mode loopback --passphrase-fd 3 "$@"
+`
+
+// gpgBatchProgram is supplied as git's gpg.program when signing
+// without a passphrase. With loopback pinentry, gpg doesn't need a
+// pinentry program or a terminal, which there usually aren't in a
+// container; a key that does need a passphrase then fails to sign
+// straight away, rather than gpg waiting for one.
+const gpgBatchProgram = `#!/bin/sh
+exec gpg --batch --no-tty --pinentry-mode loopback "$@"
+`
+
+const gpgPassphraseVar = "FLUX_GPG_PASSPHRASE"
+
+// gpgProgramVar is set in the environment of a checkout's commands
+// to its Config.GPGProgram, if given.
+const gpgProgramVar = "FLUX_GPG_PROGRAM"
+
+// gpgProgramIn gives the GPGProgram set in the environment given, or
+// empty if it's not set.
+func gpgProgramIn(env []string) string {
+	program := ""
+	for _, e := range env {
+		if strings.HasPrefix(e, gpgProgramVar+"=") {
+			program = strings.TrimPrefix(e, gpgProgramVar+"=")
+		}
+	}
+	return program
+}
+
+var (
+	scriptsMu sync.Mutex
+	scripts   = map[string]string{} // script contents -> path
+)
+
+// helperScript writes the script given to a temporary file, once per
+// process, and returns its path.
+func helperScript(name, contents string) (string, error) {
+	scriptsMu.Lock()
+	defer scriptsMu.Unlock()
+	if path, ok := scripts[contents]; ok {
+		return path, nil
+	}
+	f, err := ioutil.TempFile(os.TempDir(), name)
+	if err != nil {
+		return "", errors.Wrap(err, "creating "+name+" script")
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		return "", errors.Wrap(err, "writing "+name+" script")
+	}
+	if err := f.Chmod(0700); err != nil {
+		return "", errors.Wrap(err, "making "+name+" script executable")
+	}
+	scripts[contents] = f.Name()
+	return f.Name(), nil
+}
+
+// gpgPassphraseArgs gives the arguments and environment entries for
+// a git command, run with the environment given, that will sign
+// something with the key given, using the passphrase given, if any.
+func gpgPassphraseArgs(signingKey string, passphrase []byte, env []string) ([]string, []string, error) {
+	if len(passphrase) == 0 {
+		if signingKey == "" {
+			return nil, nil, nil
+		}
+		if program := gpgProgramIn(env); program != "" {
+			return []string{"-c", "gpg.program=" + program}, nil, nil
+		}
+		script, err := helperScript("flux-gpg", gpgBatchProgram)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{"-c", "gpg.program=" + script}, nil, nil
+	}
+	script, err := helperScript("flux-gpg", gpgProgram)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{"-c", "gpg.program=" + script}, []string{gpgPassphraseVar + "=" + string(passphrase)}, nil
+}
+
+// zero overwrites a secret, once it's no longer needed.
+func zero(secret []byte) {
+	for i := range secret {
+		secret[i] = 0
+	}
+}
+
+// Credentials supplies what's needed to authenticate with the
+// upstream. It is asked afresh for every operation that talks to the
+// upstream, so it can give short-lived or rotated credentials, e.g.,
+// from a secret manager, without the Repo being restarted.
+type Credentials interface {
+	Credentials(ctx context.Context, op Operation) (Auth, error)
+}
+
+// Auth is the authentication material for an operation; whatever is
+// left empty is not used.
+type Auth struct {
+	SSHKeyPath string
+	HTTPS      HTTPSCredentials
+}
+
+// StaticCredentials gives the same Auth for every operation; this is
+// equivalent to using the SSHKeyPath and HTTPSCredentials options.
+type StaticCredentials Auth
+
+func (s StaticCredentials) Credentials(context.Context, Operation) (Auth, error) {
+	return Auth(s), nil
+}
+
+// CredentialsFrom makes the repo, and checkouts cloned from it, get
+// credentials from the Credentials given each time they talk to the
+// upstream. An SSHKeyPath or HTTPSCredentials given as well (either
+// as an option, or in the Config of a checkout) takes precedence.
+func CredentialsFrom(c Credentials) Option {
+	return optionFunc(func(r *Repo) {
+		r.transport.credentials = c
+	})
+}
+
+// HTTPSCredentials are used to authenticate with the upstream when
+// it is accessed over HTTPS. As an Option, it supplies the
+// credentials for the Repo.
+type HTTPSCredentials struct {
+	Username string
+	Password string // or a personal access token
+}
+
+func (c HTTPSCredentials) apply(r *Repo) {
+	r.transport.httpsCredentials = c
+}
+
+func (c HTTPSCredentials) env() ([]string, error) {
+	if c.Username == "" && c.Password == "" {
+		return nil, nil
+	}
+	script, err := helperScript("flux-askpass", askpass)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"GIT_ASKPASS=" + script,
+		httpsUsernameVar + "=" + c.Username,
+		httpsPasswordVar + "=" + c.Password,
+	}, nil
+}
+
+// redactSecrets replaces any secrets supplied in the environment
+// entries given with a placeholder, so they can't leak via error
+// messages or logs.
+func redactSecrets(s string, env []string) string {
+	for _, e := range env {
+		var secret string
+		switch {
+		case strings.HasPrefix(e, httpsPasswordVar+"="):
+			secret = strings.TrimPrefix(e, httpsPasswordVar+"=")
+		case strings.HasPrefix(e, gpgPassphraseVar+"="):
+			secret = strings.TrimPrefix(e, gpgPassphraseVar+"=")
+		case strings.HasPrefix(e, proxyAuthVar+"="):
+			secret = strings.TrimPrefix(e, proxyAuthVar+"=")
+		case strings.HasPrefix(e, "https_proxy="):
+			if u, err := url.Parse(strings.TrimPrefix(e, "https_proxy=")); err == nil && u.User != nil {
+				secret, _ = u.User.Password()
+			}
+		}
+		if secret != "" {
+			s = strings.Replace(s, secret, "<redacted>", -1)
+		}
+	}
+	return s
+}
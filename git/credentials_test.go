@@ -0,0 +1,108 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSCredentialsAskpass(t *testing.T) {
+	// backslashes are mangled by some shells' echo
+	creds := HTTPSCredentials{Username: `flux\\org`, Password: `s3\cr\n3t`}
+	env, err := creds.env()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var script string
+	for _, e := range env {
+		if strings.HasPrefix(e, "GIT_ASKPASS=") {
+			script = strings.TrimPrefix(e, "GIT_ASKPASS=")
+		}
+	}
+	if script == "" {
+		t.Fatal("expected GIT_ASKPASS to be set")
+	}
+
+	for prompt, expected := range map[string]string{
+		"Username for 'https://example.com': ":      `flux\\org`,
+		"Password for 'https://flux@example.com': ": `s3\cr\n3t`,
+	} {
+		out := &bytes.Buffer{}
+		c := exec.Command(script, prompt)
+		c.Env = env
+		c.Stdout = out
+		if err := c.Run(); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, strings.TrimSpace(out.String()))
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	env, err := HTTPSCredentials{Username: "flux", Password: "s3cr3t"}.env()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := redactSecrets("fatal: could not authenticate with s3cr3t", env)
+	assert.NotContains(t, redacted, "s3cr3t")
+	assert.Equal(t, "fatal: could not authenticate with s3cr3t", redactSecrets("fatal: could not authenticate with s3cr3t", nil))
+}
+
+// rotatingCredentials gives a new password each time it's asked.
+type rotatingCredentials struct {
+	calls int
+	ops   []Operation
+}
+
+func (c *rotatingCredentials) Credentials(ctx context.Context, op Operation) (Auth, error) {
+	c.calls++
+	c.ops = append(c.ops, op)
+	return Auth{HTTPS: HTTPSCredentials{Username: "flux", Password: strings.Repeat("x", c.calls)}}, nil
+}
+
+func TestTransportCredentials(t *testing.T) {
+	creds := &rotatingCredentials{}
+	tr := transport{credentials: creds}
+	for _, expected := range []string{"x", "xx"} {
+		env, err := tr.env(context.Background(), OpFetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, env, httpsPasswordVar+"="+expected)
+	}
+
+	// Credentials given explicitly take precedence
+	tr.httpsCredentials = HTTPSCredentials{Username: "other", Password: "fixed"}
+	env, err := tr.env(context.Background(), OpPush)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, env, httpsPasswordVar+"=fixed")
+	assert.Equal(t, []Operation{OpFetch, OpFetch, OpPush}, creds.ops)
+
+	static := StaticCredentials{HTTPS: HTTPSCredentials{Username: "flux", Password: "static"}}
+	env, err = transport{credentials: static}.env(context.Background(), OpClone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, env, httpsPasswordVar+"=static")
+}
+
+type failingCredentials struct{}
+
+func (failingCredentials) Credentials(context.Context, Operation) (Auth, error) {
+	return Auth{}, errors.New("secret manager unavailable")
+}
+
+func TestTransportCredentials_Error(t *testing.T) {
+	_, err := transport{credentials: failingCredentials{}}.env(context.Background(), OpFetch)
+	if err == nil || !strings.Contains(err.Error(), "secret manager unavailable") {
+		t.Errorf("expected error from credentials to be returned, got %v", err)
+	}
+}
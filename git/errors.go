@@ -1,12 +1,388 @@
 package git
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
 
 	fluxerr "github.com/weaveworks/flux/errors"
 )
 
+// TimeoutError is returned when a git command does not complete
+// before its deadline; the command, and any processes it started,
+// will have been killed.
+type TimeoutError struct {
+	Args []string
+}
+
+func (err TimeoutError) Error() string {
+	return fmt.Sprintf("running git command: git %v: %s", err.Args, context.DeadlineExceeded)
+}
+
+// Cause gives the underlying error, for `errors.Cause`.
+func (err TimeoutError) Cause() error {
+	return context.DeadlineExceeded
+}
+
+// StaleRefsError is returned when only some of the refs could be
+// fetched. Each set of refs is updated all together or not at all,
+// so those given here have been left as they were, and any others
+// are up to date.
+type StaleRefsError struct {
+	Refs []string // the refspecs not fetched
+	Errs []error
+}
+
+func (err StaleRefsError) Error() string {
+	msgs := make([]string, len(err.Errs))
+	for i, e := range err.Errs {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("refs %v were not fetched: %s", err.Refs, strings.Join(msgs, "; "))
+}
+
+// GitError has the particulars of a git command that failed. It's
+// embedded in each of the errors a failed git command results in:
+// AuthError, NetworkError, RefNotFoundError, ConflictError, and
+// UnknownError. These are usually wrapped with more context, so use
+// Cause to get at them.
+type GitError struct {
+	Command string // the git command line
+	Message string // the salient line of what git printed to stderr, if any
+	Stderr  string // everything git printed to stderr
+	Err     error  // the error from running git, e.g., an *exec.ExitError
+}
+
+func (err GitError) Error() string {
+	if err.Message != "" {
+		return err.Message
+	}
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+	return err.Command + " failed"
+}
+
+// AuthError is returned when git couldn't authenticate with the
+// upstream, or wasn't allowed to do what was asked. Retrying won't
+// help until the credentials or permissions are fixed.
+type AuthError struct{ GitError }
+
+// NetworkError is returned when git couldn't reach the upstream, or
+// lost the connection to it. This may well be transient.
+type NetworkError struct{ GitError }
+
+// ConflictError is returned when changes couldn't be merged or
+// rebased cleanly.
+type ConflictError struct{ GitError }
+
+// UnknownError is returned when a git command failed in a way that
+// isn't otherwise classified.
+type UnknownError struct{ GitError }
+
+// RefNotFoundError is returned when a ref (or revision) asked for
+// doesn't exist in the repo, or upstream. Ref is empty if it's not
+// known which ref it was; the GitError has the details, if it was a
+// git command that failed.
+type RefNotFoundError struct {
+	Ref string
+	GitError
+}
+
+func (err RefNotFoundError) Error() string {
+	if err.Ref == "" {
+		return err.GitError.Error()
+	}
+	return fmt.Sprintf("unknown revision %q", err.Ref)
+}
+
+// FetchRevError is returned by Repo.FetchRev when the upstream won't
+// give out the commit asked for. Either it doesn't allow fetching
+// commits that aren't the tip of a ref (e.g., it doesn't have
+// uploadpack.allowAnySHA1InWant set), or it doesn't have the commit
+// at all; git can't tell which.
+type FetchRevError struct {
+	Revision string
+	Err      error
+}
+
+func (err FetchRevError) Error() string {
+	return fmt.Sprintf("upstream would not give commit %s; it may not allow fetching commits by revision, or may not have this one: %s", err.Revision, err.Err)
+}
+
+// Cause gives the underlying error, for `errors.Cause`.
+func (err FetchRevError) Cause() error {
+	return err.Err
+}
+
+// Lower-case fragments of what git (or ssh, or curl) prints to stderr
+// for each kind of failure. These are checked in order, since a
+// failure to authenticate, for example, is often followed by a more
+// general complaint about not being able to read from the remote.
+var failureKinds = []struct {
+	fragments []string
+	kind      func(GitError) error
+}{
+	{[]string{
+		"permission denied",
+		"authentication failed",
+		"could not read username",
+		"could not read password",
+		"terminal prompts disabled",
+		"host key verification failed",
+		"access denied",
+		"repository not found",
+		"returned error: 401",
+		"returned error: 403",
+	}, func(e GitError) error { return AuthError{e} }},
+	{[]string{
+		"couldn't find remote ref",
+		"unknown revision",
+		"bad revision",
+		"bad object",
+		"not a valid object name",
+		"invalid reference",
+		"not found in upstream",
+		"not our ref",
+		"does not allow request for unadvertised object",
+	}, func(e GitError) error { return RefNotFoundError{GitError: e} }},
+	{[]string{
+		"conflict",
+		"could not apply",
+		"needs merge",
+	}, func(e GitError) error { return ConflictError{e} }},
+	{[]string{
+		"could not resolve host",
+		"connection refused",
+		"connection timed out",
+		"operation timed out",
+		"network is unreachable",
+		"no route to host",
+		"connection reset",
+		"connection closed",
+		"the remote end hung up",
+		"early eof",
+		"failed to connect",
+		"unable to access",
+		"could not read from remote repository",
+		"handshake",
+		"returned error: 5", // a 5xx server error over HTTP(S)
+	}, func(e GitError) error { return NetworkError{e} }},
+}
+
+// classifyError makes the error for a failed git command, from what
+// it printed to stderr and the error from running it. Anything in
+// env (e.g., credentials), and the password in any URL in args, is
+// redacted from what's kept.
+func classifyError(args []string, stderr string, err error, env []string) error {
+	gitErr := GitError{
+		Command: redactSecrets(strings.Join(append([]string{"git"}, redactURLs(args)...), " "), env),
+		Message: redactURLsIn(redactSecrets(findErrorMessage(strings.NewReader(stderr)), env), args),
+		Stderr:  redactURLsIn(redactSecrets(stderr, env), args),
+		Err:     err,
+	}
+	lower := strings.ToLower(stderr)
+	for _, kind := range failureKinds {
+		for _, fragment := range kind.fragments {
+			if strings.Contains(lower, fragment) {
+				return kind.kind(gitErr)
+			}
+		}
+	}
+	return UnknownError{gitErr}
+}
+
+// Cause gives the underlying cause of an error returned from this
+// package, looking through the wrapping given by both this package
+// and the errors (e.g., CloningError and PushError) that come with
+// help for the user. For a failed git command, it is one of
+// AuthError, NetworkError, RefNotFoundError, ConflictError, or
+// UnknownError.
+func Cause(err error) error {
+	for {
+		err = pkgerrors.Cause(err)
+		fe, ok := err.(*fluxerr.Error)
+		if !ok || fe.Err == nil {
+			return err
+		}
+		err = fe.Err
+	}
+}
+
+// IsRetryable says whether the operation that failed with the error
+// given might succeed if tried again as it was, without anything
+// being changed. Only transient failures are: not being able to
+// reach the upstream, or it failing with a server error
+// (NetworkError), timeouts, giving up waiting for the repo lock, and
+// fetches that left refs stale for any of those reasons. Anything
+// else, e.g., an AuthError, a RefNotFoundError, an error in the
+// configuration, or a git failure that isn't otherwise known, is
+// not; nor is a NotReadyError, since WaitReady is what waits for the
+// repo.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch cause := Cause(err).(type) {
+	case NetworkError, TimeoutError, LockBusyError:
+		return true
+	case StaleRefsError:
+		for _, e := range cause.Errs {
+			if IsRetryable(e) {
+				return true
+			}
+		}
+		return false
+	default:
+		return cause == context.DeadlineExceeded
+	}
+}
+
+// SigningKeyError is returned when a signing key given as a user ID
+// (e.g., an email address) doesn't match exactly one secret key in
+// the keyring.
+type SigningKeyError struct {
+	Key          string
+	Fingerprints []string // the keys matched, if more than one
+}
+
+func (err SigningKeyError) Error() string {
+	if len(err.Fingerprints) == 0 {
+		return fmt.Sprintf("no usable secret key found for signing key %q", err.Key)
+	}
+	return fmt.Sprintf("signing key %q is ambiguous; it matches keys %s", err.Key, strings.Join(err.Fingerprints, ", "))
+}
+
+// SigningRequiredError is returned, with Config.CheckSigningConfig,
+// when the git config says commits must be signed, but there's no
+// signing key to sign them with.
+type SigningRequiredError struct {
+	Setting string // the git config variable that says so
+}
+
+func (err SigningRequiredError) Error() string {
+	return fmt.Sprintf("the git config has %s set, so commits must be signed, but no signing key was given; give a SigningKey, or unset %s", err.Setting, err.Setting)
+}
+
+// CommitTooLargeError is returned when a commit is refused because
+// a file in it, or the commit as a whole, is larger than the limit
+// set. Path is empty if it's the whole commit.
+type CommitTooLargeError struct {
+	Path  string
+	Size  int64 // in bytes
+	Limit int64 // in bytes
+}
+
+func (err CommitTooLargeError) Error() string {
+	if err.Path != "" {
+		return fmt.Sprintf("refusing to commit %s, which is %d bytes; the maximum for a file is %d bytes", err.Path, err.Size, err.Limit)
+	}
+	return fmt.Sprintf("refusing to commit changes totalling %d bytes; the maximum for a commit is %d bytes", err.Size, err.Limit)
+}
+
+// GPGAgentError is returned when signing something, if there's no
+// gpg-agent running for the keyring and one couldn't be started.
+type GPGAgentError struct {
+	Socket string // where the agent's socket was expected, if known
+	Err    error
+}
+
+func (err GPGAgentError) Error() string {
+	where := "for the keyring"
+	if err.Socket != "" {
+		where = "at " + err.Socket
+	}
+	return fmt.Sprintf("cannot sign: no gpg-agent is listening %s, and one could not be started (%v); make sure the keyring's directory (GNUPGHOME) and the socket's directory exist and are writable, or start gpg-agent beforehand", where, err.Err)
+}
+
+func (err GPGAgentError) Cause() error {
+	return err.Err
+}
+
+// UnexpectedChangesError is returned when a commit is refused because
+// it would include changes to files other than those expected, as
+// given in CommitAction.OnlyPaths.
+type UnexpectedChangesError struct {
+	Paths []string
+}
+
+func (err UnexpectedChangesError) Error() string {
+	return fmt.Sprintf("refusing to commit unexpected changes to %s", strings.Join(err.Paths, ", "))
+}
+
+// PreCommitError is returned when a commit is abandoned because the
+// Config.PreCommit hook failed.
+type PreCommitError struct {
+	Err error
+}
+
+func (err PreCommitError) Error() string {
+	return "pre-commit hook failed: " + err.Err.Error()
+}
+
+func (err PreCommitError) Cause() error {
+	return err.Err
+}
+
+// RevertConflictError is returned by Checkout.Revert when the commit
+// can't be reverted cleanly, because the files it changed have been
+// changed again since.
+type RevertConflictError struct {
+	Revision string
+	Paths    []string // the files in conflict
+}
+
+func (err RevertConflictError) Error() string {
+	return fmt.Sprintf("reverting %s conflicts with later changes to %s", err.Revision, strings.Join(err.Paths, ", "))
+}
+
+// BinaryFileError is returned when asked to do something that only
+// makes sense for a text file, such as Repo.Blame, with a binary
+// file.
+type BinaryFileError struct {
+	Path     string
+	Revision string
+}
+
+func (err BinaryFileError) Error() string {
+	return fmt.Sprintf("%s is a binary file at revision %s", err.Path, err.Revision)
+}
+
+// NoMergeBaseError is returned by Repo.MergeBase when the refs given
+// have no history in common.
+type NoMergeBaseError struct {
+	A, B string
+}
+
+func (err NoMergeBaseError) Error() string {
+	return fmt.Sprintf("%s and %s have no common ancestor", err.A, err.B)
+}
+
+// RepoTooLargeError is returned when a clone is abandoned because it
+// grew larger on disk than the limit set.
+type RepoTooLargeError struct {
+	Limit int64 // in bytes
+}
+
+func (err RepoTooLargeError) Error() string {
+	return fmt.Sprintf("clone abandoned because the repo exceeded the maximum size of %d bytes", err.Limit)
+}
+
+// PartialCloneError is returned when a partial clone was asked for,
+// with Config.CloneFilter, but the repo being cloned from won't
+// filter what it sends.
+type PartialCloneError struct {
+	Filter string
+}
+
+func (err PartialCloneError) Error() string {
+	return fmt.Sprintf("the git repo cloned from does not support partial clones (asked for filter %q); leave the clone filter empty to make full clones", err.Filter)
+}
+
 var NoRepoError = &fluxerr.Error{
 	Type: fluxerr.User,
 	Err:  errors.New("no repo in user config"),
@@ -119,3 +495,38 @@ check the box to allow write access.
 `,
 	}
 }
+
+// InvalidConfigKeyError is returned when asked to set or get a git
+// config variable that isn't valid, or can't be set.
+type InvalidConfigKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (err InvalidConfigKeyError) Error() string {
+	return fmt.Sprintf("refusing git config key %q, since %s", err.Key, err.Reason)
+}
+
+// LockBusyError is returned when an operation gives up waiting for
+// the lock of a repo, after the LockTimeout. It says what was holding
+// the lock, and for how long, so it can be tracked down.
+type LockBusyError struct {
+	Op      string
+	Waited  time.Duration
+	Holders []LockHolder // longest held first
+}
+
+func (err LockBusyError) Error() string {
+	if len(err.Holders) == 0 {
+		return fmt.Sprintf("%s gave up waiting %s for the git repo lock, behind other operations waiting for it", err.Op, err.Waited)
+	}
+	var holders []string
+	for _, h := range err.Holders {
+		how := "reading"
+		if h.Write {
+			how = "writing"
+		}
+		holders = append(holders, fmt.Sprintf("%s (%s, for %s)", h.Op, how, h.HeldFor.Round(time.Millisecond)))
+	}
+	return fmt.Sprintf("%s gave up waiting %s for the git repo lock, held by %s", err.Op, err.Waited, strings.Join(holders, ", "))
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package git
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(c *exec.Cmd) {
+}
+
+// killProcessGroup kills the command; there are no process groups to
+// speak of on Windows.
+func killProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
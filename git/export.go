@@ -2,7 +2,6 @@ package git
 
 import (
 	"context"
-	"os"
 )
 
 type Export struct {
@@ -15,17 +14,18 @@ func (e *Export) Dir() string {
 
 func (e *Export) Clean() {
 	if e.dir != "" {
-		os.RemoveAll(e.dir)
+		removeTempDir(e.dir)
 	}
 }
 
 // Export creates a minimal clone of the repo, at the ref given.
 func (r *Repo) Export(ctx context.Context, ref string) (*Export, error) {
-	dir, err := r.workingClone(ctx, "")
+	dir, err := r.workingClone(ctx, "", cloneOptions{})
 	if err != nil {
 		return nil, err
 	}
-	if err = checkout(ctx, dir, ref); err != nil {
+	if err = checkout(ctx, r.exec, dir, ref); err != nil {
+		removeTempDir(dir)
 		return nil, err
 	}
 	return &Export{dir}, nil
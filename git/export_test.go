@@ -34,7 +34,7 @@ func TestExportAtRevision(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	exportHead, err := refRevision(ctx, export.dir, "HEAD")
+	exportHead, err := refRevision(ctx, gitExec{}, export.dir, "HEAD")
 	if err != nil {
 		t.Fatal(err)
 	}
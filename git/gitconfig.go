@@ -0,0 +1,193 @@
+package git
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configKeyPattern is what a git config key looks like:
+// section[.subsection].name, where the subsection can be anything
+// but a newline, and the section and name are alphanumeric (with
+// dashes, though not to start with).
+var configKeyPattern = regexp.MustCompile(`^([a-zA-Z0-9][a-zA-Z0-9-]*)(\.[^\n\x00]*)?\.([a-zA-Z][a-zA-Z0-9-]*)$`)
+
+// commandConfigKeys are the config settings, as section.name (or
+// with any subsection as "*"), that have git run a program or
+// script given in the value. These are refused by SetConfig, since
+// they'd let whoever sets them run anything as flux.
+var commandConfigKeys = map[string]bool{
+	"core.alternaterefscommand":  true,
+	"core.askpass":               true,
+	"core.editor":                true,
+	"core.fsmonitor":             true,
+	"core.gitproxy":              true,
+	"core.hookspath":             true,
+	"core.pager":                 true,
+	"core.sshcommand":            true,
+	"credential.helper":          true,
+	"credential.*.helper":        true,
+	"diff.external":              true,
+	"diff.*.command":             true,
+	"diff.*.textconv":            true,
+	"filter.*.clean":             true,
+	"filter.*.process":           true,
+	"filter.*.smudge":            true,
+	"gpg.*.defaultkeycommand":    true,
+	"gpg.program":                true,
+	"gpg.*.program":              true,
+	"merge.*.driver":             true,
+	"remote.*.receivepack":       true,
+	"remote.*.uploadpack":        true,
+	"sequence.editor":            true,
+	"uploadpack.packobjectshook": true,
+}
+
+// commandConfigSections are sections of which every setting is, or
+// may be, a command to run.
+var commandConfigSections = map[string]bool{
+	"alias":     true,
+	"pager":     true,
+	"sendemail": true,
+}
+
+// includeConfigSections are sections that have git read more config
+// from a file given in the value (e.g., include.path), which could
+// then set anything, including the keys above.
+var includeConfigSections = map[string]bool{
+	"include":   true,
+	"includeif": true,
+}
+
+// HTTPPostBuffer is an Option setting http.postBuffer, for the repo
+// and its checkouts (as with SetConfig): the size in bytes of a push
+// over HTTP(S) above which git sends it in chunks, rather than in one
+// request of known length. git's default is 1 MiB. Some servers and
+// proxies won't take chunked requests, and a bigger push fails with
+// "the remote end hung up unexpectedly"; raising this above the size
+// of the biggest push (e.g., of a bootstrapped repo's first set of
+// manifests) gets round that, at the cost of holding it in memory.
+type HTTPPostBuffer int64
+
+func (n HTTPPostBuffer) apply(r *Repo) {
+	r.setConfigOption("http.postbuffer", int64(n))
+}
+
+// PackWindowMemory is an Option setting pack.windowMemory, for the
+// repo and its checkouts (as with SetConfig): how many bytes git may
+// use for each thread when looking for deltas while packing objects,
+// e.g., to push them; git's default is no limit. Lowering it stops
+// git using too much memory packing a big push, if that's a problem,
+// at the cost of a bigger pack.
+type PackWindowMemory int64
+
+func (n PackWindowMemory) apply(r *Repo) {
+	r.setConfigOption("pack.windowmemory", int64(n))
+}
+
+// setConfigOption records a git config setting given as an Option,
+// if it's more than zero, to be set as with SetConfig.
+func (r *Repo) setConfigOption(key string, n int64) {
+	if n <= 0 {
+		return
+	}
+	if r.gitConfig == nil {
+		r.gitConfig = map[string]string{}
+	}
+	r.gitConfig[key] = strconv.FormatInt(n, 10)
+}
+
+// canonicalConfigKey checks the key given is a valid git config key,
+// and gives it as git does, with the section and name in lower case
+// (the subsection is case sensitive). If settable, it must also be
+// one that SetConfig may set.
+func canonicalConfigKey(key string, settable bool) (string, error) {
+	m := configKeyPattern.FindStringSubmatch(key)
+	if m == nil {
+		return "", InvalidConfigKeyError{Key: key, Reason: "it is not of the form section.name or section.subsection.name"}
+	}
+	section, subsection, name := strings.ToLower(m[1]), m[2], strings.ToLower(m[3])
+	generic := section + "." + name
+	if subsection != "" {
+		generic = section + ".*." + name
+	}
+	if settable && (commandConfigKeys[generic] || commandConfigSections[section]) {
+		return "", InvalidConfigKeyError{Key: key, Reason: "it would have git run a command"}
+	}
+	if settable && includeConfigSections[section] {
+		return "", InvalidConfigKeyError{Key: key, Reason: "it would have git read config from another file"}
+	}
+	return section + subsection + "." + name, nil
+}
+
+// SetConfig sets a git config variable, e.g., "http.postBuffer", in
+// the repo's own config, and in checkouts cloned from it afterwards.
+// It's remembered, so that it's set again if the repo is cloned
+// afresh. Keys that aren't valid, or that would have git run a
+// command (e.g., "core.sshCommand") or include another config file,
+// are refused with an InvalidConfigKeyError.
+func (r *Repo) SetConfig(ctx context.Context, key, value string) error {
+	key, err := canonicalConfigKey(key, true)
+	if err != nil {
+		return err
+	}
+	unlock, err := r.lock(ctx, "SetConfig")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if r.dir != "" {
+		if err := setConfig(ctx, r.exec, r.dir, key, value); err != nil {
+			return err
+		}
+	}
+	if r.gitConfig == nil {
+		r.gitConfig = map[string]string{}
+	}
+	r.gitConfig[key] = value
+	return nil
+}
+
+// GetConfig gets the value of a git config variable from the repo's
+// own config (so not any set globally), and whether it is set. If the
+// repo hasn't been cloned yet, it gives what's been set with
+// SetConfig.
+func (r *Repo) GetConfig(ctx context.Context, key string) (string, bool, error) {
+	key, err := canonicalConfigKey(key, false)
+	if err != nil {
+		return "", false, err
+	}
+	unlock, err := r.rlock(ctx, "GetConfig")
+	if err != nil {
+		return "", false, err
+	}
+	defer unlock()
+	if r.dir == "" {
+		value, ok := r.gitConfig[key]
+		return value, ok, nil
+	}
+	settings, err := localConfig(ctx, r.exec, r.dir)
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := settings[key]
+	return value, ok, nil
+}
+
+// applyConfig sets everything given to SetConfig in the repository
+// at the directory given, in order of key so it's the same each time.
+func applyConfig(ctx context.Context, gexec gitExec, dir string, settings map[string]string) error {
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := setConfig(ctx, gexec, dir, k, settings[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
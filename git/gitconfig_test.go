@@ -0,0 +1,43 @@
+package git
+
+import (
+	"testing"
+)
+
+func TestCanonicalConfigKey(t *testing.T) {
+	for key, expected := range map[string]string{
+		"http.postBuffer":                       "http.postbuffer",
+		"Core.BigFileThreshold":                 "core.bigfilethreshold",
+		"http.https://Example.com/.sslVerify":   "http.https://Example.com/.sslverify",
+		"remote.Origin.fetch":                   "remote.Origin.fetch",
+		"remote.origin.uploadpack":              "",
+		"core.sshCommand":                       "",
+		"alias.st":                              "",
+		"filter.lfs.smudge":                     "",
+		"credential.https://example.com.helper": "",
+		"core.alternateRefsCommand":             "",
+		"gpg.ssh.defaultKeyCommand":             "",
+		"include.path":                          "",
+		"includeIf.gitdir:/tmp/.path":           "",
+		"INCLUDEIF.onbranch:master.path":        "",
+		"nodot":                                 "",
+		"--global.name":                         "",
+		"user.name\nother.key":                  "",
+	} {
+		got, err := canonicalConfigKey(key, true)
+		if expected == "" {
+			if _, ok := err.(InvalidConfigKeyError); !ok {
+				t.Errorf("expected %q to be refused, got %q (%v)", key, got, err)
+			}
+			continue
+		}
+		if err != nil || got != expected {
+			t.Errorf("expected %q to be given as %q, got %q (%v)", key, expected, got, err)
+		}
+	}
+
+	// Keys which can't be set can still be read
+	if got, err := canonicalConfigKey("core.sshCommand", false); err != nil || got != "core.sshcommand" {
+		t.Errorf("expected core.sshCommand to be readable, got %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,63 @@
+package git
+
+import (
+	"sort"
+)
+
+// GitExecutablePath is an Option giving the git executable to run,
+// rather than whichever `git` is first in the PATH.
+type GitExecutablePath string
+
+func (p GitExecutablePath) apply(r *Repo) {
+	r.exec.path = string(p)
+}
+
+// ExtraEnv is an Option giving environment variables for every git
+// command run (and so for anything git runs in turn, e.g., ssh). They
+// are added to a minimal environment, rather than to that of this
+// process; so, for instance, if git needs a PATH it must be given
+// here.
+type ExtraEnv map[string]string
+
+func (e ExtraEnv) apply(r *Repo) {
+	r.exec.env = envList(e)
+}
+
+// gitExec is how to run git for the commands of a Repo, or of a
+// Checkout cloned from it.
+type gitExec struct {
+	path   string   // of the git executable; if empty, "git" is looked up in the PATH
+	env    []string // added to the environment of every command
+	logger Logger   // if given, each command is logged to it
+}
+
+func (e gitExec) executable() string {
+	if e.path == "" {
+		return "git"
+	}
+	return e.path
+}
+
+// merge gives the gitExec with the path, the logger, and the
+// environment entries, of the one given taking precedence.
+func (e gitExec) merge(over gitExec) gitExec {
+	merged := gitExec{path: e.path, env: append(append([]string{}, e.env...), over.env...), logger: e.logger}
+	if over.path != "" {
+		merged.path = over.path
+	}
+	if over.logger != nil {
+		merged.logger = over.logger
+	}
+	return merged
+}
+
+// envList gives the entries for an environment from a map, in a
+// stable order.
+func envList(m map[string]string) []string {
+	var env []string
+	for k, v := range m {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
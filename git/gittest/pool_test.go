@@ -0,0 +1,73 @@
+package gittest
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
+	"github.com/weaveworks/flux/git"
+)
+
+func TestCheckoutPool(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := git.NewCheckoutPool(repo, TestConfig, 1)
+	defer pool.Close()
+
+	checkout, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := checkout.Dir()
+
+	// The pool is at capacity, so this should block until it times out
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	if _, err := pool.Get(shortCtx); err != context.DeadlineExceeded {
+		t.Errorf("expected Get to time out while pool is at capacity, got %v", err)
+	}
+	shortCancel()
+
+	changedFile := ""
+	for file, _ := range testfiles.Files {
+		changedFile = file
+		break
+	}
+	path := filepath.Join(dir, changedFile)
+	if err := ioutil.WriteFile(path, []byte("DIRTY"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "untracked.yaml"), []byte("DIRTY"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	checkout.Clean()
+
+	reused, err := pool.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reused.Clean()
+	if reused.Dir() != dir {
+		t.Errorf("expected checkout in %s to be reused, got %s", dir, reused.Dir())
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) == "DIRTY" {
+		t.Error("expected local changes to be discarded")
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "untracked.yaml")); err == nil {
+		t.Error("expected untracked file to be removed")
+	}
+}
@@ -1,10 +1,23 @@
 package gittest
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -39,7 +52,7 @@ func TestCommit(t *testing.T) {
 	defer cancel()
 
 	commitAction := git.CommitAction{Message: "Changed file"}
-	if err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+	if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -69,11 +82,141 @@ func TestCommit(t *testing.T) {
 }
 
 func TestSignedCommit(t *testing.T) {
+	// A program standing in for some other gpg, which records that
+	// it's been used
+	scriptDir, scriptCleanup := testfiles.TempDir(t)
+	defer scriptCleanup()
+	used := filepath.Join(scriptDir, "used")
+	wrapper := filepath.Join(scriptDir, "other-gpg")
+	if err := ioutil.WriteFile(wrapper, []byte("#!/bin/sh\ntouch "+used+"\nexec gpg \"$@\"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	programs := []string{"", "gpg", wrapper}
+	if _, err := exec.LookPath("gpg2"); err == nil {
+		programs = append(programs, "gpg2")
+	}
+	for _, program := range programs {
+		name := "default"
+		if program != "" {
+			name = filepath.Base(program)
+		}
+		t.Run(name, func(t *testing.T) {
+			testSignedCommit(t, program)
+		})
+	}
+	if _, err := os.Stat(used); err != nil {
+		t.Errorf("expected the GPGProgram given to have been used to sign: %v", err)
+	}
+}
+
+func TestSignedCommitWithKeyData(t *testing.T) {
+	gpgHome, signingKey, gpgCleanup := gpgtest.GPGKey(t)
+	defer gpgCleanup()
+	key, err := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--armor", "--export-secret-keys", signingKey).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	keyrings := func() []string {
+		dirs, err := filepath.Glob(filepath.Join(os.TempDir(), "flux-gpghome*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dirs
+	}
+	before := keyrings()
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("CHANGED"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// Not a key at all, so it can't be imported
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage", SigningKeyData: []byte("not a key")}, nil); err == nil {
+		t.Error("expected an error signing with key data that isn't a key")
+	}
+	data := append([]byte{}, key...)
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage", SigningKeyData: data}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, make([]byte, len(data))) {
+		t.Error("expected the key data to have been zeroed")
+	}
+	if after := keyrings(); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected the temporary keyrings to have been removed, but found %v (before: %v)", after, before)
+	}
+
+	// The key's only in its own keyring, so that's needed to check
+	// the signature
+	repo.SetGPGHome(gpgHome)
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commits[0].SignatureValid() || commits[0].SigningKey != signingKey[len(signingKey)-16:] {
+		t.Errorf("expected commit %s to be signed with %s, got key %q with status %q", commits[0].Revision, signingKey, commits[0].SigningKey, commits[0].SignatureStatus)
+	}
+}
+
+func TestSigningRequired(t *testing.T) {
+	gpgHome, signingKey, gpgCleanup := gpgtest.GPGKey(t)
+	defer gpgCleanup()
+	os.Setenv("GNUPGHOME", gpgHome)
+	defer os.Unsetenv("GNUPGHOME")
+
+	config := TestConfig
+	config.CheckSigningConfig = true
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := execCommand("git", "-C", checkout.Dir(), "config", "commit.gpgSign", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("CHANGED"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage"}, nil)
+	if _, ok := err.(git.SigningRequiredError); !ok {
+		t.Fatalf("expected SigningRequiredError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "SigningKey") {
+		t.Errorf("expected the error to say a signing key is needed, got %q", err.Error())
+	}
+
+	// With a key, the commit is signed as required
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage", SigningKey: signingKey}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commits[0].SignatureValid() {
+		t.Errorf("expected commit %s to be signed, got status %q", commits[0].Revision, commits[0].SignatureStatus)
+	}
+}
+
+func testSignedCommit(t *testing.T, program string) {
 	gpgHome, signingKey, gpgCleanup := gpgtest.GPGKey(t)
 	defer gpgCleanup()
 
 	config := TestConfig
 	config.SigningKey = signingKey
+	config.GPGProgram = program
 
 	os.Setenv("GNUPGHOME", gpgHome)
 	defer os.Unsetenv("GNUPGHOME")
@@ -94,7 +237,7 @@ func TestSignedCommit(t *testing.T) {
 	defer cancel()
 
 	commitAction := git.CommitAction{Message: "Changed file"}
-	if err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+	if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -111,6 +254,13 @@ func TestSignedCommit(t *testing.T) {
 	if len(commits) < 1 {
 		t.Fatal("expected at least one commit")
 	}
+	if !commits[0].SignatureValid() {
+		t.Errorf("expected signature of commit %s to be valid, status was %q", commits[0].Revision, commits[0].SignatureStatus)
+	}
+	if err := repo.VerifyCommit(ctx, commits[0].Revision); err != nil {
+		t.Error(err)
+	}
+
 	expectedKey := signingKey[len(signingKey)-16:]
 	foundKey := commits[0].SigningKey[len(commits[0].SigningKey)-16:]
 	if expectedKey != foundKey {
@@ -148,6 +298,98 @@ func TestSignedTag(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// `--raw` gives the gpg status lines, including VALIDSIG with the
+	// fingerprint of the key used.
+	out := &bytes.Buffer{}
+	cmd := exec.Command("git", "-C", checkout.Dir(), "verify-tag", "--raw", config.SyncTag)
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "VALIDSIG "+signingKey) {
+		t.Errorf("expected tag to be signed with key %s; verify-tag said:\n%s", signingKey, out.String())
+	}
+}
+
+func TestReadTag(t *testing.T) {
+	gpgHome, signingKey, gpgCleanup := gpgtest.GPGKey(t)
+	defer gpgCleanup()
+
+	config := TestConfig
+	config.SigningKey = signingKey
+
+	os.Setenv("GNUPGHOME", gpgHome)
+	defer os.Unsetenv("GNUPGHOME")
+
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: head, Message: "Sync pointer"}); err != nil {
+		t.Fatal(err)
+	}
+	// An unsigned tag, and a lightweight one
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	cmd := exec.Command("git", "-C", upstream, "tag", "-a", "-m", "Plain tag\n\nWith a body", "plain", head)
+	cmd.Env = append(os.Environ(), "GIT_COMMITTER_NAME=Tagger", "GIT_COMMITTER_EMAIL=tagger@example.com")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", upstream, "tag", "light", head); err != nil {
+		t.Fatal(err)
+	}
+	repo.SetGPGHome(gpgHome)
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := repo.ReadTag(ctx, config.SyncTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Revision != head || tag.Message != "Sync pointer" || tag.TaggerName != config.UserName || tag.TaggerEmail != config.UserEmail {
+		t.Errorf("unexpected sync tag %+v", tag)
+	}
+	if tag.SigningFingerprint != signingKey || !strings.HasSuffix(signingKey, tag.SigningKey) || tag.SigningKey == "" {
+		t.Errorf("expected the sync tag to be signed with %s, got key %q, fingerprint %q", signingKey, tag.SigningKey, tag.SigningFingerprint)
+	}
+
+	tag, err = repo.ReadTag(ctx, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Revision != head || tag.Message != "Plain tag\n\nWith a body" || tag.TaggerName != "Tagger" || tag.TaggerEmail != "tagger@example.com" || tag.Date.IsZero() {
+		t.Errorf("unexpected unsigned tag %+v", tag)
+	}
+	if tag.SigningKey != "" || tag.SigningFingerprint != "" {
+		t.Errorf("expected no signing key for an unsigned tag, got %+v", tag)
+	}
+	if tag, err = repo.ReadTag(ctx, "light"); err != nil || tag.Revision != head || tag.TaggerName != "" || tag.Date.IsZero() {
+		t.Errorf("unexpected lightweight tag %+v (err: %v)", tag, err)
+	}
+	if _, err := repo.ReadTag(ctx, "no-such-tag"); err == nil {
+		t.Error("expected an error for a tag that doesn't exist")
+	}
+
+	// Without the key, the signature can't be checked
+	emptyHome, err := ioutil.TempDir("", "flux-gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(emptyHome)
+	repo.SetGPGHome(emptyHome)
+	if _, err := repo.ReadTag(ctx, config.SyncTag); err == nil {
+		t.Error("expected an error for a tag signed with a key not in the keyring")
+	} else if e, ok := err.(git.UnverifiedTagError); !ok || e.Status != "ERRSIG" {
+		t.Errorf("expected UnverifiedTagError with status ERRSIG, got %v", err)
+	}
 }
 
 func TestCheckout(t *testing.T) {
@@ -202,7 +444,7 @@ func TestCheckout(t *testing.T) {
 		break
 	}
 	commitAction := git.CommitAction{Author: "", Message: "Changed file"}
-	if err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+	if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -216,7 +458,7 @@ func TestCheckout(t *testing.T) {
 		Comment: "Expected comment",
 	}
 	commitAction = git.CommitAction{Author: "", Message: "Changed file again"}
-	if err := checkout.CommitAndPush(ctx, commitAction, &expectedNote); err != nil {
+	if _, err := checkout.CommitAndPush(ctx, commitAction, &expectedNote); err != nil {
 		t.Fatal(err)
 	}
 
@@ -261,3 +503,3599 @@ func TestCheckout(t *testing.T) {
 	close(sd)
 	sg.Wait()
 }
+
+func TestShallowCheckout(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changedFile := ""
+	for file, _ := range testfiles.Files {
+		path := filepath.Join(checkout.Dir(), file)
+		if err := ioutil.WriteFile(path, []byte("FIRST CHANGE"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		changedFile = file
+		break
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed file"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.CloneDepth = 1
+	shallow, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shallow.Clean()
+
+	// The first revision is outside the shallow clone, so this
+	// should deepen it on demand.
+	files, err := shallow.ChangedFiles(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != filepath.Join(shallow.Dir(), changedFile) {
+		t.Errorf("expected only %s to have changed, got %v", changedFile, files)
+	}
+}
+
+func TestCommitMessageTemplate(t *testing.T) {
+	config := TestConfig
+	config.SkipMessage = " **SKIP**"
+	config.MessageTemplate = `{{range .Changes}}Release {{.Workload}} from {{.OldImage}} to {{.NewImage}}{{end}}`
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	for file, _ := range testfiles.Files {
+		path := filepath.Join(checkout.Dir(), file)
+		if err := ioutil.WriteFile(path, []byte("FIRST CHANGE"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	commitAction := git.CommitAction{
+		Message: "Ignored in favour of the template",
+		Changes: []git.CommitChange{
+			{Workload: "default:deployment/helloworld", Container: "helloworld", OldImage: "quay.io/weaveworks/helloworld:v1", NewImage: "quay.io/weaveworks/helloworld:v2"},
+		},
+	}
+	if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Release default:deployment/helloworld from quay.io/weaveworks/helloworld:v1 to quay.io/weaveworks/helloworld:v2" + config.SkipMessage
+	if msg := commits[0].Message; msg != expected {
+		t.Errorf("expected commit message %q, got %q", expected, msg)
+	}
+}
+
+// lfsInstalled says whether git can run git-lfs.
+func lfsInstalled() bool {
+	return exec.Command("git", "lfs", "version").Run() == nil
+}
+
+func TestCheckoutLFS(t *testing.T) {
+	if !lfsInstalled() {
+		t.Skip("git-lfs is not installed")
+	}
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+	filesDir := filepath.Join(newDir, "files")
+	gitDir := filepath.Join(newDir, "git")
+
+	run := func(dir string, args ...string) {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	write := func(path, content string) {
+		if err := ioutil.WriteFile(filepath.Join(filesDir, path), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filesDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	run(newDir, "init", "--bare", gitDir)
+	run(filesDir, "init")
+	run(filesDir, "config", "user.email", "example@example.com")
+	run(filesDir, "config", "user.name", "example")
+	run(filesDir, "lfs", "install", "--local")
+	run(filesDir, "lfs", "track", "*.bin")
+	write("data.bin", "the first content")
+	write("app.yaml", "kind: Deployment")
+	run(filesDir, "add", "--all")
+	run(filesDir, "commit", "-m", "With LFS content")
+	run(filesDir, "remote", "add", "origin", "file://"+gitDir)
+	run(filesDir, "push", "origin", "HEAD:master")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	repo := git.NewRepo(git.Remote{URL: "file://" + gitDir})
+	defer repo.Clean()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	config := TestConfig
+	config.EnableLFS = true
+	config.PushRetries = 1
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	content, err := ioutil.ReadFile(filepath.Join(checkout.Dir(), "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "the first content" {
+		t.Errorf("expected the LFS content in the checkout, got %q", content)
+	}
+
+	// The upstream moves on, so the push is rejected and the
+	// checkout rebased, which checks out the new LFS content.
+	write("data.bin", "the second content")
+	run(filesDir, "commit", "-am", "Change LFS content")
+	run(filesDir, "push", "origin", "HEAD:master")
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "app.yaml"), []byte("kind: StatefulSet"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Change app"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err = ioutil.ReadFile(filepath.Join(checkout.Dir(), "data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "the second content" {
+		t.Errorf("expected the new LFS content after rebasing, got %q", content)
+	}
+}
+
+func TestCheckoutLFSNotInstalled(t *testing.T) {
+	if lfsInstalled() {
+		t.Skip("git-lfs is installed")
+	}
+
+	repo, cleanup := Repo(t)
+	defer cleanup()
+	if err := repo.Ready(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.EnableLFS = true
+	if _, err := repo.Clone(context.Background(), config); err != git.ErrLFSNotInstalled {
+		t.Errorf("expected ErrLFSNotInstalled, got %v", err)
+	}
+}
+
+func TestCommitAndPushRetriesRejectedPush(t *testing.T) {
+	config := TestConfig
+	config.PushRetries = 2
+	first, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	second, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Clean()
+
+	var files []string
+	for file, _ := range testfiles.Files {
+		files = append(files, file)
+		if len(files) == 2 {
+			break
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(first.Dir(), files[0]), []byte("FIRST CHANGE"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.CommitAndPush(ctx, git.CommitAction{Message: "First change"}, &Note{Comment: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second checkout is now behind the upstream, so its push
+	// will be rejected unless it rebases.
+	if err := ioutil.WriteFile(filepath.Join(second.Dir(), files[1]), []byte("SECOND CHANGE"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	expectedNote := Note{Comment: "second"}
+	if _, err := second.CommitAndPush(ctx, git.CommitAction{Message: "Second change"}, &expectedNote); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) < 2 || commits[0].Message != "Second change" || commits[1].Message != "First change" {
+		t.Fatalf("expected the second change to be rebased on the first, got %#v", commits)
+	}
+
+	another, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer another.Clean()
+	var note Note
+	ok, err := another.GetNote(ctx, commits[0].Revision, &note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || note != expectedNote {
+		t.Errorf("expected note %#v on rebased commit, got %#v", expectedNote, note)
+	}
+}
+
+func TestExtraNotesRefs(t *testing.T) {
+	config := TestConfig
+	config.ExtraNotesRefs = []string{"policy"}
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for file, _ := range testfiles.Files {
+		path := filepath.Join(checkout.Dir(), file)
+		if err := ioutil.WriteFile(path, []byte("FIRST CHANGE"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	syncNote := Note{Comment: "sync"}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed file"}, &syncNote); err != nil {
+		t.Fatal(err)
+	}
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyNote := Note{Comment: "policy"}
+	if err := checkout.SetNoteIn(ctx, "policy", head, &policyNote); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.PushNotes(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	another, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer another.Clean()
+
+	var note Note
+	if ok, err := another.GetNote(ctx, head, &note); !ok || err != nil || note != syncNote {
+		t.Errorf("expected sync note %#v, got %#v (found: %v, err: %v)", syncNote, note, ok, err)
+	}
+	note = Note{}
+	if ok, err := another.GetNoteIn(ctx, "policy", head, &note); !ok || err != nil || note != policyNote {
+		t.Errorf("expected policy note %#v, got %#v (found: %v, err: %v)", policyNote, note, ok, err)
+	}
+}
+
+func TestRemoveNote(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.SetNoteRaw(ctx, head, []byte(`{"Comment":"to remove"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.PushNotes(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkout.RemoveNote(ctx, head); err != nil {
+		t.Fatal(err)
+	}
+	var note Note
+	if ok, err := checkout.GetNote(ctx, head, &note); ok || err != nil {
+		t.Errorf("expected no note after removing it, got %#v (found: %v, err: %v)", note, ok, err)
+	}
+	// Removing it again is harmless
+	if err := checkout.RemoveNote(ctx, head); err != nil {
+		t.Errorf("expected removing a missing note to succeed, got %v", err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	another, err := repo.Clone(ctx, TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer another.Clean()
+	if ok, err := another.GetNote(ctx, head, &note); ok || err != nil {
+		t.Errorf("expected the removal to have been pushed, got %#v (found: %v, err: %v)", note, ok, err)
+	}
+}
+
+func TestCommitTrailers(t *testing.T) {
+	config := TestConfig
+	config.SkipMessage = " [ci skip]"
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	for file, _ := range testfiles.Files {
+		path := filepath.Join(checkout.Dir(), file)
+		if err := ioutil.WriteFile(path, []byte("FIRST CHANGE"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	commitAction := git.CommitAction{
+		Author:  "Jane Doe <jane@example.com>",
+		Message: "Changed file",
+		Trailers: []git.Trailer{
+			{Key: "Co-authored-by", Value: "Jane Doe <jane@example.com>"},
+			{Key: "Signed-off-by", Value: "Weave Flux <support@weave.works>"},
+		},
+	}
+	if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	cmd := exec.Command("git", "-C", checkout.Dir(), "log", "-1", "--format=%(trailers)")
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Co-authored-by: Jane Doe <jane@example.com>\nSigned-off-by: Weave Flux <support@weave.works>"
+	if trailers := strings.TrimSpace(out.String()); trailers != expected {
+		t.Errorf("expected trailers:\n%s\n\nbut got:\n%s", expected, trailers)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject := commits[0].Message; subject != commitAction.Message+config.SkipMessage {
+		t.Errorf("expected commit subject %q, got %q", commitAction.Message+config.SkipMessage, subject)
+	}
+}
+
+func TestSkipMessagePlacement(t *testing.T) {
+	const signedOff = "Signed-off-by: Weave Flux <support@weave.works>"
+	for _, c := range []struct {
+		placement git.SkipPlacement
+		skip      string
+		template  string
+		expected  string
+	}{
+		// The newline the template ends with doesn't put the skip
+		// message on a line of its own
+		{git.SkipInline, " [skip ci]", "{{.Message}}\n", "Changed file [skip ci]\n\n" + signedOff},
+		{git.SkipNewline, " [skip ci]", "", "Changed file\n\n[skip ci]\n\n" + signedOff},
+		{git.SkipTrailer, "Skip-CI: true", "", "Changed file\n\n" + signedOff + "\nSkip-CI: true"},
+		{git.SkipPrefix, "[skip ci]", "", "[skip ci] Changed file\n\n" + signedOff},
+	} {
+		t.Run(string(c.placement), func(t *testing.T) {
+			config := TestConfig
+			config.SkipMessage = c.skip
+			config.SkipMessagePlacement = c.placement
+			config.MessageTemplate = c.template
+			checkout, _, cleanup := CheckoutWithConfig(t, config)
+			defer cleanup()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("CHANGED"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			commitAction := git.CommitAction{
+				Message:  "Changed file",
+				Trailers: []git.Trailer{{Key: "Signed-off-by", Value: "Weave Flux <support@weave.works>"}},
+			}
+			if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			out := &bytes.Buffer{}
+			cmd := exec.Command("git", "-C", checkout.Dir(), "log", "-1", "--format=%B")
+			cmd.Stdout = out
+			if err := cmd.Run(); err != nil {
+				t.Fatal(err)
+			}
+			if msg := strings.TrimSpace(out.String()); msg != c.expected {
+				t.Errorf("expected message:\n%s\n\nbut got:\n%s", c.expected, msg)
+			}
+		})
+	}
+}
+
+func TestSourceRevisionTrailer(t *testing.T) {
+	config := TestConfig
+	config.SkipMessage = " [ci skip]"
+	config.SourceRevisionTrailer = true
+	checkout, _, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	source, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file := range testfiles.Files {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), file), []byte("FIRST CHANGE"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	commitAction := git.CommitAction{
+		Message:  "Changed file",
+		Trailers: []git.Trailer{{Key: "Signed-off-by", Value: "Weave Flux <support@weave.works>"}},
+	}
+	if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	cmd := exec.Command("git", "-C", checkout.Dir(), "log", "-1", "--format=%s%n%(trailers)")
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Changed file [ci skip]\nSigned-off-by: Weave Flux <support@weave.works>\n" + git.SourceRevisionTrailerKey + ": " + source
+	if got := strings.TrimSpace(out.String()); got != expected {
+		t.Errorf("expected subject and trailers:\n%s\n\nbut got:\n%s", expected, got)
+	}
+}
+
+func TestSignedCommitWithPassphrase(t *testing.T) {
+	gpgHome, signingKey, gpgCleanup := gpgtest.GPGKeyWithPassphrase(t, "correct horse battery staple")
+	defer gpgCleanup()
+
+	config := TestConfig
+	config.SigningKey = signingKey
+
+	os.Setenv("GNUPGHOME", gpgHome)
+	defer os.Unsetenv("GNUPGHOME")
+
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	for file, _ := range testfiles.Files {
+		path := filepath.Join(checkout.Dir(), file)
+		if err := ioutil.WriteFile(path, []byte("FIRST CHANGE"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	passphrase := []byte("correct horse battery staple")
+	commitAction := git.CommitAction{Message: "Changed file", GPGPassphrase: passphrase}
+	if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(passphrase, make([]byte, len(passphrase))) {
+		t.Error("expected passphrase to be zeroed after use")
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commits[0].SignatureValid() {
+		t.Errorf("expected commit to have a valid signature, status was %q", commits[0].SignatureStatus)
+	}
+}
+
+func TestSignedCommitByUserID(t *testing.T) {
+	gpgHome, signingKey, gpgCleanup := gpgtest.GPGKey(t)
+	defer gpgCleanup()
+
+	config := TestConfig
+	config.SigningKey = "flux@weave.works"
+
+	os.Setenv("GNUPGHOME", gpgHome)
+	defer os.Unsetenv("GNUPGHOME")
+
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	change := func(content string) {
+		for file, _ := range testfiles.Files {
+			path := filepath.Join(checkout.Dir(), file)
+			if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+
+	change("FIRST CHANGE")
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed file"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commits[0].SignatureValid() {
+		t.Errorf("expected commit to have a valid signature, status was %q", commits[0].SignatureStatus)
+	}
+	if commits[0].SigningFingerprint != signingKey {
+		t.Errorf("expected commit to record fingerprint %q, got %q", signingKey, commits[0].SigningFingerprint)
+	}
+
+	change("SECOND CHANGE")
+	_, err = checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed file", SigningKey: "nobody@weave.works"}, nil)
+	if keyErr, ok := err.(git.SigningKeyError); !ok || len(keyErr.Fingerprints) != 0 {
+		t.Errorf("expected a SigningKeyError with no keys for a missing key, got %v", err)
+	}
+
+	gen := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--passphrase", "", "--quick-gen-key", "Other Flux <flux@weave.works>", "default", "sign")
+	if out, err := gen.CombinedOutput(); err != nil {
+		t.Fatalf("generating second key: %v: %s", err, out)
+	}
+	_, err = checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed file"}, nil)
+	if keyErr, ok := err.(git.SigningKeyError); !ok || len(keyErr.Fingerprints) != 2 {
+		t.Errorf("expected a SigningKeyError with two keys for an ambiguous key, got %v", err)
+	}
+}
+
+func TestCommitAndPushDetachedHead(t *testing.T) {
+	for _, recover := range []bool{false, true} {
+		config := TestConfig
+		config.RecoverDetachedHead = recover
+		checkout, repo, cleanup := CheckoutWithConfig(t, config)
+		defer cleanup()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := exec.Command("git", "-C", checkout.Dir(), "checkout", "--detach").Run(); err != nil {
+			t.Fatal(err)
+		}
+		for file, _ := range testfiles.Files {
+			path := filepath.Join(checkout.Dir(), file)
+			if err := ioutil.WriteFile(path, []byte("FIRST CHANGE"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+
+		_, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed file"}, nil)
+		if !recover {
+			if _, ok := err.(git.DetachedHeadError); !ok {
+				t.Errorf("expected DetachedHeadError, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		commits, err := repo.CommitsBefore(ctx, config.Branch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if commits[0].Message != "Changed file" {
+			t.Errorf("expected commit to be pushed to branch %s, but head commit is %q", config.Branch, commits[0].Message)
+		}
+	}
+}
+
+func TestSparseCheckout(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.Paths = []string{"test"}
+	config.SparsePaths = []string{"test"}
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+
+	if _, err := os.Stat(filepath.Join(checkout.Dir(), "test", "test-service-deploy.yaml")); err != nil {
+		t.Errorf("expected file in sparse path to be checked out: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(checkout.Dir(), "charts")); !os.IsNotExist(err) {
+		t.Errorf("expected directory outside sparse paths to be absent, got %v", err)
+	}
+
+	if err := checkout.SetSparsePaths(ctx, []string{"test", "charts"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(checkout.Dir(), "charts", "nginx", "Chart.yaml")); err != nil {
+		t.Errorf("expected file in added sparse path to be checked out: %v", err)
+	}
+
+	config.Paths = []string{"charts"}
+	if _, err := repo.Clone(ctx, config); err == nil {
+		t.Error("expected error when manifest path is outside the sparse paths")
+	}
+}
+
+func TestSubmodules(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A repo to be a submodule, next to the upstream, so that it can
+	// be given by a relative URL
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	root := filepath.Dir(upstream)
+	subFiles, work := filepath.Join(root, "subfiles"), filepath.Join(root, "work")
+	manifest := "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: vendored\n"
+	for _, args := range [][]string{
+		{"init", subFiles},
+		{"-C", subFiles, "config", "user.name", "example"},
+		{"-C", subFiles, "config", "user.email", "example@example.com"},
+	} {
+		if err := execCommand("git", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(subFiles, "namespace.yaml"), []byte(manifest), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-C", subFiles, "add", "namespace.yaml"},
+		{"-C", subFiles, "commit", "-m", "Add namespace"},
+		{"clone", "--bare", subFiles, filepath.Join(root, "sub.git")},
+		{"clone", upstream, work},
+		{"-C", work, "config", "user.name", "example"},
+		{"-C", work, "config", "user.email", "example@example.com"},
+		{"-C", work, "-c", "protocol.file.allow=always", "submodule", "add", "../sub.git", "vendored"},
+		{"-C", work, "commit", "-m", "Add submodule"},
+		{"-C", work, "push", "origin", "master"},
+	} {
+		if err := execCommand("git", args...); err != nil {
+			t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+		}
+	}
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	// git only fetches submodules from local paths if told it may
+	config.ExtraEnv = map[string]string{
+		"GIT_CONFIG_COUNT":   "1",
+		"GIT_CONFIG_KEY_0":   "protocol.file.allow",
+		"GIT_CONFIG_VALUE_0": "always",
+	}
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if _, err := os.Stat(filepath.Join(checkout.Dir(), "vendored", "namespace.yaml")); !os.IsNotExist(err) {
+		t.Errorf("expected the submodule to be left out by default, got %v", err)
+	}
+
+	for _, mode := range []git.SubmoduleMode{git.SubmodulesShallow, git.SubmodulesRecursive} {
+		config.Submodules = mode
+		config.Paths = []string{"vendored"}
+		checkout, err := repo.Clone(ctx, config)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		defer checkout.Clean()
+		content, err := ioutil.ReadFile(filepath.Join(checkout.Dir(), "vendored", "namespace.yaml"))
+		if err != nil || string(content) != manifest {
+			t.Errorf("%s: expected the file in the submodule to be checked out, got %q (err: %v)", mode, content, err)
+		}
+		files, err := checkout.ManifestFiles(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0] != filepath.Join(checkout.Dir(), "vendored", "namespace.yaml") {
+			t.Errorf("%s: expected the file in the submodule as the only manifest file, got %v", mode, files)
+		}
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A file committed with CRLF line endings, before the repo asked
+	// for line endings to be normalised
+	crlf := "kind: Namespace\r\nmetadata:\r\n  name: windows\r\n"
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	work := filepath.Join(filepath.Dir(upstream), "work")
+	if err := execCommand("git", "clone", upstream, work); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(path, content, message string) {
+		if err := ioutil.WriteFile(filepath.Join(work, path), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		for _, args := range [][]string{
+			{"-C", work, "add", path},
+			{"-C", work, "-c", "user.name=example", "-c", "user.email=example@example.com", "commit", "-m", message},
+		} {
+			if err := execCommand("git", args...); err != nil {
+				t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+			}
+		}
+	}
+	commit("windows.yaml", crlf, "Add a file from Windows")
+	commit(".gitattributes", "* text\n", "Normalise line endings")
+	if err := execCommand("git", "-C", work, "push", "origin", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Otherwise, the file is seen as changed as soon as it's
+	// written, even if it's written as it was
+	checkout, err := repo.Clone(ctx, TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "windows.yaml"), []byte(crlf), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, patch, err := checkout.PrepareCommit(ctx, git.CommitAction{Message: "Rewrote windows.yaml"}); err != nil || len(patch) == 0 {
+		t.Errorf("expected rewriting the CRLF file to make a change without NormalizeLineEndings (err: %v)", err)
+	}
+
+	config := TestConfig
+	config.NormalizeLineEndings = true
+	checkout, err = repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if clean, err := checkout.IsClean(ctx); err != nil || !clean {
+		t.Errorf("expected the checkout to be clean with NormalizeLineEndings (clean: %v, err: %v)", clean, err)
+	}
+
+	// Rewriting the file as it was, or with LF line endings, is no
+	// change at all
+	path := filepath.Join(checkout.Dir(), "windows.yaml")
+	if err := ioutil.WriteFile(path, []byte(crlf), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := checkout.PrepareCommit(ctx, git.CommitAction{Message: "Rewrote windows.yaml"}); err != git.ErrNoChanges {
+		t.Errorf("expected ErrNoChanges for rewriting the file as it was, got %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Replace(crlf, "\r\n", "\n", -1)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Rewrote windows.yaml"}, nil); err != git.ErrNoChanges {
+		t.Errorf("expected ErrNoChanges for a change only to line endings, got %v", err)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != crlf {
+		t.Errorf("expected the file to be put back as it was, got %q (err: %v)", content, err)
+	}
+
+	// A change to the content (with different line endings) is
+	// committed as it is
+	changed := strings.Replace(crlf, "windows", "linux", 1)
+	if err := ioutil.WriteFile(path, []byte(strings.Replace(changed, "\r\n", "\n", -1)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Renamed the namespace"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Path != "windows.yaml" {
+		t.Errorf("expected only windows.yaml to be committed, got %+v", result.Changes)
+	}
+
+	// core.autocrlf and core.eol are set as given
+	config.AutoCRLF, config.EOL = "input", "lf"
+	checkout, err = repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	for key, expected := range map[string]string{"core.autocrlf": "input", "core.eol": "lf"} {
+		out, err := exec.Command("git", "-C", checkout.Dir(), "config", key).Output()
+		if err != nil || strings.TrimSpace(string(out)) != expected {
+			t.Errorf("expected %s to be %q, got %q (err: %v)", key, expected, out, err)
+		}
+	}
+}
+
+func TestSwitchBranch(t *testing.T) {
+	for _, depth := range []int{0, 1} {
+		repo, cleanup := Repo(t)
+		defer cleanup()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		upstreamDir := strings.TrimPrefix(repo.Origin().URL, "file://")
+		if err := execCommand("git", "-C", upstreamDir, "branch", "staging", "master"); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Ready(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		config := TestConfig
+		config.Branches = []string{"staging"}
+		config.CloneDepth = depth
+		checkout, err := repo.Clone(ctx, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checkout.Clean()
+
+		if err := checkout.SwitchBranch(ctx, "prod"); err == nil {
+			t.Error("expected error switching to untracked branch")
+		}
+		if err := checkout.SwitchBranch(ctx, "staging"); err != nil {
+			t.Fatal(err)
+		}
+		for file, _ := range testfiles.Files {
+			if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), file), []byte("STAGING CHANGE"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Staging change"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		staging, err := repo.CommitsBefore(ctx, "staging")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if staging[0].Message != "Staging change" {
+			t.Errorf("expected commit to be pushed to staging, but head commit is %q", staging[0].Message)
+		}
+		master, err := repo.CommitsBefore(ctx, "master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if master[0].Message == "Staging change" {
+			t.Error("expected commit not to be pushed to master")
+		}
+
+		if err := checkout.SwitchBranch(ctx, "master"); err != nil {
+			t.Fatal(err)
+		}
+		head, err := checkout.HeadRevision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != master[0].Revision {
+			t.Errorf("expected HEAD to be at master (%s) after switching back, got %s", master[0].Revision, head)
+		}
+	}
+}
+
+func TestPrepareCommit(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := checkout.PrepareCommit(ctx, git.CommitAction{Message: "Nothing"}); err != git.ErrNoChanges {
+		t.Errorf("expected ErrNoChanges with no changes, got %v", err)
+	}
+
+	var file string
+	for file, _ = range testfiles.Files {
+		break
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), file), []byte("DRY RUN CHANGE\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	commitAction := git.CommitAction{Author: "Some One <someone@example.com>", Message: "Dry run"}
+	commit, patch, err := checkout.PrepareCommit(ctx, commitAction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Message != "Dry run" {
+		t.Errorf("expected message %q, got %q", "Dry run", commit.Message)
+	}
+	if commit.Revision == "" || commit.Revision == before {
+		t.Errorf("expected a new revision, got %q", commit.Revision)
+	}
+	if !bytes.Contains(patch, []byte("+DRY RUN CHANGE")) || !strings.Contains(string(patch), file) {
+		t.Errorf("expected diff to include the change to %s, got:\n%s", file, patch)
+	}
+	out, err := exec.Command("git", "-C", checkout.Dir(), "log", "-1", "--format=%an <%ae>", commit.Revision).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if author := strings.TrimSpace(string(out)); author != commitAction.Author {
+		t.Errorf("expected author %q, got %q", commitAction.Author, author)
+	}
+
+	after, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Errorf("expected HEAD to stay at %s, but it moved to %s", before, after)
+	}
+	if err := exec.Command("git", "-C", checkout.Dir(), "show-ref", "--verify", "--quiet", "refs/flux/dry-run").Run(); err == nil {
+		t.Error("expected the dry-run ref to be removed")
+	}
+
+	// The changes are still there to be committed for real, and
+	// nothing was pushed in the meantime.
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := repo.Revision(ctx, TestConfig.Branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream != before {
+		t.Errorf("expected upstream branch to be unchanged by dry run")
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "For real"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncState(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tag without state gives just the revision
+	if err := checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: head, Message: "Sync pointer"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	state, err := repo.GetSyncState(ctx, TestConfig.SyncTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(state, git.SyncState{Revision: head}) {
+		t.Errorf("expected only the revision from a plain tag, got %+v", state)
+	}
+
+	synced := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	tagAction := git.TagAction{
+		Revision: head,
+		State:    &git.SyncState{Time: synced, FluxVersion: "1.2.3"},
+	}
+	if err := checkout.MoveSyncTagAndPush(ctx, tagAction); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	state, err = repo.GetSyncState(ctx, TestConfig.SyncTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := git.SyncState{Revision: head, Time: synced, FluxVersion: "1.2.3"}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("expected state %+v, got %+v", expected, state)
+	}
+
+	if _, err := repo.GetSyncState(ctx, "no-such-tag"); err == nil {
+		t.Error("expected error for a tag that doesn't exist")
+	}
+}
+
+func TestPreviousSyncRevision(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	moveTag := func(tagAction git.TagAction) {
+		if err := checkout.MoveSyncTagAndPush(ctx, tagAction); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moveTag(git.TagAction{Revision: first, Message: "Sync pointer"})
+	if _, err := repo.PreviousSyncRevision(ctx, TestConfig.SyncTag); err == nil {
+		t.Error("expected an error for a tag that has only been in one place")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("CHANGED"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moveTag(git.TagAction{Revision: second, Message: "Sync pointer"})
+	// Moving it to the same revision doesn't count
+	moveTag(git.TagAction{Revision: second, State: &git.SyncState{FluxVersion: "1.2.3"}})
+
+	previous, err := repo.PreviousSyncRevision(ctx, TestConfig.SyncTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous != first {
+		t.Errorf("expected previous sync revision %s, got %s", first, previous)
+	}
+
+	// Rolling back makes the bad revision the previous one
+	moveTag(git.TagAction{Revision: previous, Message: "Roll back"})
+	if previous, err = repo.PreviousSyncRevision(ctx, TestConfig.SyncTag); err != nil || previous != second {
+		t.Errorf("expected previous sync revision %s after rolling back, got %s (err: %v)", second, previous, err)
+	}
+
+	if _, err := repo.PreviousSyncRevision(ctx, "no-such-tag"); err == nil {
+		t.Error("expected error for a tag that doesn't exist")
+	}
+}
+
+func TestPushWithSyncTag(t *testing.T) {
+	var warnings []error
+	config := TestConfig
+	config.Warn = func(err error) {
+		warnings = append(warnings, err)
+	}
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	upstreamRev := func(ref string) string {
+		out, _ := exec.Command("git", "-C", upstream, "rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+		return strings.TrimSpace(string(out))
+	}
+	commit := func(content string) string {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		rev, err := checkout.Commit(ctx, git.CommitAction{Message: "Changed garbage"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+
+	rev := commit("FIRST")
+	if err := checkout.PushWithSyncTag(ctx, git.TagAction{Revision: rev, Message: "Sync"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := upstreamRev("refs/heads/master"); got != rev {
+		t.Errorf("expected the branch upstream to be at %s, got %s", rev, got)
+	}
+	if got := upstreamRev("refs/tags/" + config.SyncTag); got != rev {
+		t.Errorf("expected the sync tag upstream to be at %s, got %s", rev, got)
+	}
+
+	// The upstream refuses the tag; since the push is atomic, the
+	// branch isn't updated either
+	hook := filepath.Join(upstream, "hooks", "update")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\ncase \"$1\" in refs/tags/*) exit 1;; esac\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	second := commit("SECOND")
+	if err := checkout.PushWithSyncTag(ctx, git.TagAction{Revision: second, Message: "Sync"}); err == nil {
+		t.Error("expected an error with the tag refused")
+	}
+	if got := upstreamRev("refs/heads/master"); got != rev {
+		t.Errorf("expected the branch upstream to have stayed at %s, got %s", rev, got)
+	}
+	if got := upstreamRev("refs/tags/" + config.SyncTag); got != rev {
+		t.Errorf("expected the sync tag upstream to have stayed at %s, got %s", rev, got)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got %v", warnings)
+	}
+
+	// An upstream that can't push atomically gets the refs one at a
+	// time, with a warning
+	if err := os.Remove(hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", upstream, "config", "receive.advertiseAtomic", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.PushWithSyncTag(ctx, git.TagAction{Revision: second, Message: "Sync"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := upstreamRev("refs/heads/master"); got != second {
+		t.Errorf("expected the branch upstream to be at %s, got %s", second, got)
+	}
+	if got := upstreamRev("refs/tags/" + config.SyncTag); got != second {
+		t.Errorf("expected the sync tag upstream to be at %s, got %s", second, got)
+	}
+	if len(warnings) != 1 || warnings[0] != git.ErrAtomicPushUnsupported {
+		t.Errorf("expected a warning that the push wasn't atomic, got %v", warnings)
+	}
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	entries []map[interface{}]interface{}
+}
+
+func (l *recordingLogger) Log(keyvals ...interface{}) error {
+	entry := map[interface{}]interface{}{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		entry[keyvals[i]] = keyvals[i+1]
+	}
+	l.Lock()
+	l.entries = append(l.entries, entry)
+	l.Unlock()
+	return nil
+}
+
+func TestLogWith(t *testing.T) {
+	upstream, cleanup := Repo(t)
+	defer cleanup()
+
+	logger := &recordingLogger{}
+	repo := git.NewRepo(upstream.Origin(), git.LogWith(logger))
+	defer repo.Clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = git.LogContext(ctx, "sync", "test")
+
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkout, err := repo.Clone(ctx, TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("CHANGED"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	logged := func(prefix string) bool {
+		logger.Lock()
+		defer logger.Unlock()
+		for _, entry := range logger.entries {
+			command, _ := entry["command"].(string)
+			if strings.HasPrefix(command, prefix) && entry["level"] == "debug" && entry["sync"] == "test" {
+				return true
+			}
+		}
+		return false
+	}
+	for _, prefix := range []string{"git clone --mirror", "git clone", "git commit", "git push"} {
+		if !logged(prefix) {
+			t.Errorf("expected a %q command to have been logged, with the context's values", prefix)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	upstream, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var got []git.Progress
+	record := func(p git.Progress) {
+		mu.Lock()
+		got = append(got, p)
+		mu.Unlock()
+	}
+	// For only a few objects, git doesn't bother saying how it's
+	// getting on with them itself, so there may only be the
+	// upstream's progress
+	reported := func(op git.Operation) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, p := range got {
+			if p.Op == op && p.Percent == 100 && p.Done == p.Total {
+				return true
+			}
+		}
+		return false
+	}
+
+	repo := git.NewRepo(upstream.Origin(), git.ProgressFunc(record))
+	defer repo.Clean()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reported(git.OpClone) {
+		t.Errorf("expected progress cloning the repo, got %+v", got)
+	}
+
+	// The checkout is a clone too; with CloneDepth, it's fetched
+	// rather than copied, so there's progress to report
+	var checkoutGot []git.Progress
+	config := TestConfig
+	config.CloneDepth = 1
+	config.ProgressFunc = func(p git.Progress) {
+		checkoutGot = append(checkoutGot, p)
+	}
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if len(checkoutGot) == 0 || checkoutGot[len(checkoutGot)-1].Op != git.OpClone {
+		t.Errorf("expected progress cloning the checkout, got %+v", checkoutGot)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("CHANGED"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reported(git.OpFetch) {
+		t.Errorf("expected progress fetching, got %+v", got)
+	}
+}
+
+func TestIsAncestor(t *testing.T) {
+	config := TestConfig
+	config.SyncTagForwardOnly = true
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("CHANGED"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := result.Revision
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{first, second, true},
+		{second, first, false},
+		{second, second, true},
+	} {
+		if ok, err := repo.IsAncestor(ctx, c.a, c.b); err != nil || ok != c.expected {
+			t.Errorf("expected IsAncestor(%s, %s) to be %v, got %v (err: %v)", c.a, c.b, c.expected, ok, err)
+		}
+	}
+	if _, err := repo.IsAncestor(ctx, "no-such-ref", second); err == nil {
+		t.Error("expected an error for a ref that doesn't exist")
+	}
+
+	// The sync tag can go forward, or stay put, but not back
+	if err := checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: second, Message: "Sync"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: second, Message: "Sync again"}); err != nil {
+		t.Fatal(err)
+	}
+	err = checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: first, Message: "Sync"})
+	if _, ok := err.(git.SyncTagRollbackError); !ok {
+		t.Errorf("expected SyncTagRollbackError moving the tag back, got %v", err)
+	}
+	err = checkout.PushWithSyncTag(ctx, git.TagAction{Revision: first, Message: "Sync"})
+	if _, ok := err.(git.SyncTagRollbackError); !ok {
+		t.Errorf("expected SyncTagRollbackError moving the tag back with the branch, got %v", err)
+	}
+	if rev, err := checkout.SyncRevision(ctx); err != nil || rev != second {
+		t.Errorf("expected the sync tag to have stayed at %s, got %s (err: %v)", second, rev, err)
+	}
+}
+
+func TestMergeBase(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fork, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(branch, content string) {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage", CommitBranch: branch}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("feature", "FEATURE")
+	commit("", "MASTER")
+
+	// A branch with a history of its own, starting from the empty tree
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	cmd := exec.Command("git", "-C", upstream, "commit-tree", "-m", "Unrelated", "4b825dc642cb6eb9a060e54bf8d69288fbee4904")
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=example", "GIT_AUTHOR_EMAIL=example@example.com", "GIT_COMMITTER_NAME=example", "GIT_COMMITTER_EMAIL=example@example.com")
+	orphan, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "-C", upstream, "update-ref", "refs/heads/orphan", strings.TrimSpace(string(orphan))).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if base, err := repo.MergeBase(ctx, "feature", TestConfig.Branch); err != nil || base != fork {
+		t.Errorf("expected merge base %s, got %s (err: %v)", fork, base, err)
+	}
+	if _, err := repo.MergeBase(ctx, "orphan", TestConfig.Branch); err == nil {
+		t.Error("expected an error for branches with no history in common")
+	} else if _, ok := err.(git.NoMergeBaseError); !ok {
+		t.Errorf("expected NoMergeBaseError, got %v", err)
+	}
+	if _, err := repo.MergeBase(ctx, "no-such-branch", TestConfig.Branch); err == nil {
+		t.Error("expected an error for a branch that doesn't exist")
+	}
+}
+
+func TestCommitParents(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	root, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(branch, content string) string {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage", CommitBranch: branch}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Revision
+	}
+	feature := commit("feature", "FEATURE")
+	master := commit("", "MASTER")
+
+	// Merge the feature branch into master, upstream
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	cmd := exec.Command("git", "-C", upstream, "commit-tree", "-m", "Merge feature", "-p", master, "-p", feature, master+"^{tree}")
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=example", "GIT_AUTHOR_EMAIL=example@example.com", "GIT_COMMITTER_NAME=example", "GIT_COMMITTER_EMAIL=example@example.com")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	merge := strings.TrimSpace(string(out))
+	if err := exec.Command("git", "-C", upstream, "update-ref", "refs/heads/master", merge).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	commits, err := repo.CommitsBefore(ctx, TestConfig.Branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents := map[string][]string{}
+	for _, c := range commits {
+		parents[c.Revision] = c.Parents
+	}
+	for rev, expected := range map[string][]string{
+		merge:   {master, feature},
+		master:  {root},
+		feature: {root},
+		root:    {},
+	} {
+		if got, ok := parents[rev]; !ok {
+			t.Errorf("expected commit %s in the log", rev)
+		} else if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected parents %v for %s, got %v", expected, rev, got)
+		}
+	}
+}
+
+func TestCommitBranch(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	master, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	for file, _ := range testfiles.Files {
+		files = append(files, file)
+		if len(files) == 2 {
+			break
+		}
+	}
+	for i, message := range []string{"First auto change", "Second auto change"} {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), files[i]), []byte(message), 0666); err != nil {
+			t.Fatal(err)
+		}
+		commitAction := git.CommitAction{Message: message, CommitBranch: "flux-auto"}
+		if _, err := checkout.CommitAndPush(ctx, commitAction, &Note{Comment: message}); err != nil {
+			t.Fatal(err)
+		}
+		head, err := checkout.HeadRevision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != master {
+			t.Errorf("expected checkout to be back at %s on the tracked branch, but HEAD is %s", master, head)
+		}
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	upstreamMaster, err := repo.Revision(ctx, TestConfig.Branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstreamMaster != master {
+		t.Errorf("expected tracked branch to be untouched")
+	}
+	auto, err := repo.CommitsBefore(ctx, "flux-auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auto) < 3 || auto[0].Message != "Second auto change" || auto[1].Message != "First auto change" || auto[2].Revision != master {
+		t.Errorf("expected both commits on flux-auto, on top of %s; got %+v", master, auto)
+	}
+}
+
+type recordingPRCreator struct {
+	base, head, title, body string
+}
+
+func (p *recordingPRCreator) OpenPR(ctx context.Context, base, head, title, body string) (string, error) {
+	p.base, p.head, p.title, p.body = base, head, title, body
+	return "https://example.com/pulls/1", nil
+}
+
+func TestCommitAndOpenPR(t *testing.T) {
+	prs := &recordingPRCreator{}
+	config := TestConfig
+	config.PRCreator = prs
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := checkout.CommitAndOpenPR(ctx, git.CommitAction{Message: "No branch"}, nil); err == nil {
+		t.Error("expected error without a CommitBranch")
+	}
+
+	for file, _ := range testfiles.Files {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), file), []byte("PR CHANGE"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	commitAction := git.CommitAction{Message: "Update images\n\nBecause there are new ones.", CommitBranch: "flux-auto"}
+	prURL, err := checkout.CommitAndOpenPR(ctx, commitAction, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prURL != "https://example.com/pulls/1" {
+		t.Errorf("expected URL from the PRCreator, got %q", prURL)
+	}
+	expected := recordingPRCreator{base: "master", head: "flux-auto", title: "Update images", body: "Because there are new ones."}
+	if *prs != expected {
+		t.Errorf("expected pull request %+v, got %+v", expected, *prs)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Revision(ctx, "flux-auto"); err != nil {
+		t.Errorf("expected branch to be pushed before opening the pull request: %v", err)
+	}
+}
+
+func TestValidateManifestDirs(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.Paths = []string{"test", "tset"}
+	_, err := repo.Clone(ctx, config)
+	if missing, ok := err.(git.MissingManifestDirError); !ok || missing.Path != "tset" {
+		t.Errorf("expected MissingManifestDirError for mistyped path, got %v", err)
+	}
+
+	config.Paths = []string{"test"}
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if err := checkout.ValidateManifestDirs(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(checkout.Dir(), "test")
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = checkout.ValidateManifestDirs()
+	if empty, ok := err.(git.EmptyManifestDirError); !ok || empty.Path != "test" {
+		t.Errorf("expected EmptyManifestDirError for path with no files, got %v", err)
+	}
+}
+
+func TestManifestFilesExportIgnore(t *testing.T) {
+	checkout, _, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	files := map[string]string{
+		".gitattributes":             "*.fixture.yaml export-ignore\nfixtures export-ignore\n",
+		"deploy/.gitattributes":      "local.yaml export-ignore\n",
+		"deploy/app.yaml":            "kind: Deployment",
+		"deploy/app.fixture.yaml":    "kind: Deployment",
+		"deploy/local.yaml":          "kind: Deployment",
+		"fixtures/app.yaml":          "kind: Deployment",
+		"fixtures/nested/other.yaml": "kind: Deployment",
+	}
+	for path, content := range files {
+		path = filepath.Join(checkout.Dir(), path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := checkout.ManifestFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, f := range found {
+		rel, err := filepath.Rel(checkout.Dir(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[filepath.ToSlash(rel)] = true
+	}
+	if !seen["deploy/app.yaml"] {
+		t.Error("expected deploy/app.yaml to be included")
+	}
+	for _, path := range []string{"deploy/app.fixture.yaml", "deploy/local.yaml", "fixtures/app.yaml", "fixtures/nested/other.yaml"} {
+		if seen[path] {
+			t.Errorf("expected %s, which is export-ignore'd, to be left out", path)
+		}
+	}
+}
+
+func TestManifestFiles(t *testing.T) {
+	config := TestConfig
+	config.Ignore = []string{"LICENSE"} // in addition to those in the file
+	checkout, _, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	files := map[string]string{
+		".fluxignore":            "*.md\n!keep.md\nci/\n",
+		"README.md":              "# Not a manifest",
+		"keep.md":                "# Kept on purpose",
+		"ci/pipeline.yaml":       "steps: []",
+		"LICENSE":                "All rights reserved",
+		"deploy/app.yaml":        "kind: Deployment",
+		"deploy/docs/README.md":  "# Also not a manifest",
+		".github/workflows.yaml": "on: push",
+		"deploy/.cache/app.yaml": "kind: Deployment",
+	}
+	for path, content := range files {
+		path = filepath.Join(checkout.Dir(), path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := checkout.ManifestFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, f := range found {
+		rel, err := filepath.Rel(checkout.Dir(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[filepath.ToSlash(rel)] = true
+	}
+	for _, path := range []string{"keep.md", "deploy/app.yaml"} {
+		if !seen[path] {
+			t.Errorf("expected %s to be included", path)
+		}
+	}
+	for _, path := range []string{".fluxignore", "README.md", "ci/pipeline.yaml", "LICENSE", "deploy/docs/README.md", ".github/workflows.yaml", "deploy/.cache/app.yaml"} {
+		if seen[path] {
+			t.Errorf("expected %s to be ignored", path)
+		}
+	}
+}
+
+func TestManifestFiles_HiddenPath(t *testing.T) {
+	testfiles.Files[".kube/app.yaml"] = "kind: Deployment"
+	testfiles.Files[".kube/.cache/app.yaml"] = "kind: Deployment"
+	defer delete(testfiles.Files, ".kube/app.yaml")
+	defer delete(testfiles.Files, ".kube/.cache/app.yaml")
+
+	config := TestConfig
+	config.Paths = []string{".kube"}
+	checkout, _, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	// The manifest path being hidden doesn't hide what's in it, but
+	// hidden directories under it are still skipped.
+	found, err := checkout.ManifestFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{filepath.Join(checkout.Dir(), ".kube", "app.yaml")}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected files %v, got %v", expected, found)
+	}
+}
+
+func TestManifestFilesByDir(t *testing.T) {
+	config := TestConfig
+	config.Paths = []string{"test", "charts"}
+	config.Ignore = []string{"values.yaml"}
+	checkout, _, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	// A file in one dir, reached by a symlink in the other, is given
+	// for both
+	if err := os.Symlink("../charts/nginx/Chart.yaml", filepath.Join(checkout.Dir(), "test", "Chart.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	byDir, err := checkout.ManifestFilesByDir(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for dir, files := range byDir {
+		relDir, err := filepath.Rel(checkout.Dir(), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			rel, err := filepath.Rel(checkout.Dir(), f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[relDir] = append(got[relDir], filepath.ToSlash(rel))
+		}
+		sort.Strings(got[relDir])
+	}
+	expected := map[string][]string{
+		"test":   {"charts/nginx/Chart.yaml", "test/test-service-deploy.yaml"},
+		"charts": {"charts/nginx/Chart.yaml", "charts/nginx/templates/deployment.yaml"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected files by dir %v, got %v", expected, got)
+	}
+
+	outside, err := ioutil.TempDir("", "flux-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(checkout.Dir(), "charts", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.ManifestFilesByDir(context.Background()); err == nil {
+		t.Error("expected an error for a symlink out of the repo")
+	} else if _, ok := err.(git.SymlinkOutsideRepoError); !ok {
+		t.Errorf("expected SymlinkOutsideRepoError, got %v", err)
+	}
+}
+
+func TestSquashCommits(t *testing.T) {
+	config := TestConfig
+	config.SquashCommits = true
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var files []string
+	for file, _ := range testfiles.Files {
+		files = append(files, file)
+		if len(files) == 2 {
+			break
+		}
+	}
+	messages := []string{"First change\n\nwith details", "Second change"}
+	for i, message := range messages {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), files[i]), []byte(message), 0666); err != nil {
+			t.Fatal(err)
+		}
+		commitAction := git.CommitAction{Message: message}
+		if err := checkout.QueueCommit(ctx, commitAction, &Note{Comment: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if head, _ := checkout.HeadRevision(ctx); head != before {
+		t.Fatalf("expected nothing to be committed before PushQueued")
+	}
+	if err := checkout.PushQueued(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, config.Branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) < 2 || commits[1].Revision != before {
+		t.Fatalf("expected a single commit on top of %s, got %+v", before, commits)
+	}
+	expected := "Squashed 2 changes"
+	if commits[0].Message != expected {
+		t.Errorf("expected message %q, got %q", expected, commits[0].Message)
+	}
+
+	var notes []Note
+	ok, err := checkout.GetNote(ctx, commits[0].Revision, &notes)
+	if !ok || err != nil {
+		t.Fatalf("expected to find note, got %v, %v", ok, err)
+	}
+	if len(notes) != 2 || notes[0].Comment != messages[0] || notes[1].Comment != messages[1] {
+		t.Errorf("expected notes for both changes, got %+v", notes)
+	}
+
+	// with nothing queued, PushQueued does nothing
+	if err := checkout.PushQueued(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManifestSymlinks(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.Paths = []string{"test"}
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+
+	// Replace the manifest path with a symlink to a directory
+	// elsewhere in the repo, which itself has a symlink to a file.
+	for path, content := range map[string]string{
+		"generated/app.yaml": "kind: Deployment",
+		"other/svc.yaml":     "kind: Service",
+	} {
+		path = filepath.Join(checkout.Dir(), path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test := filepath.Join(checkout.Dir(), "test")
+	if err := os.RemoveAll(test); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("generated", test); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../other/svc.yaml", filepath.Join(checkout.Dir(), "generated", "svc.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", filepath.Join(checkout.Dir(), "generated", "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkout.ValidateManifestDirs(); err != nil {
+		t.Fatal(err)
+	}
+	if dirs := checkout.ManifestDirs(); len(dirs) != 1 || dirs[0] != filepath.Join(checkout.Dir(), "generated") {
+		t.Errorf("expected manifest dir to be resolved to generated/, got %v", dirs)
+	}
+	found, err := checkout.ManifestFiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rels []string
+	for _, f := range found {
+		rel, err := filepath.Rel(checkout.Dir(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rels = append(rels, filepath.ToSlash(rel))
+	}
+	sort.Strings(rels)
+	if expected := []string{"generated/app.yaml", "other/svc.yaml"}; !reflect.DeepEqual(rels, expected) {
+		t.Errorf("expected files %v, got %v", expected, rels)
+	}
+
+	// A symlink out of the repo, whether it's the manifest path or
+	// under it, is an error.
+	outside, err := ioutil.TempDir("", "flux-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.yaml"), []byte("kind: Secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	escape := filepath.Join(checkout.Dir(), "generated", "escape")
+	if err := os.Symlink(outside, escape); err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkout.ManifestFiles(context.Background())
+	if link, ok := err.(git.SymlinkOutsideRepoError); !ok || link.Path != "generated/escape" {
+		t.Errorf("expected SymlinkOutsideRepoError for generated/escape, got %v", err)
+	}
+	if err := os.Remove(escape); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(test); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, test); err != nil {
+		t.Fatal(err)
+	}
+	err = checkout.ValidateManifestDirs()
+	if link, ok := err.(git.SymlinkOutsideRepoError); !ok || link.Path != "test" {
+		t.Errorf("expected SymlinkOutsideRepoError for test, got %v", err)
+	}
+}
+
+func TestCommitDeletionsAndRenames(t *testing.T) {
+	for _, mode := range []git.StageMode{git.StageAll, git.StageTracked} {
+		t.Run(string(mode), func(t *testing.T) {
+			config := TestConfig
+			config.StageMode = mode
+			checkout, repo, cleanup := CheckoutWithConfig(t, config)
+			defer cleanup()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var files []string
+			for file, _ := range testfiles.Files {
+				files = append(files, file)
+				if len(files) == 2 {
+					break
+				}
+			}
+			deleted, renamed := files[0], files[1]
+			if err := os.Remove(filepath.Join(checkout.Dir(), deleted)); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filepath.Join(checkout.Dir(), renamed), filepath.Join(checkout.Dir(), "renamed.yaml")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Delete and rename"}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := repo.Refresh(ctx); err != nil {
+				t.Fatal(err)
+			}
+			another, err := repo.Clone(ctx, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer another.Clean()
+
+			exists := func(path string) bool {
+				_, err := os.Stat(filepath.Join(another.Dir(), path))
+				return err == nil
+			}
+			if exists(deleted) {
+				t.Errorf("expected %s to have been deleted", deleted)
+			}
+			if exists(renamed) {
+				t.Errorf("expected %s to have been moved", renamed)
+			}
+			// only StageAll picks up the new file
+			if exists("renamed.yaml") != (mode == git.StageAll) {
+				t.Errorf("with stage mode %q, expected renamed.yaml to be committed: %v", mode, mode == git.StageAll)
+			}
+		})
+	}
+}
+
+func TestStageTracked_NewFile(t *testing.T) {
+	config := TestConfig
+	config.StageMode = git.StageTracked
+	checkout, _, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "new.yaml"), []byte("kind: Service"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Add a file"}, nil); err != git.ErrNoChanges {
+		t.Errorf("expected ErrNoChanges when only tracking changes to existing files, got %v", err)
+	}
+}
+
+func TestCloneMaxRepoBytes(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.MaxRepoBytes = 1
+	if _, err := repo.Clone(ctx, config); err != (git.RepoTooLargeError{Limit: 1}) {
+		t.Errorf("expected RepoTooLargeError, got %v", err)
+	}
+
+	config.MaxRepoBytes = 100 << 20
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkout.Clean()
+}
+
+func TestCommitAuthorAndCommitter(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var file string
+	for file, _ = range testfiles.Files {
+		break
+	}
+	for i, action := range []git.CommitAction{
+		{Message: "With author name and email", AuthorName: "Jane Doe", AuthorEmail: "jane@example.com"},
+		{Message: "With author", Author: "Jane Doe <jane@example.com>"},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), file), []byte(action.Message), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := checkout.CommitAndPush(ctx, action, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		commits, err := repo.CommitsBefore(ctx, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := commits[0]
+		if c.AuthorName != "Jane Doe" || c.AuthorEmail != "jane@example.com" {
+			t.Errorf("commit %d: expected author Jane Doe <jane@example.com>, got %s <%s>", i, c.AuthorName, c.AuthorEmail)
+		}
+		if c.CommitterName != TestConfig.UserName || c.CommitterEmail != TestConfig.UserEmail {
+			t.Errorf("commit %d: expected committer %s <%s>, got %s <%s>", i, TestConfig.UserName, TestConfig.UserEmail, c.CommitterName, c.CommitterEmail)
+		}
+	}
+}
+
+func TestCommitAndPushEmpty(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "No changes"}, nil); err != git.ErrNoChanges {
+		t.Errorf("expected ErrNoChanges, got %v", err)
+	}
+	if head, _ := checkout.HeadRevision(ctx); head != before {
+		t.Errorf("expected no commit to be made")
+	}
+
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Marker", AllowEmpty: true}, &Note{Comment: "marker"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) < 2 || commits[0].Message != "Marker" || commits[1].Revision != before {
+		t.Errorf("expected empty marker commit on top of %s, got %+v", before, commits)
+	}
+}
+
+type recordingCredentials struct {
+	mu  sync.Mutex
+	ops []git.Operation
+}
+
+func (c *recordingCredentials) Credentials(ctx context.Context, op git.Operation) (git.Auth, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ops = append(c.ops, op)
+	return git.Auth{}, nil
+}
+
+func TestCheckoutCredentials(t *testing.T) {
+	creds := &recordingCredentials{}
+	config := TestConfig
+	config.Credentials = creds
+	checkout, _, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var file string
+	for file, _ = range testfiles.Files {
+		break
+	}
+	for i, message := range []string{"First change", "Second change"} {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), file), []byte(message), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: message}, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Credentials are asked for on every push, so that rotated
+		// secrets are picked up.
+		if len(creds.ops) != i+1 || creds.ops[i] != git.OpPush {
+			t.Errorf("expected credentials to be asked for once for each push, got %v", creds.ops)
+		}
+	}
+}
+
+func TestSyncRevision_NoTag(t *testing.T) {
+	checkout, cleanup := Checkout(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := checkout.SyncRevision(ctx); err != (git.RefNotFoundError{Ref: "refs/tags/" + TestConfig.SyncTag}) {
+		t.Errorf("expected RefNotFoundError before the sync tag exists, got %v", err)
+	}
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: head, Message: "Sync pointer"}); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := checkout.SyncRevision(ctx); err != nil || rev != head {
+		t.Errorf("expected sync tag to be at %s, got %q (%v)", head, rev, err)
+	}
+}
+
+func TestCommitAndPushSizeLimits(t *testing.T) {
+	config := TestConfig
+	config.MaxFileBytes = 1024
+	config.MaxCommitBytes = 3000
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, size int) {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), name), bytes.Repeat([]byte("x"), size), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("rendered.yaml", 2048)
+	_, err = checkout.CommitAndPush(ctx, git.CommitAction{Message: "Too big"}, nil)
+	if tooLarge, ok := err.(git.CommitTooLargeError); !ok || tooLarge.Path != "rendered.yaml" || tooLarge.Size != 2048 {
+		t.Errorf("expected CommitTooLargeError for rendered.yaml, got %v", err)
+	}
+
+	for _, name := range []string{"rendered.yaml", "a.yaml", "b.yaml", "c.yaml"} {
+		write(name, 1000)
+	}
+	_, err = checkout.CommitAndPush(ctx, git.CommitAction{Message: "Too big altogether"}, nil)
+	if tooLarge, ok := err.(git.CommitTooLargeError); !ok || tooLarge.Path != "" || tooLarge.Size != 4000 {
+		t.Errorf("expected CommitTooLargeError for the whole commit, got %v", err)
+	}
+
+	if head, _ := checkout.HeadRevision(ctx); head != before {
+		t.Fatal("expected no commit to be made")
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if upstream, _ := repo.ResolveRevision(ctx, "refs/heads/"+config.Branch); upstream != before {
+		t.Fatal("expected nothing to be pushed")
+	}
+
+	for _, name := range []string{"a.yaml", "b.yaml", "c.yaml"} {
+		if err := os.Remove(filepath.Join(checkout.Dir(), name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Just right"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitHooks(t *testing.T) {
+	var pushedDir, pushedRev string
+	config := TestConfig
+	config.PreCommit = func(ctx context.Context, dir string) error {
+		if _, err := os.Stat(filepath.Join(dir, "invalid.yaml")); err == nil {
+			return errors.New("invalid.yaml is not a valid manifest")
+		}
+		return nil
+	}
+	config.PostPush = func(ctx context.Context, dir, rev string) {
+		pushedDir, pushedRev = dir, rev
+	}
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(checkout.Dir(), "invalid.yaml")
+	if err := ioutil.WriteFile(invalid, []byte("not: [valid"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkout.CommitAndPush(ctx, git.CommitAction{Message: "Invalid"}, nil)
+	if _, ok := err.(git.PreCommitError); !ok {
+		t.Fatalf("expected PreCommitError, got %v", err)
+	}
+	if head, _ := checkout.HeadRevision(ctx); head != before {
+		t.Error("expected no commit to be made")
+	}
+	if _, err := os.Stat(invalid); !os.IsNotExist(err) {
+		t.Error("expected the working tree to be reset")
+	}
+	if pushedRev != "" {
+		t.Error("expected PostPush not to be called")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "valid.yaml"), []byte("kind: Deployment"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Valid"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := repo.ResolveRevision(ctx, "refs/heads/"+config.Branch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushedDir != checkout.Dir() || pushedRev != upstream {
+		t.Errorf("expected PostPush with %s at %s, got %s at %s", checkout.Dir(), upstream, pushedDir, pushedRev)
+	}
+}
+
+func TestCommitThenPush(t *testing.T) {
+	config := TestConfig
+	config.PushRetries = 1
+	first, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	second, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Clean()
+	before, err := repo.Revision(ctx, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two commits made locally, and not pushed
+	for i, name := range []string{"one", "two"} {
+		if err := ioutil.WriteFile(filepath.Join(second.Dir(), name+".yaml"), []byte(name), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := second.Commit(ctx, git.CommitAction{Message: "Commit " + name}, &Note{Comment: name}); err != nil {
+			t.Fatalf("commit %d: %v", i, err)
+		}
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rev, _ := repo.Revision(ctx, "master"); rev != before {
+		t.Fatal("expected Commit not to push anything")
+	}
+
+	// Someone else pushes in the meantime, so the push is rejected
+	// and the commits are rebased
+	if err := ioutil.WriteFile(filepath.Join(first.Dir(), "garbage"), []byte("Elsewhere"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.CommitAndPush(ctx, git.CommitAction{Message: "Elsewhere"}, &Note{Comment: "elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Push(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) < 3 || commits[0].Message != "Commit two" || commits[1].Message != "Commit one" || commits[2].Message != "Elsewhere" {
+		t.Fatalf("expected both commits to be rebased onto the other, got %#v", commits[:3])
+	}
+	another, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer another.Clean()
+	for i, comment := range []string{"two", "one", "elsewhere"} {
+		var note Note
+		if ok, err := another.GetNote(ctx, commits[i].Revision, &note); err != nil || !ok || note.Comment != comment {
+			t.Errorf("expected note %q on %q, got %#v (%v, %v)", comment, commits[i].Message, note, ok, err)
+		}
+	}
+}
+
+func TestCommitDate(t *testing.T) {
+	config := TestConfig
+	config.PushRetries = 1
+	first, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	second, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Clean()
+
+	var files []string
+	for file := range testfiles.Files {
+		files = append(files, file)
+		if len(files) == 3 {
+			break
+		}
+	}
+	date := time.Date(2019, time.March, 4, 12, 30, 0, 0, time.FixedZone("", 2*60*60))
+
+	if err := ioutil.WriteFile(filepath.Join(first.Dir(), files[0]), []byte("FIRST CHANGE"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.CommitAndPush(ctx, git.CommitAction{Message: "First change"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The second checkout is behind the upstream, so its commit is
+	// rebased when its push is rejected; it should keep its date
+	// regardless.
+	if err := ioutil.WriteFile(filepath.Join(second.Dir(), files[1]), []byte("SECOND CHANGE"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.CommitAndPush(ctx, git.CommitAction{Message: "Second change", CommitDate: date}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits[0].Message != "Second change" {
+		t.Fatalf("expected HEAD to be the second change, got %q", commits[0].Message)
+	}
+	if !commits[0].AuthorDate.Equal(date) || !commits[0].CommitDate.Equal(date) {
+		t.Errorf("expected author and committer dates of %s, got %s and %s", date, commits[0].AuthorDate, commits[0].CommitDate)
+	}
+	if _, offset := commits[0].CommitDate.Zone(); offset != 2*60*60 {
+		t.Errorf("expected the time zone to be kept, got offset %d", offset)
+	}
+
+	// Without a date, the commit is made now.
+	if err := ioutil.WriteFile(filepath.Join(second.Dir(), files[2]), []byte("THIRD CHANGE"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Minute)
+	if _, err := second.CommitAndPush(ctx, git.CommitAction{Message: "Third change"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err = repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits[0].AuthorDate.Before(before) || commits[0].CommitDate.Before(before) {
+		t.Errorf("expected commit to be dated now, got %s and %s", commits[0].AuthorDate, commits[0].CommitDate)
+	}
+}
+
+func TestDeleteTags(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: head, Message: "Sync pointer"}); err != nil {
+		t.Fatal(err)
+	}
+	// More than are deleted in one push
+	var releases []string
+	args := []string{"-C", checkout.Dir(), "push", repo.Origin().URL}
+	for i := 0; i < 150; i++ {
+		name := fmt.Sprintf("release-%d", i)
+		if err := execCommand("git", "-C", checkout.Dir(), "tag", name); err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, name)
+		args = append(args, "refs/tags/"+name)
+	}
+	if err := execCommand("git", args...); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := repo.Tags(ctx, "release-*"); err != nil || len(tags) != len(releases) {
+		t.Fatalf("expected %d release tags, got %d (err %v)", len(releases), len(tags), err)
+	}
+
+	// One that has never existed is ignored
+	if err := repo.DeleteTags(ctx, append(releases, "never-existed")...); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := repo.Tags(ctx, "release-*"); err != nil || len(tags) != 0 {
+		t.Errorf("expected release tags to be gone from the mirror, got %+v (err %v)", tags, err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := repo.Tags(ctx, "release-*"); err != nil || len(tags) != 0 {
+		t.Errorf("expected release tags to be gone upstream, got %+v (err %v)", tags, err)
+	}
+	if tags, err := repo.Tags(ctx, TestConfig.SyncTag); err != nil || len(tags) != 1 {
+		t.Errorf("expected sync tag to be left alone, got %+v (err %v)", tags, err)
+	}
+
+	// Deleting again is fine
+	if err := repo.DeleteTag(ctx, "release-0"); err != nil {
+		t.Error(err)
+	}
+	if err := repo.DeleteTag(ctx, TestConfig.SyncTag); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := repo.RefExists(ctx, "refs/tags/"+TestConfig.SyncTag); err != nil || ok {
+		t.Errorf("expected sync tag to be deleted upstream (err %v)", err)
+	}
+}
+
+func TestCommitOnlyPaths(t *testing.T) {
+	checkout, _, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if clean, err := checkout.IsClean(ctx); err != nil || !clean {
+		t.Fatalf("expected a fresh checkout to be clean (err %v)", err)
+	}
+
+	// Left behind by, say, an earlier attempt that failed
+	stray := filepath.Join(checkout.Dir(), "stray.yaml")
+	if err := ioutil.WriteFile(stray, []byte("kind: Stray"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(checkout.Dir(), "wanted"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "wanted", "deployment.yaml"), []byte("kind: Deployment"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if clean, err := checkout.IsClean(ctx); err != nil || clean {
+		t.Errorf("expected checkout with new files not to be clean (err %v)", err)
+	}
+	changes, err := checkout.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[0].Type != git.FileUntracked {
+		t.Errorf("expected two untracked files, got %+v", changes)
+	}
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkout.CommitAndPush(ctx, git.CommitAction{Message: "Wanted", OnlyPaths: []string{"wanted"}}, nil)
+	if err, ok := err.(git.UnexpectedChangesError); !ok || !reflect.DeepEqual(err.Paths, []string{"stray.yaml"}) {
+		t.Fatalf("expected UnexpectedChangesError for stray.yaml, got %v", err)
+	}
+	if head, _ := checkout.HeadRevision(ctx); head != before {
+		t.Error("expected no commit to be made")
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Error("expected the stray file to be left in place")
+	}
+
+	if err := os.Remove(stray); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Wanted", OnlyPaths: []string{"wanted/"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if clean, err := checkout.IsClean(ctx); err != nil || !clean {
+		t.Errorf("expected checkout to be clean after committing (err %v)", err)
+	}
+}
+
+func TestSignatureCache(t *testing.T) {
+	gpgHome, signingKey, gpgCleanup := gpgtest.GPGKey(t)
+	defer gpgCleanup()
+	emptyHome, emptyCleanup := testfiles.TempDir(t)
+	defer emptyCleanup()
+
+	config := TestConfig
+	config.SigningKey = signingKey
+
+	os.Setenv("GNUPGHOME", gpgHome)
+	defer os.Unsetenv("GNUPGHOME")
+
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("Signed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Signed"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() string {
+		commits, err := repo.CommitsBefore(ctx, result.Revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return commits[0].SignatureStatus
+	}
+	if s := status(); s != "G" {
+		t.Fatalf("expected a good signature, got %q", s)
+	}
+	// A keyring without the key, whether given in the environment
+	// or to the repo, means the signature is checked afresh
+	os.Setenv("GNUPGHOME", emptyHome)
+	if s := status(); s == "G" {
+		t.Error("expected the signature to be checked afresh with the keyring from the environment")
+	}
+	os.Setenv("GNUPGHOME", gpgHome)
+	repo.SetGPGHome(emptyHome)
+	if s := status(); s == "G" {
+		t.Error("expected the signature to be checked afresh with the new keyring")
+	}
+	repo.SetGPGHome(gpgHome)
+	if s := status(); s != "G" {
+		t.Errorf("expected a good signature with the key back, got %q", s)
+	}
+
+	// Revoking the key changes the keyring, so the signature is
+	// checked afresh, rather than remembered as good
+	revocation, err := ioutil.ReadFile(filepath.Join(gpgHome, "openpgp-revocs.d", signingKey+".rev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gpg writes the certificate with the armour header escaped, so
+	// that it isn't imported by accident
+	cmd := exec.Command("gpg", "--homedir", gpgHome, "--batch", "--import")
+	cmd.Stdin = strings.NewReader(strings.Replace(string(revocation), ":-----BEGIN", "-----BEGIN", 1))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("importing revocation: %v\n%s", err, out)
+	}
+	if s := status(); s != "R" {
+		t.Errorf("expected a signature by a revoked key, got %q", s)
+	}
+}
+
+func TestPushRemote(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	forkDir, cleanupFork := testfiles.TempDir(t)
+	defer cleanupFork()
+	if err := execCommand("git", "clone", "--bare", "--quiet", repo.Origin().URL, forkDir); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.RemoteName = "upstream"
+	config.PushRemote = git.Remote{URL: forkDir}
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+
+	revParse := func(dir, ref string) string {
+		out, err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", ref).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if revParse(checkout.Dir(), "refs/remotes/upstream/master") == "" {
+		t.Error("expected the branch to be tracked under the remote name given")
+	}
+	if revParse(checkout.Dir(), "refs/remotes/origin/master") != "" {
+		t.Error("expected nothing to be tracked under origin")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("Forked"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "To the fork"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev := revParse(forkDir, "master"); rev != result.Revision {
+		t.Errorf("expected the fork's master to be %s, got %q", result.Revision, rev)
+	}
+	if rev := revParse(repo.Origin().URL, "master"); rev == result.Revision {
+		t.Error("expected the origin not to have been pushed to")
+	}
+	if rev := revParse(checkout.Dir(), "refs/remotes/push/master"); rev != result.Revision {
+		t.Errorf("expected the pushed branch to be recorded under the push remote name, got %q", rev)
+	}
+
+	if err := checkout.MoveSyncTagAndPush(ctx, git.TagAction{Revision: result.Revision, Message: "Synced"}); err != nil {
+		t.Fatal(err)
+	}
+	if rev := revParse(forkDir, TestConfig.SyncTag+"^{commit}"); rev != result.Revision {
+		t.Errorf("expected the sync tag to be pushed to the fork, got %q", rev)
+	}
+}
+
+func TestCommitAndPushResult(t *testing.T) {
+	checkout, _, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir := checkout.Dir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "helloworld-deploy.yaml"), []byte("kind: Deployment"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "new"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "new", "added.yaml"), []byte("kind: Service"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changes"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, err := checkout.HeadRevision(ctx); err != nil || result.Revision != head {
+		t.Errorf("expected revision %q to be the head %q (err %v)", result.Revision, head, err)
+	}
+	expected := []git.FileChange{
+		{Path: "garbage", Type: git.FileDeleted},
+		{Path: "helloworld-deploy.yaml", Type: git.FileModified},
+		{Path: "new/added.yaml", Type: git.FileAdded},
+	}
+	if !reflect.DeepEqual(result.Changes, expected) {
+		t.Errorf("expected changes %+v, got %+v", expected, result.Changes)
+	}
+}
+
+func TestCommitTree(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"helloworld-deploy.yaml": []byte("kind: Deployment"),
+		"garbage":                nil,
+		"new/added.yaml":         []byte("kind: Service"),
+	}
+	result, err := checkout.CommitTree(ctx, files, git.CommitAction{Message: "In memory"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []git.FileChange{
+		{Path: "garbage", Type: git.FileDeleted},
+		{Path: "helloworld-deploy.yaml", Type: git.FileModified},
+		{Path: "new/added.yaml", Type: git.FileAdded},
+	}
+	if !reflect.DeepEqual(result.Changes, expected) {
+		t.Errorf("expected changes %+v, got %+v", expected, result.Changes)
+	}
+
+	// The working tree is left alone ...
+	if head, _ := checkout.HeadRevision(ctx); head != before {
+		t.Error("expected HEAD not to move")
+	}
+	if clean, err := checkout.IsClean(ctx); err != nil || !clean {
+		t.Errorf("expected checkout to be clean (err %v)", err)
+	}
+	if _, err := os.Stat(filepath.Join(checkout.Dir(), "garbage")); err != nil {
+		t.Error("expected deleted file to be left in the working tree")
+	}
+
+	// ... while the commit is upstream
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := repo.Revision(ctx, "master"); err != nil || rev != result.Revision {
+		t.Errorf("expected upstream master to be %s, got %s (err %v)", result.Revision, rev, err)
+	}
+	if content, err := repo.ReadFileAtRev(ctx, result.Revision, "new/added.yaml"); err != nil || string(content) != "kind: Service" {
+		t.Errorf("unexpected content of added file %q (err %v)", content, err)
+	}
+	if _, err := repo.ReadFileAtRev(ctx, result.Revision, "garbage"); err == nil {
+		t.Error("expected deleted file not to be in the commit")
+	}
+
+	// A second commit builds on the first, and one that changes
+	// nothing is not made
+	next, err := checkout.CommitTree(ctx, map[string][]byte{"new/added.yaml": []byte("kind: Ingress")}, git.CommitAction{Message: "Again"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if parent, err := repo.Revision(ctx, next.Revision+"^"); err != nil || parent != result.Revision {
+		t.Errorf("expected parent %s, got %s (err %v)", result.Revision, parent, err)
+	}
+	if _, err := checkout.CommitTree(ctx, map[string][]byte{"new/added.yaml": []byte("kind: Ingress")}, git.CommitAction{Message: "Nothing"}, nil); err != git.ErrNoChanges {
+		t.Errorf("expected ErrNoChanges, got %v", err)
+	}
+
+	if _, err := checkout.CommitTree(ctx, map[string][]byte{"../outside": []byte("x")}, git.CommitAction{Message: "Bad"}, nil); err == nil {
+		t.Error("expected an error for a path outside the repo")
+	}
+}
+
+func TestCommitTreeKeepsMode(t *testing.T) {
+	checkout, _, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Make a file executable, and commit that
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Executable"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := checkout.CommitTree(ctx, map[string][]byte{
+		"run.sh":   []byte("#!/bin/sh\necho hello\n"),
+		"added.sh": []byte("#!/bin/sh\n"),
+	}, git.CommitAction{Message: "In memory"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{"run.sh": "100755", "added.sh": "100644"} {
+		out, err := exec.Command("git", "-C", checkout.Dir(), "ls-tree", result.Revision, "--", path).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := strings.Fields(string(out)); len(mode) == 0 || mode[0] != expected {
+			t.Errorf("expected %s to have mode %s, got %q", path, expected, out)
+		}
+	}
+}
+
+func TestCloneBootstrap(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// An empty upstream, and one with only an unrelated branch
+	emptyDir, cleanupEmpty := testfiles.TempDir(t)
+	defer cleanupEmpty()
+	if err := execCommand("git", "init", "--bare", "--quiet", emptyDir); err != nil {
+		t.Fatal(err)
+	}
+	otherDir, cleanupOther := testfiles.TempDir(t)
+	defer cleanupOther()
+	if err := execCommand("git", "init", "--quiet", "--initial-branch=main", otherDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(otherDir, "README"), []byte("Other"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", otherDir, "add", "README"); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", otherDir, "-c", "user.name=other", "-c", "user.email=other@example.com", "commit", "-m", "Other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", otherDir, "config", "receive.denyCurrentBranch", "ignore"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, dir := range map[string]string{"empty": emptyDir, "unrelated branch": otherDir} {
+		repo := git.NewRepo(git.Remote{URL: dir}, git.Backoff{Initial: time.Hour})
+		if err := repo.Ready(ctx); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if _, err := repo.Clone(ctx, TestConfig); err == nil {
+			t.Errorf("%s: expected error cloning without AllowBootstrap", name)
+		}
+
+		config := TestConfig
+		config.AllowBootstrap = true
+		checkout, err := repo.Clone(ctx, config)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		commits, err := repo.CommitsBefore(ctx, "refs/heads/"+config.Branch)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(commits) != 1 || commits[0].Message != "Initial commit" || commits[0].CommitterName != config.UserName {
+			t.Errorf("%s: expected just the initial commit, made as %s, got %+v", name, config.UserName, commits)
+		}
+		files, err := repo.ListFilesAtRev(ctx, "refs/heads/"+config.Branch)
+		if err != nil || len(files) != 0 {
+			t.Errorf("%s: expected no files in the new branch, got %v (err %v)", name, files, err)
+		}
+
+		// The checkout can be used as normal, and cloning again finds
+		// the branch there.
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "deployment.yaml"), []byte("kind: Deployment"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "First change"}, nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkout.Clean()
+		if err := repo.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		again, err := repo.Clone(ctx, config)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(again.Dir(), "deployment.yaml")); err != nil {
+			t.Errorf("%s: expected the first change in a later clone", name)
+		}
+		again.Clean()
+		repo.Clean()
+	}
+
+	// The unrelated branch is left alone
+	out := &bytes.Buffer{}
+	cmd := exec.Command("git", "-C", otherDir, "log", "--format=%s", "main")
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if log := strings.TrimSpace(out.String()); log != "Other" {
+		t.Errorf("expected the main branch not to change, got log %q", log)
+	}
+}
+
+func TestRevert(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	path := filepath.Join(checkout.Dir(), "garbage")
+	change := func(content string) string {
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage to " + content}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Revision
+	}
+	first, second := change("ONE"), change("TWO")
+
+	// The first can't be reverted, because the second changed the
+	// same file
+	_, err := checkout.Revert(ctx, first, git.CommitAction{}, nil)
+	if conflict, ok := err.(git.RevertConflictError); !ok || !reflect.DeepEqual(conflict.Paths, []string{"garbage"}) {
+		t.Errorf("expected a RevertConflictError for garbage, got %v", err)
+	}
+	if clean, err := checkout.IsClean(ctx); err != nil || !clean {
+		t.Errorf("expected the checkout to be left clean after a conflict (err: %v)", err)
+	}
+
+	note := Note{Comment: "rolled back"}
+	result, err := checkout.Revert(ctx, second, git.CommitAction{}, &note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "ONE" {
+		t.Errorf("expected the file to be as before the reverted commit, got %q (err: %v)", content, err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits[0].Revision != result.Revision || commits[0].Message != `Revert "Changed garbage to TWO"` {
+		t.Errorf("expected the revert to have been pushed as %s, got %+v", result.Revision, commits[0])
+	}
+	var got Note
+	if ok, err := checkout.GetNote(ctx, result.Revision, &got); !ok || err != nil || got != note {
+		t.Errorf("expected note %#v on the revert, got %#v (found: %v, err: %v)", note, got, ok, err)
+	}
+
+	// It's already been undone
+	if _, err := checkout.Revert(ctx, second, git.CommitAction{}, nil); err != git.ErrNoChanges {
+		t.Errorf("expected ErrNoChanges reverting again, got %v", err)
+	}
+	if clean, err := checkout.IsClean(ctx); err != nil || !clean {
+		t.Errorf("expected the checkout to be left clean (err: %v)", err)
+	}
+}
+
+func TestPushOptions(t *testing.T) {
+	config := TestConfig
+	config.PushOptions = []string{"ci.skip"}
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	commit := func(checkout *git.Checkout, content string, options ...string) {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		commitAction := git.CommitAction{Message: "Changed garbage", PushOptions: options}
+		if _, err := checkout.CommitAndPush(ctx, commitAction, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The upstream doesn't take push options to start with, so they
+	// are left out
+	commit(checkout, "ONE")
+
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	received := filepath.Join(upstream, "push-options")
+	hook := "#!/bin/sh\ni=0\nwhile [ $i -lt \"${GIT_PUSH_OPTION_COUNT:-0}\" ]; do eval \"echo \\$GIT_PUSH_OPTION_$i\"; i=$((i+1)); done >> " + received + "\n"
+	if err := ioutil.WriteFile(filepath.Join(upstream, "hooks", "post-receive"), []byte(hook), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "-C", upstream, "config", "receive.advertisePushOptions", "true").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	another, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer another.Clean()
+	commit(another, "TWO", "merge_request.create")
+
+	options, err := ioutil.ReadFile(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(options) != "ci.skip\nmerge_request.create\n" {
+		t.Errorf("expected the push options from the config and the commit action, got %q", options)
+	}
+}
+
+func TestVerifyPush(t *testing.T) {
+	config := TestConfig
+	config.VerifyPush = true
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	commit := func(content string) (git.PushResult, error) {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage"}, nil)
+	}
+	if _, err := commit("ONE"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hook that replaces each commit pushed to the branch with
+	// another
+	upstream := strings.TrimPrefix(repo.Origin().URL, "file://")
+	hook := `#!/bin/sh
+export GIT_COMMITTER_NAME=hook GIT_COMMITTER_EMAIL=hook@example.com GIT_AUTHOR_NAME=hook GIT_AUTHOR_EMAIL=hook@example.com
+while read old new ref; do
+	if [ "$ref" = refs/heads/` + config.Branch + ` ]; then
+		git update-ref "$ref" "$(git commit-tree -p "$new" -m rewritten "$new^{tree}")"
+	fi
+done
+`
+	if err := ioutil.WriteFile(filepath.Join(upstream, "hooks", "post-receive"), []byte(hook), 0777); err != nil {
+		t.Fatal(err)
+	}
+	_, err := commit("TWO")
+	diverged, ok := err.(git.DivergedAfterPushError)
+	if !ok {
+		t.Fatalf("expected DivergedAfterPushError, got %v", err)
+	}
+	head, err := checkout.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diverged.Branch != config.Branch || diverged.Pushed != head || diverged.Remote == "" || diverged.Remote == head {
+		t.Errorf("expected %s to have been pushed to %s and rewritten, got %+v", head, config.Branch, diverged)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	_, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	paths := []string{"charts", "test"}
+	expected, err := repo.ListFilesAtRev(ctx, "HEAD", paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := repo.Archive(ctx, "HEAD", paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			got = append(got, hdr.Name)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(expected)
+	sort.Strings(got)
+	if len(got) == 0 || !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the archive to have %v, got %v", expected, got)
+	}
+
+	// Closing early stops git, and lets go of the repo
+	archive, err = repo.Archive(ctx, "HEAD", paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archive.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+	if err := repo.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.Archive(ctx, "no-such-revision", paths); err == nil {
+		t.Error("expected an error archiving a revision that doesn't exist")
+	}
+	if _, err := repo.Archive(ctx, "HEAD", nil); err != git.ErrNoArchivePaths {
+		t.Errorf("expected ErrNoArchivePaths for no paths, got %v", err)
+	}
+}
+
+func TestBlame(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	commit := func(file, content, author string) string {
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), file), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		result, err := checkout.CommitAndPush(ctx, git.CommitAction{Author: author, Message: "Changed " + file}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Revision
+	}
+	first := commit("garbage", "image: one\nreplicas: 1\n", "Alice <alice@example.com>")
+	second := commit("garbage", "image: two\nreplicas: 1\n", "Bob <bob@example.com>")
+	commit("binary", "\x00\x01\x02", "Bob <bob@example.com>")
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := repo.Blame(ctx, "HEAD", "garbage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected two lines, got %+v", lines)
+	}
+	for i, expected := range []git.BlameLine{
+		{Number: 1, Text: "image: two", Revision: second, AuthorName: "Bob", AuthorEmail: "bob@example.com", Summary: "Changed garbage"},
+		{Number: 2, Text: "replicas: 1", Revision: first, AuthorName: "Alice", AuthorEmail: "alice@example.com", Summary: "Changed garbage"},
+	} {
+		got := lines[i]
+		if got.AuthorDate.IsZero() {
+			t.Errorf("expected an author date for line %d", expected.Number)
+		}
+		got.AuthorDate = time.Time{}
+		if got != expected {
+			t.Errorf("expected line %+v, got %+v", expected, got)
+		}
+	}
+
+	// As of the first revision, it's all Alice's
+	if lines, err = repo.Blame(ctx, first, "garbage"); err != nil || len(lines) != 2 || lines[0].AuthorName != "Alice" {
+		t.Errorf("expected the first line to be Alice's as of %s, got %+v (err: %v)", first, lines, err)
+	}
+
+	if _, err := repo.Blame(ctx, "HEAD", "binary"); err == nil {
+		t.Error("expected an error blaming a binary file")
+	} else if _, ok := err.(git.BinaryFileError); !ok {
+		t.Errorf("expected BinaryFileError, got %v", err)
+	}
+}
+
+func TestPerFileCommits(t *testing.T) {
+	config := TestConfig
+	config.PerFileCommits = true
+	config.MessageTemplate = "{{.Message}}: {{.File}}"
+	checkout, repo, cleanup := CheckoutWithConfig(t, config)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("Changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(checkout.Dir(), "helloworld-deploy.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "new.yaml"), []byte("New"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Update"}, &Note{Comment: "per file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 3 {
+		t.Errorf("expected three files changed, got %+v", result.Changes)
+	}
+
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{"new.yaml", "helloworld-deploy.yaml", "garbage"}
+	if len(commits) < len(files) || commits[0].Revision != result.Revision {
+		t.Fatalf("expected the last commit pushed to be %s, got %#v", result.Revision, commits)
+	}
+	for i, file := range files {
+		if commits[i].Message != "Update: "+file {
+			t.Errorf("expected commit %d to be for %s, got %q", i, file, commits[i].Message)
+		}
+		changes, err := repo.DiffFiles(ctx, commits[i].Revision+"^", commits[i].Revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 1 || changes[0].Path != file {
+			t.Errorf("expected commit %d to change only %s, got %+v", i, file, changes)
+		}
+		var note Note
+		if ok, err := checkout.GetNote(ctx, commits[i].Revision, &note); err != nil || !ok || note.Comment != "per file" {
+			t.Errorf("expected a note on commit %d, got %#v (%v, %v)", i, note, ok, err)
+		}
+	}
+	if clean, err := checkout.IsClean(ctx); err != nil || !clean {
+		t.Errorf("expected everything to be committed (%v)", err)
+	}
+}
+
+func TestHTTPPostBuffer(t *testing.T) {
+	upstream, cleanup := Repo(t)
+	defer cleanup()
+	gitDir := strings.TrimPrefix(upstream.Origin().URL, "file://")
+	if err := execCommand("git", "-C", gitDir, "config", "http.receivepack", "true"); err != nil {
+		t.Fatal(err)
+	}
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A server that won't take chunked requests, as some proxies
+	// won't; git sends a push bigger than http.postBuffer in chunks
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + filepath.Dir(gitDir), "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength < 0 && r.Method == "POST" {
+			http.Error(w, "chunked requests not allowed", http.StatusLengthRequired)
+			return
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	big := make([]byte, 3<<20)
+	rand.Read(big) // so it doesn't compress
+	for _, postBuffer := range []int64{0, 16 << 20} {
+		repo := git.NewRepo(git.Remote{URL: server.URL + "/" + filepath.Base(gitDir)}, git.HTTPPostBuffer(postBuffer), git.PackWindowMemory(1<<20))
+		defer repo.Clean()
+		if err := repo.Ready(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if value, _, err := repo.GetConfig(ctx, "pack.windowMemory"); err != nil || value != "1048576" {
+			t.Errorf("expected pack.windowMemory to be set, got %q (%v)", value, err)
+		}
+		checkout, err := repo.Clone(ctx, TestConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checkout.Clean()
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "big"), big, 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err = checkout.CommitAndPush(ctx, git.CommitAction{Message: "Add a big file"}, nil)
+		if postBuffer == 0 && err == nil {
+			t.Error("expected a push bigger than git's default http.postBuffer to fail")
+		}
+		if postBuffer > 0 && err != nil {
+			t.Errorf("expected a push smaller than http.postBuffer to succeed, got %v", err)
+		}
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	upstream, cleanup := Repo(t)
+	defer cleanup()
+	gitDir := strings.TrimPrefix(upstream.Origin().URL, "file://")
+	if err := execCommand("git", "-C", gitDir, "config", "http.receivepack", "true"); err != nil {
+		t.Fatal(err)
+	}
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewTLSServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + filepath.Dir(gitDir), "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	defer server.Close()
+	url := server.URL + "/" + filepath.Base(gitDir)
+
+	// The server's certificate is self-signed, so it's its own CA
+	caBundle := filepath.Join(filepath.Dir(gitDir), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caBundle, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	untrusted := git.NewRepo(git.Remote{URL: url})
+	defer untrusted.Clean()
+	failCtx, failCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer failCancel()
+	if err := untrusted.Ready(failCtx); err == nil {
+		t.Error("expected cloning from a server with an untrusted certificate to fail")
+	}
+
+	for _, opt := range []git.Option{git.CABundlePath(caBundle), git.InsecureSkipTLSVerify(true)} {
+		repo := git.NewRepo(git.Remote{URL: url}, opt)
+		defer repo.Clean()
+		if err := repo.Ready(ctx); err != nil {
+			t.Fatalf("%#v: %v", opt, err)
+		}
+		checkout, err := repo.Clone(ctx, TestConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checkout.Clean()
+		if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte(fmt.Sprintf("%#v", opt)), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Changed garbage"}, nil); err != nil {
+			t.Errorf("%#v: expected push to succeed, got %v", opt, err)
+		}
+		if err := repo.Refresh(ctx); err != nil {
+			t.Errorf("%#v: expected fetch to succeed, got %v", opt, err)
+		}
+	}
+
+	// A checkout can be given the CA bundle of its own, and told not
+	// to check at all
+	var warnings []error
+	config := TestConfig
+	config.InsecureSkipTLSVerify = true
+	config.Warn = func(err error) { warnings = append(warnings, err) }
+	repo := git.NewRepo(git.Remote{URL: url}, git.CABundlePath(caBundle))
+	defer repo.Clean()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkout, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if len(warnings) != 1 || warnings[0] != git.ErrInsecureTLS {
+		t.Errorf("expected a warning that TLS verification is off, got %v", warnings)
+	}
+}
+
+func TestRepoConfig(t *testing.T) {
+	repo, cleanup := Repo(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Set before the repo is cloned, and so applied once it is
+	if err := repo.SetConfig(ctx, "http.postBuffer", "524288000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetConfig(ctx, "core.sshCommand", "touch /tmp/pwned"); err == nil {
+		t.Fatal("expected a key that runs a command to be refused")
+	} else if _, ok := err.(git.InvalidConfigKeyError); !ok {
+		t.Fatalf("expected InvalidConfigKeyError, got %v", err)
+	}
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetConfig(ctx, "core.bigFileThreshold", "100m"); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"http.postbuffer": "524288000", "core.bigFileThreshold": "100m"} {
+		if value, ok, err := repo.GetConfig(ctx, key); err != nil || !ok || value != expected {
+			t.Errorf("expected %s to be %q, got %q (%v, %v)", key, expected, value, ok, err)
+		}
+	}
+	if _, ok, err := repo.GetConfig(ctx, "http.lowSpeedLimit"); err != nil || ok {
+		t.Errorf("expected http.lowSpeedLimit not to be set (%v)", err)
+	}
+
+	// Checkouts get the settings too
+	checkout, err := repo.Clone(ctx, TestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	out, err := exec.Command("git", "-C", checkout.Dir(), "config", "--local", "core.bigFileThreshold").Output()
+	if err != nil || strings.TrimSpace(string(out)) != "100m" {
+		t.Errorf("expected the checkout to have core.bigFileThreshold set, got %q (%v)", out, err)
+	}
+
+	// and they're put back if the repo is cloned afresh
+	repo.Clean()
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := repo.GetConfig(ctx, "core.bigfilethreshold"); err != nil || !ok || value != "100m" {
+		t.Errorf("expected core.bigFileThreshold to be set again, got %q (%v, %v)", value, ok, err)
+	}
+}
+
+func TestCloneFilter(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("Changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Change garbage"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TestConfig
+	config.CloneFilter = "blob:none"
+	partial, err := repo.Clone(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.Clean()
+
+	// Only the files in the working tree have been fetched; the
+	// garbage from before wasn't, until it's asked for
+	missing, err := exec.Command("git", "-C", partial.Dir(), "rev-list", "--objects", "--missing=print", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(missing), "\n?") {
+		t.Errorf("expected some objects to have been left out, got:\n%s", missing)
+	}
+	old, err := exec.Command("git", "-C", partial.Dir(), "show", "HEAD^:garbage").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(old) == "Changed" {
+		t.Errorf("expected the garbage from before the change, got %q", old)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(partial.Dir(), "garbage")); err != nil || string(contents) != "Changed" {
+		t.Errorf("expected the garbage to be checked out, got %q (%v)", contents, err)
+	}
+}
+
+func TestRemoteRevision(t *testing.T) {
+	checkout, repo, cleanup := CheckoutWithConfig(t, TestConfig)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	local, err := repo.Revision(ctx, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote, err := repo.RemoteRevision(ctx, "master"); err != nil || remote != local {
+		t.Fatalf("expected the remote revision to be %s, got %s (%v)", local, remote, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(checkout.Dir(), "garbage"), []byte("Changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	result, err := checkout.CommitAndPush(ctx, git.CommitAction{Message: "Change garbage"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The upstream has moved on, and the repo doesn't know yet
+	if remote, err := repo.RemoteRevision(ctx, "master"); err != nil || remote != result.Revision {
+		t.Errorf("expected the remote revision to be %s, got %s (%v)", result.Revision, remote, err)
+	}
+	if rev, _ := repo.Revision(ctx, "master"); rev != local {
+		t.Errorf("expected RemoteRevision not to fetch anything, but master is at %s", rev)
+	}
+
+	if _, err := repo.RemoteRevision(ctx, "no-such-branch"); err != (git.RefNotFoundError{Ref: "refs/heads/no-such-branch"}) {
+		t.Errorf("expected RefNotFoundError for a missing branch, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is the name of the file, at the top of the repo, with
+// patterns (in the syntax of .gitignore) for files under the manifest
+// paths that aren't manifests.
+const IgnoreFile = ".fluxignore"
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool // re-include anything matched
+	dirOnly bool // only match directories
+}
+
+// ignoreMatcher decides which files are ignored, according to a list
+// of patterns with the same meaning as in .gitignore: the last
+// pattern matching a path decides whether it is ignored.
+type ignoreMatcher []ignorePattern
+
+func parseIgnore(lines []string) ignoreMatcher {
+	var m ignoreMatcher
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:] // for escaping a leading `#` or `!`
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// A pattern with a slash at the start or in the middle is
+		// relative to the top of the repo; otherwise it can match
+		// at any level.
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expr := globToRegexp(line)
+		if !anchored {
+			expr = "(.*/)?" + expr
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			continue // as git does, skip patterns that make no sense
+		}
+		p.re = re
+		m = append(m, p)
+	}
+	return m
+}
+
+// globToRegexp translates a glob, with `**` meaning any number of
+// directories, to a regular expression.
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			expr.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String()
+}
+
+// ignored says whether the path given, relative to the top of the
+// repo and using forward slashes, is ignored.
+func (m ignoreMatcher) ignored(path string, isDir bool) bool {
+	ignored := false
+	for _, p := range m {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.re.MatchString(path) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// readIgnoreFile reads the patterns from the ignore file at the top
+// of the checkout, if there is one.
+func readIgnoreFile(dir string) ([]string, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, IgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(bs))
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines, sc.Err()
+}
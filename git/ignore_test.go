@@ -0,0 +1,49 @@
+package git
+
+import (
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	m := parseIgnore([]string{
+		"# comment",
+		"",
+		"*.md",
+		"!important.md",
+		"/LICENSE",
+		"ci/",
+		"docs/**/*.yaml",
+		"**/test-*",
+		"tmp?.yaml",
+		`\#hash.yaml`,
+	})
+	for _, c := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"README.md", false, true},
+		{"deploy/README.md", false, true},
+		{"important.md", false, false},
+		{"deploy/important.md", false, false},
+		{"LICENSE", false, true},
+		{"deploy/LICENSE", false, false},
+		{"ci", true, true},
+		{"deploy/ci", true, true},
+		{"ci", false, false}, // a file called ci is not a directory
+		{"docs/example.yaml", false, true},
+		{"docs/a/b/example.yaml", false, true},
+		{"deploy/docs/example.yaml", false, false},
+		{"test-thing.yaml", false, true},
+		{"deploy/test-thing.yaml", false, true},
+		{"tmp1.yaml", false, true},
+		{"tmp12.yaml", false, false},
+		{"#hash.yaml", false, true},
+		{"deploy/app.yaml", false, false},
+		{"# comment", false, false},
+	} {
+		if got := m.ignored(c.path, c.isDir); got != c.ignored {
+			t.Errorf("%q (dir: %v): expected ignored to be %v, got %v", c.path, c.isDir, c.ignored, got)
+		}
+	}
+}
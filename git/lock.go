@@ -0,0 +1,172 @@
+package git
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LockTimeout is an Option giving how long an operation on the repo
+// waits for another to let go of it, before failing with
+// LockBusyError. If it's zero (the default), operations wait for as
+// long as it takes, or until their context is done.
+type LockTimeout time.Duration
+
+func (t LockTimeout) apply(r *Repo) {
+	r.lockTimeout = time.Duration(t)
+}
+
+// LockHolder is an operation holding the lock of a repo.
+type LockHolder struct {
+	Op      string // e.g., "Refresh"
+	Write   bool   // whether it has the lock for writing, rather than reading
+	Since   time.Time
+	HeldFor time.Duration // as of when it was reported
+}
+
+// LockHolders gives the operations holding the lock of the repo,
+// longest held first; e.g., to find out what's stuck, if other
+// operations are failing with LockBusyError.
+func (r *Repo) LockHolders() []LockHolder {
+	return r.mu.holdersNow()
+}
+
+// rlock locks the repo for reading by the operation named, giving up
+// after the LockTimeout or when the context is done. It returns the
+// function to unlock it again.
+func (r *Repo) rlock(ctx context.Context, op string) (func(), error) {
+	return r.mu.acquire(ctx, false, op, r.lockTimeout)
+}
+
+// lock is like rlock, but locks the repo for writing.
+func (r *Repo) lock(ctx context.Context, op string) (func(), error) {
+	return r.mu.acquire(ctx, true, op, r.lockTimeout)
+}
+
+// rhold locks the repo for reading however long that takes, for the
+// operations which can't fail; these only look at (or change, with
+// hold) the state of the repo, so don't hold it for long themselves.
+func (r *Repo) rhold(op string) func() {
+	unlock, _ := r.mu.acquire(context.Background(), false, op, 0)
+	return unlock
+}
+
+// hold is like rhold, but locks the repo for writing.
+func (r *Repo) hold(op string) func() {
+	unlock, _ := r.mu.acquire(context.Background(), true, op, 0)
+	return unlock
+}
+
+// repoLock is a readers-writer lock which, unlike sync.RWMutex, can
+// be given up on, and which keeps track of what holds it. As with
+// sync.RWMutex, once a writer is waiting, readers arriving after it
+// wait too, so that writers aren't held off indefinitely. It can't be
+// locked again by something already holding it.
+type repoLock struct {
+	mu             sync.Mutex
+	readers        int
+	writing        bool
+	writersWaiting int
+	released       chan struct{} // closed, and replaced, whenever the lock may have become free
+	holders        map[int]LockHolder
+	nextID         int
+}
+
+func (l *repoLock) acquire(ctx context.Context, write bool, op string, timeout time.Duration) (func(), error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	l.mu.Lock()
+	if write {
+		l.writersWaiting++
+	}
+	for !l.free(write) {
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+		released := l.released
+		l.mu.Unlock()
+		var err error
+		select {
+		case <-released:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-expired:
+			err = LockBusyError{Op: op, Waited: timeout, Holders: l.holdersNow()}
+		}
+		l.mu.Lock()
+		if err != nil {
+			if write {
+				// Readers waiting behind this can go ahead now
+				l.writersWaiting--
+				l.wake()
+			}
+			l.mu.Unlock()
+			return nil, err
+		}
+	}
+	if write {
+		l.writersWaiting--
+		l.writing = true
+	} else {
+		l.readers++
+	}
+	if l.holders == nil {
+		l.holders = map[int]LockHolder{}
+	}
+	id := l.nextID
+	l.nextID++
+	l.holders[id] = LockHolder{Op: op, Write: write, Since: time.Now()}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(id, write) }) }, nil
+}
+
+// free says whether the lock can be had for writing, or reading. It
+// must be called with mu held.
+func (l *repoLock) free(write bool) bool {
+	if write {
+		return !l.writing && l.readers == 0
+	}
+	return !l.writing && l.writersWaiting == 0
+}
+
+func (l *repoLock) release(id int, write bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.holders, id)
+	if write {
+		l.writing = false
+	} else {
+		l.readers--
+	}
+	l.wake()
+}
+
+// wake lets anything waiting for the lock look again. It must be
+// called with mu held.
+func (l *repoLock) wake() {
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+func (l *repoLock) holdersNow() []LockHolder {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	holders := make([]LockHolder, 0, len(l.holders))
+	for _, h := range l.holders {
+		h.HeldFor = now.Sub(h.Since)
+		holders = append(holders, h)
+	}
+	sort.Slice(holders, func(i, j int) bool { return holders[i].Since.Before(holders[j].Since) })
+	return holders
+}
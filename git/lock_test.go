@@ -0,0 +1,80 @@
+package git
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockTimeout(t *testing.T) {
+	r := NewRepo(Remote{}, LockTimeout(50*time.Millisecond))
+	unlock, err := r.lock(context.Background(), "GC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.rlock(context.Background(), "Revision")
+	busy, ok := err.(LockBusyError)
+	if !ok {
+		t.Fatalf("expected LockBusyError, got %v", err)
+	}
+	if busy.Op != "Revision" || len(busy.Holders) != 1 || busy.Holders[0].Op != "GC" || !busy.Holders[0].Write {
+		t.Errorf("expected Revision to be waiting on GC, got %+v", busy)
+	}
+	if busy.Holders[0].HeldFor < 50*time.Millisecond {
+		t.Errorf("expected GC to have held the lock for at least the timeout, got %s", busy.Holders[0].HeldFor)
+	}
+	if !strings.Contains(busy.Error(), "GC (writing, for ") {
+		t.Errorf("expected the error to name the holder, got %q", busy.Error())
+	}
+
+	unlock()
+	unlock() // unlocking twice is harmless
+	if holders := r.LockHolders(); len(holders) != 0 {
+		t.Errorf("expected nothing to hold the lock, got %+v", holders)
+	}
+	unlock, err = r.rlock(context.Background(), "Revision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
+
+func TestLockWriterPriority(t *testing.T) {
+	r := NewRepo(Remote{})
+	unlockRead, err := r.rlock(context.Background(), "Revision")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan func())
+	go func() {
+		unlock, _ := r.lock(context.Background(), "GC")
+		locked <- unlock
+	}()
+	// Wait for the writer to be waiting
+	for {
+		r.mu.mu.Lock()
+		waiting := r.mu.writersWaiting
+		r.mu.mu.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// With a writer waiting, a reader arriving now waits too
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := r.rlock(ctx, "Tags"); err != context.DeadlineExceeded {
+		t.Fatalf("expected reader to wait behind the writer, got %v", err)
+	}
+
+	unlockRead()
+	unlockWrite := <-locked
+	if holders := r.LockHolders(); len(holders) != 1 || holders[0].Op != "GC" {
+		t.Errorf("expected GC to hold the lock, got %+v", holders)
+	}
+	unlockWrite()
+}
@@ -0,0 +1,49 @@
+package git
+
+import (
+	"time"
+)
+
+// Operation names a kind of git operation, for the purpose of
+// reporting on it.
+type Operation string
+
+const (
+	OpClone  Operation = "clone"
+	OpFetch  Operation = "fetch"
+	OpPush   Operation = "push"
+	OpCommit Operation = "commit"
+	OpGC     Operation = "gc"
+	// OpLsRemote is looking at the refs upstream, without fetching
+	// them; credentials for it are those for OpFetch.
+	OpLsRemote Operation = "ls-remote"
+)
+
+// Observer is told about each git operation once it has finished,
+// including how long it took and whether it failed. It may be called
+// from several goroutines at once.
+type Observer interface {
+	ObserveOperation(op Operation, url string, took time.Duration, err error)
+}
+
+// ObserveWith is an Option that reports the operations done for the
+// repo, and its checkouts, to the observer given.
+func ObserveWith(o Observer) Option {
+	return optionFunc(func(r *Repo) {
+		r.observer = o
+	})
+}
+
+// observe reports an operation started at `start` to the observer,
+// if there is one. The URL is reported without any password it
+// contains. A commit with nothing to commit is reported as
+// succeeding, since it's a normal outcome rather than a failure.
+func observe(o Observer, op Operation, remote Remote, start time.Time, err error) {
+	if o == nil {
+		return
+	}
+	if Cause(err) == ErrNoChanges {
+		err = nil
+	}
+	o.ObserveOperation(op, remote.SafeURL(), time.Since(start), err)
+}
@@ -9,7 +9,12 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"context"
 
@@ -29,112 +34,1291 @@ var exemptedTraceCommands = []string{
 var allowedEnvVars = []string{"http_proxy", "https_proxy", "no_proxy", "HOME", "GNUPGHOME"}
 
 type gitCmdConfig struct {
-	dir string
-	env []string
-	out io.Writer
+	dir    string
+	exec   gitExec // how to run git, as configured for the Repo or Checkout
+	env    []string
+	in     io.Reader
+	out    io.Writer
+	errOut io.Writer // gets what git prints to stderr, as well as it being kept for any error
 }
 
-func config(ctx context.Context, workingDir, user, email string) error {
+func config(ctx context.Context, gexec gitExec, workingDir, user, email string) error {
 	for k, v := range map[string]string{
 		"user.name":  user,
 		"user.email": email,
 	} {
 		args := []string{"config", k, v}
-		if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
+		if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
 			return errors.Wrap(err, "setting git config")
 		}
 	}
 	return nil
 }
 
-func clone(ctx context.Context, workingDir, repoURL, repoBranch string) (path string, err error) {
+// signingRequired says whether the git config in effect for the repo
+// (including the global config) has commit.gpgSign set, so that git
+// will sign commits even when not asked to.
+func signingRequired(ctx context.Context, gexec gitExec, workingDir string) (bool, error) {
+	out := &bytes.Buffer{}
+	args := []string{"config", "--type=bool", "--get", "commit.gpgSign"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		// It exits non-zero, quietly, if it's not set
+		if e, ok := err.(UnknownError); ok && e.Stderr == "" {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "reading git config commit.gpgSign")
+	}
+	return strings.TrimSpace(out.String()) == "true", nil
+}
+
+// exportIgnored gives those of the paths given (relative to the top
+// of the repo) that have the export-ignore attribute set, as git sees
+// the .gitattributes files in the working tree.
+func exportIgnored(ctx context.Context, gexec gitExec, workingDir string, paths []string) (map[string]bool, error) {
+	in, out := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, p := range paths {
+		in.WriteString(p)
+		in.WriteByte(0)
+	}
+	args := []string{"check-attr", "-z", "--stdin", "export-ignore"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, in: in, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git check-attr")
+	}
+	// Each is given as path NUL attribute NUL value NUL
+	fields := strings.Split(out.String(), "\x00")
+	ignored := map[string]bool{}
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == "set" {
+			ignored[fields[i]] = true
+		}
+	}
+	return ignored, nil
+}
+
+// setConfig sets a git config variable in the repo's own config.
+func setConfig(ctx context.Context, gexec gitExec, workingDir, key, value string) error {
+	args := []string{"config", "--local", "--replace-all", "--", key, value}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrapf(err, "setting git config %s", key)
+	}
+	return nil
+}
+
+// localConfig gives all the repo's own git config variables, with
+// the keys as git gives them; for a variable with several values, the
+// last is given, as with `git config --get`.
+func localConfig(ctx context.Context, gexec gitExec, workingDir string) (map[string]string, error) {
+	out := &bytes.Buffer{}
+	args := []string{"config", "--local", "--list", "-z"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "reading git config")
+	}
+	settings := map[string]string{}
+	for _, entry := range strings.Split(strings.TrimSuffix(out.String(), "\x00"), "\x00") {
+		if entry == "" {
+			continue
+		}
+		// Each entry is "key\nvalue", or just "key" for a
+		// variable given without a value (which means true)
+		kv := strings.SplitN(entry, "\n", 2)
+		if len(kv) == 1 {
+			settings[kv[0]] = "true"
+		} else {
+			settings[kv[0]] = kv[1]
+		}
+	}
+	return settings, nil
+}
+
+// cloneOptions are the variations on a working clone.
+type cloneOptions struct {
+	depth    int      // if more than zero, make a shallow clone
+	sparse   bool     // start with a sparse checkout of only the top-level files
+	maxBytes int64    // if more than zero, abandon the clone if it gets bigger than this
+	exec     *gitExec // how to run git in the clone, if not as for the repo
+	remote   string   // what to call the remote cloned from, if not "origin"
+	filter   string   // if given, make a partial clone with this filter spec, e.g., "blob:none"
+	progress ProgressFunc
+}
+
+func clone(ctx context.Context, gexec gitExec, workingDir, repoURL, repoBranch string, opts cloneOptions) (path string, err error) {
 	repoPath := workingDir
 	args := []string{"clone"}
 	if repoBranch != "" {
 		args = append(args, "--branch", repoBranch)
 	}
-	args = append(args, repoURL, repoPath)
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
-		return "", errors.Wrap(err, "git clone")
+	if opts.sparse {
+		args = append(args, "--sparse")
+	}
+	if opts.remote != "" {
+		args = append(args, "--origin", opts.remote)
+	}
+	if opts.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.depth), "--shallow-submodules")
+	}
+	if opts.filter != "" {
+		args = append(args, "--filter="+opts.filter)
+	}
+	// git ignores --depth and --filter for plain local paths
+	if (opts.depth > 0 || opts.filter != "") && !strings.Contains(repoURL, "://") && filepath.IsAbs(repoURL) {
+		repoURL = "file://" + repoURL
+	}
+	extra, progressOut := progressArgs(OpClone, opts.progress)
+	args = append(append(args, extra...), repoURL, repoPath)
+	errOut := &bytes.Buffer{}
+	var cmdErrOut io.Writer = errOut
+	if progressOut != nil {
+		cmdErrOut = io.MultiWriter(errOut, progressOut)
+	}
+	err = withSizeLimit(ctx, repoPath, opts.maxBytes, func(ctx context.Context) error {
+		return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, errOut: cmdErrOut})
+	})
+	if err != nil {
+		if _, ok := err.(RepoTooLargeError); ok {
+			return "", err
+		}
+		return "", errors.Wrap(err, "git clone")
+	}
+	// git makes a full clone instead, with just a warning, if the
+	// other end won't filter
+	if opts.filter != "" && strings.Contains(errOut.String(), "filtering not recognized by server") {
+		return "", PartialCloneError{Filter: opts.filter}
+	}
+	return repoPath, nil
+}
+
+// mirror makes a mirror clone of the upstream in workingDir. If a
+// reference clone is given, objects in it are borrowed from there
+// rather than being copied.
+func mirror(ctx context.Context, gexec gitExec, workingDir, repoURL string, maxBytes int64, env []string, reference string, progress ProgressFunc) (path string, err error) {
+	repoPath := workingDir
+	extra, progressOut := progressArgs(OpClone, progress)
+	args := append([]string{"clone", "--mirror"}, extra...)
+	if reference != "" {
+		// A local clone would otherwise copy (or link) the objects
+		// regardless
+		args = append(args, "--no-local", "--reference", reference)
+	}
+	args = append(args, repoURL, repoPath)
+	err = withSizeLimit(ctx, repoPath, maxBytes, func(ctx context.Context) error {
+		return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, errOut: progressOut})
+	})
+	if err != nil {
+		if _, ok := err.(RepoTooLargeError); ok {
+			return "", err
+		}
+		return "", errors.Wrap(err, "git clone --mirror")
+	}
+	// So that checkouts can be partial clones of the mirror (see
+	// Config.CloneFilter), fetching what they left out when they
+	// need it.
+	for _, key := range []string{"uploadpack.allowFilter", "uploadpack.allowAnySHA1InWant"} {
+		if err := setConfig(ctx, gexec, repoPath, key, "true"); err != nil {
+			return "", err
+		}
+	}
+	// By default, a bare repo keeps no reflogs; keeping them for tags
+	// is how Repo.PreviousSyncRevision finds where a tag was before.
+	if err := setConfig(ctx, gexec, repoPath, "core.logAllRefUpdates", "always"); err != nil {
+		return "", err
+	}
+	return repoPath, nil
+}
+
+// sizeCheckInterval is how often withSizeLimit looks at the size of
+// the directory it's watching.
+var sizeCheckInterval = 200 * time.Millisecond
+
+// withSizeLimit runs f, which is expected to write into dir, and
+// cancels the context given to it (thereby killing any git command
+// it is running) if the size of dir goes over the limit. In that
+// case, it returns a RepoTooLargeError. A limit of zero or less
+// means no limit.
+func withSizeLimit(ctx context.Context, dir string, limit int64, f func(context.Context) error) error {
+	if limit <= 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	exceeded := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(sizeCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				exceeded <- false
+				return
+			case <-ticker.C:
+				if size, err := dirSize(dir); err == nil && size > limit {
+					cancel()
+					exceeded <- true
+					return
+				}
+			}
+		}
+	}()
+	err := f(ctx)
+	close(done)
+	if <-exceeded {
+		return RepoTooLargeError{Limit: limit}
+	}
+	// It may have finished between checks, having gone over.
+	if size, serr := dirSize(dir); err == nil && serr == nil && size > limit {
+		return RepoTooLargeError{Limit: limit}
+	}
+	return err
+}
+
+// dirSize gives the total size of the files under dir. Files that
+// disappear while it's looking (as git's temporary files do) are
+// not counted.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func checkout(ctx context.Context, gexec gitExec, workingDir, ref string) error {
+	args := []string{"checkout", ref, "--"}
+	return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec})
+}
+
+// checkPush sanity-checks that we can write to the upstream repo
+// (being able to `clone` is an adequate check that we can read the
+// upstream).
+func checkPush(ctx context.Context, gexec gitExec, workingDir, upstream string, env []string) error {
+	// An empty upstream has nothing to tag, so tag a commit made for
+	// the purpose instead.
+	target := "HEAD"
+	if ok, err := refExists(ctx, gexec, workingDir, "HEAD"); err != nil {
+		return err
+	} else if !ok {
+		identity := []string{"GIT_AUTHOR_NAME=Flux", "GIT_AUTHOR_EMAIL=flux@localhost", "GIT_COMMITTER_NAME=Flux", "GIT_COMMITTER_EMAIL=flux@localhost"}
+		if target, err = emptyCommit(ctx, gexec, workingDir, "Flux write check", "", identity); err != nil {
+			return errors.Wrap(err, "commit for write check")
+		}
+	}
+	// --force just in case we fetched the tag from upstream when cloning
+	args := []string{"tag", "--force", CheckPushTag, target}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "tag for write check")
+	}
+	args = []string{"push", "--force", upstream, "tag", CheckPushTag}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "attempt to push tag")
+	}
+	args = []string{"push", "--delete", upstream, "tag", CheckPushTag}
+	return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env})
+}
+
+// stage adds changes to the index ready for committing. Changes to
+// tracked files are left for `commit -a` to pick up, so this only
+// does anything for StageAll, in which case it adds everything under
+// the paths given, including new files; that also means renames are
+// committed as such, rather than as just a deletion.
+func stage(ctx context.Context, gexec gitExec, workingDir string, subdirs []string, mode StageMode, env []string) error {
+	if mode == StageTracked {
+		return nil
+	}
+	args := []string{"add", "--all", "--"}
+	args = append(args, subdirs...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git add --all")
+	}
+	return nil
+}
+
+// status gives the changes in the working tree and index that haven't
+// been committed, including untracked files (but not ignored files).
+// A file changed in both the index and the working tree is listed
+// once.
+func status(ctx context.Context, gexec gitExec, workingDir string) ([]FileChange, error) {
+	out := &bytes.Buffer{}
+	args := []string{"status", "--porcelain", "-z", "--untracked-files=all", "--no-renames"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git status")
+	}
+	// Each entry is "XY path\0", where X is the status in the index
+	// and Y that in the working tree.
+	var changes []FileChange
+	for _, entry := range strings.Split(strings.TrimSuffix(out.String(), "\x00"), "\x00") {
+		if entry == "" {
+			continue
+		}
+		if len(entry) < 4 {
+			return nil, fmt.Errorf("unexpected entry in git status output: %q", entry)
+		}
+		change := FileChange{Path: entry[3:], Type: FileModified}
+		switch xy := entry[:2]; {
+		case xy == "??":
+			change.Type = FileUntracked
+		case strings.Contains(xy, "D"):
+			change.Type = FileDeleted
+		case xy[0] == 'A':
+			change.Type = FileAdded
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// stagedChanges gives all the files a commit of everything staged
+// would change, including deletions. As with filesToCommit, changes
+// to tracked files are staged first.
+func stagedChanges(ctx context.Context, gexec gitExec, workingDir string) ([]FileChange, error) {
+	if err := execGitCmd(ctx, []string{"add", "--update"}, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return nil, errors.Wrap(err, "git add --update")
+	}
+	out := &bytes.Buffer{}
+	args := []string{"diff", "--cached", "--name-status", "--no-renames", "-z"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "listing staged files")
+	}
+	return parseNameStatus(out.String())
+}
+
+// committedFile is a file as it would be committed, with its size.
+type committedFile struct {
+	path string
+	size int64
+}
+
+// filesToCommit gives the files that a commit of everything staged
+// would add or change, with their sizes. Since commit is run with
+// `-a`, changes to tracked files are staged first, so that they're
+// counted too.
+func filesToCommit(ctx context.Context, gexec gitExec, workingDir string) ([]committedFile, error) {
+	if err := execGitCmd(ctx, []string{"add", "--update"}, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return nil, errors.Wrap(err, "git add --update")
+	}
+	out := &bytes.Buffer{}
+	args := []string{"diff", "--cached", "--raw", "--no-renames", "--no-abbrev", "-z"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "listing staged files")
+	}
+
+	// Each entry is ":oldmode newmode oldsha newsha status\0path\0"
+	var files []committedFile
+	blobs := &bytes.Buffer{}
+	fields := strings.Split(strings.TrimSuffix(out.String(), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(fields[i])
+		if len(meta) != 5 {
+			return nil, fmt.Errorf("unexpected entry in git diff output: %q", fields[i])
+		}
+		if meta[4] == "D" || meta[1] == "160000" { // deleted, or a submodule
+			continue
+		}
+		files = append(files, committedFile{path: fields[i+1]})
+		fmt.Fprintln(blobs, meta[3])
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	out.Reset()
+	args = []string{"cat-file", "--batch-check=%(objectsize)"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, in: blobs, out: out}); err != nil {
+		return nil, errors.Wrap(err, "getting sizes of staged files")
+	}
+	sizes := splitList(out.String())
+	if len(sizes) != len(files) {
+		return nil, fmt.Errorf("expected %d sizes from git cat-file, got %d", len(files), len(sizes))
+	}
+	for i, s := range sizes {
+		size, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing size of %s", files[i].path)
+		}
+		files[i].size = size
+	}
+	return files, nil
+}
+
+// commit commits the changes to all tracked files or, if paths are
+// given, only those to the paths, which must be known to git (e.g.,
+// staged), leaving any other changes staged.
+func commit(ctx context.Context, gexec gitExec, workingDir string, commitAction CommitAction, env []string, paths ...string) error {
+	gpgArgs, gpgEnv, err := gpgPassphraseArgs(commitAction.SigningKey, commitAction.GPGPassphrase, env)
+	if err != nil {
+		return err
+	}
+	env = append(gpgEnv, env...)
+	args := append(gpgArgs, "commit", "--no-verify", "-m", commitAction.Message)
+	if len(paths) == 0 {
+		args = append(args, "-a")
+	}
+	if commitAction.AuthorName != "" || commitAction.AuthorEmail != "" {
+		env = append(env, authorEnv(commitAction)...)
+	} else if commitAction.Author != "" {
+		args = append(args, "--author", commitAction.Author)
+	}
+	env = append(env, dateEnv(commitAction.CommitDate)...)
+	if commitAction.SigningKey != "" {
+		args = append(args, fmt.Sprintf("--gpg-sign=%s", commitAction.SigningKey))
+	}
+	if commitAction.AllowEmpty {
+		args = append(args, "--allow-empty")
+	}
+	args = append(append(args, "--"), paths...)
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		// git reports this on stdout, and just exits non-zero
+		if strings.Contains(out.String(), "nothing to commit") || strings.Contains(out.String(), "no changes added to commit") {
+			return ErrNoChanges
+		}
+		return errors.Wrap(err, "git commit")
+	}
+	return nil
+}
+
+// commitToRef makes a commit of the changes staged according to the
+// mode given, as `stage` and `commit` would, but without touching the
+// index, HEAD or the current branch; the commit is pointed to by the
+// ref given, and its revision returned. The commit is never signed.
+func commitToRef(ctx context.Context, gexec gitExec, workingDir, ref string, subdirs []string, mode StageMode, commitAction CommitAction) (string, error) {
+	// Work on a copy of the index, so the real one is left as it is.
+	indexPath, err := gitPath(ctx, gexec, workingDir, "index")
+	if err != nil {
+		return "", err
+	}
+	index, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return "", err
+	}
+	tmpIndex, err := ioutil.TempFile(os.TempDir(), "flux-index")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpIndex.Name())
+	_, err = tmpIndex.Write(index)
+	tmpIndex.Close()
+	if err != nil {
+		return "", err
+	}
+	env := append([]string{"GIT_INDEX_FILE=" + tmpIndex.Name()}, authorEnv(commitAction)...)
+	env = append(env, dateEnv(commitAction.CommitDate)...)
+
+	if err := execGitCmd(ctx, []string{"add", "--update"}, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return "", errors.Wrap(err, "git add --update")
+	}
+	if err := stage(ctx, gexec, workingDir, subdirs, mode, env); err != nil {
+		return "", err
+	}
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, []string{"write-tree"}, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		return "", errors.Wrap(err, "git write-tree")
+	}
+	tree := strings.TrimSpace(out.String())
+	out.Reset()
+	args := []string{"commit-tree", tree, "-p", "HEAD", "-m", commitAction.Message}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		return "", errors.Wrap(err, "git commit-tree")
+	}
+	rev := strings.TrimSpace(out.String())
+	if err := execGitCmd(ctx, []string{"update-ref", ref, rev}, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return "", errors.Wrap(err, "git update-ref")
+	}
+	return rev, nil
+}
+
+// emptyCommit makes a commit with no files and no parents, signed
+// with the key given if it's not empty, and returns its revision. It
+// doesn't update any refs.
+func emptyCommit(ctx context.Context, gexec gitExec, workingDir, message, signingKey string, env []string) (string, error) {
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, []string{"mktree"}, gitCmdConfig{dir: workingDir, exec: gexec, in: &bytes.Buffer{}, out: out}); err != nil {
+		return "", errors.Wrap(err, "git mktree")
+	}
+	tree := strings.TrimSpace(out.String())
+	out.Reset()
+	args := []string{"commit-tree", tree, "-m", message}
+	if signingKey != "" {
+		args = append(args, "--gpg-sign="+signingKey)
+	}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		return "", errors.Wrap(err, "git commit-tree")
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// authorEnv gives the environment entries that set the author of a
+// commit as given in the commit action: AuthorName and AuthorEmail if
+// either is given, otherwise Author if it's in the form "Name
+// <email>". Anything not given is left to git, which will use the
+// committer.
+func authorEnv(commitAction CommitAction) []string {
+	name, email := commitAction.AuthorName, commitAction.AuthorEmail
+	if name == "" && email == "" {
+		name, email, _ = splitAuthor(commitAction.Author)
+	}
+	var env []string
+	if name != "" {
+		env = append(env, "GIT_AUTHOR_NAME="+name)
+	}
+	if email != "" {
+		env = append(env, "GIT_AUTHOR_EMAIL="+email)
+	}
+	return env
+}
+
+// gitDate formats a time as git's internal date format, which is
+// exact to the second and keeps the time zone.
+func gitDate(t time.Time) string {
+	return fmt.Sprintf("%d %s", t.Unix(), t.Format("-0700"))
+}
+
+// dateEnv gives the environment entries that set both the author
+// and committer dates of commits to the time given, if it's not zero.
+func dateEnv(t time.Time) []string {
+	if t.IsZero() {
+		return nil
+	}
+	return []string{"GIT_AUTHOR_DATE=" + gitDate(t), "GIT_COMMITTER_DATE=" + gitDate(t)}
+}
+
+// committerDateEnv is like dateEnv, but only sets the committer date;
+// e.g., for rebasing, which keeps the author date of each commit.
+func committerDateEnv(t time.Time) []string {
+	if t.IsZero() {
+		return nil
+	}
+	return []string{"GIT_COMMITTER_DATE=" + gitDate(t)}
+}
+
+// committerEnv gives the environment entries that set the committer
+// of commits, if the name and email are given.
+func committerEnv(name, email string) []string {
+	var env []string
+	if name != "" {
+		env = append(env, "GIT_COMMITTER_NAME="+name)
+	}
+	if email != "" {
+		env = append(env, "GIT_COMMITTER_EMAIL="+email)
+	}
+	return env
+}
+
+// splitAuthor splits an author given as "Name <email>" into its
+// parts.
+func splitAuthor(author string) (name, email string, ok bool) {
+	lt, gt := strings.Index(author, "<"), strings.LastIndex(author, ">")
+	if lt < 0 || gt < lt {
+		return "", "", false
+	}
+	return strings.TrimSpace(author[:lt]), author[lt+1 : gt], true
+}
+
+func updateRef(ctx context.Context, gexec gitExec, workingDir, ref, rev string) error {
+	if err := execGitCmd(ctx, []string{"update-ref", ref, rev}, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git update-ref")
+	}
+	return nil
+}
+
+func deleteRef(ctx context.Context, gexec gitExec, workingDir, ref string) error {
+	if err := execGitCmd(ctx, []string{"update-ref", "-d", ref}, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git update-ref -d")
+	}
+	return nil
+}
+
+// diff gives the unified diff between two revisions, limited to the
+// paths given, if any.
+func diff(ctx context.Context, gexec gitExec, workingDir, from, to string, subPaths []string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	args := []string{"diff", "--no-color", from, to, "--"}
+	args = append(args, subPaths...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git diff")
+	}
+	return out.Bytes(), nil
+}
+
+// diffFiles gives the files changed between two revisions, limited to
+// the paths given, if any. Renames are reported as a deletion and an
+// addition.
+func diffFiles(ctx context.Context, gexec gitExec, workingDir, from, to string, subPaths []string) ([]FileChange, error) {
+	out := &bytes.Buffer{}
+	args := []string{"diff", "--name-status", "--no-renames", "-z", from, to, "--"}
+	args = append(args, subPaths...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git diff --name-status")
+	}
+	return parseNameStatus(out.String())
+}
+
+// parseNameStatus parses the output of `git diff --name-status
+// --no-renames -z`, in which each entry is "status\0path\0".
+func parseNameStatus(s string) ([]FileChange, error) {
+	changes := []FileChange{}
+	if s == "" {
+		return changes, nil
+	}
+	fields := strings.Split(strings.TrimSuffix(s, "\x00"), "\x00")
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("unexpected output from git diff: %q", s)
+	}
+	for i := 0; i < len(fields); i += 2 {
+		change := FileChange{Path: fields[i+1]}
+		switch fields[i] {
+		case "A":
+			change.Type = FileAdded
+		case "D":
+			change.Type = FileDeleted
+		default: // M, or T for a change of type, e.g., to a symlink
+			change.Type = FileModified
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// showFile gives the contents of the file at path, as of the
+// revision given.
+func showFile(ctx context.Context, gexec gitExec, workingDir, rev, path string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	args := []string{"show", "--no-color", rev + ":" + path}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git show")
+	}
+	return out.Bytes(), nil
+}
+
+// isBinary says whether content looks like that of a binary file, as
+// git decides: by whether there's a NUL byte in the first 8000 bytes.
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// blame gives the commit that last changed each line of the file at
+// path, as of the revision given.
+func blame(ctx context.Context, gexec gitExec, workingDir, rev, path string) ([]BlameLine, error) {
+	out := &bytes.Buffer{}
+	args := []string{"blame", "--line-porcelain", rev, "--", path}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git blame")
+	}
+	return parseBlame(out.String())
+}
+
+// parseBlame parses the output of `git blame --line-porcelain`. Each
+// line of the file comes as a header line, "<revision> <original
+// line> <final line> [<lines in group>]", then lines of "<key>
+// <value>" about the commit, then the line itself, after a tab.
+func parseBlame(s string) ([]BlameLine, error) {
+	var (
+		lines      []BlameLine
+		line       BlameLine
+		authorTime int64
+		inHeader   bool
+	)
+	for _, l := range strings.Split(s, "\n") {
+		if l == "" {
+			continue
+		}
+		if !inHeader {
+			fields := strings.Fields(l)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("unexpected line in git blame output: %q", l)
+			}
+			n, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("unexpected line in git blame output: %q", l)
+			}
+			line, inHeader = BlameLine{Revision: fields[0], Number: n}, true
+			continue
+		}
+		if strings.HasPrefix(l, "\t") {
+			line.Text = l[1:]
+			lines = append(lines, line)
+			inHeader = false
+			continue
+		}
+		split := strings.SplitN(l, " ", 2)
+		value := ""
+		if len(split) == 2 {
+			value = split[1]
+		}
+		switch split[0] {
+		case "author":
+			line.AuthorName = value
+		case "author-mail":
+			line.AuthorEmail = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+		case "author-time":
+			t, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing author time in git blame output")
+			}
+			authorTime = t
+		case "author-tz":
+			tz, err := time.Parse("-0700", value)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing author time zone in git blame output")
+			}
+			line.AuthorDate = time.Unix(authorTime, 0).In(tz.Location())
+		case "summary":
+			line.Summary = value
+		}
+	}
+	if inHeader {
+		return nil, errors.New("git blame output ended part way through a line")
+	}
+	return lines, nil
+}
+
+// listFiles gives the files in the tree of the revision given,
+// limited to the paths given, if any.
+func listFiles(ctx context.Context, gexec gitExec, workingDir, rev string, subPaths []string) ([]string, error) {
+	out := &bytes.Buffer{}
+	args := []string{"ls-tree", "-r", "-z", "--name-only", rev, "--"}
+	args = append(args, subPaths...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "git ls-tree")
+	}
+	var files []string
+	for _, f := range strings.Split(out.String(), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// pushMirror pushes the refspecs given to the remote, forcing any
+// updates; or if none are given, pushes all refs as with `push
+// --mirror`, including deleting refs not present locally.
+func pushMirror(ctx context.Context, gexec gitExec, workingDir, remoteURL string, refspecs []string, env []string) error {
+	args := []string{"push", "--mirror", remoteURL}
+	if len(refspecs) > 0 {
+		args = append([]string{"push", "--force", remoteURL}, refspecs...)
+	}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git push to mirror")
+	}
+	return nil
+}
+
+// errPushRejected is the cause of an error from push when the
+// upstream has refs which are not ancestors of those being pushed.
+var errPushRejected = errors.New("push rejected by upstream; it has commits that are not present locally")
+
+// errPushOptionsUnsupported is the cause of an error from push when
+// it was given push options, and the upstream doesn't take them.
+var errPushOptionsUnsupported = errors.New("the upstream does not support push options")
+
+// errAtomicPushUnsupported is the cause of an error from push when
+// it's asked to be --atomic, but the upstream can't do that.
+var errAtomicPushUnsupported = errors.New("the upstream does not support atomic pushes")
+
+// push the refs given to the upstream repo
+func push(ctx context.Context, gexec gitExec, workingDir, upstream string, refs []string, env []string, extra ...string) error {
+	// --porcelain so we can tell when refs were rejected
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+	args := append(append([]string{"push", "--porcelain"}, extra...), upstream)
+	args = append(args, refs...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out, errOut: errOut}); err != nil {
+		if strings.Contains(out.String(), "[rejected]") {
+			err = errPushRejected
+		} else if strings.Contains(errOut.String(), "does not support push options") {
+			err = errPushOptionsUnsupported
+		} else if strings.Contains(errOut.String(), "does not support --atomic push") {
+			err = errAtomicPushUnsupported
+		}
+		return errors.Wrap(err, fmt.Sprintf("git push %s %s", upstream, refs))
+	}
+	return nil
+}
+
+// rebase the current branch onto the ref given, giving up if it
+// cannot be done cleanly.
+func rebase(ctx context.Context, gexec gitExec, workingDir, onto, signingKey string, passphrase []byte, env []string) error {
+	gpgArgs, gpgEnv, err := gpgPassphraseArgs(signingKey, passphrase, env)
+	if err != nil {
+		return err
+	}
+	env = append(gpgEnv, env...)
+	args := append(gpgArgs, "rebase")
+	if signingKey != "" {
+		args = append(args, fmt.Sprintf("--gpg-sign=%s", signingKey))
+	}
+	args = append(args, onto)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		execGitCmd(ctx, []string{"rebase", "--abort"}, gitCmdConfig{dir: workingDir, exec: gexec})
+		return errors.Wrap(err, "git rebase "+onto)
+	}
+	return nil
+}
+
+// fetch updates refs from the upstream.
+func fetch(ctx context.Context, gexec gitExec, workingDir, upstream string, env []string, refspec ...string) error {
+	args := append([]string{"fetch", "--tags", upstream}, refspec...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil && !isRefNotFound(err) {
+		return errors.Wrap(err, fmt.Sprintf("git fetch --tags %s %s", upstream, refspec))
+	}
+	return nil
+}
+
+// fetchNotes updates all the notes refs from the upstream, and
+// nothing else.
+func fetchNotes(ctx context.Context, gexec gitExec, workingDir, upstream string, env []string) error {
+	args := []string{"fetch", "--no-tags", upstream, "+refs/notes/*:refs/notes/*"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git fetch notes from "+upstream)
+	}
+	return nil
+}
+
+// gc packs loose objects and drops unreachable objects in the repo,
+// then removes any refs for branches that have gone from the
+// remote. Since unreachable objects are pruned straight away, nothing
+// else should be writing to the repo while this runs.
+func gc(ctx context.Context, gexec gitExec, workingDir, remote string, env []string) error {
+	args := []string{"gc", "--quiet", "--prune=now"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git gc")
+	}
+	args = []string{"remote", "prune", remote}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git remote prune")
+	}
+	return nil
+}
+
+// fetchAtomic fetches the refspecs given from the upstream, updating
+// either all the refs or none of them. It doesn't write FETCH_HEAD or
+// start a GC, so that it can be run alongside other fetches into the
+// same repo.
+func fetchAtomic(ctx context.Context, gexec gitExec, workingDir, upstream string, env []string, progress ProgressFunc, refspecs ...string) error {
+	extra, progressOut := progressArgs(OpFetch, progress)
+	args := append([]string{"fetch", "--atomic", "--no-write-fetch-head", "--no-auto-gc"}, extra...)
+	args = append(append(args, upstream), refspecs...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, errOut: progressOut}); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("git fetch %s %s", upstream, refspecs))
+	}
+	return nil
+}
+
+// fetchConcurrently fetches each set of refspecs given, at the same
+// time. If any fail, a StaleRefsError says which refs weren't
+// updated.
+func fetchConcurrently(ctx context.Context, gexec gitExec, workingDir, upstream string, env []string, refspecSets [][]string, progress ProgressFunc) error {
+	errs := make([]error, len(refspecSets))
+	var wg sync.WaitGroup
+	for i := range refspecSets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fetchAtomic(ctx, gexec, workingDir, upstream, env, progress, refspecSets[i]...)
+		}(i)
+	}
+	wg.Wait()
+
+	var stale StaleRefsError
+	for i, err := range errs {
+		if err != nil {
+			stale.Refs = append(stale.Refs, refspecSets[i]...)
+			stale.Errs = append(stale.Errs, err)
+		}
+	}
+	if len(stale.Errs) > 0 {
+		return stale
+	}
+	return nil
+}
+
+// remoteRef gives the revision of the ref given upstream, and whether
+// it's there at all, using `git ls-remote`. The working directory can
+// be empty, since nothing in it is used or changed.
+func remoteRef(ctx context.Context, gexec gitExec, workingDir, upstream, ref string, env []string) (string, bool, error) {
+	out := &bytes.Buffer{}
+	args := []string{"ls-remote", "--", upstream, ref}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		return "", false, errors.Wrap(err, "git ls-remote "+upstream)
+	}
+	// The pattern matches any ref ending with it, so look for this
+	// one in particular
+	for _, l := range splitList(out.String()) {
+		if split := strings.Fields(l); len(split) == 2 && split[1] == ref {
+			return split[0], true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// fetchExisting fetches the refspecs given from the upstream, but
+// only those with a source ref that exists upstream; fetching a
+// missing ref would otherwise fail the whole fetch.
+func fetchExisting(ctx context.Context, gexec gitExec, workingDir, upstream string, env []string, refspecs ...string) error {
+	out := &bytes.Buffer{}
+	args := []string{"ls-remote", upstream}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, out: out}); err != nil {
+		return errors.Wrap(err, "git ls-remote "+upstream)
+	}
+	remoteRefs := map[string]struct{}{}
+	for _, l := range splitList(out.String()) {
+		if split := strings.Fields(l); len(split) == 2 {
+			remoteRefs[split[1]] = struct{}{}
+		}
+	}
+	var existing []string
+	for _, refspec := range refspecs {
+		src := strings.SplitN(strings.TrimPrefix(refspec, "+"), ":", 2)[0]
+		if _, ok := remoteRefs[src]; ok || strings.Contains(src, "*") {
+			existing = append(existing, refspec)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	return fetch(ctx, gexec, workingDir, upstream, env, existing...)
+}
+
+// isFullRevision says whether the revision given is a full object
+// name, which is all `git fetch` will take in place of a ref.
+func isFullRevision(rev string) bool {
+	if len(rev) != 40 && len(rev) != 64 {
+		return false
+	}
+	for _, c := range rev {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasCommit says whether the commit given is in the repo.
+func hasCommit(ctx context.Context, gexec gitExec, workingDir, rev string) bool {
+	args := []string{"cat-file", "-e", rev + "^{commit}"}
+	return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}) == nil
+}
+
+// fetchRev fetches the commit given from the upstream, along with
+// whatever of its history is missing, without updating any refs.
+func fetchRev(ctx context.Context, gexec gitExec, workingDir, upstream, rev string, env []string) error {
+	args := []string{"fetch", "--no-write-fetch-head", "--no-auto-gc", upstream, rev}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		if isRefNotFound(err) {
+			return FetchRevError{Revision: rev, Err: err}
+		}
+		return errors.Wrap(err, "git fetch "+rev)
+	}
+	return nil
+}
+
+// fetchShallow fetches the refspecs given from the upstream, to the
+// depth given.
+func fetchShallow(ctx context.Context, gexec gitExec, workingDir, upstream string, depth int, refspec ...string) error {
+	args := append([]string{"fetch", "--depth", strconv.Itoa(depth), upstream}, refspec...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil && !isRefNotFound(err) {
+		return errors.Wrap(err, fmt.Sprintf("git fetch --depth %d %s %s", depth, upstream, refspec))
+	}
+	return nil
+}
+
+// unshallow fetches the remainder of the history for a shallow clone.
+func unshallow(ctx context.Context, gexec gitExec, workingDir, upstream string) error {
+	args := []string{"fetch", "--unshallow", upstream}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git fetch --unshallow "+upstream)
+	}
+	return nil
+}
+
+func isShallow(ctx context.Context, gexec gitExec, workingDir string) (bool, error) {
+	out := &bytes.Buffer{}
+	args := []string{"rev-parse", "--is-shallow-repository"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out.String()) == "true", nil
+}
+
+// lfsSkipSmudge is in the environment of every git command for a
+// checkout with LFS content. Since the working clone's origin is the
+// local mirror, which has no LFS objects, the smudge filter would
+// fail whenever git checks out a file; so files are checked out as
+// their LFS pointers, and lfsPull fills in the content.
+const lfsSkipSmudge = "GIT_LFS_SKIP_SMUDGE=1"
+
+// lfsPull fetches and checks out the Git LFS content for the current
+// branch, from the upstream given.
+func lfsPull(ctx context.Context, gexec gitExec, workingDir, upstream string, env []string) error {
+	// git-lfs is found as git finds it, i.e., with the PATH given
+	// in the ExtraEnv, if any.
+	if err := execGitCmd(ctx, []string{"lfs", "version"}, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return ErrLFSNotInstalled
+	}
+	args := []string{"lfs", "install", "--local"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git lfs install")
+	}
+	args = []string{"-c", "remote.lfs-upstream.url=" + upstream, "lfs", "pull", "lfs-upstream"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git lfs pull")
+	}
+	return nil
+}
+
+// submoduleUpdate checks out the submodules of the working clone at
+// the commits recorded for them, fetching only those commits if a
+// depth is given. Since the working clone's remote is the local
+// mirror, relative submodule URLs are resolved against the upstream
+// given instead; that's only while initialising them, so that the
+// fetches within the submodules go to their own remotes.
+func submoduleUpdate(ctx context.Context, gexec gitExec, workingDir, remote, upstream string, depth int, recursive bool, env []string) error {
+	args := []string{"-c", "remote." + remote + ".url=" + upstream, "submodule", "init"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git submodule init")
+	}
+	args = []string{"submodule", "update", "--checkout"}
+	if depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(depth))
+	}
+	if recursive {
+		args = append(args, "--init", "--recursive")
+	}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "git submodule update")
+	}
+	return nil
+}
+
+// setLineEndings sets core.autocrlf and core.eol in the working
+// clone, to those given if they're not empty, and if noConversion is
+// set, turns off git's conversion of line endings altogether, by
+// unsetting the text attribute for every file (in info/attributes,
+// which takes precedence over .gitattributes). The files are then
+// checked out again, as they would have been with those settings.
+func setLineEndings(ctx context.Context, gexec gitExec, workingDir, autocrlf, eol string, noConversion bool) error {
+	for _, c := range []struct{ key, value string }{{"core.autocrlf", autocrlf}, {"core.eol", eol}} {
+		if c.value == "" {
+			continue
+		}
+		if err := setConfig(ctx, gexec, workingDir, c.key, c.value); err != nil {
+			return err
+		}
+	}
+	if noConversion {
+		attributes, err := gitPath(ctx, gexec, workingDir, "info/attributes")
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(attributes), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(attributes, []byte("* -text\n"), 0600); err != nil {
+			return err
+		}
 	}
-	return repoPath, nil
+	// git only writes the files it thinks have changed since the
+	// index was made, so that has to go for all of them to be
+	// written afresh.
+	index, err := gitPath(ctx, gexec, workingDir, "index")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(index); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return resetHard(ctx, gexec, workingDir, "HEAD")
 }
 
-func mirror(ctx context.Context, workingDir, repoURL string) (path string, err error) {
-	repoPath := workingDir
-	args := []string{"clone", "--mirror"}
-	args = append(args, repoURL, repoPath)
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
-		return "", errors.Wrap(err, "git clone --mirror")
+// gitPath gives the absolute path of the file given within the
+// working clone's .git directory, as `git rev-parse --git-path` does.
+func gitPath(ctx context.Context, gexec gitExec, workingDir, path string) (string, error) {
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, []string{"rev-parse", "--git-path", path}, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return "", err
 	}
-	return repoPath, nil
+	p := strings.TrimSpace(out.String())
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(workingDir, p)
+	}
+	return p, nil
 }
 
-func checkout(ctx context.Context, workingDir, ref string) error {
-	args := []string{"checkout", ref, "--"}
-	return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir})
+// lineEndingChanges gives the files under the paths given that differ
+// from HEAD (in the index or the working tree) only in their line
+// endings; i.e., that have changes, none of which are left when CRs
+// at the ends of lines are ignored.
+func lineEndingChanges(ctx context.Context, gexec gitExec, workingDir string, subdirs []string) ([]string, error) {
+	changed := func(extra ...string) (map[string]bool, error) {
+		out := &bytes.Buffer{}
+		args := append(append([]string{"diff", "--numstat", "--no-renames", "-z"}, extra...), "HEAD", "--")
+		args = append(args, subdirs...)
+		if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+			return nil, errors.Wrap(err, "listing changed files")
+		}
+		// Each is "added<TAB>deleted<TAB>path", with "-" for the
+		// counts of a binary file
+		files := map[string]bool{}
+		for _, entry := range strings.Split(out.String(), "\x00") {
+			fields := strings.SplitN(entry, "\t", 3)
+			if len(fields) == 3 {
+				files[fields[2]] = fields[0] != "0" || fields[1] != "0"
+			}
+		}
+		return files, nil
+	}
+	all, err := changed()
+	if err != nil {
+		return nil, err
+	}
+	ignoringCR, err := changed("--ignore-cr-at-eol")
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for file, lines := range all {
+		if lines && !ignoringCR[file] {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
 }
 
-// checkPush sanity-checks that we can write to the upstream repo
-// (being able to `clone` is an adequate check that we can read the
-// upstream).
-func checkPush(ctx context.Context, workingDir, upstream string) error {
-	// --force just in case we fetched the tag from upstream when cloning
-	args := []string{"tag", "--force", CheckPushTag}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
-		return errors.Wrap(err, "tag for write check")
+// checkoutPaths puts the files given back, in the index and the
+// working tree, as they are at the ref given.
+func checkoutPaths(ctx context.Context, gexec gitExec, workingDir, ref string, paths []string) error {
+	args := append([]string{"checkout", ref, "--"}, paths...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git checkout "+ref)
 	}
-	args = []string{"push", "--force", upstream, "tag", CheckPushTag}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
-		return errors.Wrap(err, "attempt to push tag")
+	return nil
+}
+
+// resetHard resets the working tree and index to the ref given, and
+// removes any untracked files.
+func resetHard(ctx context.Context, gexec gitExec, workingDir, ref string) error {
+	args := []string{"reset", "--hard", ref, "--"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git reset --hard "+ref)
 	}
-	args = []string{"push", "--delete", upstream, "tag", CheckPushTag}
-	return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir})
+	args = []string{"clean", "-ffdx"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git clean")
+	}
+	return nil
 }
 
-func commit(ctx context.Context, workingDir string, commitAction CommitAction) error {
-	args := []string{"commit", "--no-verify", "-a", "-m", commitAction.Message}
-	var env []string
-	if commitAction.Author != "" {
-		args = append(args, "--author", commitAction.Author)
+// revert applies the reverse of the commit given to the working tree
+// and index, without committing it. If that conflicts with later
+// changes, it's abandoned, and a RevertConflictError returned.
+func revert(ctx context.Context, gexec gitExec, workingDir, rev string) error {
+	args := []string{"revert", "--no-commit", rev}
+	err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec})
+	if err == nil {
+		return nil
 	}
-	if commitAction.SigningKey != "" {
-		args = append(args, fmt.Sprintf("--gpg-sign=%s", commitAction.SigningKey))
+	// git reports the conflicts on stdout, so look at what's left
+	// unmerged instead.
+	out := &bytes.Buffer{}
+	args = []string{"diff", "--name-only", "-z", "--diff-filter=U"}
+	if derr := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); derr != nil {
+		return errors.Wrap(derr, "listing conflicts after git revert")
 	}
-	args = append(args, "--")
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, env: env}); err != nil {
-		return errors.Wrap(err, "git commit")
+	conflicts := strings.Split(strings.TrimSuffix(out.String(), "\x00"), "\x00")
+	// This is done even if the context has expired, so the revert
+	// isn't left half-done.
+	if aerr := execGitCmd(context.Background(), []string{"revert", "--abort"}, gitCmdConfig{dir: workingDir, exec: gexec}); aerr != nil {
+		return errors.Wrap(aerr, "abandoning git revert")
+	}
+	if out.Len() > 0 {
+		return RevertConflictError{Revision: rev, Paths: conflicts}
+	}
+	return errors.Wrap(err, "git revert")
+}
+
+// sparseCheckout limits the working tree to the directories given
+// (and files at the top level).
+func sparseCheckout(ctx context.Context, gexec gitExec, workingDir string, paths []string) error {
+	args := []string{"sparse-checkout", "init", "--cone"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git sparse-checkout init")
+	}
+	args = append([]string{"sparse-checkout", "set"}, paths...)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git sparse-checkout set")
 	}
 	return nil
 }
 
-// push the refs given to the upstream repo
-func push(ctx context.Context, workingDir, upstream string, refs []string) error {
-	args := append([]string{"push", upstream}, refs...)
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("git push %s %s", upstream, refs))
+// addWorktree creates a working tree of the repo in repoDir, at the
+// path and ref given, with a detached HEAD.
+func addWorktree(ctx context.Context, gexec gitExec, repoDir, path, ref string) error {
+	args := []string{"worktree", "add", "--detach", path, ref}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: repoDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git worktree add")
 	}
 	return nil
 }
 
-// fetch updates refs from the upstream.
-func fetch(ctx context.Context, workingDir, upstream string, refspec ...string) error {
-	args := append([]string{"fetch", "--tags", upstream}, refspec...)
-	// In git <=2.20 the error started with an uppercase, in 2.21 this
-	// was changed to be consistent with all other die() and error()
-	// messages, cast to lowercase to support both versions.
-	// Ref: https://github.com/git/git/commit/0b9c3afdbfb62936337efc52b4007a446939b96b
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil &&
-		!strings.Contains(strings.ToLower(err.Error()), "couldn't find remote ref") {
-		return errors.Wrap(err, fmt.Sprintf("git fetch --tags %s %s", upstream, refspec))
+func removeWorktree(ctx context.Context, gexec gitExec, repoDir, path string) error {
+	args := []string{"worktree", "remove", "--force", path}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: repoDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git worktree remove")
+	}
+	return nil
+}
+
+// currentBranch gives the branch checked out, or "HEAD" if HEAD is
+// detached.
+func currentBranch(ctx context.Context, gexec gitExec, workingDir string) (string, error) {
+	out := &bytes.Buffer{}
+	args := []string{"rev-parse", "--abbrev-ref", "HEAD"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// checkoutBranchAtHead (re)creates the branch given at HEAD, and
+// checks it out.
+func checkoutBranchAtHead(ctx context.Context, gexec gitExec, workingDir, branch string) error {
+	args := []string{"checkout", "-B", branch}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git checkout -B "+branch)
+	}
+	return nil
+}
+
+// checkoutBranchAt (re)creates the branch given at the revision
+// given, and checks it out.
+func checkoutBranchAt(ctx context.Context, gexec gitExec, workingDir, branch, rev string) error {
+	args := []string{"checkout", "-B", branch, rev}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "git checkout -B "+branch+" "+rev)
 	}
 	return nil
 }
 
-func refExists(ctx context.Context, workingDir, ref string) (bool, error) {
+func refExists(ctx context.Context, gexec gitExec, workingDir, ref string) (bool, error) {
 	args := []string{"rev-list", ref, "--"}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
-		if strings.Contains(err.Error(), "bad revision") {
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		// a SHA1 for an object we don't have is a "bad object",
+		// which also counts as not found
+		if isRefNotFound(err) {
 			return false, nil
 		}
 		return false, err
@@ -142,47 +1326,159 @@ func refExists(ctx context.Context, workingDir, ref string) (bool, error) {
 	return true, nil
 }
 
+// isRefNotFound says whether a git command failed because a ref
+// asked for doesn't exist.
+func isRefNotFound(err error) bool {
+	_, ok := err.(RefNotFoundError)
+	return ok
+}
+
 // Get the full ref for a shorthand notes ref.
-func getNotesRef(ctx context.Context, workingDir, ref string) (string, error) {
+func getNotesRef(ctx context.Context, gexec gitExec, workingDir, ref string) (string, error) {
 	out := &bytes.Buffer{}
 	args := []string{"notes", "--ref", ref, "get-ref"}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, out: out}); err != nil {
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
 		return "", err
 	}
 	return strings.TrimSpace(out.String()), nil
 }
 
-func addNote(ctx context.Context, workingDir, rev, notesRef string, note interface{}) error {
+func addNote(ctx context.Context, gexec gitExec, workingDir, rev, notesRef string, note interface{}) error {
+	b, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	// With the newline, as `git notes add -m` would give
+	return addNoteRaw(ctx, gexec, workingDir, rev, notesRef, append(b, '\n'), false)
+}
+
+// setNote is like addNote, but replaces any existing note.
+func setNote(ctx context.Context, gexec gitExec, workingDir, rev, notesRef string, note interface{}) error {
 	b, err := json.Marshal(note)
 	if err != nil {
 		return err
 	}
-	args := []string{"notes", "--ref", notesRef, "add", "-m", string(b), rev}
-	return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir})
+	return addNoteRaw(ctx, gexec, workingDir, rev, notesRef, append(b, '\n'), true)
 }
 
-func getNote(ctx context.Context, workingDir, notesRef, rev string, note interface{}) (ok bool, err error) {
+// addNoteRaw adds a note with exactly the content given, replacing
+// any existing note if force is true. The content is written as a
+// blob and the note made from that, since `git notes add -m` would
+// tidy up the whitespace (and can't take a NUL).
+func addNoteRaw(ctx context.Context, gexec gitExec, workingDir, rev, notesRef string, content []byte, force bool) error {
 	out := &bytes.Buffer{}
-	args := []string{"notes", "--ref", notesRef, "show", rev}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, out: out}); err != nil {
-		if strings.Contains(strings.ToLower(err.Error()), "no note found for object") {
-			return false, nil
-		}
+	args := []string{"hash-object", "-w", "--stdin"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, in: bytes.NewReader(content), out: out}); err != nil {
+		return errors.Wrap(err, "writing note")
+	}
+	args = []string{"notes", "--ref", notesRef, "add", "--allow-empty", "-C", strings.TrimSpace(out.String())}
+	if force {
+		args = append(args, "--force")
+	}
+	return execGitCmd(ctx, append(args, rev), gitCmdConfig{dir: workingDir, exec: gexec})
+}
+
+// removeNote removes the note for the revision given, if there is one.
+func removeNote(ctx context.Context, gexec gitExec, workingDir, notesRef, rev string) error {
+	args := []string{"notes", "--ref", notesRef, "remove", "--ignore-missing", rev}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		return errors.Wrap(err, "removing note")
+	}
+	return nil
+}
+
+func getNote(ctx context.Context, gexec gitExec, workingDir, notesRef, rev string, note interface{}) (ok bool, err error) {
+	content, ok, err := getNoteRaw(ctx, gexec, workingDir, notesRef, rev)
+	if !ok || err != nil {
 		return false, err
 	}
-	if err := json.NewDecoder(out).Decode(note); err != nil {
+	if err := json.Unmarshal(content, note); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
+// getNoteRaw gives the content of the note for the revision given,
+// exactly as it was written, and false if there is no such note.
+func getNoteRaw(ctx context.Context, gexec gitExec, workingDir, notesRef, rev string) ([]byte, bool, error) {
+	out := &bytes.Buffer{}
+	args := []string{"notes", "--ref", notesRef, "list", rev}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		if strings.Contains(strings.ToLower(err.Error()), "no note found for object") {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	blob := strings.TrimSpace(out.String())
+	out.Reset()
+	args = []string{"cat-file", "blob", blob}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, false, errors.Wrap(err, "reading note for "+rev)
+	}
+	return out.Bytes(), true, nil
+}
+
+// getNotes reads the notes for the revisions given, in one go. Each
+// note is decoded into a value obtained from newNote, and the result
+// is keyed by revision. Revisions with no note are absent from the
+// result.
+func getNotes(ctx context.Context, gexec gitExec, workingDir, notesRef string, revs []string, newNote func() interface{}) (map[string]interface{}, error) {
+	out := &bytes.Buffer{}
+	args := []string{"notes", "--ref", notesRef, "list"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, err
+	}
+	blobs := map[string]string{} // commit -> note blob
+	for _, l := range splitList(out.String()) {
+		if split := strings.Fields(l); len(split) == 2 {
+			blobs[split[1]] = split[0]
+		}
+	}
+
+	var wanted []string
+	in := &bytes.Buffer{}
+	for _, rev := range revs {
+		if blob, ok := blobs[rev]; ok {
+			wanted = append(wanted, rev)
+			fmt.Fprintln(in, blob)
+		}
+	}
+	result := make(map[string]interface{}, len(wanted))
+	if len(wanted) == 0 {
+		return result, nil
+	}
+
+	out.Reset()
+	args = []string{"cat-file", "--batch"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, in: in, out: out}); err != nil {
+		return nil, err
+	}
+	// The output is, for each object, a header line of `<sha> <type>
+	// <size>`, then the contents, then a newline.
+	for _, rev := range wanted {
+		var sha, typ string
+		var size int
+		if _, err := fmt.Fscanf(out, "%s %s %d\n", &sha, &typ, &size); err != nil {
+			return nil, errors.Wrap(err, "reading git cat-file output")
+		}
+		content := out.Next(size)
+		out.Next(1) // trailing newline
+		note := newNote()
+		if err := json.Unmarshal(content, note); err != nil {
+			return nil, errors.Wrap(err, "decoding note for "+rev)
+		}
+		result[rev] = note
+	}
+	return result, nil
+}
+
 // Get all revisions with a note (NB: DO NOT RELY ON THE ORDERING)
 // It appears to be ordered by ascending git object ref, not by time.
 // Return a map to make it easier to do "if in" type queries.
-func noteRevList(ctx context.Context, workingDir, notesRef string) (map[string]struct{}, error) {
+func noteRevList(ctx context.Context, gexec gitExec, workingDir, notesRef string) (map[string]struct{}, error) {
 	out := &bytes.Buffer{}
 	args := []string{"notes", "--ref", notesRef, "list"}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, out: out}); err != nil {
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
 		return nil, err
 	}
 	noteList := splitList(out.String())
@@ -196,44 +1492,255 @@ func noteRevList(ctx context.Context, workingDir, notesRef string) (map[string]s
 	return result, nil
 }
 
-// Get the commit hash for a reference
-func refRevision(ctx context.Context, workingDir, ref string) (string, error) {
+// resolveRevision gives the commit that the ref given points at,
+// following symbolic refs and annotated tags. If there's no such
+// commit, it returns a RefNotFoundError.
+func resolveRevision(ctx context.Context, gexec gitExec, workingDir, ref string) (string, error) {
 	out := &bytes.Buffer{}
-	args := []string{"rev-list", "--max-count", "1", ref, "--"}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, out: out}); err != nil {
+	args := []string{"rev-parse", "--verify", "--quiet", ref + "^{commit}"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		// With --quiet, git just exits non-zero if the ref
+		// doesn't resolve; anything else comes with a message.
+		if e, ok := err.(UnknownError); ok && e.Stderr == "" {
+			return "", RefNotFoundError{Ref: ref}
+		}
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// previousTagRevision goes back through the reflog of the tag given
+// for the first commit it pointed at that isn't the one it points at
+// now. (`git log -g` won't do, since it skips entries that aren't
+// commits, as those for annotated tags aren't.) It returns a
+// RefNotFoundError if the reflog runs out first.
+func previousTagRevision(ctx context.Context, gexec gitExec, workingDir, tag string) (string, error) {
+	ref := "refs/tags/" + tag
+	current, err := resolveRevision(ctx, gexec, workingDir, ref)
+	if err != nil {
 		return "", err
 	}
+	for n := 1; ; n++ {
+		rev, err := resolveRevision(ctx, gexec, workingDir, fmt.Sprintf("%s@{%d}", ref, n))
+		if err != nil {
+			return "", err
+		}
+		if rev != current {
+			return rev, nil
+		}
+	}
+}
+
+// mergeBase gives the best common ancestor of the two refs given, or
+// a NoMergeBaseError if there isn't one.
+func mergeBase(ctx context.Context, gexec gitExec, workingDir, a, b string) (string, error) {
+	out := &bytes.Buffer{}
+	args := []string{"merge-base", a, b}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		// git just exits non-zero if there's no merge base; anything
+		// else comes with a message.
+		if e, ok := err.(UnknownError); ok && e.Stderr == "" {
+			return "", NoMergeBaseError{A: a, B: b}
+		}
+		return "", errors.Wrap(err, "git merge-base")
+	}
 	return strings.TrimSpace(out.String()), nil
 }
 
-// Return the revisions and one-line log commit messages
-func onelinelog(ctx context.Context, workingDir, refspec string, subdirs []string) ([]Commit, error) {
+// isAncestor says whether the commit a is an ancestor of the commit
+// b; a commit counts as its own ancestor.
+func isAncestor(ctx context.Context, gexec gitExec, workingDir, a, b string) (bool, error) {
+	args := []string{"merge-base", "--is-ancestor", a, b}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec}); err != nil {
+		// As with merge-base, a quiet non-zero exit means "no"
+		if e, ok := err.(UnknownError); ok && e.Stderr == "" {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "git merge-base --is-ancestor")
+	}
+	return true, nil
+}
+
+func refRevision(ctx context.Context, gexec gitExec, workingDir, ref string) (string, error) {
 	out := &bytes.Buffer{}
-	args := []string{"log", "--pretty=format:%GK|%H|%s", refspec}
-	args = append(args, "--")
-	if len(subdirs) > 0 {
-		args = append(args, subdirs...)
+	args := []string{"rev-list", "--max-count", "1", ref, "--"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return "", err
 	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// Return the revisions and one-line log commit messages. Any extra
+// arguments given are passed to `git log` before the refspec.
+func onelinelog(ctx context.Context, gexec gitExec, workingDir, refspec string, subdirs []string, extra ...string) ([]Commit, error) {
+	return logCommits(ctx, gexec, workingDir, "%GK|%GF|%G?", refspec, subdirs, extra...)
+}
 
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, out: out}); err != nil {
+func logCommits(ctx context.Context, gexec gitExec, workingDir, signatureFormat, refspec string, subdirs []string, extra ...string) ([]Commit, error) {
+	out := &bytes.Buffer{}
+	args := logArgs(signatureFormat, refspec, subdirs, extra)
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
 		return nil, err
 	}
 
 	return splitLog(out.String())
 }
 
+// streamLog is like onelinelog, but gives each commit to the
+// function given as it's read, rather than all of them at the end.
+// It leaves the signatures out, which saves running gpg for every
+// commit. If the function returns an error, git is stopped, and the
+// error returned.
+func streamLog(ctx context.Context, gexec gitExec, workingDir, refspec string, subdirs []string, fn func(Commit) error, extra ...string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		args := logArgs("||", refspec, subdirs, extra)
+		err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: pw})
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(nil, maxLogLine)
+	var err error
+	for err == nil && scanner.Scan() {
+		var commit Commit
+		if commit, err = parseLogLine(scanner.Text()); err == nil {
+			err = fn(commit)
+		}
+	}
+	if err == nil {
+		if err = scanner.Err(); err == nil {
+			return <-done
+		}
+	}
+	// Stop git, and let it finish writing, so it can exit.
+	cancel()
+	pr.CloseWithError(err)
+	<-done
+	return err
+}
+
+// archiveReader reads the output of `git archive` as it's written.
+type archiveReader struct {
+	*io.PipeReader
+	cancel func()
+	done   chan struct{}
+	once   sync.Once
+	unlock func()
+}
+
+// Close stops git, if it's still going, and waits for it to exit.
+func (a *archiveReader) Close() error {
+	a.once.Do(func() {
+		a.cancel()
+		a.PipeReader.Close()
+		<-a.done
+		a.unlock()
+	})
+	return nil
+}
+
+// archive runs `git archive` for the commit given, limited to the
+// paths given, and gives what it writes to be read. Any error from
+// git is returned from reading, once what git wrote has been read.
+// The func given is called once git has exited and the reader is
+// closed.
+func archive(ctx context.Context, gexec gitExec, workingDir, commit string, paths []string, closed func()) io.ReadCloser {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		args := append([]string{"archive", "--format=tar", commit, "--"}, paths...)
+		err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: pw})
+		if err != nil {
+			err = errors.Wrap(err, "git archive")
+		}
+		pw.CloseWithError(err)
+		close(done)
+	}()
+	return &archiveReader{PipeReader: pr, cancel: cancel, done: done, unlock: closed}
+}
+
+// maxLogLine is the longest line (so, mostly, commit subject) that
+// streamLog will read.
+const maxLogLine = 1024 * 1024
+
+func logArgs(signatureFormat, refspec string, subdirs, extra []string) []string {
+	args := []string{"log", "--pretty=format:" + signatureFormat + "|%H|%P|%aI|%cI|%an|%ae|%cn|%ce|%s"}
+	args = append(args, extra...)
+	args = append(args, refspec, "--")
+	return append(args, subdirs...)
+}
+
+// signatures gives what git makes of the signatures of the commits
+// given, checking them all with one command.
+func signatures(ctx context.Context, gexec gitExec, workingDir string, revs []string, env []string) (map[string]signature, error) {
+	in, out := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, rev := range revs {
+		fmt.Fprintln(in, rev)
+	}
+	args := []string{"log", "--no-walk=unsorted", "--stdin", "--pretty=format:%H|%GK|%GF|%G?"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, in: in, out: out}); err != nil {
+		return nil, errors.Wrap(err, "checking signatures")
+	}
+	sigs := map[string]signature{}
+	for _, line := range splitList(out.String()) {
+		parts := strings.Split(line, "|")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("unexpected line in git log output: %q", line)
+		}
+		sigs[parts[0]] = signature{key: parts[1], fingerprint: parts[2], status: parts[3]}
+	}
+	return sigs, nil
+}
+
 func splitLog(s string) ([]Commit, error) {
 	lines := splitList(s)
 	commits := make([]Commit, len(lines))
 	for i, m := range lines {
-		parts := strings.SplitN(m, "|", 3)
-		commits[i].SigningKey = parts[0]
-		commits[i].Revision = parts[1]
-		commits[i].Message = parts[2]
+		commit, err := parseLogLine(m)
+		if err != nil {
+			return nil, err
+		}
+		commits[i] = commit
 	}
 	return commits, nil
 }
 
+func parseLogLine(m string) (Commit, error) {
+	parts := strings.SplitN(m, "|", 12)
+	if len(parts) != 12 {
+		return Commit{}, fmt.Errorf("unexpected line in git log output: %q", m)
+	}
+	authorDate, err := time.Parse(time.RFC3339, parts[5])
+	if err != nil {
+		return Commit{}, errors.Wrap(err, "parsing author date of "+parts[3])
+	}
+	commitDate, err := time.Parse(time.RFC3339, parts[6])
+	if err != nil {
+		return Commit{}, errors.Wrap(err, "parsing commit date of "+parts[3])
+	}
+	return Commit{
+		SigningKey:         parts[0],
+		SigningFingerprint: parts[1],
+		SignatureStatus:    parts[2],
+		Revision:           parts[3],
+		Parents:            strings.Fields(parts[4]),
+		AuthorDate:         authorDate,
+		CommitDate:         commitDate,
+		AuthorName:         parts[7],
+		AuthorEmail:        parts[8],
+		CommitterName:      parts[9],
+		CommitterEmail:     parts[10],
+		Message:            parts[11],
+	}, nil
+}
+
 func splitList(s string) []string {
 	outStr := strings.TrimSpace(s)
 	if outStr == "" {
@@ -242,34 +1749,197 @@ func splitList(s string) []string {
 	return strings.Split(outStr, "\n")
 }
 
+// tagMessage gives the first line of the message of an annotated
+// tag; for a lightweight tag, it's that of the commit.
+func tagMessage(ctx context.Context, gexec gitExec, workingDir, tag string) (string, error) {
+	out := &bytes.Buffer{}
+	args := []string{"for-each-ref", "--format=%(contents:subject)", "refs/tags/" + tag}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return "", errors.Wrap(err, "reading message of tag "+tag)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// readTag gives the tag named, and its signature, if it has one.
+func readTag(ctx context.Context, gexec gitExec, workingDir, name string) (Tag, string, error) {
+	out := &bytes.Buffer{}
+	// The message can have anything but NULs in it, so those
+	// separate the fields.
+	format := strings.Join([]string{
+		"%(refname:strip=2)", "%(objectname)", "%(*objectname)", "%(creatordate:iso-strict)",
+		"%(taggername)", "%(taggeremail)", "%(contents:signature)", "%(contents)",
+	}, "%00")
+	args := []string{"for-each-ref", "--format=" + format, "refs/tags/" + name}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return Tag{}, "", errors.Wrap(err, "reading tag "+name)
+	}
+	// A pattern also matches the refs under it, e.g., refs/tags/a/b
+	// for a; those aren't the tag asked for.
+	fields := strings.SplitN(out.String(), "\x00", 8)
+	if len(fields) != 8 || fields[0] != name {
+		return Tag{}, "", RefNotFoundError{Ref: "refs/tags/" + name}
+	}
+	date, err := time.Parse(time.RFC3339, fields[3])
+	if err != nil {
+		return Tag{}, "", errors.Wrapf(err, "parsing date of tag %s", name)
+	}
+	rev := fields[2]
+	if rev == "" {
+		rev = fields[1]
+	}
+	signature := fields[6]
+	return Tag{
+		Name:        name,
+		Revision:    rev,
+		Date:        date,
+		TaggerName:  fields[4],
+		TaggerEmail: strings.TrimSuffix(strings.TrimPrefix(fields[5], "<"), ">"),
+		Message:     strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(fields[7], "\n"), signature)),
+	}, signature, nil
+}
+
+// verifyTagSignature checks the signature of the tag named, giving
+// the long ID and the fingerprint of the key that made it, from the
+// status lines gpg gives with `--raw`.
+func verifyTagSignature(ctx context.Context, gexec gitExec, workingDir, name string, env []string) (key, fingerprint string, err error) {
+	errOut := &bytes.Buffer{}
+	args := []string{"verify-tag", "--raw", "refs/tags/" + name}
+	err = execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env, errOut: errOut})
+	var status string
+	for _, line := range strings.Split(errOut.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "GOODSIG":
+			key = fields[2]
+		case "VALIDSIG":
+			fingerprint = fields[2]
+		case "BADSIG", "ERRSIG", "EXPSIG", "EXPKEYSIG", "REVKEYSIG":
+			status = fields[1]
+		}
+	}
+	if err != nil {
+		if status != "" {
+			return "", "", UnverifiedTagError{Tag: name, Status: status}
+		}
+		return "", "", errors.Wrap(err, "verifying tag "+name)
+	}
+	return key, fingerprint, nil
+}
+
+// listTags gives the tags matching the pattern given, or all tags if
+// it's empty, most recently made first.
+func listTags(ctx context.Context, gexec gitExec, workingDir, pattern string) ([]Tag, error) {
+	out := &bytes.Buffer{}
+	// Tag names can't have spaces in them, so it's safe to use them
+	// to separate fields.
+	args := []string{"tag", "--list", "--sort=-creatordate",
+		"--format=%(refname:strip=2) %(objectname) %(*objectname) %(creatordate:iso-strict)"}
+	if pattern != "" {
+		args = append(args, "--", pattern)
+	}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return nil, errors.Wrap(err, "listing tags")
+	}
+	lines := splitList(out.String())
+	tags := make([]Tag, len(lines))
+	for i, line := range lines {
+		fields := strings.Split(line, " ")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected output from git tag: %q", line)
+		}
+		date, err := time.Parse(time.RFC3339, fields[3])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing date of tag %s", fields[0])
+		}
+		// An annotated tag is peeled to the commit it tags; a
+		// lightweight tag refers to the commit directly.
+		rev := fields[2]
+		if rev == "" {
+			rev = fields[1]
+		}
+		tags[i] = Tag{Name: fields[0], Revision: rev, Date: date}
+	}
+	return tags, nil
+}
+
+// deleteTags deletes the tags given from the upstream, then locally.
+// Deleting a tag that's not there is not an error in either case.
+func deleteTags(ctx context.Context, gexec gitExec, workingDir, upstream string, tags []string, env []string) error {
+	args := []string{"push", upstream}
+	var deletes bytes.Buffer
+	for _, tag := range tags {
+		args = append(args, ":refs/tags/"+tag)
+		fmt.Fprintf(&deletes, "delete refs/tags/%s\n", tag)
+	}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "deleting tags upstream")
+	}
+	args = []string{"update-ref", "--stdin"}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, in: &deletes}); err != nil {
+		return errors.Wrap(err, "deleting tags")
+	}
+	return nil
+}
+
 // Move the tag to the ref given and push that tag upstream
-func moveTagAndPush(ctx context.Context, workingDir, tag, upstream string, tagAction TagAction) error {
-	args := []string{"tag", "--force", "-a", "-m", tagAction.Message}
-	var env []string
+func moveTagAndPush(ctx context.Context, gexec gitExec, workingDir, tag, upstream string, tagAction TagAction, env []string) error {
+	if err := moveTag(ctx, gexec, workingDir, tag, tagAction, env); err != nil {
+		return err
+	}
+	args := []string{"push", "--force", upstream, "tag", tag}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "pushing tag to origin")
+	}
+	return nil
+}
+
+// moveTag makes an annotated tag, or moves it if it exists already,
+// without pushing it.
+func moveTag(ctx context.Context, gexec gitExec, workingDir, tag string, tagAction TagAction, env []string) error {
+	gpgArgs, gpgEnv, err := gpgPassphraseArgs(tagAction.SigningKey, tagAction.GPGPassphrase, env)
+	if err != nil {
+		return err
+	}
+	args := append(gpgArgs, "tag", "--force", "-a", "-m", tagAction.Message)
 	if tagAction.SigningKey != "" {
-		args = append(args, fmt.Sprintf("--local-user=%s", tagAction.SigningKey))
+		args = append(args, "--sign", fmt.Sprintf("--local-user=%s", tagAction.SigningKey))
 	}
 	args = append(args, tag, tagAction.Revision)
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, env: env}); err != nil {
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: append(gpgEnv, env...)}); err != nil {
 		return errors.Wrap(err, "moving tag "+tag)
 	}
-	args = []string{"push", "--force", upstream, "tag", tag}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}); err != nil {
-		return errors.Wrap(err, "pushing tag to origin")
-	}
 	return nil
 }
 
-func verifyTag(ctx context.Context, workingDir, tag string) error {
-	var env []string
+func verifyTag(ctx context.Context, gexec gitExec, workingDir, tag string, env []string) error {
 	args := []string{"verify-tag", tag}
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, env: env}); err != nil {
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
 		return errors.Wrap(err, "verifying tag "+tag)
 	}
 	return nil
 }
 
-func changed(ctx context.Context, workingDir, ref string, subPaths []string) ([]string, error) {
+func verifyCommit(ctx context.Context, gexec gitExec, workingDir, rev string, env []string) error {
+	args := []string{"verify-commit", rev}
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, env: env}); err != nil {
+		return errors.Wrap(err, "verifying commit "+rev)
+	}
+	return nil
+}
+
+// gpgEnv gives the environment entries needed to point gpg at the
+// keyring directory given, if any.
+func gpgEnv(gpgHome string) []string {
+	if gpgHome == "" {
+		return nil
+	}
+	return []string{"GNUPGHOME=" + gpgHome}
+}
+
+func changed(ctx context.Context, gexec gitExec, workingDir, ref string, subPaths []string) ([]string, error) {
 	out := &bytes.Buffer{}
 	// This uses --diff-filter to only look at changes for file _in
 	// the working dir_; i.e, we do not report on things that no
@@ -280,7 +1950,7 @@ func changed(ctx context.Context, workingDir, ref string, subPaths []string) ([]
 		args = append(args, subPaths...)
 	}
 
-	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, out: out}); err != nil {
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
 		return nil, err
 	}
 	return splitList(out.String()), nil
@@ -311,24 +1981,32 @@ func traceGitCommand(args []string, config gitCmdConfig, stdout string, stderr s
 		out,
 		err,
 		config.dir,
-		strings.Join(config.env, ","),
+		redactSecrets(strings.Join(config.env, ","), config.env),
 	)
 }
 
 // execGitCmd runs a `git` command with the supplied arguments.
 func execGitCmd(ctx context.Context, args []string, config gitCmdConfig) error {
-	c := exec.CommandContext(ctx, "git", args...)
+	// Not exec.CommandContext, since that would only kill git itself
+	// and not the processes it starts.
+	gexec := config.exec
+	c := exec.Command(gexec.executable(), args...)
+	setProcessGroup(c)
 
 	if config.dir != "" {
 		c.Dir = config.dir
 	}
-	c.Env = append(env(), config.env...)
+	c.Env = append(append(env(), gexec.env...), config.env...)
+	c.Stdin = config.in
 	c.Stdout = ioutil.Discard
 	if config.out != nil {
 		c.Stdout = config.out
 	}
 	errOut := &bytes.Buffer{}
 	c.Stderr = errOut
+	if config.errOut != nil {
+		c.Stderr = io.MultiWriter(errOut, config.errOut)
+	}
 
 	traceStdout := &bytes.Buffer{}
 	traceStderr := &bytes.Buffer{}
@@ -337,12 +2015,25 @@ func execGitCmd(ctx context.Context, args []string, config gitCmdConfig) error {
 		c.Stderr = io.MultiWriter(c.Stderr, traceStderr)
 	}
 
-	err := c.Run()
+	start := time.Now()
+	err := c.Start()
+	if err == nil {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				killProcessGroup(c)
+			case <-done:
+			}
+		}()
+		err = c.Wait()
+		close(done)
+	}
 	if err != nil {
-		msg := findErrorMessage(errOut)
-		if msg != "" {
-			err = errors.New(msg)
-		}
+		err = classifyError(args, errOut.String(), err, config.env)
+	}
+	if gexec.logger != nil {
+		logCommand(ctx, gexec.logger, args, config.dir, append(append([]string{}, gexec.env...), config.env...), time.Since(start), err)
 	}
 
 	if trace {
@@ -352,7 +2043,7 @@ func execGitCmd(ctx context.Context, args []string, config gitCmdConfig) error {
 	}
 
 	if ctx.Err() == context.DeadlineExceeded {
-		return errors.Wrap(ctx.Err(), fmt.Sprintf("running git command: %s %v", "git", args))
+		return TimeoutError{Args: args}
 	} else if ctx.Err() == context.Canceled {
 		return errors.Wrap(ctx.Err(), fmt.Sprintf("context was unexpectedly cancelled when running git command: %s %v", "git", args))
 	}
@@ -372,15 +2063,23 @@ func env() []string {
 	return env
 }
 
-// check returns true if there are changes locally.
-func check(ctx context.Context, workingDir string, subdirs []string) bool {
-	// `--quiet` means "exit with 1 if there are changes"
-	args := []string{"diff", "--quiet"}
+// check returns true if there are changes locally that would be
+// staged according to the mode given.
+func check(ctx context.Context, gexec gitExec, workingDir string, subdirs []string, mode StageMode) bool {
+	untracked := "all"
+	if mode == StageTracked {
+		untracked = "no"
+	}
+	out := &bytes.Buffer{}
+	args := []string{"status", "--porcelain", "--untracked-files=" + untracked}
 	args = append(args, "--")
 	if len(subdirs) > 0 {
 		args = append(args, subdirs...)
 	}
-	return execGitCmd(ctx, args, gitCmdConfig{dir: workingDir}) != nil
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: workingDir, exec: gexec, out: out}); err != nil {
+		return true // let committing, if it's attempted, report the problem
+	}
+	return out.Len() > 0
 }
 
 func findErrorMessage(output io.Reader) string {
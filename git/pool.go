@@ -0,0 +1,167 @@
+package git
+
+import (
+	"context"
+	"sync"
+)
+
+// CheckoutPool hands out working clones of a Repo, reusing them
+// rather than cloning afresh each time. A checkout obtained from the
+// pool is returned to it by calling `Clean()` on the checkout.
+//
+// Before it is handed out again, a checkout is brought up to date
+// with the repo and any local changes are thrown away, so it is as
+// though it were a new clone.
+type CheckoutPool struct {
+	repo   *Repo
+	config Config
+
+	// a slot is taken from here for every checkout that's live, so
+	// there are at most cap(slots) checkouts at once
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*Checkout
+	closed bool
+}
+
+// NewCheckoutPool creates a pool of checkouts of the repo given,
+// using the config given, with at most `max` checkouts at any time.
+func NewCheckoutPool(repo *Repo, conf Config, max int) *CheckoutPool {
+	if max < 1 {
+		max = 1
+	}
+	return &CheckoutPool{
+		repo:   repo,
+		config: conf,
+		slots:  make(chan struct{}, max),
+	}
+}
+
+// Get returns a checkout from the pool, or a fresh clone if there
+// are no idle checkouts. If the pool is at capacity, it blocks until
+// a checkout is returned, or the context is done.
+func (p *CheckoutPool) Get(ctx context.Context) (*Checkout, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	p.mu.Lock()
+	var c *Checkout
+	if n := len(p.idle); n > 0 {
+		c, p.idle = p.idle[n-1], p.idle[:n-1]
+		c.idle = false
+	}
+	p.mu.Unlock()
+
+	if c != nil {
+		// Whoever had it last may have changed its config (e.g., with
+		// SetSparsePaths), so restore that of the pool.
+		c.config = p.config
+		c.queued = nil
+		c.pending = nil
+		if err := p.repo.refreshCheckout(ctx, c); err == nil {
+			return c, nil
+		}
+		// If it can't be refreshed, it's no use to anyone; fall
+		// through to making a new one.
+		c.remove()
+	}
+
+	c, err := p.repo.Clone(ctx, p.config)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	c.pool = p
+	return c, nil
+}
+
+func (p *CheckoutPool) put(c *Checkout) {
+	p.mu.Lock()
+	if c.idle {
+		// already returned
+		p.mu.Unlock()
+		return
+	}
+	if p.closed {
+		c.remove()
+	} else {
+		c.idle = true
+		p.idle = append(p.idle, c)
+	}
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// Close removes all the idle checkouts in the pool; any checkouts
+// still in use will be removed when they are returned.
+func (p *CheckoutPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, c := range p.idle {
+		c.remove()
+	}
+	p.idle = nil
+}
+
+// refreshCheckout brings a checkout up to date with the repo,
+// discarding any local changes.
+func (r *Repo) refreshCheckout(ctx context.Context, c *Checkout) error {
+	unlock, err := r.rlock(ctx, "CheckoutPool.Get")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+
+	trackingRef := c.trackingRef(c.config.Branch)
+	refspecs := []string{"+refs/tags/*:refs/tags/*"}
+	for _, b := range c.branches {
+		refspecs = append(refspecs, "+refs/heads/"+b+":"+c.trackingRef(b))
+	}
+	refspecs = append(refspecs, c.notesRefspecs()...)
+	fetchCtx, cancel := withTimeout(ctx, c.config.FetchTimeout)
+	err = fetchExisting(fetchCtx, c.exec, c.dir, r.dir, nil, refspecs...)
+	cancel()
+	if err != nil {
+		return err
+	}
+	// The checkout may have been switched to another of its
+	// branches; put it back on the configured branch.
+	current, err := currentBranch(ctx, c.exec, c.dir)
+	if err != nil {
+		return err
+	}
+	if current != "HEAD" && current != c.config.Branch {
+		if err := resetHard(ctx, c.exec, c.dir, "HEAD"); err != nil {
+			return err
+		}
+		if err := checkoutBranchAt(ctx, c.exec, c.dir, c.config.Branch, trackingRef); err != nil {
+			return err
+		}
+	}
+	if err := c.ensureOnBranch(ctx); err != nil {
+		return err
+	}
+	if err := resetHard(ctx, c.exec, c.dir, trackingRef); err != nil {
+		return err
+	}
+	if len(c.config.SparsePaths) > 0 {
+		if err := c.SetSparsePaths(ctx, c.config.SparsePaths); err != nil {
+			return err
+		}
+	}
+	if err := c.updateSubmodules(ctx); err != nil {
+		return err
+	}
+	if c.config.EnableLFS {
+		return c.lfsPull(ctx)
+	}
+	return nil
+}
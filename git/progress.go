@@ -0,0 +1,110 @@
+package git
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress is how far along git is with a stage of fetching or
+// cloning, from what it prints with --progress; e.g., "Receiving
+// objects: 45% (12150/27000)".
+type Progress struct {
+	Op      Operation // OpClone, or OpFetch
+	Stage   string    // as git gives it, e.g., "Receiving objects"
+	Remote  bool      // whether it's the upstream's progress, e.g., counting objects, or git's own
+	Percent int
+	Done    int64
+	Total   int64
+	Elapsed time.Duration // since git started
+}
+
+// ProgressFunc is given the progress of the repo's clone of its
+// upstream, and of each fetch from it, as git reports it. As an
+// Option, it's used for the repo; as Config.ProgressFunc, for cloning
+// checkouts. It may be called from more than one goroutine at once,
+// since some fetches are done concurrently, and it should return
+// quickly, since git waits on it.
+type ProgressFunc func(Progress)
+
+func (f ProgressFunc) apply(r *Repo) {
+	r.progress = f
+}
+
+// progressPattern matches a line of progress from git, which is
+// either a stage with a count and a percentage, possibly followed by
+// the amount transferred and the rate, or (which isn't matched) a
+// stage with only a count, e.g., "remote: Enumerating objects: 27,
+// done."
+var progressPattern = regexp.MustCompile(`^(remote: )?([A-Za-z][A-Za-z ]*):\s+(\d+)% \((\d+)/(\d+)\)`)
+
+// parseProgress parses a line of progress from git, giving false if
+// it isn't one.
+func parseProgress(line string) (Progress, bool) {
+	// The upstream's lines may end with an escape to clear the
+	// rest of the terminal line, or with spaces to overwrite it.
+	line = strings.TrimRight(strings.TrimSuffix(strings.TrimRight(line, " "), "\x1b[K"), " ")
+	m := progressPattern.FindStringSubmatch(line)
+	if m == nil {
+		return Progress{}, false
+	}
+	percent, _ := strconv.Atoi(m[3])
+	done, _ := strconv.ParseInt(m[4], 10, 64)
+	total, _ := strconv.ParseInt(m[5], 10, 64)
+	return Progress{
+		Stage:   m[2],
+		Remote:  m[1] != "",
+		Percent: percent,
+		Done:    done,
+		Total:   total,
+	}, true
+}
+
+// progressWriter takes what git prints to stderr, and gives each line
+// of progress in it to a ProgressFunc. git ends a line with a
+// carriage return when it will overwrite it with the next, so either
+// that or a newline ends a line.
+type progressWriter struct {
+	op    Operation
+	fn    ProgressFunc
+	start time.Time
+
+	mu   sync.Mutex
+	line []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			w.line = append(w.line, p...)
+			break
+		}
+		w.line = append(w.line, p[:i]...)
+		if progress, ok := parseProgress(string(w.line)); ok {
+			progress.Op = w.op
+			progress.Elapsed = time.Since(w.start)
+			w.fn(progress)
+		}
+		w.line = w.line[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// progressArgs gives the arguments for git to report progress (which
+// it otherwise only does to a terminal), and a writer for its stderr
+// to go to, if there's a ProgressFunc; otherwise, neither.
+func progressArgs(op Operation, fn ProgressFunc) ([]string, io.Writer) {
+	if fn == nil {
+		return nil, nil
+	}
+	return []string{"--progress"}, &progressWriter{op: op, fn: fn, start: time.Now()}
+}
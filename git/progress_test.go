@@ -0,0 +1,41 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var got []Progress
+	w := &progressWriter{op: OpClone, fn: func(p Progress) {
+		p.Elapsed = 0
+		got = append(got, p)
+	}}
+	// As git prints it, written in pieces that don't line up with
+	// the lines
+	for _, s := range []string{
+		"Cloning into bare repository 'repo'...\n",
+		"remote: Enumerating objects: 27, done.\n",
+		"remote: Counting objects:  50% (1/2)\x1b[K\rremote: Counting objects: 100% (2/2), done.\x1b[K\n",
+		"Receiving objects:  44% (12",
+		"000/27000), 1.20 MiB | 2.40 MiB/s   \r",
+		"Receiving objects: 100% (27000/27000), 2.71 MiB | 2.40 MiB/s, done.\n",
+		"Resolving deltas: 100% (5/5), done.\n",
+		"Receiving objects:  99% (1/1)", // not finished, so not reported
+	} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []Progress{
+		{Op: OpClone, Stage: "Counting objects", Remote: true, Percent: 50, Done: 1, Total: 2},
+		{Op: OpClone, Stage: "Counting objects", Remote: true, Percent: 100, Done: 2, Total: 2},
+		{Op: OpClone, Stage: "Receiving objects", Percent: 44, Done: 12000, Total: 27000},
+		{Op: OpClone, Stage: "Receiving objects", Percent: 100, Done: 27000, Total: 27000},
+		{Op: OpClone, Stage: "Resolving deltas", Percent: 100, Done: 5, Total: 5},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
@@ -0,0 +1,74 @@
+package pullrequest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const gitHubAPI = "https://api.github.com"
+
+// GitHub opens pull requests using the GitHub REST API.
+type GitHub struct {
+	Token   string // an access token that can write to the repo
+	Repo    string // as "owner/name"
+	BaseURL string // for GitHub Enterprise; if empty, api.github.com is used
+	Client  *http.Client
+}
+
+type gitHubPull struct {
+	Number  int    `json:"number,omitempty"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Head    string `json:"head,omitempty"`
+	Base    string `json:"base,omitempty"`
+	HTMLURL string `json:"html_url,omitempty"`
+}
+
+// OpenPR opens a pull request from the branch `head` into `base`,
+// returning its URL. If there's already an open pull request for
+// those branches, its title and body are updated instead.
+func (g *GitHub) OpenPR(ctx context.Context, base, head, title, body string) (string, error) {
+	pullsURL := g.api() + "/repos/" + g.Repo + "/pulls"
+	owner := strings.SplitN(g.Repo, "/", 2)[0]
+
+	var open []gitHubPull
+	query := url.Values{
+		"state": {"open"},
+		"head":  {owner + ":" + head},
+		"base":  {base},
+	}
+	if err := doJSON(ctx, g.Client, "GET", pullsURL+"?"+query.Encode(), g.header(), nil, &open); err != nil {
+		return "", err
+	}
+
+	var result gitHubPull
+	if len(open) > 0 {
+		update := gitHubPull{Title: title, Body: body}
+		if err := doJSON(ctx, g.Client, "PATCH", fmt.Sprintf("%s/%d", pullsURL, open[0].Number), g.header(), update, &result); err != nil {
+			return "", err
+		}
+		return result.HTMLURL, nil
+	}
+	create := gitHubPull{Title: title, Body: body, Head: head, Base: base}
+	if err := doJSON(ctx, g.Client, "POST", pullsURL, g.header(), create, &result); err != nil {
+		return "", err
+	}
+	return result.HTMLURL, nil
+}
+
+func (g *GitHub) api() string {
+	if g.BaseURL == "" {
+		return gitHubAPI
+	}
+	return strings.TrimSuffix(g.BaseURL, "/")
+}
+
+func (g *GitHub) header() http.Header {
+	return http.Header{
+		"Authorization": {"token " + g.Token},
+		"Accept":        {"application/vnd.github.v3+json"},
+	}
+}
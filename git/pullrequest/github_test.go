@@ -0,0 +1,87 @@
+package pullrequest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeGitHub keeps pull requests in memory, for the API calls used by
+// GitHub.OpenPR.
+func fakeGitHub(t *testing.T, pulls map[int]*gitHubPull) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/repos/owner/repo/pulls":
+			if r.URL.Query().Get("state") != "open" {
+				t.Errorf("expected to ask for open pull requests, got %q", r.URL.RawQuery)
+			}
+			open := []gitHubPull{}
+			for _, p := range pulls {
+				if "owner:"+p.Head == r.URL.Query().Get("head") && p.Base == r.URL.Query().Get("base") {
+					open = append(open, *p)
+				}
+			}
+			json.NewEncoder(w).Encode(open)
+		case r.Method == "POST" && r.URL.Path == "/repos/owner/repo/pulls":
+			var p gitHubPull
+			json.NewDecoder(r.Body).Decode(&p)
+			p.Number = len(pulls) + 1
+			p.HTMLURL = fmt.Sprintf("https://github.com/owner/repo/pull/%d", p.Number)
+			pulls[p.Number] = &p
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(p)
+		case r.Method == "PATCH":
+			var number int
+			if _, err := fmt.Sscanf(r.URL.Path, "/repos/owner/repo/pulls/%d", &number); err != nil || pulls[number] == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var update gitHubPull
+			json.NewDecoder(r.Body).Decode(&update)
+			pulls[number].Title, pulls[number].Body = update.Title, update.Body
+			json.NewEncoder(w).Encode(pulls[number])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestGitHubOpenPR(t *testing.T) {
+	pulls := map[int]*gitHubPull{}
+	server := fakeGitHub(t, pulls)
+	defer server.Close()
+
+	g := &GitHub{Token: "s3cr3t", Repo: "owner/repo", BaseURL: server.URL}
+	ctx := context.Background()
+
+	prURL, err := g.OpenPR(ctx, "master", "flux-auto", "Update images", "First")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prURL != "https://github.com/owner/repo/pull/1" {
+		t.Errorf("unexpected URL for new pull request: %s", prURL)
+	}
+
+	prURL, err = g.OpenPR(ctx, "master", "flux-auto", "Update more images", "Second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prURL != "https://github.com/owner/repo/pull/1" {
+		t.Errorf("expected existing pull request to be updated, got URL %s", prURL)
+	}
+	if len(pulls) != 1 || pulls[1].Title != "Update more images" || pulls[1].Body != "Second" {
+		t.Errorf("expected a single, updated pull request, got %+v", pulls)
+	}
+
+	g.Token = "wrong"
+	if _, err := g.OpenPR(ctx, "master", "flux-auto", "Nope", ""); err == nil {
+		t.Error("expected error with a bad token")
+	}
+}
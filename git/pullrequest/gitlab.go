@@ -0,0 +1,70 @@
+package pullrequest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const gitLabAPI = "https://gitlab.com/api/v4"
+
+// GitLab opens merge requests using the GitLab REST API.
+type GitLab struct {
+	Token   string // a personal or project access token with API scope
+	Project string // as "group/name", or the numeric project ID
+	BaseURL string // for self-hosted GitLab, e.g., https://gitlab.example.com/api/v4; if empty, gitlab.com is used
+	Client  *http.Client
+}
+
+type gitLabMergeRequest struct {
+	IID          int    `json:"iid,omitempty"`
+	Title        string `json:"title"`
+	Description  string `json:"description"`
+	SourceBranch string `json:"source_branch,omitempty"`
+	TargetBranch string `json:"target_branch,omitempty"`
+	WebURL       string `json:"web_url,omitempty"`
+}
+
+// OpenPR opens a merge request from the branch `head` into `base`,
+// returning its URL. If there's already an open merge request for
+// those branches, its title and description are updated instead.
+func (g *GitLab) OpenPR(ctx context.Context, base, head, title, body string) (string, error) {
+	mrsURL := g.api() + "/projects/" + url.PathEscape(g.Project) + "/merge_requests"
+
+	var open []gitLabMergeRequest
+	query := url.Values{
+		"state":         {"opened"},
+		"source_branch": {head},
+		"target_branch": {base},
+	}
+	if err := doJSON(ctx, g.Client, "GET", mrsURL+"?"+query.Encode(), g.header(), nil, &open); err != nil {
+		return "", err
+	}
+
+	var result gitLabMergeRequest
+	if len(open) > 0 {
+		update := gitLabMergeRequest{Title: title, Description: body}
+		if err := doJSON(ctx, g.Client, "PUT", fmt.Sprintf("%s/%d", mrsURL, open[0].IID), g.header(), update, &result); err != nil {
+			return "", err
+		}
+		return result.WebURL, nil
+	}
+	create := gitLabMergeRequest{Title: title, Description: body, SourceBranch: head, TargetBranch: base}
+	if err := doJSON(ctx, g.Client, "POST", mrsURL, g.header(), create, &result); err != nil {
+		return "", err
+	}
+	return result.WebURL, nil
+}
+
+func (g *GitLab) api() string {
+	if g.BaseURL == "" {
+		return gitLabAPI
+	}
+	return strings.TrimSuffix(g.BaseURL, "/")
+}
+
+func (g *GitLab) header() http.Header {
+	return http.Header{"Private-Token": {g.Token}}
+}
@@ -0,0 +1,92 @@
+package pullrequest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeGitLab keeps merge requests in memory, for the API calls used
+// by GitLab.OpenPR.
+func fakeGitLab(t *testing.T, mrs map[int]*gitLabMergeRequest) *httptest.Server {
+	const mrsPath = "/api/v4/projects/group%2Fproject/merge_requests"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := r.URL.EscapedPath()
+		switch {
+		case r.Method == "GET" && path == mrsPath:
+			q := r.URL.Query()
+			if q.Get("state") != "opened" {
+				t.Errorf("expected to ask for open merge requests, got %q", r.URL.RawQuery)
+			}
+			open := []gitLabMergeRequest{}
+			for _, mr := range mrs {
+				if mr.SourceBranch == q.Get("source_branch") && mr.TargetBranch == q.Get("target_branch") {
+					open = append(open, *mr)
+				}
+			}
+			json.NewEncoder(w).Encode(open)
+		case r.Method == "POST" && path == mrsPath:
+			var mr gitLabMergeRequest
+			json.NewDecoder(r.Body).Decode(&mr)
+			mr.IID = len(mrs) + 1
+			mr.WebURL = fmt.Sprintf("https://gitlab.com/group/project/merge_requests/%d", mr.IID)
+			mrs[mr.IID] = &mr
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(mr)
+		case r.Method == "PUT":
+			iid, err := strconv.Atoi(strings.TrimPrefix(path, mrsPath+"/"))
+			if err != nil || mrs[iid] == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var update gitLabMergeRequest
+			json.NewDecoder(r.Body).Decode(&update)
+			mrs[iid].Title, mrs[iid].Description = update.Title, update.Description
+			json.NewEncoder(w).Encode(mrs[iid])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestGitLabOpenPR(t *testing.T) {
+	mrs := map[int]*gitLabMergeRequest{}
+	server := fakeGitLab(t, mrs)
+	defer server.Close()
+
+	g := &GitLab{Token: "s3cr3t", Project: "group/project", BaseURL: server.URL + "/api/v4"}
+	ctx := context.Background()
+
+	mrURL, err := g.OpenPR(ctx, "master", "flux-auto", "Update images", "First")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mrURL != "https://gitlab.com/group/project/merge_requests/1" {
+		t.Errorf("unexpected URL for new merge request: %s", mrURL)
+	}
+
+	mrURL, err = g.OpenPR(ctx, "master", "flux-auto", "Update more images", "Second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mrURL != "https://gitlab.com/group/project/merge_requests/1" {
+		t.Errorf("expected existing merge request to be updated, got URL %s", mrURL)
+	}
+	if len(mrs) != 1 || mrs[1].Title != "Update more images" || mrs[1].Description != "Second" {
+		t.Errorf("expected a single, updated merge request, got %+v", mrs)
+	}
+
+	g.Token = "wrong"
+	if _, err := g.OpenPR(ctx, "master", "flux-auto", "Nope", ""); err == nil {
+		t.Error("expected error with a bad token")
+	}
+}
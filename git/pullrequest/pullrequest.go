@@ -0,0 +1,53 @@
+// Package pullrequest has implementations of git.PRCreator for
+// hosted git services.
+package pullrequest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// doJSON makes a request with the value `in` (if not nil) as the JSON
+// body, and decodes the JSON response into `out` (if not nil).
+func doJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		bs, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(bs)
+	}
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		request.Header[k] = vs
+	}
+	if in != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s %s: unexpected status %s: %s", method, url, response.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
@@ -1,9 +1,11 @@
 package git
 
 import (
+	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"os"
+	"fmt"
+	"io"
+	"math/rand"
 	"sync"
 
 	"context"
@@ -22,8 +24,44 @@ var (
 	ErrNoConfig   = errors.New("git repo does not have valid config")
 	ErrNotCloned  = errors.New("git repo has not been cloned yet")
 	ErrClonedOnly = errors.New("git repo has been cloned but not yet checked for write access")
+
+	// ErrAtomicPushUnsupported is given to Config.Warn when refs that
+	// should have been pushed together atomically were pushed one
+	// after the other, since the upstream can't do atomic pushes.
+	ErrAtomicPushUnsupported = errors.New("git upstream does not support atomic pushes, so refs were pushed separately")
+
+	// ErrInsecureTLS is the warning given for InsecureSkipTLSVerify,
+	// to the Repo's logger, or Config.Warn for a checkout.
+	ErrInsecureTLS = errors.New("TLS certificate verification of the git upstream is turned off")
+
+	// ErrNoArchivePaths is returned by Archive when it's given no
+	// paths to limit the archive to.
+	ErrNoArchivePaths = errors.New("no paths given to archive")
 )
 
+// UnverifiedCommitError is returned when a commit walked with
+// VerifySignatures in effect does not have a valid signature.
+type UnverifiedCommitError struct {
+	Revision string
+	Status   string
+}
+
+func (err UnverifiedCommitError) Error() string {
+	return fmt.Sprintf("commit %s does not have a valid GPG signature (status %q)", err.Revision, err.Status)
+}
+
+// UnverifiedTagError is returned by ReadTag for a signed tag whose
+// signature doesn't check out; Status is the gpg status given for
+// it, e.g., BADSIG, or ERRSIG if the key isn't in the keyring.
+type UnverifiedTagError struct {
+	Tag    string
+	Status string
+}
+
+func (err UnverifiedTagError) Error() string {
+	return fmt.Sprintf("tag %s does not have a valid GPG signature (status %q)", err.Tag, err.Status)
+}
+
 type NotReadyError struct {
 	underlying error
 }
@@ -51,11 +89,32 @@ type Repo struct {
 	timeout  time.Duration
 	readonly bool
 
+	verifySignatures bool
+	gpgHome          string
+	transport        transport
+	observer         Observer
+	gcEvery          int
+	backoff          Backoff
+	maxBytes         int64
+	cacheDir         string
+	progress         ProgressFunc
+	exec             gitExec
+	signatures       *signatureCache
+	gitConfig        map[string]string // from SetConfig; guarded by mu
+
 	// State
-	mu     sync.RWMutex
-	status GitRepoStatus
-	err    error
-	dir    string
+	mu          repoLock
+	lockTimeout time.Duration
+	status      GitRepoStatus
+	err         error
+	dir         string
+
+	notesMu    sync.Mutex // serialises FetchNotes, which only needs a read lock of mu
+	worktreeMu sync.Mutex // serialises adding and removing worktrees, which git doesn't do safely at once
+	mirrorMu   sync.Mutex // serialises MirrorTo, which only needs a read lock of mu
+	tagsMu     sync.Mutex // serialises pushing tags, from DeleteTags and from checkouts
+	refreshMu  sync.Mutex // serialises Refresh and GC, so that fetching only needs a read lock of mu
+	refreshes  int        // since the last GC; guarded by refreshMu
 
 	notify chan struct{}
 	C      chan struct{}
@@ -87,6 +146,108 @@ var ReadOnly optionFunc = func(r *Repo) {
 	r.readonly = true
 }
 
+// VerifySignatures makes the repo check the GPG signature of every
+// commit returned from CommitsBefore and CommitsBetween.
+var VerifySignatures optionFunc = func(r *Repo) {
+	r.verifySignatures = true
+}
+
+// GPGHome is the keyring directory used to verify signatures. If not
+// given, the GNUPGHOME of the process is used.
+type GPGHome string
+
+func (g GPGHome) apply(r *Repo) {
+	r.gpgHome = string(g)
+}
+
+// SetGPGHome changes the keyring directory used to verify signatures,
+// e.g., when the keys have been written afresh somewhere else.
+// Signatures already checked with the old keyring are forgotten.
+func (r *Repo) SetGPGHome(gpgHome string) {
+	defer r.hold("SetGPGHome")()
+	r.gpgHome = gpgHome
+}
+
+// SSHKeyPath is the path to a private key to use when talking to the
+// upstream over SSH, rather than the default identity.
+type SSHKeyPath string
+
+func (k SSHKeyPath) apply(r *Repo) {
+	r.transport.sshKeyPath = string(k)
+}
+
+// GCEvery makes the repo garbage collect itself (as with `GC`) after
+// every so many refreshes. Zero, the default, means never.
+type GCEvery int
+
+func (n GCEvery) apply(r *Repo) {
+	r.gcEvery = int(n)
+}
+
+// Backoff controls how long the repo waits before trying again, when
+// it fails to get ready (e.g., because it can't clone the
+// upstream). The wait starts at Initial, and is multiplied by Factor
+// after each consecutive failure, up to Max. Each wait is then varied
+// at random by up to Jitter (a fraction of the wait), so that many
+// replicas don't all retry in step. Initial, Max or Factor left zero
+// (or given as less than makes sense: a wait of nothing, or a Factor
+// less than one) take the default; a Jitter of zero means none.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64
+}
+
+var defaultBackoff = Backoff{
+	Initial: 10 * time.Second,
+	Max:     5 * time.Minute,
+	Factor:  2,
+	Jitter:  0.2,
+}
+
+func (b Backoff) apply(r *Repo) {
+	if b.Initial <= 0 {
+		b.Initial = defaultBackoff.Initial
+	}
+	if b.Max <= 0 {
+		b.Max = defaultBackoff.Max
+	}
+	if b.Factor < 1 {
+		b.Factor = defaultBackoff.Factor
+	}
+	r.backoff = b
+}
+
+// wait gives the time to wait after the number of consecutive
+// failures given, counting from one.
+func (b Backoff) wait(failures int) time.Duration {
+	d := float64(b.Initial)
+	for i := 1; i < failures && b.Factor > 1; i++ {
+		d *= b.Factor
+		if b.Max > 0 && d > float64(b.Max) {
+			break
+		}
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	return time.Duration(d)
+}
+
+// MaxRepoBytes limits the size on disk of the mirror; if cloning the
+// upstream goes over this many bytes, the clone is abandoned, and
+// the repo is not ready (with a RepoTooLargeError). Zero, the
+// default, means no limit.
+type MaxRepoBytes int64
+
+func (n MaxRepoBytes) apply(r *Repo) {
+	r.maxBytes = int64(n)
+}
+
 // NewRepo constructs a repo mirror which will sync itself.
 func NewRepo(origin Remote, opts ...Option) *Repo {
 	status := RepoNew
@@ -98,64 +259,83 @@ func NewRepo(origin Remote, opts ...Option) *Repo {
 		status:   status,
 		interval: defaultInterval,
 		timeout:  defaultTimeout,
+		backoff:  defaultBackoff,
 		err:      ErrNotCloned,
 		notify:   make(chan struct{}, 1), // `1` so that Notify doesn't block
 		C:        make(chan struct{}, 1), // `1` so we don't block on completing a refresh
+
+		signatures: newSignatureCache(defaultSignatureCacheSize),
 	}
 	for _, opt := range opts {
 		opt.apply(r)
 	}
+	if r.transport.insecureTLS && r.exec.logger != nil {
+		r.exec.logger.Log("level", "warn", "err", ErrInsecureTLS)
+	}
+	if r.transport.controlPersist > 0 {
+		// If this fails, ssh just won't share connections
+		if dir, err := makeTempDir(sshControlPrefix); err == nil {
+			r.transport.controlDir = dir
+		}
+	}
 	return r
 }
 
 // Origin returns the Remote with which the Repo was constructed.
 func (r *Repo) Origin() Remote {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	defer r.rhold("Origin")()
 	return r.origin
 }
 
 // Dir returns the local directory into which the repo has been
 // cloned, if it has been cloned.
 func (r *Repo) Dir() string {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	defer r.rhold("Dir")()
 	return r.dir
 }
 
-// Clean removes the mirrored repo. Syncing may continue with a new
+// Clean removes the mirrored repo, and closes any shared SSH
+// connections (see SSHMultiplexing). Syncing may continue with a new
 // directory, so you may need to stop that first.
 func (r *Repo) Clean() {
-	r.mu.Lock()
+	unlock := r.hold("Clean")
 	if r.dir != "" {
-		os.RemoveAll(r.dir)
+		removeTempDir(r.dir)
+	}
+	if r.transport.controlDir != "" {
+		stopControlMasters(r.transport.controlDir)
 	}
 	r.dir = ""
 	r.status = RepoNew
-	r.mu.Unlock()
+	unlock()
 }
 
 // Status reports that readiness status of this Git repo: whether it
 // has been cloned and is writable, and if not, the error stopping it
 // getting to the next state.
 func (r *Repo) Status() (GitRepoStatus, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	defer r.rhold("Status")()
 	return r.status, r.err
 }
 
+// Err returns the error from the most recent attempt to get the repo
+// ready, or to refresh it once ready; it is nil if the repo is
+// ready.
+func (r *Repo) Err() error {
+	_, err := r.Status()
+	return err
+}
+
 func (r *Repo) setUnready(s GitRepoStatus, err error) {
-	r.mu.Lock()
+	defer r.hold("setUnready")()
 	r.status = s
 	r.err = err
-	r.mu.Unlock()
 }
 
 func (r *Repo) setReady() {
-	r.mu.Lock()
+	defer r.hold("setReady")()
 	r.status = RepoReady
 	r.err = nil
-	r.mu.Unlock()
 }
 
 // Notify tells the repo that it should fetch from the origin as soon
@@ -192,40 +372,610 @@ func (r *Repo) errorIfNotReady() error {
 
 // Revision returns the revision (SHA1) of the ref passed in
 func (r *Repo) Revision(ctx context.Context, ref string) (string, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	unlock, err := r.rlock(ctx, "Revision")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
 	if err := r.errorIfNotReady(); err != nil {
 		return "", err
 	}
-	return refRevision(ctx, r.dir, ref)
+	return refRevision(ctx, r.exec, r.dir, ref)
+}
+
+// ResolveRevision gives the commit (SHA1) that the ref given, e.g., a
+// branch, tag, or symbolic ref like HEAD, points at. If there's no
+// such ref, it returns a RefNotFoundError.
+func (r *Repo) ResolveRevision(ctx context.Context, ref string) (string, error) {
+	unlock, err := r.rlock(ctx, "ResolveRevision")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return "", err
+	}
+	return resolveRevision(ctx, r.exec, r.dir, ref)
+}
+
+// RefExists says whether the ref given exists, i.e., whether
+// ResolveRevision would find it.
+func (r *Repo) RefExists(ctx context.Context, ref string) (bool, error) {
+	_, err := r.ResolveRevision(ctx, ref)
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case RefNotFoundError:
+		return false, nil
+	default:
+		return false, err
+	}
 }
 
 func (r *Repo) CommitsBefore(ctx context.Context, ref string, paths ...string) ([]Commit, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	unlock, err := r.rlock(ctx, "CommitsBefore")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	if err := r.errorIfNotReady(); err != nil {
 		return nil, err
 	}
-	return onelinelog(ctx, r.dir, ref, paths)
+	return r.verifiedLog(ctx, ref, paths)
 }
 
-func (r *Repo) CommitsBetween(ctx context.Context, ref1, ref2 string, paths ...string) ([]Commit, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// CommitsSince returns the commits reachable from ref that were
+// committed at or after the time given (to the second), most recent
+// first. It's the committer date that counts, since that's when a
+// commit landed; the author date may be earlier or later. Commits
+// are compared by instant, so the time zones of the commits and of
+// since make no difference, and out-of-order dates (e.g., from clock
+// skew) don't hide newer commits behind older ones.
+func (r *Repo) CommitsSince(ctx context.Context, ref string, since time.Time, paths ...string) ([]Commit, error) {
+	unlock, err := r.rlock(ctx, "CommitsSince")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	if err := r.errorIfNotReady(); err != nil {
 		return nil, err
 	}
-	return onelinelog(ctx, r.dir, ref1+".."+ref2, paths)
+	ok, err := refExists(ctx, r.exec, r.dir, ref)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, RefNotFoundError{Ref: ref}
+	}
+	// Plain --since stops at the first commit older than the
+	// cutoff, so would miss any newer commits beyond it; this
+	// filters instead.
+	return r.verifiedLog(ctx, ref, paths, "--since-as-filter="+since.UTC().Format(time.RFC3339))
+}
+
+// CommitsBetween returns the commits reachable from `to` but not from
+// `from`, most recent first. Both refs must exist; if they are the
+// same, the result is empty.
+func (r *Repo) CommitsBetween(ctx context.Context, from, to string, paths ...string) ([]Commit, error) {
+	unlock, err := r.rlock(ctx, "CommitsBetween")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	for _, ref := range []string{from, to} {
+		ok, err := refExists(ctx, r.exec, r.dir, ref)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, RefNotFoundError{Ref: ref}
+		}
+	}
+	if from == to {
+		return []Commit{}, nil
+	}
+	return r.verifiedLog(ctx, from+".."+to, paths)
+}
+
+// MergeBase gives the best common ancestor of the two refs, as `git
+// merge-base` does; e.g., where a branch forked from the branch it's
+// to be merged into, so that CommitsBetween the merge base and the
+// branch are those the branch adds. Both refs must exist. If they
+// have no history in common, it returns a NoMergeBaseError.
+func (r *Repo) MergeBase(ctx context.Context, a, b string) (string, error) {
+	unlock, err := r.rlock(ctx, "MergeBase")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return "", err
+	}
+	for _, ref := range []string{a, b} {
+		ok, err := refExists(ctx, r.exec, r.dir, ref)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", RefNotFoundError{Ref: ref}
+		}
+	}
+	return mergeBase(ctx, r.exec, r.dir, a, b)
+}
+
+// IsAncestor says whether the commit maybeAncestor is in the history
+// of the commit descendant (including being the same commit); e.g.,
+// to check that moving the sync tag would move it forward. Either
+// not existing is a RefNotFoundError.
+func (r *Repo) IsAncestor(ctx context.Context, maybeAncestor, descendant string) (bool, error) {
+	unlock, err := r.rlock(ctx, "IsAncestor")
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return false, err
+	}
+	for _, ref := range []string{maybeAncestor, descendant} {
+		ok, err := refExists(ctx, r.exec, r.dir, ref)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, RefNotFoundError{Ref: ref}
+		}
+	}
+	return isAncestor(ctx, r.exec, r.dir, maybeAncestor, descendant)
+}
+
+// GetSyncState reads the state recorded in the tag given, as by
+// `Checkout.MoveSyncTagAndPush` with a State. The Revision is always
+// that the tag points at; for a tag which doesn't have state recorded
+// in it (e.g., one made before state was recorded), that is all
+// that's returned.
+func (r *Repo) GetSyncState(ctx context.Context, tag string) (SyncState, error) {
+	unlock, err := r.rlock(ctx, "GetSyncState")
+	if err != nil {
+		return SyncState{}, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return SyncState{}, err
+	}
+	rev, err := refRevision(ctx, r.exec, r.dir, "tags/"+tag)
+	if err != nil {
+		return SyncState{}, err
+	}
+	message, err := tagMessage(ctx, r.exec, r.dir, tag)
+	if err != nil {
+		return SyncState{}, err
+	}
+	var state SyncState
+	if err := json.Unmarshal([]byte(message), &state); err != nil {
+		state = SyncState{}
+	}
+	state.Revision = rev
+	return state, nil
+}
+
+// PreviousSyncRevision gives the revision the tag given pointed at
+// before it was moved to where it is now (skipping any moves that
+// left it at the same revision, e.g., to record a fresh SyncState);
+// e.g., to move a sync tag back there, after syncing a bad commit.
+//
+// This comes from the reflog of the tag in the repo's mirror, so it
+// only knows about moves seen by a Refresh since the mirror was made
+// (if the tag moved more than once in between, only the last move is
+// seen), and forgets them as git expires reflog entries (see
+// gc.reflogExpire). If there's no earlier revision in the reflog, it
+// returns a RefNotFoundError.
+func (r *Repo) PreviousSyncRevision(ctx context.Context, tag string) (string, error) {
+	unlock, err := r.rlock(ctx, "PreviousSyncRevision")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return "", err
+	}
+	return previousTagRevision(ctx, r.exec, r.dir, tag)
+}
+
+// Tag is a tag in the repo.
+type Tag struct {
+	Name     string
+	Revision string // of the commit tagged
+	// Date is when the tag was made, for an annotated tag; for a
+	// lightweight tag, it's the committer date of the commit.
+	Date time.Time
+	// The rest are only filled in by ReadTag, and only for an
+	// annotated tag; the signing key and its fingerprint (as for a
+	// Commit) are only given for a signed tag once its signature has
+	// been verified.
+	TaggerName         string
+	TaggerEmail        string
+	Message            string // without the signature
+	SigningKey         string
+	SigningFingerprint string
+}
+
+// Tags returns the tags in the repo matching the glob pattern given
+// (e.g., "release-*"), or all of them if it's empty, newest first.
+func (r *Repo) Tags(ctx context.Context, pattern string) ([]Tag, error) {
+	unlock, err := r.rlock(ctx, "Tags")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	return listTags(ctx, r.exec, r.dir, pattern)
+}
+
+// ReadTag returns the tag named, with who made it and its message.
+// If it's signed, the signature is verified with the keys in the
+// Repo's GPGHome, and the tag only returned if it's good; otherwise,
+// the error is an UnverifiedTagError.
+func (r *Repo) ReadTag(ctx context.Context, name string) (Tag, error) {
+	unlock, err := r.rlock(ctx, "ReadTag")
+	if err != nil {
+		return Tag{}, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return Tag{}, err
+	}
+	tag, signature, err := readTag(ctx, r.exec, r.dir, name)
+	if err != nil || signature == "" {
+		return tag, err
+	}
+	if tag.SigningKey, tag.SigningFingerprint, err = verifyTagSignature(ctx, r.exec, r.dir, name, gpgEnv(r.gpgHome)); err != nil {
+		return Tag{}, err
+	}
+	return tag, nil
+}
+
+// deleteTagsBatch is how many tags DeleteTags deletes with each push,
+// to keep the command line to a reasonable length.
+const deleteTagsBatch = 100
+
+// DeleteTag deletes the tag given from the upstream, as DeleteTags.
+func (r *Repo) DeleteTag(ctx context.Context, name string) error {
+	return r.DeleteTags(ctx, name)
+}
+
+// DeleteTags deletes the tags given from the upstream, and from the
+// mirror. Tags that are already gone are ignored, so it's safe to
+// try again after a failure. It's serialised with the moving of tags
+// by checkouts of this repo, though not of course with anything else
+// pushing tags to the upstream.
+func (r *Repo) DeleteTags(ctx context.Context, names ...string) error {
+	r.tagsMu.Lock()
+	defer r.tagsMu.Unlock()
+	unlock, err := r.rlock(ctx, "DeleteTags")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > deleteTagsBatch {
+			batch = batch[:deleteTagsBatch]
+		}
+		names = names[len(batch):]
+
+		env, err := r.transport.env(ctx, OpPush)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		err = deleteTags(ctx, r.exec, r.dir, r.origin.URL, batch, env)
+		observe(r.observer, OpPush, r.origin, start, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangeType says how a file was changed in a diff.
+type ChangeType string
+
+const (
+	FileAdded    ChangeType = "added"
+	FileModified ChangeType = "modified"
+	FileDeleted  ChangeType = "deleted"
+	// FileUntracked is only for the status of a checkout, where it's
+	// a new file that hasn't been added.
+	FileUntracked ChangeType = "untracked"
+)
+
+// FileChange is a file changed between two revisions.
+type FileChange struct {
+	Path string // relative to the top of the repo
+	Type ChangeType
+}
+
+// Diff returns the unified diff between two revisions. If paths are
+// given (e.g., the same as in the Config), only changes to files
+// under those are included.
+func (r *Repo) Diff(ctx context.Context, from, to string, paths ...string) ([]byte, error) {
+	unlock, err := r.rlock(ctx, "Diff")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	return diff(ctx, r.exec, r.dir, from, to, paths)
+}
+
+// DiffFiles returns which files changed between two revisions, and
+// how. As with Diff, it can be limited to the paths given.
+func (r *Repo) DiffFiles(ctx context.Context, from, to string, paths ...string) ([]FileChange, error) {
+	unlock, err := r.rlock(ctx, "DiffFiles")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	return diffFiles(ctx, r.exec, r.dir, from, to, paths)
+}
+
+// ReadFileAtRev returns the contents of the file at path (relative to
+// the top of the repo), as it was at the revision given. It doesn't
+// need a checkout, so it won't disturb any working tree.
+func (r *Repo) ReadFileAtRev(ctx context.Context, rev, path string) ([]byte, error) {
+	unlock, err := r.rlock(ctx, "ReadFileAtRev")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	return showFile(ctx, r.exec, r.dir, rev, path)
+}
+
+// ListFilesAtRev returns the paths of the files in the repo as it was
+// at the revision given, limited to the paths given (e.g., the
+// manifest directories of a Config), if any.
+func (r *Repo) ListFilesAtRev(ctx context.Context, rev string, paths ...string) ([]string, error) {
+	unlock, err := r.rlock(ctx, "ListFilesAtRev")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	return listFiles(ctx, r.exec, r.dir, rev, paths)
+}
+
+// Archive gives a tar archive of the files in the repo as they were
+// at the revision given, limited to the paths given (e.g., the
+// manifest directories of a Config), as `git archive` makes it. The
+// Repo doesn't know which directories hold manifests, so at least one
+// path must be given: with none, it returns ErrNoArchivePaths rather
+// than archive the whole tree. The archive is read as git writes it;
+// closing the reader before the end stops git. The repo is
+// read-locked until the reader is closed, so it should always be
+// closed, and fairly promptly.
+func (r *Repo) Archive(ctx context.Context, rev string, paths []string) (io.ReadCloser, error) {
+	if len(paths) == 0 {
+		return nil, ErrNoArchivePaths
+	}
+	unlock, err := r.rlock(ctx, "Archive")
+	if err != nil {
+		return nil, err
+	}
+	if err := r.errorIfNotReady(); err != nil {
+		unlock()
+		return nil, err
+	}
+	// Check first, so that a bad revision is an error here rather
+	// than when reading
+	commit, err := resolveRevision(ctx, r.exec, r.dir, rev)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return archive(ctx, r.exec, r.dir, commit, paths, unlock), nil
+}
+
+// BlameLine is a line of a file, along with the commit that last
+// changed it, as given by Repo.Blame.
+type BlameLine struct {
+	Number      int    // counting from 1
+	Text        string // without the newline
+	Revision    string
+	AuthorName  string
+	AuthorEmail string
+	AuthorDate  time.Time
+	Summary     string // the subject of the commit
+}
+
+// Blame says, for each line of the file at path as of the revision
+// given, which commit last changed it and who wrote that commit, as
+// `git blame` does; e.g., to say who made a bad change to a manifest.
+// There's no sense in this for a binary file, so for one of those it
+// returns a BinaryFileError.
+func (r *Repo) Blame(ctx context.Context, rev, path string) ([]BlameLine, error) {
+	unlock, err := r.rlock(ctx, "Blame")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	content, err := showFile(ctx, r.exec, r.dir, rev, path)
+	if err != nil {
+		return nil, err
+	}
+	if isBinary(content) {
+		return nil, BinaryFileError{Path: path, Revision: rev}
+	}
+	return blame(ctx, r.exec, r.dir, rev, path)
+}
+
+// MirrorTo pushes the refs in the repo to another remote, e.g., a
+// backup, as with `git push --mirror`: afterwards the remote has the
+// same refs as the repo, and no others. If refspecs are given, only
+// those are pushed, and nothing is deleted. The credentials given
+// are used to push; if nil, those of the repo are used. Either way,
+// the remote is reached, and its host key or certificate checked, as
+// the upstream is.
+//
+// Since this holds a read lock on the repo, it will not see a
+// half-done refresh; and only one MirrorTo runs at a time.
+func (r *Repo) MirrorTo(ctx context.Context, remote Remote, creds Credentials, refspecs ...string) error {
+	r.mirrorMu.Lock()
+	defer r.mirrorMu.Unlock()
+	unlock, err := r.rlock(ctx, "MirrorTo")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	t := r.transport
+	if creds != nil {
+		t = t.withCredentials(creds)
+	}
+	env, err := t.env(ctx, OpPush)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = pushMirror(ctx, r.exec, r.dir, remote.URL, refspecs, env)
+	observe(r.observer, OpPush, remote, start, err)
+	return err
+}
+
+// verifiedLog returns the commits in the refspec given, checking
+// each has a valid signature if the repo is verifying signatures.
+func (r *Repo) verifiedLog(ctx context.Context, refspec string, paths []string, extra ...string) ([]Commit, error) {
+	commits := []Commit{}
+	err := r.walk(ctx, refspec, paths, func(c Commit) error {
+		commits = append(commits, c)
+		return nil
+	}, extra...)
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// StopWalk can be returned by the function given to WalkCommits, to
+// stop the walk without it failing.
+var StopWalk = errors.New("stop walking commits")
+
+// walkBatch is how many commits walk reads before giving them to the
+// function, so that their signatures can be checked together.
+const walkBatch = 100
+
+// WalkCommits calls fn with each commit reachable from ref, most
+// recent first, as it's read; so unlike CommitsBefore, the whole
+// history needn't be held in memory, and the walk can be stopped
+// early by fn returning StopWalk. Any other error returned by fn ends
+// the walk, and is returned. As with CommitsBefore, only commits
+// changing the paths given (if any) are included, and if the repo is
+// verifying signatures, a commit without a valid signature ends the
+// walk with UnverifiedCommitError. The repo is locked for reading
+// while fn is called, so it mustn't do anything which needs it
+// locked for writing, such as GC.
+func (r *Repo) WalkCommits(ctx context.Context, ref string, fn func(Commit) error, paths ...string) error {
+	unlock, err := r.rlock(ctx, "WalkCommits")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	return r.walk(ctx, ref, paths, fn)
+}
+
+// walk does the work of WalkCommits. It must be called with a read
+// lock held.
+func (r *Repo) walk(ctx context.Context, refspec string, paths []string, fn func(Commit) error, extra ...string) error {
+	batch := make([]Commit, 0, walkBatch)
+	flush := func() error {
+		if err := r.fillSignatures(ctx, batch); err != nil {
+			return err
+		}
+		for _, c := range batch {
+			if r.verifySignatures && !c.SignatureValid() {
+				return UnverifiedCommitError{Revision: c.Revision, Status: c.SignatureStatus}
+			}
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err := streamLog(ctx, r.exec, r.dir, refspec, paths, func(c Commit) error {
+		if batch = append(batch, c); len(batch) < walkBatch {
+			return nil
+		}
+		return flush()
+	}, extra...)
+	if err == nil {
+		err = flush()
+	}
+	if err == StopWalk {
+		return nil
+	}
+	return err
+}
+
+// VerifyCommit checks that the commit given has a valid signature.
+func (r *Repo) VerifyCommit(ctx context.Context, rev string) error {
+	unlock, err := r.rlock(ctx, "VerifyCommit")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	return verifyCommit(ctx, r.exec, r.dir, rev, gpgEnv(r.gpgHome))
+}
+
+// VerifyTag checks that the annotated tag given has a valid signature.
+func (r *Repo) VerifyTag(ctx context.Context, tag string) error {
+	unlock, err := r.rlock(ctx, "VerifyTag")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	return verifyTag(ctx, r.exec, r.dir, tag, gpgEnv(r.gpgHome))
 }
 
 // step attempts to advance the repo state machine, and returns `true`
 // if it has made progress, `false` otherwise.
 func (r *Repo) step(bg context.Context) bool {
-	r.mu.RLock()
+	unlock := r.rhold("step")
 	url := r.origin.URL
 	dir := r.dir
 	status := r.status
-	r.mu.RUnlock()
+	unlock()
 
 	switch status {
 
@@ -235,36 +985,51 @@ func (r *Repo) step(bg context.Context) bool {
 		return false
 
 	case RepoNew:
-		rootdir, err := ioutil.TempDir(os.TempDir(), "flux-gitclone")
+		rootdir, err := makeTempDir(mirrorDirPrefix)
 		if err != nil {
 			panic(err)
 		}
 
-		ctx, cancel := context.WithTimeout(bg, r.timeout)
-		dir, err = mirror(ctx, rootdir, url)
-		cancel()
+		env, err := r.transport.env(bg, OpClone)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(bg, r.timeout)
+			start := time.Now()
+			if r.cacheDir != "" {
+				dir, err = mirrorWithReference(ctx, r.exec, rootdir, r.cacheDir, url, r.maxBytes, env, r.progress)
+			} else {
+				dir, err = mirror(ctx, r.exec, rootdir, url, r.maxBytes, env, "", r.progress)
+			}
+			observe(r.observer, OpClone, r.origin, start, err)
+			cancel()
+		}
 		if err == nil {
-			r.mu.Lock()
+			unlock := r.hold("step")
 			r.dir = dir
 			ctx, cancel := context.WithTimeout(bg, r.timeout)
-			err = r.fetch(ctx)
+			err = applyConfig(ctx, r.exec, dir, r.gitConfig)
+			if err == nil {
+				err = r.fetch(ctx)
+			}
 			cancel()
-			r.mu.Unlock()
+			unlock()
 		}
 		if err == nil {
 			r.setUnready(RepoCloned, ErrClonedOnly)
 			return true
 		}
 		dir = ""
-		os.RemoveAll(rootdir)
+		removeTempDir(rootdir)
 		r.setUnready(RepoNew, err)
 		return false
 
 	case RepoCloned:
 		if !r.readonly {
-			ctx, cancel := context.WithTimeout(bg, r.timeout)
-			err := checkPush(ctx, dir, url)
-			cancel()
+			env, err := r.transport.env(bg, OpPush)
+			if err == nil {
+				ctx, cancel := context.WithTimeout(bg, r.timeout)
+				err = checkPush(ctx, r.exec, dir, url, env)
+				cancel()
+			}
 			if err != nil {
 				r.setUnready(RepoCloned, err)
 				return false
@@ -295,11 +1060,43 @@ func (r *Repo) Ready(ctx context.Context) error {
 	return err
 }
 
+// WaitReady is like Ready, but when the repo gets stuck it tries
+// again (after waiting according to the Backoff), until the repo is
+// ready or the context is done. It returns the last error
+// encountered if it does not get to a ready state; that's straight
+// away if the error isn't one worth trying again for (see
+// IsRetryable), e.g., the credentials aren't accepted.
+func (r *Repo) WaitReady(ctx context.Context) error {
+	for failures := 1; ; failures++ {
+		for r.step(ctx) {
+			// keep going!
+		}
+		status, err := r.Status()
+		if status == RepoReady || status == RepoNoConfig {
+			return err
+		}
+		if err != nil && !IsRetryable(err) {
+			return err
+		}
+		tryAgain := time.NewTimer(r.backoff.wait(failures))
+		select {
+		case <-ctx.Done():
+			tryAgain.Stop()
+			return err
+		case <-tryAgain.C:
+		}
+	}
+}
+
 // Start begins synchronising the repo by cloning it, then fetching
-// the required tags and so on.
+// the required tags and so on. When it can't get ready, it tries
+// again after waiting according to the Backoff; or if the error
+// isn't one worth trying again for soon (see IsRetryable), e.g., the
+// credentials aren't accepted, after waiting the longest it would.
 func (r *Repo) Start(shutdown <-chan struct{}, done *sync.WaitGroup) error {
 	defer done.Done()
 
+	failures := 0
 	for {
 		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
 		advanced := r.step(ctx)
@@ -309,17 +1106,24 @@ func (r *Repo) Start(shutdown <-chan struct{}, done *sync.WaitGroup) error {
 			continue
 		}
 
-		status, _ := r.Status()
+		status, err := r.Status()
 		if status == RepoReady {
-			if err := r.refreshLoop(shutdown); err != nil {
+			failures = 0
+			if err = r.refreshLoop(shutdown); err != nil {
 				r.setUnready(RepoNew, err)
-				continue // with new status, skipping timer
 			}
 		} else if status == RepoNoConfig {
 			return nil
 		}
 
-		tryAgain := time.NewTimer(10 * time.Second)
+		failures++
+		wait := r.backoff.wait(failures)
+		if err != nil && !IsRetryable(err) {
+			// It won't come right until something else changes,
+			// so there's no sense in trying again any sooner
+			wait = r.backoff.Max
+		}
+		tryAgain := time.NewTimer(wait)
 		select {
 		case <-shutdown:
 			if !tryAgain.Stop() {
@@ -333,23 +1137,175 @@ func (r *Repo) Start(shutdown <-chan struct{}, done *sync.WaitGroup) error {
 	return nil
 }
 
+// Refresh fetches from the upstream. Reads of the repo (and cloning
+// from it) can go ahead while it fetches, since a fetch only adds
+// objects and then updates refs; a read will see the refs as they
+// were either before or after the fetch. Refreshes are serialised
+// with each other and with GC. It makes one attempt; whether it's
+// worth trying again after a failure is for the caller to decide,
+// e.g., with IsRetryable.
 func (r *Repo) Refresh(ctx context.Context) error {
-	// the lock here and below is difficult to avoid; possibly we
-	// could clone to another repo and pull there, then swap when complete.
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if err := r.errorIfNotReady(); err != nil {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	if err := r.fetchShared(ctx); err != nil {
 		return err
 	}
-	if err := r.fetch(ctx); err != nil {
-		return err
+	r.refreshes++
+	if r.gcEvery > 0 && r.refreshes >= r.gcEvery {
+		// A failed GC doesn't make the refresh any less
+		// successful; it's reported to the observer, and will be
+		// tried again after another round of refreshes.
+		if unlock, err := r.lock(ctx, "GC"); err == nil {
+			if r.errorIfNotReady() == nil {
+				r.gc(ctx)
+			}
+			unlock()
+		}
 	}
 	r.refreshed()
 	return nil
 }
 
+// fetchShared does the fetch for Refresh, holding only the read lock.
+func (r *Repo) fetchShared(ctx context.Context) error {
+	unlock, err := r.rlock(ctx, "Refresh")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	return r.fetch(ctx)
+}
+
+// GC garbage collects the mirrored repo, and prunes any refs for
+// branches deleted upstream. Unlike Refresh, it holds the repo lock
+// while it runs, since it removes objects; so it won't happen while
+// the repo is being read, or a checkout being cloned from it.
+func (r *Repo) GC(ctx context.Context) error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	unlock, err := r.lock(ctx, "GC")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	return r.gc(ctx)
+}
+
+// gc does the work of GC; the caller must hold refreshMu and the
+// lock.
+func (r *Repo) gc(ctx context.Context) error {
+	r.refreshes = 0
+	env, err := r.transport.env(ctx, OpGC)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = gc(ctx, r.exec, r.dir, "origin", env)
+	observe(r.observer, OpGC, r.origin, start, err)
+	return err
+}
+
+// FetchRev makes sure the repo has the commit given, by its full
+// revision, fetching it on its own from the upstream if need be;
+// e.g., to look at a commit reported by a webhook without waiting for
+// a refresh, or one that's no longer on any branch. Not all upstreams
+// allow this, in which case the error is a FetchRevError. No ref is
+// made for the commit, so it may be removed by GC if it's not on a
+// branch by then.
+func (r *Repo) FetchRev(ctx context.Context, rev string) error {
+	if !isFullRevision(rev) {
+		return fmt.Errorf("%q is not a full revision, which is needed to fetch a commit", rev)
+	}
+	unlock, err := r.rlock(ctx, "FetchRev")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	if hasCommit(ctx, r.exec, r.dir, rev) {
+		return nil
+	}
+	env, err := r.transport.env(ctx, OpFetch)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = fetchRev(ctx, r.exec, r.dir, "origin", rev, env)
+	observe(r.observer, OpFetch, r.origin, start, err)
+	return err
+}
+
+// FetchNotes updates the notes refs from the upstream, without doing
+// a full fetch. Since it doesn't touch any other refs, it can go
+// ahead while the repo is being read.
+func (r *Repo) FetchNotes(ctx context.Context) error {
+	r.notesMu.Lock()
+	defer r.notesMu.Unlock()
+	unlock, err := r.rlock(ctx, "FetchNotes")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return err
+	}
+	env, err := r.transport.env(ctx, OpFetch)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = fetchNotes(ctx, r.exec, r.dir, "origin", env)
+	observe(r.observer, OpFetch, r.origin, start, err)
+	return err
+}
+
+// RemoteRevision gives the revision the branch given is at upstream,
+// as of now, without fetching it or otherwise changing the repo; so
+// it's cheap, compared to Refresh, to find out whether there's
+// anything new, e.g., by comparing the revision to that of the
+// branch in the repo (or a checkout). It uses the same credentials,
+// proxy and so on as fetching does. It doesn't need the repo to have
+// been cloned. If there's no such branch upstream, it returns a
+// RefNotFoundError.
+func (r *Repo) RemoteRevision(ctx context.Context, branch string) (string, error) {
+	unlock, err := r.rlock(ctx, "RemoteRevision")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	env, err := r.transport.env(ctx, OpFetch)
+	if err != nil {
+		return "", err
+	}
+	ref := "refs/heads/" + branch
+	start := time.Now()
+	rev, ok, err := remoteRef(ctx, r.exec, r.dir, r.origin.URL, ref, env)
+	observe(r.observer, OpLsRemote, r.origin, start, err)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", RefNotFoundError{Ref: ref}
+	}
+	return rev, nil
+}
+
+// refreshLoop refreshes the repo every poll interval, and when it's
+// notified, until shutdown. A refresh that fails with an error worth
+// trying again for (see IsRetryable) is tried again after waiting
+// according to the Backoff, keeping the mirror as it was meanwhile;
+// any other error is returned.
 func (r *Repo) refreshLoop(shutdown <-chan struct{}) error {
 	gitPoll := time.NewTimer(r.interval)
+	failures := 0
 	for {
 		select {
 		case <-shutdown:
@@ -370,32 +1326,65 @@ func (r *Repo) refreshLoop(shutdown <-chan struct{}) error {
 			err := r.Refresh(ctx)
 			cancel()
 			if err != nil {
-				return err
+				if !IsRetryable(err) {
+					return err
+				}
+				failures++
+				if r.exec.logger != nil {
+					r.exec.logger.Log("level", "warn", "op", "refresh", "err", err)
+				}
+				gitPoll.Reset(r.backoff.wait(failures))
+				continue
 			}
+			failures = 0
 			gitPoll.Reset(r.interval)
 		}
 	}
 }
 
+// mirrorRefspecs are the refs fetched into the repo: notes are
+// fetched separately from everything else, since they are fetched at
+// the same time.
+var mirrorRefspecs = [][]string{
+	{"+refs/*:refs/*", "^refs/notes/*"},
+	{"+refs/notes/*:refs/notes/*"},
+}
+
 // fetch gets updated refs, and associated objects, from the upstream.
 func (r *Repo) fetch(ctx context.Context) error {
-	if err := fetch(ctx, r.dir, "origin"); err != nil {
+	env, err := r.transport.env(ctx, OpFetch)
+	if err != nil {
 		return err
 	}
-	return nil
+	start := time.Now()
+	err = fetchConcurrently(ctx, r.exec, r.dir, "origin", env, mirrorRefspecs, r.progress)
+	observe(r.observer, OpFetch, r.origin, start, err)
+	return err
 }
 
 // workingClone makes a non-bare clone, at `ref` (probably a branch),
 // and returns the filesystem path to it.
-func (r *Repo) workingClone(ctx context.Context, ref string) (string, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+func (r *Repo) workingClone(ctx context.Context, ref string, opts cloneOptions) (string, error) {
+	unlock, err := r.rlock(ctx, "workingClone")
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
 	if err := r.errorIfNotReady(); err != nil {
 		return "", err
 	}
-	working, err := ioutil.TempDir(os.TempDir(), "flux-working")
+	working, err := makeTempDir(workingDirPrefix)
+	if err != nil {
+		return "", err
+	}
+	gexec := r.exec
+	if opts.exec != nil {
+		gexec = *opts.exec
+	}
+	path, err := clone(ctx, gexec, working, r.dir, ref, opts)
 	if err != nil {
+		removeTempDir(working)
 		return "", err
 	}
-	return clone(ctx, working, r.dir, ref)
+	return path, nil
 }
@@ -0,0 +1,1529 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
+)
+
+func TestCommitsBefore_VerifySignatures(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := createRepo(newDir, []string{"config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly, VerifySignatures)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := repo.Revision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.CommitsBefore(ctx, "HEAD")
+	verr, ok := err.(UnverifiedCommitError)
+	if !ok {
+		t.Fatalf("expected UnverifiedCommitError for unsigned commits, got %v", err)
+	}
+	if verr.Revision != head {
+		t.Errorf("expected offending revision to be %s, got %s", head, verr.Revision)
+	}
+
+	if err := repo.VerifyCommit(ctx, head); err == nil {
+		t.Error("expected unsigned commit to fail verification")
+	}
+}
+
+func TestWalkCommits(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// More commits than are read in one batch
+	const count = walkBatch*2 + 50
+	if err := execCommand("git", "-C", newDir, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	stream := &bytes.Buffer{}
+	for i := 0; i < count; i++ {
+		message := fmt.Sprintf("Commit %d", i)
+		fmt.Fprintf(stream, "commit refs/heads/master\ncommitter Flux <flux@example.com> %d +0000\ndata %d\n%s\n", 1500000000+i, len(message), message)
+	}
+	importCmd := exec.Command("git", "-C", newDir, "fast-import", "--quiet")
+	importCmd.Stdin = stream
+	if out, err := importCmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := repo.CommitsBefore(ctx, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != count {
+		t.Fatalf("expected %d commits, got %d", count, len(all))
+	}
+	var walked []Commit
+	if err := repo.WalkCommits(ctx, "master", func(c Commit) error {
+		walked = append(walked, c)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(walked, all) {
+		t.Error("expected walking the commits to give the same as CommitsBefore")
+	}
+
+	// Stopping early
+	walked = nil
+	if err := repo.WalkCommits(ctx, "master", func(c Commit) error {
+		if walked = append(walked, c); len(walked) == 3 {
+			return StopWalk
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) != 3 || walked[0].Message != fmt.Sprintf("Commit %d", count-1) {
+		t.Errorf("expected the three most recent commits, got %+v", walked)
+	}
+
+	// Any other error from the function is returned
+	boom := errors.New("boom")
+	if err := repo.WalkCommits(ctx, "master", func(c Commit) error { return boom }); err != boom {
+		t.Errorf("expected the function's error, got %v", err)
+	}
+	if err := repo.WalkCommits(ctx, "no-such-branch", func(c Commit) error { return nil }); err == nil {
+		t.Error("expected an error walking from a ref that doesn't exist")
+	}
+}
+
+func TestCommitsBetween(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := createRepo(newDir, []string{"dev", "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	commits, err := repo.CommitsBetween(ctx, "HEAD~2", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 {
+		t.Errorf("expected two commits, got %d", len(commits))
+	}
+
+	commits, err = repo.CommitsBetween(ctx, "HEAD", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits == nil || len(commits) != 0 {
+		t.Errorf("expected empty slice of commits, got %#v", commits)
+	}
+
+	if _, err = repo.CommitsBetween(ctx, "HEAD", "does-not-exist"); err == nil {
+		t.Error("expected error for unknown ref")
+	}
+}
+
+func TestCommitsSince(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := execCommand("git", "-C", newDir, "init"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config(ctx, gitExec{}, newDir, "operations_test_user", "example@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// The second commit has a committer date before that of its
+	// parent, and before the cutoff; the last has its author date
+	// after its committer date, and is in another time zone.
+	for _, dates := range []struct{ subject, author, committer string }{
+		{"first", "2019-03-14T09:20:00Z", "2019-03-14T09:20:00Z"},
+		{"skewed", "2019-03-14T09:00:00Z", "2019-03-14T09:00:00Z"},
+		{"third", "2019-03-14T08:00:00Z", "2019-03-14T10:00:00Z"},
+		{"fourth", "2019-03-14T11:00:00Z", "2019-03-14T12:00:00+02:00"},
+	} {
+		c := exec.Command("git", "-C", newDir, "commit", "--allow-empty", "-m", dates.subject)
+		c.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+dates.author, "GIT_COMMITTER_DATE="+dates.committer)
+		if err := c.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2019, 3, 14, 10, 15, 0, 0, time.FixedZone("+01:00", 3600)) // 09:15Z
+	commits, err := repo.CommitsSince(ctx, "HEAD", since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for _, c := range commits {
+		subjects = append(subjects, c.Message)
+	}
+	if expected := []string{"fourth", "third", "first"}; !reflect.DeepEqual(subjects, expected) {
+		t.Errorf("expected commits %v, got %v", expected, subjects)
+	}
+
+	// The cutoff is inclusive
+	commits, err = repo.CommitsSince(ctx, "HEAD", time.Date(2019, 3, 14, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 {
+		t.Errorf("expected two commits at or after 10:00Z, got %+v", commits)
+	}
+
+	if _, err := repo.CommitsSince(ctx, "does-not-exist", since); err == nil {
+		t.Error("expected error for unknown ref")
+	}
+}
+
+func TestTags(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := execCommand("git", "-C", newDir, "init"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config(ctx, gitExec{}, newDir, "operations_test_user", "example@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// A lightweight tag is dated by its commit, and an annotated tag
+	// by when it was made (which git takes from the committer date).
+	for _, step := range []struct {
+		date string
+		args []string
+	}{
+		{"2019-03-14T09:00:00Z", []string{"commit", "--allow-empty", "-m", "first"}},
+		{"2019-03-14T09:00:00Z", []string{"tag", "release-1"}},
+		{"2019-03-14T11:00:00Z", []string{"tag", "-a", "-m", "Other", "other"}},
+		{"2019-03-14T10:00:00Z", []string{"commit", "--allow-empty", "-m", "second"}},
+		{"2019-03-14T12:00:00+02:00", []string{"tag", "-a", "-m", "Release 3", "release-3", "HEAD~1"}},
+		{"2019-03-14T11:30:00Z", []string{"tag", "-a", "-m", "Release 2", "release-2"}},
+	} {
+		c := exec.Command("git", append([]string{"-C", newDir}, step.args...)...)
+		c.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+step.date, "GIT_COMMITTER_DATE="+step.date)
+		if err := c.Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first, err := repo.ResolveRevision(ctx, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.ResolveRevision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := repo.Tags(ctx, "release-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Tag{
+		{Name: "release-2", Revision: second, Date: time.Date(2019, 3, 14, 11, 30, 0, 0, time.UTC)},
+		{Name: "release-3", Revision: first, Date: time.Date(2019, 3, 14, 10, 0, 0, 0, time.UTC)},
+		{Name: "release-1", Revision: first, Date: time.Date(2019, 3, 14, 9, 0, 0, 0, time.UTC)},
+	}
+	if len(tags) != len(expected) {
+		t.Fatalf("expected tags %+v, got %+v", expected, tags)
+	}
+	for i := range expected {
+		if tags[i].Name != expected[i].Name || tags[i].Revision != expected[i].Revision || !tags[i].Date.Equal(expected[i].Date) {
+			t.Errorf("expected tag %+v, got %+v", expected[i], tags[i])
+		}
+	}
+
+	tags, err = repo.Tags(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 4 || tags[0].Name != "release-2" || tags[1].Name != "other" {
+		t.Errorf("expected all four tags, newest first, got %+v", tags)
+	}
+
+	tags, err = repo.Tags(ctx, "nothing-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("expected no tags, got %+v", tags)
+	}
+}
+
+func TestFetchNotes(t *testing.T) {
+	upstreamDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstreamDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A note and a new commit arrive upstream; only the note should be
+	// fetched.
+	if _, err := testNote(upstreamDir, "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Revision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", upstreamDir, "commit", "--allow-empty", "-m", "Another revision"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.FetchNotes(ctx); err != nil {
+		t.Fatal(err)
+	}
+	notes, err := noteRevList(ctx, gitExec{}, repo.Dir(), testNoteRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := notes[head]; !ok {
+		t.Errorf("expected note for %s to be fetched", head)
+	}
+	newHead, err := repo.Revision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newHead != head {
+		t.Error("expected branch not to be updated by FetchNotes")
+	}
+}
+
+type recordingObserver struct {
+	mu  sync.Mutex
+	ops []Operation
+	ok  []bool
+}
+
+func (o *recordingObserver) ObserveOperation(op Operation, url string, took time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ops = append(o.ops, op)
+	o.ok = append(o.ok, err == nil)
+}
+
+// count gives how many times the operation given has been observed,
+// succeeding or failing as given.
+func (o *recordingObserver) count(op Operation, ok bool) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for i := range o.ops {
+		if o.ops[i] == op && o.ok[i] == ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestObserveWith_NoChanges(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+	observer := &recordingObserver{}
+	repo := NewRepo(Remote{URL: newDir}, ObserveWith(observer))
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+	checkout, err := repo.Clone(ctx, Config{Branch: "master", UserName: "example", UserEmail: "example@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+
+	files, err := checkout.ManifestFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(checkout.Dir(), files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observer.mu.Lock()
+	observer.ops, observer.ok = nil, nil
+	observer.mu.Unlock()
+	// The file is already as given, so there's nothing to commit
+	if _, err := checkout.CommitTree(ctx, map[string][]byte{rel: content}, CommitAction{Message: "Nothing"}, nil); err != ErrNoChanges {
+		t.Fatalf("expected ErrNoChanges, got %v", err)
+	}
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if !reflect.DeepEqual(observer.ops, []Operation{OpCommit}) || !observer.ok[0] {
+		t.Errorf("expected a commit with no changes to be reported as succeeding, got %v (success: %v)", observer.ops, observer.ok)
+	}
+}
+
+func TestObserveWith(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+	observer := &recordingObserver{}
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly, ObserveWith(observer))
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Operation{OpClone, OpFetch, OpFetch}
+	if !reflect.DeepEqual(observer.ops, expected) {
+		t.Errorf("expected operations %v, got %v", expected, observer.ops)
+	}
+	for i, ok := range observer.ok {
+		if !ok {
+			t.Errorf("expected %s to be reported as succeeding", observer.ops[i])
+		}
+	}
+
+	failing := &recordingObserver{}
+	repo = NewRepo(Remote{URL: newDir + "-does-not-exist"}, ReadOnly, ObserveWith(failing), Backoff{Initial: time.Hour})
+	shortCtx, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if err := repo.Ready(shortCtx); err == nil {
+		t.Fatal("expected repo with bad URL not to become ready")
+	}
+	if len(failing.ops) != 1 || failing.ops[0] != OpClone || failing.ok[0] {
+		t.Errorf("expected a single failed clone, got %v (success: %v)", failing.ops, failing.ok)
+	}
+}
+
+func TestWaitReady_Backoff(t *testing.T) {
+	// Nothing is listening on the port once it's closed, so
+	// connecting fails, which is worth trying again.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	observer := &recordingObserver{}
+	backoff := Backoff{Initial: 10 * time.Millisecond, Max: 40 * time.Millisecond, Factor: 2}
+	repo := NewRepo(Remote{URL: "http://" + l.Addr().String() + "/repo"}, ReadOnly, ObserveWith(observer), backoff)
+
+	// Ready itself makes only the one attempt.
+	if err := repo.Ready(context.Background()); err == nil {
+		t.Fatal("expected repo with bad URL not to become ready")
+	}
+	observer.mu.Lock()
+	attempts := len(observer.ops)
+	observer.ops, observer.ok = nil, nil
+	observer.mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("expected Ready to make one attempt to clone, got %d", attempts)
+	}
+
+	// Waits of 10ms, 20ms, 40ms, 40ms, ... so in 200ms there's time
+	// for a handful of attempts but not many more.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = repo.WaitReady(ctx)
+	if err == nil {
+		t.Fatal("expected repo with bad URL not to become ready")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected WaitReady to return promptly when the context was done, but it took %s", took)
+	}
+	if repo.Err() != err {
+		t.Errorf("expected Err() to give the last error %v, got %v", err, repo.Err())
+	}
+	observer.mu.Lock()
+	attempts = len(observer.ops)
+	observer.mu.Unlock()
+	if attempts < 2 || attempts > 8 {
+		t.Errorf("expected between 2 and 8 attempts to clone, got %d", attempts)
+	}
+}
+
+func TestWaitReady_NotRetryable(t *testing.T) {
+	missing, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	observer := &recordingObserver{}
+	backoff := Backoff{Initial: 10 * time.Millisecond, Max: 40 * time.Millisecond, Factor: 2}
+	repo := NewRepo(Remote{URL: filepath.Join(missing, "does-not-exist")}, ReadOnly, ObserveWith(observer), backoff)
+
+	// A repo that isn't there won't appear by trying again, so
+	// WaitReady gives up after the first attempt.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	err := repo.WaitReady(ctx)
+	if err == nil {
+		t.Fatal("expected repo with bad URL not to become ready")
+	}
+	if IsRetryable(err) {
+		t.Errorf("expected a missing repo not to be retryable, got %v", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("expected WaitReady to return as soon as it failed, but it took %s", took)
+	}
+	observer.mu.Lock()
+	attempts := len(observer.ops)
+	observer.mu.Unlock()
+	if attempts != 1 {
+		t.Errorf("expected one attempt to clone, got %d", attempts)
+	}
+}
+
+// startRepo runs Start for the repo given, and gives a func to stop
+// it and wait for it to return.
+func startRepo(repo *Repo) func() {
+	shutdown, done := make(chan struct{}), &sync.WaitGroup{}
+	done.Add(1)
+	go repo.Start(shutdown, done)
+	return func() {
+		close(shutdown)
+		done.Wait()
+	}
+}
+
+func TestStart_Retryable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	observer := &recordingObserver{}
+	backoff := Backoff{Initial: 10 * time.Millisecond, Max: 40 * time.Millisecond, Factor: 2}
+	repo := NewRepo(Remote{URL: "http://" + l.Addr().String() + "/repo"}, ReadOnly, ObserveWith(observer), backoff)
+	stop := startRepo(repo)
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	if err := repo.Err(); !IsRetryable(err) {
+		t.Errorf("expected a retryable error, got %v", err)
+	}
+	if attempts := observer.count(OpClone, false); attempts < 2 || attempts > 8 {
+		t.Errorf("expected between 2 and 8 attempts to clone, got %d", attempts)
+	}
+}
+
+func TestStart_NotRetryable(t *testing.T) {
+	missing, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	observer := &recordingObserver{}
+	backoff := Backoff{Initial: 10 * time.Millisecond, Max: time.Minute, Factor: 2}
+	repo := NewRepo(Remote{URL: filepath.Join(missing, "does-not-exist")}, ReadOnly, ObserveWith(observer), backoff)
+	stop := startRepo(repo)
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	// Having failed for good, it waits the longest it would before
+	// trying again
+	if status, err := repo.Status(); status != RepoNew || err == nil || IsRetryable(err) {
+		t.Errorf("expected the repo to be unready with a permanent error, got %s (%v)", status, err)
+	}
+	if attempts := observer.count(OpClone, false); attempts != 1 {
+		t.Errorf("expected one attempt to clone, got %d", attempts)
+	}
+}
+
+// failUploadPack has the repo's fetches fail, with git printing the
+// message given as the reason; or with no message, fetch as usual.
+func failUploadPack(t *testing.T, repo *Repo, message string) {
+	args := []string{"-C", repo.Dir(), "config", "--unset", "remote.origin.uploadpack"}
+	if message != "" {
+		args = []string{"-C", repo.Dir(), "config", "remote.origin.uploadpack", fmt.Sprintf("echo '%s' >&2; exit 1", message)}
+	}
+	if err := execCommand("git", args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStart_RefreshRetryable(t *testing.T) {
+	upstreamDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstreamDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+	observer := &recordingObserver{}
+	backoff := Backoff{Initial: 10 * time.Millisecond, Max: 40 * time.Millisecond, Factor: 2}
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly, ObserveWith(observer), backoff, PollInterval(time.Hour))
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+	dir := repo.Dir()
+
+	failUploadPack(t, repo, "ssh: connect to host githost port 22: Connection refused")
+	stop := startRepo(repo)
+	defer stop()
+	repo.Notify()
+	time.Sleep(200 * time.Millisecond)
+
+	// The refresh is tried again, while the mirror is kept as it is
+	if failures := observer.count(OpFetch, false); failures < 2 {
+		t.Errorf("expected the refresh to be tried again, got %d failures", failures)
+	}
+	if status, err := repo.Status(); status != RepoReady || err != nil {
+		t.Errorf("expected the repo to stay ready, got %s (%v)", status, err)
+	}
+	if repo.Dir() != dir {
+		t.Error("expected the mirror to be kept")
+	}
+
+	// Once the upstream is back, the next try catches up
+	if err := execCommand("git", "-C", upstreamDir, "commit", "--allow-empty", "-m", "Another revision"); err != nil {
+		t.Fatal(err)
+	}
+	upstreamHead, err := refRevision(ctx, gitExec{}, upstreamDir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failUploadPack(t, repo, "")
+	for {
+		if head, err := repo.Revision(ctx, "HEAD"); err == nil && head == upstreamHead {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("expected the repo to be refreshed once the upstream was back")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if repo.Dir() != dir || observer.count(OpClone, true) != 1 {
+		t.Error("expected the mirror to be kept, not cloned again")
+	}
+}
+
+func TestStart_RefreshNotRetryable(t *testing.T) {
+	upstreamDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstreamDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+	observer := &recordingObserver{}
+	backoff := Backoff{Initial: 10 * time.Millisecond, Max: time.Minute, Factor: 2}
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly, ObserveWith(observer), backoff, PollInterval(time.Hour))
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	failUploadPack(t, repo, "git@githost: Permission denied (publickey).")
+	stop := startRepo(repo)
+	repo.Notify()
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	// The refresh isn't tried again, and nor is cloning afresh, any
+	// time soon
+	if failures := observer.count(OpFetch, false); failures != 1 {
+		t.Errorf("expected one failed refresh, got %d", failures)
+	}
+	if status, err := repo.Status(); status != RepoNew || err == nil || IsRetryable(err) {
+		t.Errorf("expected the repo to be unready with the error from refreshing, got %s (%v)", status, err)
+	}
+	if clones := observer.count(OpClone, true) + observer.count(OpClone, false); clones != 1 {
+		t.Errorf("expected no attempt to clone again, got %d clones in all", clones)
+	}
+}
+
+func TestBackoffWait(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 10 * time.Second, Factor: 2}
+	for failures, expected := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+		5: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		if wait := b.wait(failures); wait != expected {
+			t.Errorf("after %d failures, expected to wait %s, got %s", failures, expected, wait)
+		}
+	}
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if wait := b.wait(2); wait < time.Second || wait > 3*time.Second {
+			t.Fatalf("expected wait with jitter to be within 50%% of 2s, got %s", wait)
+		}
+	}
+	if wait := b.wait(9); wait > b.Max {
+		t.Errorf("expected wait with jitter to be no more than the maximum, got %s", wait)
+	}
+}
+
+func TestBackoffDefaults(t *testing.T) {
+	// Given only Max, the rest are as default, rather than there
+	// being no wait at all.
+	r := NewRepo(Remote{URL: "https://example.com/repo"}, Backoff{Max: time.Minute})
+	if expected := (Backoff{Initial: defaultBackoff.Initial, Max: time.Minute, Factor: defaultBackoff.Factor}); r.backoff != expected {
+		t.Errorf("expected backoff %+v, got %+v", expected, r.backoff)
+	}
+	if wait := r.backoff.wait(1); wait != defaultBackoff.Initial {
+		t.Errorf("expected to wait %s after the first failure, got %s", defaultBackoff.Initial, wait)
+	}
+
+	r = NewRepo(Remote{URL: "https://example.com/repo"}, Backoff{Initial: -time.Second, Factor: 0.5, Jitter: 0.1})
+	if expected := (Backoff{Initial: defaultBackoff.Initial, Max: defaultBackoff.Max, Factor: defaultBackoff.Factor, Jitter: 0.1}); r.backoff != expected {
+		t.Errorf("expected backoff %+v, got %+v", expected, r.backoff)
+	}
+}
+
+// looseObjects gives the number of loose objects in the repo.
+func looseObjects(t *testing.T, ctx context.Context, dir string) int {
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, []string{"count-objects"}, gitCmdConfig{dir: dir, out: out}); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if _, err := fmt.Sscanf(out.String(), "%d objects", &count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func writeLooseObject(t *testing.T, ctx context.Context, dir string) {
+	args := []string{"hash-object", "-w", "--stdin"}
+	in := bytes.NewBufferString("unreachable " + time.Now().String())
+	if err := execGitCmd(ctx, args, gitCmdConfig{dir: dir, in: in, out: ioutil.Discard}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+	observer := &recordingObserver{}
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly, GCEvery(2), ObserveWith(observer))
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	writeLooseObject(t, ctx, repo.Dir())
+	if n := looseObjects(t, ctx, repo.Dir()); n == 0 {
+		t.Fatal("expected some loose objects before GC")
+	}
+	if err := repo.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := looseObjects(t, ctx, repo.Dir()); n != 0 {
+		t.Errorf("expected no loose objects after GC, got %d", n)
+	}
+
+	// The first refresh doesn't reach the GC threshold, the second
+	// does.
+	writeLooseObject(t, ctx, repo.Dir())
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := looseObjects(t, ctx, repo.Dir()); n == 0 {
+		t.Error("expected loose objects to survive a single refresh")
+	}
+	if err := repo.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := looseObjects(t, ctx, repo.Dir()); n != 0 {
+		t.Errorf("expected no loose objects after second refresh, got %d", n)
+	}
+
+	var gcs int
+	for i, op := range observer.ops {
+		if op == OpGC {
+			gcs++
+			if !observer.ok[i] {
+				t.Error("expected GC to be reported as succeeding")
+			}
+		}
+	}
+	if gcs != 2 {
+		t.Errorf("expected two GCs to be observed, got %d", gcs)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"dev", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateFile(filepath.Join(newDir, "dev"), map[string]string{"helloworld-deploy.yaml": "changed\n"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", newDir, "rm", "--quiet", "prod/helloworld-deploy.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", newDir, "commit", "-a", "-m", "Change dev, remove from prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	patch, err := repo.Diff(ctx, "HEAD~1", "HEAD", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(patch, []byte("+changed")) || bytes.Contains(patch, []byte("prod/")) {
+		t.Errorf("expected diff of only dev/, got:\n%s", patch)
+	}
+
+	changes, err := repo.DiffFiles(ctx, "HEAD~1", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FileChange{
+		{Path: "dev/helloworld-deploy.yaml", Type: FileModified},
+		{Path: "prod/helloworld-deploy.yaml", Type: FileDeleted},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+	}
+
+	// prod was added in the second commit
+	changes, err = repo.DiffFiles(ctx, "HEAD~3", "HEAD~2", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no changes under dev/, got %v", changes)
+	}
+	changes, err = repo.DiffFiles(ctx, "HEAD~3", "HEAD~2", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 {
+		t.Error("expected files to be added under prod/")
+	}
+	for _, c := range changes {
+		if c.Type != FileAdded {
+			t.Errorf("expected %s to be added, but it was %s", c.Path, c.Type)
+		}
+	}
+}
+
+func TestReadFileAtRev(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"dev", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateDirAndCommit(newDir, "dev", map[string]string{"helloworld-deploy.yaml": "changed\n"}); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	current, err := repo.ReadFileAtRev(ctx, "HEAD", "dev/helloworld-deploy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "changed\n" {
+		t.Errorf("expected changed file at HEAD, got %q", current)
+	}
+	previous, err := repo.ReadFileAtRev(ctx, "HEAD~1", "dev/helloworld-deploy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(previous) != testfiles.Files["helloworld-deploy.yaml"] {
+		t.Errorf("expected original file at HEAD~1, got %q", previous)
+	}
+	if _, err := repo.ReadFileAtRev(ctx, "HEAD", "dev/does-not-exist.yaml"); err == nil {
+		t.Error("expected error reading file that does not exist")
+	}
+
+	files, err := repo.ListFilesAtRev(ctx, "HEAD", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(testfiles.Files) {
+		t.Errorf("expected %d files under dev/, got %v", len(testfiles.Files), files)
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f, "dev/") {
+			t.Errorf("expected only files under dev/, got %s", f)
+		}
+	}
+	// prod was added in the second commit
+	files, err = repo.ListFilesAtRev(ctx, "HEAD~3", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no files under prod/ before it was added, got %v", files)
+	}
+}
+
+func TestResolveRevision(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", newDir, "tag", "-a", "-m", "annotated", "v1", "HEAD~1"); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	head, err := repo.Revision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := repo.Revision(ctx, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, expected := range map[string]string{
+		"HEAD":              head,
+		"master":            head,
+		"refs/heads/master": head,
+		"v1":                previous, // the commit, not the tag object
+		head[:7]:            head,
+	} {
+		rev, err := repo.ResolveRevision(ctx, ref)
+		if err != nil {
+			t.Errorf("resolving %s: %v", ref, err)
+		} else if rev != expected {
+			t.Errorf("expected %s to resolve to %s, got %s", ref, expected, rev)
+		}
+		if ok, err := repo.RefExists(ctx, ref); !ok || err != nil {
+			t.Errorf("expected %s to exist, got %v, %v", ref, ok, err)
+		}
+	}
+
+	for _, ref := range []string{"does-not-exist", "refs/tags/v2", "0000000000000000000000000000000000000000"} {
+		_, err := repo.ResolveRevision(ctx, ref)
+		if notFound, ok := err.(RefNotFoundError); !ok || notFound.Ref != ref {
+			t.Errorf("expected RefNotFoundError for %s, got %v", ref, err)
+		}
+		if ok, err := repo.RefExists(ctx, ref); ok || err != nil {
+			t.Errorf("expected %s not to exist, got %v, %v", ref, ok, err)
+		}
+	}
+}
+
+func TestRefresh_StaleRefs(t *testing.T) {
+	upstreamDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstreamDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testNote(upstreamDir, "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+	notesRef := "refs/notes/" + testNoteRef
+	oldNotes, err := refRevision(ctx, gitExec{}, repo.Dir(), notesRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new commit and note arrive upstream, but the notes ref can't
+	// be updated locally.
+	if err := execCommand("git", "-C", upstreamDir, "commit", "--allow-empty", "-m", "Another revision"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testNote(upstreamDir, "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	lock := filepath.Join(repo.Dir(), notesRef+".lock")
+	if err := os.MkdirAll(filepath.Dir(lock), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(lock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.Refresh(ctx)
+	stale, ok := err.(StaleRefsError)
+	if !ok {
+		t.Fatalf("expected StaleRefsError, got %v", err)
+	}
+	if !reflect.DeepEqual(stale.Refs, mirrorRefspecs[1]) {
+		t.Errorf("expected notes refs to be reported as stale, got %v", stale.Refs)
+	}
+
+	upstreamHead, err := refRevision(ctx, gitExec{}, upstreamDir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Revision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != upstreamHead {
+		t.Errorf("expected branch to be fetched, despite notes failing")
+	}
+	notes, err := refRevision(ctx, gitExec{}, repo.Dir(), notesRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes != oldNotes {
+		t.Errorf("expected notes ref to be left as it was")
+	}
+}
+
+// BenchmarkFetch compares fetching the branches and notes one after
+// the other, with fetching them concurrently as Refresh does, from an
+// upstream that takes a while to respond.
+func BenchmarkFetch(b *testing.B) {
+	upstreamDir, err := ioutil.TempDir(os.TempDir(), "flux-test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(upstreamDir)
+
+	ctx := context.Background()
+	if err := createRepo(upstreamDir, []string{"config"}); err != nil {
+		b.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		b.Fatal(err)
+	}
+	defer repo.Clean()
+	// upload-pack is run with the shell, so this delays each fetch
+	if err := execCommand("git", "-C", repo.Dir(), "config", "remote.origin.uploadpack", "sleep 0.1; git-upload-pack"); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, refspecs := range mirrorRefspecs {
+				if err := fetchAtomic(ctx, gitExec{}, repo.Dir(), "origin", nil, nil, refspecs...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := fetchConcurrently(ctx, gitExec{}, repo.Dir(), "origin", nil, mirrorRefspecs, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkReadDuringRefresh reads the repo while it's being
+// refreshed over and over, from an upstream that takes a while to
+// respond; reads shouldn't have to wait for the refreshes.
+func BenchmarkReadDuringRefresh(b *testing.B) {
+	upstreamDir, err := ioutil.TempDir(os.TempDir(), "flux-test")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(upstreamDir)
+
+	ctx := context.Background()
+	if err := createRepo(upstreamDir, []string{"config"}); err != nil {
+		b.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		b.Fatal(err)
+	}
+	defer repo.Clean()
+	if err := execCommand("git", "-C", repo.Dir(), "config", "remote.origin.uploadpack", "sleep 0.1; git-upload-pack"); err != nil {
+		b.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := repo.Refresh(ctx); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := repo.CommitsBefore(ctx, "HEAD"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestFetchRev(t *testing.T) {
+	upstreamDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstreamDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	// A commit that isn't on any branch upstream
+	out := &bytes.Buffer{}
+	c := exec.Command("git", "-C", upstreamDir, "commit-tree", "HEAD^{tree}", "-p", "HEAD", "-m", "Not on a branch")
+	c.Stdout = out
+	if err := c.Run(); err != nil {
+		t.Fatal(err)
+	}
+	rev := strings.TrimSpace(out.String())
+
+	if err := repo.FetchRev(ctx, rev[:12]); err == nil {
+		t.Error("expected error fetching an abbreviated revision")
+	}
+
+	// Protocol v2 upstreams allow any commit to be fetched, so use the
+	// original protocol, where it has to be allowed explicitly.
+	if err := execCommand("git", "-C", repo.Dir(), "config", "protocol.version", "0"); err != nil {
+		t.Fatal(err)
+	}
+	err := repo.FetchRev(ctx, rev)
+	if _, ok := err.(FetchRevError); !ok {
+		t.Fatalf("expected FetchRevError, got %v", err)
+	}
+	if _, ok := Cause(err).(RefNotFoundError); !ok {
+		t.Errorf("expected the cause to be a RefNotFoundError, got %T", Cause(err))
+	}
+	if err := execCommand("git", "-C", upstreamDir, "config", "uploadpack.allowAnySHA1InWant", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.FetchRev(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	commits, err := repo.CommitsBefore(ctx, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commits[0].Revision != rev || commits[0].Message != "Not on a branch" {
+		t.Errorf("expected the fetched commit, got %+v", commits[0])
+	}
+
+	// It's there now, so there's no need to ask the upstream
+	if err := execCommand("git", "-C", upstreamDir, "config", "uploadpack.allowAnySHA1InWant", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.FetchRev(ctx, rev); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxRepoBytes(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+	if err := createRepo(newDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly, MaxRepoBytes(1), Backoff{Initial: time.Hour})
+	shortCtx, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if err := repo.Ready(shortCtx); err != (RepoTooLargeError{Limit: 1}) {
+		t.Errorf("expected RepoTooLargeError, got %v", err)
+	}
+
+	repo = NewRepo(Remote{URL: newDir}, ReadOnly, MaxRepoBytes(100<<20))
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	repo.Clean()
+}
+
+func TestWithSizeLimit(t *testing.T) {
+	dir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Keep writing until told to stop, like a clone that's getting
+	// too big.
+	err := withSizeLimit(ctx, dir, 1024, func(ctx context.Context) error {
+		f, err := os.Create(filepath.Join(dir, "big"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		chunk := make([]byte, 512)
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+				if _, err := f.Write(chunk); err != nil {
+					return err
+				}
+			}
+		}
+	})
+	if err != (RepoTooLargeError{Limit: 1024}) {
+		t.Errorf("expected RepoTooLargeError, got %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("expected writing to be stopped before the test's deadline")
+	}
+
+	// Within the limit
+	if err := withSizeLimit(ctx, dir, 1<<20, func(context.Context) error { return nil }); err != nil {
+		t.Errorf("expected no error within the limit, got %v", err)
+	}
+}
+
+func TestMirrorTo(t *testing.T) {
+	upstreamDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+	backupDir, cleanupBackup := testfiles.TempDir(t)
+	defer cleanupBackup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstreamDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", upstreamDir, "branch", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "init", "--bare", "--quiet", backupDir); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo(Remote{URL: upstreamDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+	head, err := repo.Revision(ctx, "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backupRevision := func(ref string) string {
+		out := &bytes.Buffer{}
+		if err := execGitCmd(ctx, []string{"rev-parse", "--verify", "--quiet", ref}, gitCmdConfig{dir: backupDir, out: out}); err != nil {
+			return ""
+		}
+		return strings.TrimSpace(out.String())
+	}
+
+	// Only the refspec asked for
+	if err := repo.MirrorTo(ctx, Remote{URL: backupDir}, nil, "refs/heads/master"); err != nil {
+		t.Fatal(err)
+	}
+	if rev := backupRevision("refs/heads/master"); rev != head {
+		t.Errorf("expected master in backup to be at %s, got %q", head, rev)
+	}
+	if rev := backupRevision("refs/heads/other"); rev != "" {
+		t.Errorf("expected only master to be pushed to backup, but other is at %s", rev)
+	}
+
+	// Everything
+	if err := repo.MirrorTo(ctx, Remote{URL: backupDir}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rev := backupRevision("refs/heads/other"); rev != head {
+		t.Errorf("expected other in backup to be at %s, got %q", head, rev)
+	}
+
+	if err := repo.MirrorTo(ctx, Remote{URL: backupDir + "-does-not-exist"}, nil); err == nil {
+		t.Error("expected error pushing to a mirror that doesn't exist")
+	}
+}
+
+func TestGitExecutablePath(t *testing.T) {
+	upstreamDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+	binDir, cleanupBin := testfiles.TempDir(t)
+	defer cleanupBin()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstreamDir, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := execCommand("git", "-C", upstreamDir, "config", "receive.denyCurrentBranch", "ignore"); err != nil {
+		t.Fatal(err)
+	}
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The wrapper records the environment it sees, for each command
+	logPath := filepath.Join(binDir, "log")
+	wrapper := filepath.Join(binDir, "wrapped-git")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$FLUX_TEST_WHO ${FLUX_TEST_LEAK:-unleaked} $1\" >> %s\nexec %s \"$@\"\n", logPath, realGit)
+	if err := ioutil.WriteFile(wrapper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FLUX_TEST_LEAK", "leaked")
+	defer os.Unsetenv("FLUX_TEST_LEAK")
+
+	repo := NewRepo(Remote{URL: upstreamDir}, GitExecutablePath(wrapper), ExtraEnv{"FLUX_TEST_WHO": "repo"})
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	checkout, err := repo.Clone(ctx, Config{
+		Branch:    "master",
+		UserName:  "example",
+		UserEmail: "example@example.com",
+		ExtraEnv:  map[string]string{"FLUX_TEST_WHO": "checkout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkout.Clean()
+	if err := updateFile(checkout.Dir(), map[string]string{"dev/changed.yaml": "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkout.CommitAndPush(ctx, CommitAction{Message: "Change"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, line := range splitList(string(log)) {
+		seen[line] = true
+	}
+	for _, expected := range []string{"repo unleaked clone", "repo unleaked fetch", "checkout unleaked clone", "checkout unleaked commit", "checkout unleaked push"} {
+		if !seen[expected] {
+			t.Errorf("expected %q in the log of git commands, got:\n%s", expected, log)
+		}
+	}
+	for line := range seen {
+		if strings.Contains(line, "leaked") && !strings.Contains(line, "unleaked") {
+			t.Errorf("expected the environment of this process not to be passed on, got %q", line)
+		}
+	}
+}
+
+// ownObjects gives how many objects the repo at dir has in its own
+// object store, loose or packed, rather than borrowed from elsewhere.
+func ownObjects(t *testing.T, ctx context.Context, dir string) int {
+	out := &bytes.Buffer{}
+	if err := execGitCmd(ctx, []string{"count-objects", "-v"}, gitCmdConfig{dir: dir, out: out}); err != nil {
+		t.Fatal(err)
+	}
+	var total int
+	for _, line := range splitList(out.String()) {
+		var n int
+		if _, err := fmt.Sscanf(line, "count: %d", &n); err == nil {
+			total += n
+		} else if _, err := fmt.Sscanf(line, "in-pack: %d", &n); err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+func TestCacheDir(t *testing.T) {
+	upstream, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+	cacheDir, cacheCleanup := testfiles.TempDir(t)
+	defer cacheCleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(upstream, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two at once, so they have to take turns with the cache
+	repos := []*Repo{
+		NewRepo(Remote{URL: upstream}, ReadOnly, CacheDir(cacheDir)),
+		NewRepo(Remote{URL: upstream}, ReadOnly, CacheDir(cacheDir)),
+	}
+	errs := make(chan error, len(repos))
+	for _, repo := range repos {
+		defer repo.Clean()
+		go func(repo *Repo) { errs <- repo.Ready(ctx) }(repo)
+	}
+	for range repos {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one reference clone in the cache, got %d entries", len(entries))
+	}
+	reference := filepath.Join(cacheDir, entries[0].Name())
+	if n := ownObjects(t, ctx, reference); n == 0 {
+		t.Error("expected the reference clone to have the objects")
+	}
+	head, err := refRevision(ctx, gitExec{}, upstream, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, repo := range repos {
+		if n := ownObjects(t, ctx, repo.Dir()); n != 0 {
+			t.Errorf("expected repo %d to borrow all its objects, but it has %d of its own", i, n)
+		}
+		if rev, err := repo.Revision(ctx, "HEAD"); err != nil || rev != head {
+			t.Errorf("expected repo %d to be at %s, got %s (err: %v)", i, head, rev, err)
+		}
+	}
+
+	// Clones of the mirror get the objects it borrows
+	export, err := repos[0].Export(ctx, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer export.Clean()
+	if rev, err := refRevision(ctx, gitExec{}, export.dir, "HEAD"); err != nil || rev != head {
+		t.Errorf("expected the export to be at %s, got %s (err: %v)", head, rev, err)
+	}
+}
@@ -0,0 +1,161 @@
+package git
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultSignatureCacheSize is how many commits' signatures a Repo
+// remembers, unless told otherwise with SignatureCacheSize.
+const defaultSignatureCacheSize = 10000
+
+// SignatureCacheSize is an Option giving how many commits' signatures
+// to remember, so that walking the same history again doesn't run
+// gpg for every commit. Zero or less means signatures are always
+// checked afresh.
+type SignatureCacheSize int
+
+func (s SignatureCacheSize) apply(r *Repo) {
+	r.signatures = newSignatureCache(int(s))
+}
+
+// signature is what git makes of the GPG signature of a commit.
+type signature struct {
+	key, fingerprint, status string
+}
+
+// cacheable says whether the signature can be remembered. A commit's
+// signature never changes, but one that can't be checked because the
+// key is missing (status "E") may check out once the key is added to
+// the keyring.
+func (s signature) cacheable() bool {
+	return s.status != "E"
+}
+
+// keyringFiles are the files in a GPG home that, if changed, may
+// change what's made of a signature: the public keys (in either
+// format), e.g., when one is revoked, and how far they're trusted.
+var keyringFiles = []string{"pubring.kbx", "pubring.gpg", "trustdb.gpg"}
+
+// keyringVersion identifies the keyring in the GPG home given (or the
+// default, if it's empty) as it is now, by the size and modification
+// time of its files, so that the cache can tell when it's changed.
+func keyringVersion(gpgHome string) string {
+	dir := gpgHome
+	if dir == "" {
+		dir = os.Getenv("GNUPGHOME")
+	}
+	if dir == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			dir = filepath.Join(home, ".gnupg")
+		}
+	}
+	version := gpgHome
+	for _, name := range keyringFiles {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			version += fmt.Sprintf(":%s@%d+%d", name, info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return version
+}
+
+// signatureCache remembers the signatures of commits, as checked with
+// a particular keyring, forgetting the least recently used when it's
+// full. It's emptied if asked about a different keyring, or the same
+// keyring after it's changed, since the answers may then be different.
+type signatureCache struct {
+	mu      sync.Mutex
+	size    int
+	keyring string // as given by keyringVersion
+	entries map[string]*list.Element
+	lru     *list.List // of *signatureEntry, most recently used first
+}
+
+type signatureEntry struct {
+	rev string
+	sig signature
+}
+
+func newSignatureCache(size int) *signatureCache {
+	return &signatureCache{size: size, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *signatureCache) get(keyring, rev string) (signature, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkKeyring(keyring)
+	e, ok := c.entries[rev]
+	if !ok {
+		return signature{}, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*signatureEntry).sig, true
+}
+
+func (c *signatureCache) add(keyring, rev string, sig signature) {
+	if c.size <= 0 || !sig.cacheable() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checkKeyring(keyring)
+	if e, ok := c.entries[rev]; ok {
+		e.Value.(*signatureEntry).sig = sig
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[rev] = c.lru.PushFront(&signatureEntry{rev: rev, sig: sig})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*signatureEntry).rev)
+	}
+}
+
+// checkKeyring empties the cache if it was filled using a different
+// keyring, or version of it. It must be called with mu held.
+func (c *signatureCache) checkKeyring(keyring string) {
+	if keyring == c.keyring {
+		return
+	}
+	c.keyring = keyring
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+// fillSignatures fills in the signatures of the commits given, from
+// the cache where possible, and otherwise by asking git (and so gpg)
+// about all the rest at once. It must be called with a read lock held.
+func (r *Repo) fillSignatures(ctx context.Context, commits []Commit) error {
+	keyring := keyringVersion(r.gpgHome)
+	var missing []string
+	for i := range commits {
+		if sig, ok := r.signatures.get(keyring, commits[i].Revision); ok {
+			commits[i].setSignature(sig)
+		} else {
+			missing = append(missing, commits[i].Revision)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sigs, err := signatures(ctx, r.exec, r.dir, missing, gpgEnv(r.gpgHome))
+	if err != nil {
+		return err
+	}
+	for i := range commits {
+		if sig, ok := sigs[commits[i].Revision]; ok {
+			commits[i].setSignature(sig)
+			r.signatures.add(keyring, commits[i].Revision, sig)
+		}
+	}
+	return nil
+}
+
+func (c *Commit) setSignature(sig signature) {
+	c.SigningKey, c.SigningFingerprint, c.SignatureStatus = sig.key, sig.fingerprint, sig.status
+}
@@ -0,0 +1,83 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignatureCacheEviction(t *testing.T) {
+	cache := newSignatureCache(2)
+	good := signature{key: "ABCD", status: "G"}
+	cache.add("", "a", good)
+	cache.add("", "b", good)
+	if _, ok := cache.get("", "a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	// b is now the least recently used
+	cache.add("", "c", good)
+	if _, ok := cache.get("", "b"); ok {
+		t.Error("expected b to have been evicted")
+	}
+	for _, rev := range []string{"a", "c"} {
+		if sig, ok := cache.get("", rev); !ok || sig != good {
+			t.Errorf("expected %s to be cached, got %+v, %v", rev, sig, ok)
+		}
+	}
+
+	cache.add("", "d", signature{status: "E"})
+	if _, ok := cache.get("", "d"); ok {
+		t.Error("expected a signature that couldn't be checked not to be cached")
+	}
+
+	if _, ok := cache.get("/other/keyring", "a"); ok {
+		t.Error("expected a different keyring to empty the cache")
+	}
+	if _, ok := cache.get("", "a"); ok {
+		t.Error("expected the cache to stay empty on going back to the first keyring")
+	}
+}
+
+func TestSignatureCacheDisabled(t *testing.T) {
+	cache := newSignatureCache(0)
+	cache.add("", "a", signature{status: "G"})
+	if _, ok := cache.get("", "a"); ok {
+		t.Error("expected nothing to be cached")
+	}
+}
+
+func TestKeyringVersion(t *testing.T) {
+	gpgHome, err := ioutil.TempDir("", "flux-gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gpgHome)
+
+	empty := keyringVersion(gpgHome)
+	pubring := filepath.Join(gpgHome, "pubring.kbx")
+	if err := ioutil.WriteFile(pubring, []byte("keys"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	written := keyringVersion(gpgHome)
+	if written == empty {
+		t.Error("expected adding a keyring file to change the version")
+	}
+	if v := keyringVersion(gpgHome); v != written {
+		t.Errorf("expected the version to stay %q while the keyring is unchanged, got %q", written, v)
+	}
+
+	cache := newSignatureCache(2)
+	cache.add(written, "a", signature{key: "ABCD", status: "G"})
+	if _, ok := cache.get(keyringVersion(gpgHome), "a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(pubring, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get(keyringVersion(gpgHome), "a"); ok {
+		t.Error("expected changing the keyring to empty the cache")
+	}
+}
@@ -0,0 +1,214 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isKeyID says whether the signing key given is already a key ID or
+// fingerprint (in hex, possibly with a leading 0x), rather than a
+// user ID such as an email address.
+func isKeyID(key string) bool {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "0x"), "0X")
+	switch len(key) {
+	case 8, 16, 40, 64:
+	default:
+		return false
+	}
+	for _, c := range key {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveSigningKey gives the fingerprint of the secret key that the
+// signing key given refers to. Key IDs and fingerprints are returned
+// as they are; anything else is taken to be a user ID, and looked up
+// in the keyring (as given by GNUPGHOME in extraEnv, or the process's
+// own). A bare email address is matched exactly, rather than as a
+// substring. If there is not exactly one usable key matching, the
+// result is a SigningKeyError. Since the key is about to be used, it
+// also makes sure there's a gpg-agent to sign with (see
+// ensureGPGAgent), unless there's a GPGProgram (in extraEnv) to use
+// instead of gpg.
+func resolveSigningKey(ctx context.Context, key string, extraEnv []string) (string, error) {
+	if key == "" {
+		return key, nil
+	}
+	program := gpgProgramIn(extraEnv)
+	if program == "" {
+		program = "gpg"
+		if err := ensureGPGAgent(ctx, extraEnv); err != nil {
+			return "", err
+		}
+	}
+	if isKeyID(key) {
+		return key, nil
+	}
+	uid := key
+	if strings.Contains(uid, "@") && !strings.ContainsAny(uid, "<>=") {
+		uid = "<" + uid + ">"
+	}
+
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, program, "--batch", "--with-colons", "--list-secret-keys", "--", uid)
+	cmd.Env = append(env(), extraEnv...)
+	cmd.Stdout, cmd.Stderr = out, errOut
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(errOut.String(), "No secret key") {
+			return "", SigningKeyError{Key: key}
+		}
+		return "", errors.Wrapf(err, "looking up signing key %q: %s", key, strings.TrimSpace(errOut.String()))
+	}
+
+	fingerprints := parseSecretKeys(out.String())
+	if len(fingerprints) != 1 {
+		return "", SigningKeyError{Key: key, Fingerprints: fingerprints}
+	}
+	return fingerprints[0], nil
+}
+
+// parseSecretKeys gives the fingerprints of the primary secret keys
+// in the output of `gpg --with-colons --list-secret-keys` that can be
+// used for signing, skipping those that are revoked, expired or
+// disabled.
+func parseSecretKeys(s string) []string {
+	var fingerprints []string
+	var usable, wantFpr bool
+	for _, line := range splitList(s) {
+		fields := strings.Split(line, ":")
+		switch fields[0] {
+		case "sec":
+			wantFpr = true
+			usable = len(fields) > 11 &&
+				!strings.ContainsAny(fields[1], "rendi") &&
+				strings.ContainsAny(fields[11], "sS") &&
+				!strings.Contains(fields[11], "D")
+		case "ssb":
+			wantFpr = false
+		case "fpr":
+			if wantFpr && usable && len(fields) > 9 {
+				fingerprints = append(fingerprints, fields[9])
+			}
+			wantFpr = false
+		}
+	}
+	return fingerprints
+}
+
+// importSigningKey imports the armored secret key given into a
+// keyring of its own, in a temporary directory, so it can be signed
+// with without going in any other keyring. It returns the environment
+// entries for using the keyring (to go after those in extraEnv), the
+// fingerprints of the secret keys imported that can sign, and a func
+// to remove the keyring again, along with any agent started for it;
+// that must be called once the signing is done, whether it worked or
+// not.
+func importSigningKey(ctx context.Context, key []byte, extraEnv []string) (_, _ []string, _ func(), err error) {
+	home, err := makeTempDir(gpgHomePrefix)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyEnv := gpgEnv(home)
+	extraEnv = append(append([]string{}, extraEnv...), keyEnv...)
+	cleanup := func() {
+		// There's nothing to be done if this fails, and the agent goes
+		// away by itself once its directory has been removed.
+		cmd := exec.Command("gpgconf", "--kill", "gpg-agent")
+		cmd.Env = append(env(), extraEnv...)
+		cmd.Run()
+		removeTempDir(home)
+	}
+	defer func() {
+		if err != nil {
+			cleanup()
+		}
+	}()
+
+	program := gpgProgramIn(extraEnv)
+	if program == "" {
+		program = "gpg"
+	}
+	errOut := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, program, "--batch", "--import")
+	cmd.Env = append(env(), extraEnv...)
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(key), errOut
+	if err := cmd.Run(); err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "importing signing key: %s", strings.TrimSpace(errOut.String()))
+	}
+	out := &bytes.Buffer{}
+	errOut.Reset()
+	cmd = exec.CommandContext(ctx, program, "--batch", "--with-colons", "--list-secret-keys")
+	cmd.Env = append(env(), extraEnv...)
+	cmd.Stdout, cmd.Stderr = out, errOut
+	if err := cmd.Run(); err != nil {
+		return nil, nil, nil, errors.Wrapf(err, "listing imported signing keys: %s", strings.TrimSpace(errOut.String()))
+	}
+	return keyEnv, parseSecretKeys(out.String()), cleanup, nil
+}
+
+// ensureGPGAgent makes sure gpg will be able to reach a gpg-agent,
+// which (from GnuPG 2.1) does the signing. gpg would usually start
+// one itself, but may not manage to in a container, and then fails
+// with an unhelpful message; so if there's no agent running for the
+// keyring, this starts one (which lasts as long as the keyring's
+// directory), and if that doesn't work either, returns a
+// GPGAgentError saying where the agent's socket was expected. If
+// GnuPG's tools for talking to the agent aren't installed (e.g., with
+// GnuPG 1), there's no agent to look for, and it returns nil.
+func ensureGPGAgent(ctx context.Context, extraEnv []string) error {
+	if _, err := exec.LookPath("gpg-connect-agent"); err != nil {
+		return nil
+	}
+	if agentRunning(ctx, extraEnv) {
+		return nil
+	}
+	errOut := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "gpgconf", "--launch", "gpg-agent")
+	cmd.Env = append(env(), extraEnv...)
+	cmd.Stderr = errOut
+	err := cmd.Run()
+	if err == nil && agentRunning(ctx, extraEnv) {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		err = errors.New("gpg-agent was started, but can't be reached")
+	} else if msg := strings.TrimSpace(errOut.String()); msg != "" {
+		err = errors.Wrap(err, msg)
+	}
+	return GPGAgentError{Socket: agentSocket(ctx, extraEnv), Err: err}
+}
+
+// agentRunning says whether a gpg-agent is running for the keyring,
+// without starting one.
+func agentRunning(ctx context.Context, extraEnv []string) bool {
+	out := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "gpg-connect-agent", "--no-autostart", "GETINFO version", "/bye")
+	cmd.Env = append(env(), extraEnv...)
+	cmd.Stdout = out
+	// It reports not finding an agent on stderr, and exits zero
+	// regardless; the agent is there if it answered.
+	return cmd.Run() == nil && strings.Contains(out.String(), "OK")
+}
+
+// agentSocket gives the path to where gpg expects the socket of the
+// keyring's gpg-agent, or empty if gpg can't say.
+func agentSocket(ctx context.Context, extraEnv []string) string {
+	out := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, "gpgconf", "--list-dirs", "agent-socket")
+	cmd.Env = append(env(), extraEnv...)
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out.String())
+}
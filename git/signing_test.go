@@ -0,0 +1,74 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsKeyID(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"4FFBFC0B":           true,
+		"0x42532AEA4FFBFC0B": true,
+		"649C056644DBB17D123D699B42532AEA4FFBFC0B": true,
+		"flux@weave.works":                         false,
+		"Weave Flux":                               false,
+		"DEADBEEFX":                                false,
+	} {
+		assert.Equal(t, expected, isKeyID(key), key)
+	}
+}
+
+func TestParseSecretKeys(t *testing.T) {
+	out := `sec:u:1024:17:42532AEA4FFBFC0B:1552550000:::u:::scSC:::+:::23::0:
+fpr:::::::::649C056644DBB17D123D699B42532AEA4FFBFC0B:
+grp:::::::::0123456789ABCDEF0123456789ABCDEF01234567:
+uid:u::::1552550000::AAAA::Weave Flux <flux@weave.works>::::::::::0:
+ssb:u:2048:1:1111111111111111:1552550000::::::s:::+:::23:
+fpr:::::::::2222222222222222222222222222221111111111:
+sec:r:1024:17:3333333333333333:1552550000:::u:::scSC:::+:::23::0:
+fpr:::::::::4444444444444444444444443333333333333333:
+sec:u:1024:17:5555555555555555:1552550000:::u:::eE:::+:::23::0:
+fpr:::::::::6666666666666666666666665555555555555555:
+`
+	assert.Equal(t, []string{"649C056644DBB17D123D699B42532AEA4FFBFC0B"}, parseSecretKeys(out))
+}
+
+func TestEnsureGPGAgent(t *testing.T) {
+	if _, err := exec.LookPath("gpg-connect-agent"); err != nil {
+		t.Skip("GnuPG 2 is not installed")
+	}
+	ctx := context.Background()
+
+	home, err := ioutil.TempDir("", "flux-gpg-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	env := []string{"GNUPGHOME=" + home}
+	if agentRunning(ctx, env) {
+		t.Fatal("expected no agent to be running for a new keyring")
+	}
+	if err := ensureGPGAgent(ctx, env); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd := exec.Command("gpgconf", "--kill", "gpg-agent")
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Run()
+	}()
+	assert.True(t, agentRunning(ctx, env), "expected an agent to have been started")
+
+	missing := []string{"GNUPGHOME=" + filepath.Join(home, "missing")}
+	err = ensureGPGAgent(ctx, missing)
+	agentErr, ok := err.(GPGAgentError)
+	if !ok {
+		t.Fatalf("expected GPGAgentError for a keyring that isn't there, got %v", err)
+	}
+	assert.Contains(t, agentErr.Error(), "gpg-agent")
+}
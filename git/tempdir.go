@@ -0,0 +1,113 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefixes for the temporary directories made by this package, so
+// that those left behind (e.g., by a process that was killed) can be
+// found again by CleanupStale.
+const (
+	mirrorDirPrefix   = "flux-gitclone"
+	workingDirPrefix  = "flux-working"
+	worktreeDirPrefix = "flux-worktree"
+	sshControlPrefix  = "flux-ssh"
+	gpgHomePrefix     = "flux-gpghome"
+)
+
+// staleAfter is how old a temporary directory must be before
+// CleanupStale will remove it.
+const staleAfter = time.Hour
+
+// liveTempDirs has the temporary directories in use by this process,
+// which CleanupStale leaves alone however old they are.
+var liveTempDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+// makeTempDir makes a temporary directory with the prefix given, and
+// records it as in use until it's removed with removeTempDir.
+func makeTempDir(prefix string) (string, error) {
+	dir, err := ioutil.TempDir(os.TempDir(), prefix)
+	if err != nil {
+		return "", err
+	}
+	liveTempDirs.Lock()
+	liveTempDirs.dirs[dir] = true
+	liveTempDirs.Unlock()
+	return dir, nil
+}
+
+// ensureTempDir makes sure a directory first made with makeTempDir
+// exists, in case it has since been removed, and records it as in
+// use again.
+func ensureTempDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	liveTempDirs.Lock()
+	liveTempDirs.dirs[dir] = true
+	liveTempDirs.Unlock()
+	return nil
+}
+
+// removeTempDir removes a directory made with makeTempDir. It
+// doesn't take a context, since it should be done regardless of
+// whether the operation that used the directory was cancelled.
+func removeTempDir(dir string) error {
+	err := os.RemoveAll(dir)
+	liveTempDirs.Lock()
+	delete(liveTempDirs.dirs, dir)
+	liveTempDirs.Unlock()
+	return err
+}
+
+// CleanupStale removes temporary directories left behind by earlier
+// runs of this package: those in the system temporary directory with
+// one of the prefixes used here, which haven't been modified for an
+// hour, and which aren't in use by this process. It returns the
+// paths of the directories removed. Since it can't tell whether
+// another process is using a directory, it shouldn't be used when
+// other processes using this package share the temporary directory.
+func (r *Repo) CleanupStale() ([]string, error) {
+	return cleanupStale(os.TempDir(), time.Now().Add(-staleAfter))
+}
+
+func cleanupStale(tmp string, before time.Time) ([]string, error) {
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		return nil, err
+	}
+	liveTempDirs.Lock()
+	defer liveTempDirs.Unlock()
+	var removed []string
+	for _, info := range entries {
+		if !info.IsDir() || !info.ModTime().Before(before) || !hasTempDirPrefix(info.Name()) {
+			continue
+		}
+		dir := filepath.Join(tmp, info.Name())
+		if liveTempDirs.dirs[dir] {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+func hasTempDirPrefix(name string) bool {
+	for _, prefix := range []string{mirrorDirPrefix, workingDirPrefix, worktreeDirPrefix, sshControlPrefix, gpgHomePrefix} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
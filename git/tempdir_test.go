@@ -0,0 +1,124 @@
+package git
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
+)
+
+// withTempDir points os.TempDir at a fresh directory for the
+// duration of a test, so that what's made there can be counted.
+func withTempDir(t *testing.T) (string, func()) {
+	tmp, cleanup := testfiles.TempDir(t)
+	old, had := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", tmp)
+	return tmp, func() {
+		if had {
+			os.Setenv("TMPDIR", old)
+		} else {
+			os.Unsetenv("TMPDIR")
+		}
+		cleanup()
+	}
+}
+
+func TestClone_CancelledLeavesNoDir(t *testing.T) {
+	upstreamDir, cleanupUpstream := testfiles.TempDir(t)
+	defer cleanupUpstream()
+	if err := createRepo(upstreamDir, []string{"config"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp, cleanup := withTempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	repo := NewRepo(Remote{URL: upstreamDir})
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	config := Config{Branch: "master", UserName: "example", UserEmail: "example@example.com", NotesRef: "fluxtest"}
+	// Cancelling at different points catches the clone at different
+	// stages; whichever it's at, nothing should be left behind.
+	for after := time.Duration(0); after < 100*time.Millisecond; after += 2 * time.Millisecond {
+		ctx, cancel := context.WithTimeout(context.Background(), after)
+		checkout, err := repo.Clone(ctx, config)
+		cancel()
+		if err == nil {
+			checkout.Clean()
+		}
+	}
+	// Failing after the clone is made, here because the path doesn't
+	// exist, should also remove it.
+	config.Paths = []string{"does-not-exist"}
+	if _, err := repo.Clone(ctx, config); err == nil {
+		t.Error("expected error for missing path")
+	}
+
+	entries, err := ioutil.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range entries {
+		if strings.HasPrefix(info.Name(), workingDirPrefix) {
+			t.Errorf("expected no working clones to be left behind, found %s", info.Name())
+		}
+	}
+}
+
+func TestCleanupStale(t *testing.T) {
+	tmp, cleanup := withTempDir(t)
+	defer cleanup()
+
+	old := time.Now().Add(-2 * time.Hour)
+	mkdir := func(name string, modified time.Time) string {
+		dir := filepath.Join(tmp, name)
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	stale := mkdir(workingDirPrefix+"123", old)
+	staleMirror := mkdir(mirrorDirPrefix+"456", old)
+	fresh := mkdir(workingDirPrefix+"789", time.Now())
+	other := mkdir("someone-elses", old)
+
+	live, err := makeTempDir(worktreeDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeTempDir(live)
+	if err := os.Chtimes(live, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := (&Repo{}).CleanupStale()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("expected two directories to be removed, got %v", removed)
+	}
+	for _, dir := range []string{stale, staleMirror} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", dir)
+		}
+	}
+	for _, dir := range []string{fresh, other, live} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("expected %s to be kept, got %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// transport holds the settings for git commands that talk to the
+// upstream: how to authenticate, and how to get there.
+type transport struct {
+	credentials      Credentials // may be nil
+	sshKeyPath       string
+	httpsCredentials HTTPSCredentials
+	proxyURL         string
+	knownHostsPath   string
+	hostKeys         HostKeyVerification
+	caBundlePath     string
+	insecureTLS      bool
+	// for SSH connection multiplexing; see SSHMultiplexing
+	controlDir     string
+	controlPersist time.Duration
+}
+
+// ProxyURL is the URL of a proxy through which to reach the
+// upstream, for both HTTPS and SSH. It can be an `http://` proxy
+// (using CONNECT), or a `socks5://` proxy; `https://` proxies aren't
+// supported, since SSH would be proxied without TLS. Hosts excluded
+// from proxying by `no_proxy` in the environment are honoured for
+// HTTPS, but not SSH. SSH through an HTTP proxy needs socat, and
+// version 1.7.4 or later if the proxy URL has credentials in it.
+type ProxyURL string
+
+func (p ProxyURL) apply(r *Repo) {
+	r.transport.proxyURL = string(p)
+}
+
+// CABundlePath is the path to a file of PEM certificates for git to
+// check the certificate of an HTTPS upstream against, instead of the
+// system's; e.g., for a server with a certificate from a private CA.
+type CABundlePath string
+
+func (p CABundlePath) apply(r *Repo) {
+	r.transport.caBundlePath = string(p)
+}
+
+// InsecureSkipTLSVerify turns off checking the certificate of an
+// HTTPS upstream, so that anyone in the middle can read and change
+// what's fetched and pushed. It's a last resort, for when there's no
+// CA bundle to give with CABundlePath; the Repo logs a warning (if
+// given a logger with LogWith) when it's constructed with it.
+type InsecureSkipTLSVerify bool
+
+func (v InsecureSkipTLSVerify) apply(r *Repo) {
+	r.transport.insecureTLS = bool(v)
+}
+
+// HostKeyVerification says how ssh checks the host keys of the
+// upstream. The zero value, HostKeyDefault, leaves it to ssh's own
+// configuration; anything less than strict must be asked for
+// explicitly.
+type HostKeyVerification string
+
+const (
+	HostKeyDefault   HostKeyVerification = ""
+	HostKeyStrict    HostKeyVerification = "strict"     // only hosts with known keys are accepted
+	HostKeyAcceptNew HostKeyVerification = "accept-new" // keys of new hosts are accepted and remembered; changed keys are refused
+	HostKeyInsecure  HostKeyVerification = "insecure"   // host keys are not checked at all
+)
+
+// ParseHostKeyVerification gives the HostKeyVerification named, or
+// an error if it's not one of those defined.
+func ParseHostKeyVerification(s string) (HostKeyVerification, error) {
+	switch v := HostKeyVerification(s); v {
+	case HostKeyDefault, HostKeyStrict, HostKeyAcceptNew, HostKeyInsecure:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown host key verification mode %q; expected strict, accept-new, or insecure", s)
+}
+
+func (v HostKeyVerification) apply(r *Repo) {
+	r.transport.hostKeys = v
+}
+
+// KnownHostsPath is the path to a known_hosts file for ssh to check
+// the host key of the upstream against, instead of the user's own.
+type KnownHostsPath string
+
+func (p KnownHostsPath) apply(r *Repo) {
+	r.transport.knownHostsPath = string(p)
+}
+
+// SSHMultiplexing makes ssh connections to the upstream be kept open
+// for the duration given after they're last used, and shared by later
+// git commands, so that each fetch or push doesn't have to set up a
+// new connection and authenticate again. The control sockets for the
+// connections are kept in a temporary directory accessible only to
+// this user, which is removed (and the connections closed) by
+// Repo.Clean.
+//
+// Anyone who can use a control socket can use the connection it
+// controls without authenticating, so this should only be used
+// where no untrusted process runs as the same user.
+type SSHMultiplexing time.Duration
+
+func (d SSHMultiplexing) apply(r *Repo) {
+	r.transport.controlPersist = time.Duration(d)
+}
+
+// controlOptions gives the ssh options for connection multiplexing,
+// if it's enabled.
+func (t transport) controlOptions() ([]string, error) {
+	if t.controlDir == "" || t.controlPersist <= 0 {
+		return nil, nil
+	}
+	// The directory is removed by Repo.Clean, but syncing may go on
+	// after that; so make sure it's there.
+	if err := ensureTempDir(t.controlDir); err != nil {
+		return nil, errors.Wrap(err, "making directory for SSH control sockets")
+	}
+	persist := int(t.controlPersist / time.Second)
+	if persist < 1 {
+		persist = 1
+	}
+	return []string{
+		"ControlMaster=auto",
+		"ControlPath=" + filepath.Join(t.controlDir, "%C"),
+		"ControlPersist=" + strconv.Itoa(persist),
+	}, nil
+}
+
+// stopControlMasters closes any multiplexed ssh connections with
+// control sockets in the directory given, and removes the directory.
+func stopControlMasters(dir string) {
+	sockets, _ := ioutil.ReadDir(dir)
+	for _, socket := range sockets {
+		if socket.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		// The host is needed on the command line, but isn't used
+		// when the control socket is given.
+		exec.CommandContext(ctx, "ssh", "-o", "ControlPath="+filepath.Join(dir, socket.Name()), "-O", "exit", "upstream").Run()
+		cancel()
+	}
+	removeTempDir(dir)
+}
+
+// auth gives the authentication material for the operation given:
+// that from the Credentials, if there are any, overridden by the SSH
+// key path and HTTPS credentials, if given.
+func (t transport) auth(ctx context.Context, op Operation) (Auth, error) {
+	var auth Auth
+	if t.credentials != nil {
+		var err error
+		if auth, err = t.credentials.Credentials(ctx, op); err != nil {
+			return Auth{}, errors.Wrap(err, "getting credentials")
+		}
+	}
+	if t.sshKeyPath != "" {
+		auth.SSHKeyPath = t.sshKeyPath
+	}
+	if t.httpsCredentials != (HTTPSCredentials{}) {
+		auth.HTTPS = t.httpsCredentials
+	}
+	return auth, nil
+}
+
+// withCredentials gives the transport as it is, but authenticating
+// with only the credentials given; how hosts and certificates are
+// checked, and how the upstream is reached, stay the same.
+func (t transport) withCredentials(creds Credentials) transport {
+	t.credentials = creds
+	t.sshKeyPath = ""
+	t.httpsCredentials = HTTPSCredentials{}
+	return t
+}
+
+// env gives the environment entries for commands that talk to the
+// upstream, for the operation given.
+func (t transport) env(ctx context.Context, op Operation) ([]string, error) {
+	auth, err := t.auth(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	proxyEnv, proxyCommand, err := proxy(t.proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyOptions, err := t.hostKeyOptions()
+	if err != nil {
+		return nil, err
+	}
+	controlOptions, err := t.controlOptions()
+	if err != nil {
+		return nil, err
+	}
+	env, err := sshEnv(auth.SSHKeyPath, proxyCommand, append(hostKeyOptions, controlOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	credsEnv, err := auth.HTTPS.env()
+	if err != nil {
+		return nil, err
+	}
+	tlsEnv, err := t.tlsEnv()
+	if err != nil {
+		return nil, err
+	}
+	env = append(append(env, proxyEnv...), tlsEnv...)
+	return append(env, credsEnv...), nil
+}
+
+// tlsEnv gives the environment entries for git to check the
+// certificates of HTTPS upstreams as configured.
+func (t transport) tlsEnv() ([]string, error) {
+	var env []string
+	if t.caBundlePath != "" {
+		if _, err := os.Stat(t.caBundlePath); err != nil {
+			return nil, errors.Wrap(err, "checking CA bundle")
+		}
+		env = append(env, "GIT_SSL_CAINFO="+t.caBundlePath)
+	}
+	if t.insecureTLS {
+		env = append(env, "GIT_SSL_NO_VERIFY=true")
+	}
+	return env, nil
+}
+
+// hostKeyOptions gives the ssh options for checking host keys as
+// configured.
+func (t transport) hostKeyOptions() ([]string, error) {
+	var options []string
+	switch t.hostKeys {
+	case HostKeyDefault:
+	case HostKeyStrict:
+		options = append(options, "StrictHostKeyChecking=yes")
+	case HostKeyAcceptNew:
+		options = append(options, "StrictHostKeyChecking=accept-new")
+	case HostKeyInsecure:
+		if t.knownHostsPath != "" {
+			return nil, errors.New("a known_hosts file was given, but host key verification is insecure")
+		}
+		return []string{"StrictHostKeyChecking=no", "UserKnownHostsFile=/dev/null"}, nil
+	default:
+		_, err := ParseHostKeyVerification(string(t.hostKeys))
+		return nil, err
+	}
+	if t.knownHostsPath != "" {
+		if t.hostKeys == HostKeyStrict {
+			if _, err := os.Stat(t.knownHostsPath); err != nil {
+				return nil, errors.Wrap(err, "checking known_hosts file")
+			}
+		}
+		options = append(options, "UserKnownHostsFile="+t.knownHostsPath)
+	}
+	return options, nil
+}
+
+// sshEnv gives the environment entries needed for ssh to use the
+// private key at the path given, the proxy command given, and any
+// other options given, if any. The key file must not be readable by
+// anyone other than its owner, since ssh will refuse to use it
+// otherwise.
+func sshEnv(keyPath, proxyCommand string, options ...string) ([]string, error) {
+	cmd := []string{"ssh"}
+	if keyPath != "" {
+		info, err := os.Stat(keyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "checking SSH key file")
+		}
+		if perm := info.Mode().Perm(); perm&0077 != 0 {
+			return nil, fmt.Errorf("SSH key file %s has permissions %#o; it must be accessible only by its owner (e.g., 0600)", keyPath, perm)
+		}
+		cmd = append(cmd, "-i", shellQuote(keyPath), "-o", shellQuote("IdentitiesOnly=yes"))
+	}
+	// GIT_SSH_COMMAND is run by the shell, so each value needs
+	// quoting to be passed as one argument, as it is
+	if proxyCommand != "" {
+		cmd = append(cmd, "-o", shellQuote("ProxyCommand="+proxyCommand))
+	}
+	for _, option := range options {
+		cmd = append(cmd, "-o", shellQuote(option))
+	}
+	if len(cmd) == 1 {
+		return nil, nil
+	}
+	return []string{"GIT_SSH_COMMAND=" + strings.Join(cmd, " ")}, nil
+}
+
+// shellQuote quotes the string given for the shell, so that it's
+// taken as one word, whatever's in it.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+const proxyAuthVar = "FLUX_GIT_PROXY_AUTH"
+
+// proxyConnect is the ssh ProxyCommand for an HTTP proxy that needs
+// credentials, given the proxy's host and port and the host and port
+// to connect to. The credentials are given to socat from the
+// environment on a file descriptor, as gpgProgram does with the
+// passphrase; ssh's stdin is kept aside meanwhile, for socat to
+// relay.
+const proxyConnect = `#!/bin/sh
+exec 4<&0
+printf '%s' "$` + proxyAuthVar + `" |
+    socat - "PROXY:$1:$3:$4,proxyport=$2,proxy-authorization-file=/dev/fd/3" 3<&0 0<&4 4<&-
+`
+
+// proxy gives the environment entries for proxying HTTPS, and the
+// ssh ProxyCommand for proxying SSH, via the proxy URL given.
+func proxy(proxyURL string) ([]string, string, error) {
+	if proxyURL == "" {
+		return nil, "", nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "parsing proxy URL")
+	}
+
+	host, port := u.Hostname(), u.Port()
+	var env []string
+	var proxyCommand string
+	switch u.Scheme {
+	case "http":
+		if port == "" {
+			port = "80"
+		}
+		if u.User == nil {
+			proxyCommand = fmt.Sprintf("socat - PROXY:%s:%%h:%%p,proxyport=%s", host, port)
+			break
+		}
+		// The credentials go to socat in the environment, rather
+		// than in its command line, where anyone could see them.
+		script, err := helperScript("flux-proxy", proxyConnect)
+		if err != nil {
+			return nil, "", err
+		}
+		proxyCommand = fmt.Sprintf("%s %s %s %%h %%p", shellQuote(script), host, port)
+		password, _ := u.User.Password()
+		env = append(env, proxyAuthVar+"="+u.User.Username()+":"+password)
+	case "https":
+		return nil, "", errors.New("https:// proxies are not supported; use an http:// or socks5:// proxy")
+	case "socks5", "socks5h":
+		if port == "" {
+			port = "1080"
+		}
+		proxyCommand = fmt.Sprintf("nc -X 5 -x %s %%h %%p", net.JoinHostPort(host, port))
+	default:
+		return nil, "", fmt.Errorf("unsupported proxy URL scheme %q; expected http, https, or socks5", u.Scheme)
+	}
+
+	env = append(env, "http_proxy="+proxyURL, "https_proxy="+proxyURL)
+	return env, proxyCommand, nil
+}
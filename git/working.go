@@ -1,20 +1,194 @@
 package git
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 var (
-	ErrReadOnly = errors.New("cannot make a working clone of a read-only git repo")
+	ErrReadOnly        = errors.New("cannot make a working clone of a read-only git repo")
+	ErrLFSNotInstalled = errors.New("git-lfs is needed for Git LFS support, but is not installed")
+)
+
+const pushRetryBackoff = 500 * time.Millisecond
+
+// DetachedHeadError is returned when a checkout is found to have a
+// detached HEAD, rather than having the configured branch checked
+// out; committing would make a commit not reachable from the branch.
+type DetachedHeadError struct {
+	Branch string
+}
+
+func (err DetachedHeadError) Error() string {
+	return fmt.Sprintf("checkout has a detached HEAD, but should be on branch %s", err.Branch)
+}
+
+// PushRejectedError is returned from CommitAndPush when the push was
+// still rejected after rebasing and retrying as many times as
+// configured.
+type PushRejectedError struct {
+	Attempts int
+	Err      error
+}
+
+func (err PushRejectedError) Error() string {
+	return fmt.Sprintf("push rejected after %d attempts: %s", err.Attempts, err.Err.Error())
+}
+
+// DivergedAfterPushError is returned when Config.VerifyPush is set,
+// and after pushing, the upstream branch isn't at the commit pushed;
+// e.g., because a hook on the server rewrote it. Remote is empty if
+// the branch isn't there at all.
+type DivergedAfterPushError struct {
+	Branch string
+	Pushed string
+	Remote string
+}
+
+func (err DivergedAfterPushError) Error() string {
+	if err.Remote == "" {
+		return fmt.Sprintf("pushed %s to branch %s, but the branch is not there upstream afterwards", err.Pushed, err.Branch)
+	}
+	return fmt.Sprintf("pushed %s to branch %s, but the branch is at %s upstream afterwards", err.Pushed, err.Branch, err.Remote)
+}
+
+// SyncTagRollbackError is returned, with Config.SyncTagForwardOnly,
+// when moving the sync tag would move it to a commit that isn't
+// descended from the one it's at.
+type SyncTagRollbackError struct {
+	Tag      string
+	Current  string // the commit the tag is at
+	Revision string // the commit it would have been moved to
+}
+
+func (err SyncTagRollbackError) Error() string {
+	return fmt.Sprintf("refusing to move tag %s from %s to %s, which is not descended from it", err.Tag, err.Current, err.Revision)
+}
+
+// ShallowCloneError is returned when a revision is needed that is
+// not in the history of a shallow clone, even after deepening it.
+type ShallowCloneError struct {
+	Revision string
+	Depth    int
+}
+
+func (err ShallowCloneError) Error() string {
+	return fmt.Sprintf("revision %s not found, even after deepening shallow clone (depth %d)", err.Revision, err.Depth)
+}
+
+// MissingManifestDirError is returned when a path given in
+// Config.Paths doesn't exist in the checkout.
+type MissingManifestDirError struct {
+	Path   string
+	Sparse bool // whether the checkout is sparse, which may be why
+}
+
+func (err MissingManifestDirError) Error() string {
+	if err.Sparse {
+		return fmt.Sprintf("manifest path %q not present in checkout; check it is included in the sparse paths", err.Path)
+	}
+	return fmt.Sprintf("manifest path %q does not exist in the repo", err.Path)
+}
+
+// EmptyManifestDirError is returned when a path given in
+// Config.Paths exists, but has no files in it.
+type EmptyManifestDirError struct {
+	Path string
+}
+
+func (err EmptyManifestDirError) Error() string {
+	return fmt.Sprintf("manifest path %q exists in the repo, but contains no files", err.Path)
+}
+
+// SymlinkOutsideRepoError is returned when a manifest path, or a file
+// or directory under one, is a symlink pointing outside the checkout.
+type SymlinkOutsideRepoError struct {
+	Path   string // relative to the top of the checkout
+	Target string // where the symlink resolves to
+}
+
+func (err SymlinkOutsideRepoError) Error() string {
+	return fmt.Sprintf("%q is a symlink to %q, which is outside the repo", err.Path, err.Target)
+}
+
+// StageMode says which changes in a checkout are committed.
+type StageMode string
+
+const (
+	// StageAll commits all changes under the manifest paths,
+	// including new files, deletions and renames. This is the
+	// default.
+	StageAll StageMode = "all"
+	// StageTracked commits only changes to the files already in the
+	// repo, i.e., modifications and deletions, as `git commit -a`
+	// does.
+	StageTracked StageMode = "tracked"
+)
+
+// SkipPlacement says where Config.SkipMessage goes in commit
+// messages.
+type SkipPlacement string
+
+const (
+	// SkipInline appends the SkipMessage to the end of the last line
+	// of the message, before any trailers, so it should start with a
+	// space. This is the default.
+	SkipInline SkipPlacement = "inline"
+	// SkipNewline puts the SkipMessage on a line of its own, after
+	// the message and a blank line, and before any trailers.
+	SkipNewline SkipPlacement = "newline"
+	// SkipTrailer puts the SkipMessage after any trailers, as the
+	// last line of the message; it's up to the SkipMessage to look
+	// like a trailer (e.g., "Skip-CI: true"), if that matters.
+	SkipTrailer SkipPlacement = "trailer"
+	// SkipPrefix puts the SkipMessage at the start of the first line
+	// of the message, followed by a space.
+	SkipPrefix SkipPlacement = "prefix"
+)
+
+// SubmoduleMode says which submodules of a repo are checked out in
+// its working clones.
+type SubmoduleMode string
+
+const (
+	// SubmodulesNone leaves submodules out, so their directories are
+	// empty. This is the default.
+	SubmodulesNone SubmoduleMode = "none"
+	// SubmodulesShallow checks out the repo's own submodules (but
+	// not any they have) at the commits recorded for them, fetching
+	// only those commits.
+	SubmodulesShallow SubmoduleMode = "shallow"
+	// SubmodulesRecursive checks out the repo's submodules, and
+	// theirs, and so on, each with its whole history.
+	SubmodulesRecursive SubmoduleMode = "recursive"
 )
 
+// ParseSubmoduleMode gives the SubmoduleMode named, or an error if
+// it's not one of those defined.
+func ParseSubmoduleMode(s string) (SubmoduleMode, error) {
+	switch m := SubmoduleMode(s); m {
+	case "", SubmodulesNone, SubmodulesShallow, SubmodulesRecursive:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown submodule mode %q; expected none, shallow, or recursive", s)
+}
+
 // Config holds some values we use when working in the working clone of
 // a repo.
 type Config struct {
 	Branch      string   // branch we're syncing to
+	Branches    []string // other branches that can be checked out with SwitchBranch
 	Paths       []string // paths within the repo containing files we care about
 	SyncTag     string
 	NotesRef    string
@@ -23,6 +197,204 @@ type Config struct {
 	SigningKey  string
 	SetAuthor   bool
 	SkipMessage string
+	CloneDepth  int // if more than zero, make shallow clones with this many commits
+	// SkipMessagePlacement says where the SkipMessage goes; by
+	// default, it's SkipInline. Other than for SkipInline, any
+	// space around the SkipMessage is ignored.
+	SkipMessagePlacement SkipPlacement
+	// GPGProgram, if given, is what git runs to sign commits and
+	// tags (as gpg.program), instead of gpg; e.g., gpg2, or Sequoia's
+	// gpg-sq. It must take gpg's arguments, as git gives them; to
+	// sign with a GPGPassphrase, or to find the key for a SigningKey
+	// given as a user ID, it must also take gpg's options for those.
+	// It's left to look after any agent itself.
+	GPGProgram string
+	// CloneFilter, if given, makes checkouts partial clones, with
+	// the filter spec given to `git clone --filter`; e.g.,
+	// "blob:none" leaves out the contents of files until they're
+	// needed, so only those in the working tree are fetched to start
+	// with, and the history is fetched as it's looked at. Anything
+	// left out is fetched from the Repo's copy when git needs it,
+	// without anything else having to be done. It goes well with
+	// SparsePaths.
+	CloneFilter string
+	// MaxRepoBytes, if more than zero, limits the size on disk of
+	// working clones; Clone gives up with a RepoTooLargeError if
+	// the clone gets larger than this.
+	MaxRepoBytes int64
+	// MaxFileBytes and MaxCommitBytes, if more than zero, limit the
+	// size of each file added or changed by a commit, and the total
+	// of them; CommitAndPush refuses with a CommitTooLargeError,
+	// before committing, if either is exceeded.
+	MaxFileBytes   int64
+	MaxCommitBytes int64
+	// SparsePaths, if given, limits working clones to these
+	// directories (plus files at the top level); usually it will be
+	// the same as, or include, Paths.
+	SparsePaths []string
+	// AllowBootstrap lets Clone create Branch upstream if it doesn't
+	// exist, e.g., because the upstream is empty; the branch starts
+	// with an empty commit, made as UserName and signed with
+	// SigningKey if that's given. Otherwise, Clone fails if there is
+	// no such branch.
+	AllowBootstrap bool
+	// RemoteName is what the checkout calls the remote it's cloned
+	// from, and so where the branches from it are found, as
+	// refs/remotes/<RemoteName>/; if empty, it's "origin".
+	RemoteName string
+	// PushRemote, if it has a URL, is where commits, notes and the
+	// sync tag are pushed, rather than the Repo's origin; e.g., a fork
+	// of an upstream that can only be read. Branches fetched from it
+	// (on rebasing after a rejected push) go under
+	// refs/remotes/<PushRemoteName>/, or "push" if that's empty.
+	// Bootstrapping still happens in the Repo's origin.
+	PushRemote     Remote
+	PushRemoteName string
+	SSHKeyPath     string // private key used to push upstream; if empty, that given to the Repo is used
+	// MessageTemplate is a text/template used to render commit
+	// messages from the CommitAction. If empty, the CommitAction's
+	// Message is used as-is.
+	MessageTemplate string
+	// SourceRevisionTrailer adds a trailer to each commit message
+	// (with the key SourceRevisionTrailerKey) giving the revision the
+	// checkout was at when the commit was made; i.e., that the change
+	// was made from. It comes after any trailers in the CommitAction.
+	SourceRevisionTrailer bool
+	// ExtraNotesRefs are notes refs used in addition to NotesRef,
+	// e.g., by other subsystems keeping their own notes. They are
+	// fetched and pushed along with NotesRef.
+	ExtraNotesRefs []string
+	EnableLFS      bool // fetch Git LFS content into working clones
+	PushRetries    int  // how many times to rebase and retry a push rejected as non-fast-forward
+	// Submodules says which submodules are checked out, by Clone and
+	// when a pooled checkout is refreshed; by default, none are.
+	// They're fetched from where .gitmodules says, with any relative
+	// URLs taken as relative to the Repo's origin, using the same
+	// credentials and proxy as for the upstream.
+	Submodules SubmoduleMode
+	// PushOptions are sent with each push of commits, as with `git
+	// push -o`, e.g., "merge_request.create" for GitLab, along with
+	// any in the CommitAction. If the upstream doesn't take push
+	// options, they're left out.
+	PushOptions []string
+	// VerifyPush makes each push of commits check afterwards, with
+	// `git ls-remote`, that the upstream branch is at the commit
+	// pushed; if it isn't, e.g., because a hook on the server rewrote
+	// the commit, the push fails with a DivergedAfterPushError. (So
+	// will a push that someone else's lands on top of before the
+	// check.)
+	VerifyPush bool
+	// RecoverDetachedHead makes a checkout found with a detached HEAD
+	// recreate the branch at HEAD, rather than failing with
+	// DetachedHeadError.
+	RecoverDetachedHead bool
+	// SyncTagForwardOnly makes MoveSyncTagAndPush and
+	// PushWithSyncTag refuse, with a SyncTagRollbackError, to move
+	// the sync tag to a commit that isn't descended from the one it
+	// marks, so that it can't be moved back in the history by
+	// accident. With CloneDepth, the history in between has to be
+	// within the depth of the clone to be seen.
+	SyncTagForwardOnly bool
+	// Warn, if given, is told of anything that didn't go as asked
+	// but didn't stop the operation either; e.g., that
+	// PushWithSyncTag couldn't push atomically
+	// (ErrAtomicPushUnsupported).
+	Warn func(err error)
+	// CheckSigningConfig makes commits with no signing key fail with
+	// a SigningRequiredError if the git config (the repo's own, or
+	// the global config) has commit.gpgSign set, rather than git
+	// trying to sign with whatever key it finds for the committer.
+	CheckSigningConfig bool
+	// ProgressFunc, if given, is told how far along Clone is with
+	// cloning the checkout from the Repo; see ProgressFunc (the
+	// Option) for the Repo's own clone and fetches.
+	ProgressFunc ProgressFunc
+	// Timeouts for individual operations, each applying on top of
+	// any deadline of the context given. Zero means no timeout.
+	CloneTimeout time.Duration
+	FetchTimeout time.Duration
+	PushTimeout  time.Duration
+	// Credentials for pushing upstream over HTTPS; if empty, those
+	// given to the Repo are used.
+	HTTPSUsername string
+	HTTPSPassword string
+	// Credentials, if given, are used instead of those given to the
+	// Repo when talking to the upstream; as with the Repo,
+	// SSHKeyPath and the HTTPS credentials above take precedence.
+	Credentials Credentials
+	// ProxyURL is used to reach the upstream when pushing; if empty,
+	// that given to the Repo is used. See the ProxyURL option.
+	ProxyURL string
+	// CABundlePath is a file of certificates to check the upstream's
+	// against, as with the CABundlePath option, when pushing; if
+	// empty, that given to the Repo is used. InsecureSkipTLSVerify
+	// doesn't check it at all (nor does the Repo if it was given the
+	// option); that's told to Warn, if given, on cloning.
+	CABundlePath          string
+	InsecureSkipTLSVerify bool
+	// KnownHostsPath and HostKeyVerification say how ssh checks the
+	// upstream's host key when pushing; if empty, those given to the
+	// Repo are used.
+	KnownHostsPath      string
+	HostKeyVerification HostKeyVerification
+	// GitExecutablePath is the git executable to run for the
+	// checkout; if empty, that given to the Repo is used. ExtraEnv
+	// has environment variables for every command run for the
+	// checkout, which take precedence over those given to the Repo.
+	// See the GitExecutablePath and ExtraEnv options.
+	GitExecutablePath string
+	ExtraEnv          map[string]string
+	// Ignore has patterns for files to leave out of ManifestFiles, as
+	// in IgnoreFile; these are applied after those in the file.
+	Ignore []string
+	// StageMode says which changes are committed; by default, it's
+	// StageAll.
+	StageMode StageMode
+	// AutoCRLF and EOL, if given, are used for core.autocrlf and
+	// core.eol in checkouts, saying how git converts the line endings
+	// of files it sees as text.
+	AutoCRLF string
+	EOL      string
+	// NormalizeLineEndings keeps changes to line endings alone from
+	// being committed. Git's conversion of line endings (by AutoCRLF
+	// and EOL, and the text and eol attributes in .gitattributes) is
+	// turned off, so files are compared with how they were committed,
+	// rather than how git would commit them now; e.g., those with
+	// CRLF line endings in a repo that has since asked for LF are
+	// left alone. And before committing, any file the only changes to
+	// which are to line endings is put back as it was.
+	NormalizeLineEndings bool
+	// SquashCommits makes QueueCommit hold changes back, so that
+	// PushQueued commits them all at once.
+	SquashCommits bool
+	// PerFileCommits makes CommitAndPush commit each changed file
+	// on its own, so that a change to one can be reverted without
+	// the others; the commits are then pushed together. Each has the
+	// message rendered with its CommitAction.File set to the file's
+	// path, or if there's no MessageTemplate, the message given with
+	// the path added to the subject; and each gets the note.
+	PerFileCommits bool
+	// PRCreator is used by CommitAndOpenPR to open pull requests;
+	// see the pullrequest package for implementations.
+	PRCreator PRCreator
+	// PreCommit, if given, is called by CommitAndPush with the path
+	// to the checkout once changes are staged, and before they're
+	// committed; e.g., to validate the manifests. If it returns an
+	// error, the changes are discarded (the working tree is reset
+	// to HEAD) and CommitAndPush returns a PreCommitError.
+	PreCommit func(ctx context.Context, dir string) error
+	// PostPush, if given, is called by CommitAndPush after a commit
+	// has been pushed, with the path to the checkout and the
+	// revision pushed; e.g., to notify something else.
+	PostPush func(ctx context.Context, dir, revision string)
+}
+
+// PRCreator opens a pull request (or merge request) from the branch
+// `head` into the branch `base`, returning its URL. If one is already
+// open for those branches, it should be updated rather than a second
+// one opened.
+type PRCreator interface {
+	OpenPR(ctx context.Context, base, head, title, body string) (string, error)
 }
 
 // Checkout is a local working clone of the remote repo. It is
@@ -32,75 +404,464 @@ type Checkout struct {
 	dir          string
 	config       Config
 	upstream     Remote
-	realNotesRef string // cache the notes ref, since we use it to push as well
+	pushTo       Remote   // the upstream, or Config.PushRemote if given
+	realNotesRef string   // cache the notes ref, since we use it to push as well
+	env          []string // for commands that sign things or make commits
+	exec         gitExec  // that of the Repo, with the Config's GitExecutablePath and ExtraEnv
+	transport    transport
+	observer     Observer
+	tagsMu       *sync.Mutex // that of the Repo, so tags aren't deleted while being moved
+
+	extraNotesRefs []string // full refs for ExtraNotesRefs, pushed along with realNotesRef
+	branches       []string // Config.Branch and Config.Branches, as at clone time
+
+	queued  []queuedCommit           // waiting for PushQueued
+	pending map[string][]pendingNote // by branch, for commits not yet pushed
+
+	noPushOptions bool // whether the upstream has refused push options
+
+	pool *CheckoutPool // the pool this checkout belongs to, if any
+	idle bool          // whether it's sitting in the pool
 }
 
 type Commit struct {
-	SigningKey string
-	Revision   string
-	Message    string
+	SigningKey         string
+	SigningFingerprint string // of the key that made the signature, as given by `%GF` in git log
+	SignatureStatus    string // as given by `%G?` in git log
+	Revision           string
+	Parents            []string // revisions, in order; more than one for a merge, none for a root commit
+	AuthorDate         time.Time
+	CommitDate         time.Time
+	AuthorName         string
+	AuthorEmail        string
+	CommitterName      string
+	CommitterEmail     string
+	Message            string
+}
+
+// SignatureValid reports whether git considers the signature of the
+// commit good.
+func (c Commit) SignatureValid() bool {
+	return c.SignatureStatus == "G"
 }
 
 // CommitAction - struct holding commit information
 type CommitAction struct {
-	Author     string
-	Message    string
-	SigningKey string
+	// Author is who the commit is attributed to, as "Name <email>";
+	// AuthorName and AuthorEmail, if given, are used instead. The
+	// committer is always Config.UserName and Config.UserEmail, so
+	// these can record who asked for a change as distinct from what
+	// made it.
+	Author      string
+	AuthorName  string
+	AuthorEmail string
+	Message     string
+	SigningKey  string
+	Changes     []CommitChange
+	Trailers    []Trailer // appended to the message, after any SkipMessage (unless that's a SkipTrailer)
+	// CommitBranch, if given, is the branch to commit to and push,
+	// rather than Config.Branch; it is created if it doesn't exist
+	// upstream, and otherwise the commit is put on top of it. The
+	// checkout is on Config.Branch again afterwards.
+	CommitBranch string
+	// GPGPassphrase unlocks the signing key, if it's protected. It is
+	// zeroed once the commit has been pushed (or has failed).
+	GPGPassphrase []byte
+	// SigningKeyData, if given, is an armored secret key to sign the
+	// commit with, e.g., from a secret given in the environment,
+	// instead of a key in the keyring. It's imported into a keyring
+	// of its own in a temporary directory, which is removed once the
+	// commit has been pushed (or has failed), and the data zeroed.
+	// If it has more than one signing key, SigningKey says which to
+	// use; Config.SigningKey is not used.
+	SigningKeyData []byte
+	// AllowEmpty makes a commit even if there are no changes, e.g.,
+	// as a marker. Otherwise, committing with no changes does
+	// nothing, and returns ErrNoChanges.
+	AllowEmpty bool
+	// CommitDate, if given, is used as both the author date and the
+	// committer date of the commit, instead of now; e.g., so that
+	// the same change made again results in the same commit. It is
+	// kept if the commit has to be rebased before pushing.
+	CommitDate time.Time
+	// OnlyPaths, if given, are the files (or directories) the commit
+	// is expected to change. If it would change anything else, e.g.,
+	// a file left behind by an earlier failed attempt, it's refused
+	// with an UnexpectedChangesError, and the changes are left in the
+	// working tree to be looked at.
+	OnlyPaths []string
+	// File is the path of the file being committed, relative to the
+	// top of the repo, when committing with Config.PerFileCommits;
+	// e.g., for use in the MessageTemplate. It's set by the
+	// checkout, rather than given.
+	File string
+	// PushOptions are sent with the push of the commit, after any
+	// in Config.PushOptions.
+	PushOptions []string
+}
+
+// Trailer is a git trailer, e.g., `Co-authored-by: Jane <jane@example.com>`
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+func (t Trailer) String() string {
+	return t.Key + ": " + t.Value
+}
+
+// CommitChange describes a change made in a commit, so that it can
+// be used when rendering the commit message.
+type CommitChange struct {
+	Workload  string
+	Container string
+	OldImage  string
+	NewImage  string
+}
+
+// SourceRevisionTrailerKey is the key of the trailer added with
+// Config.SourceRevisionTrailer.
+const SourceRevisionTrailerKey = "Flux-Source-Revision"
+
+// withSourceRevision gives the trailers given, followed by the source
+// revision trailer if the config asks for it.
+func (c *Checkout) withSourceRevision(ctx context.Context, trailers []Trailer) ([]Trailer, error) {
+	if !c.config.SourceRevisionTrailer {
+		return trailers, nil
+	}
+	head, err := c.HeadRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]Trailer{}, trailers...), Trailer{Key: SourceRevisionTrailerKey, Value: head}), nil
+}
+
+// withTrailers appends the trailers given to the message, separated
+// from it by a blank line so that git recognises them as trailers.
+func withTrailers(message string, trailers []Trailer) string {
+	lines := make([]string, len(trailers))
+	for i, t := range trailers {
+		lines[i] = t.String()
+	}
+	return withTrailerLines(message, lines)
+}
+
+func withTrailerLines(message string, lines []string) string {
+	if len(lines) == 0 {
+		return message
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// finishMessage gives the message with the SkipMessage put where the
+// config says, and the trailers given.
+func (c *Checkout) finishMessage(message string, trailers []Trailer) string {
+	skip := strings.TrimSpace(c.config.SkipMessage)
+	if skip == "" {
+		return withTrailers(message, trailers)
+	}
+	switch c.config.SkipMessagePlacement {
+	case SkipNewline:
+		message = strings.TrimRight(message, "\n") + "\n\n" + skip
+	case SkipTrailer:
+		lines := make([]string, len(trailers), len(trailers)+1)
+		for i, t := range trailers {
+			lines[i] = t.String()
+		}
+		return withTrailerLines(message, append(lines, skip))
+	case SkipPrefix:
+		message = skip + " " + message
+	default:
+		// A template may well end the message with a newline, which
+		// would otherwise leave the SkipMessage on a line of its own.
+		message = strings.TrimRight(message, "\n") + c.config.SkipMessage
+	}
+	return withTrailers(message, trailers)
+}
+
+// renderMessage gives the commit message for the commit action,
+// using the message template if one is configured. The template is
+// supplied the CommitAction itself, so it can refer to .Message,
+// .Author and .Changes.
+func (c *Checkout) renderMessage(commitAction CommitAction) (string, error) {
+	if c.config.MessageTemplate == "" {
+		return commitAction.Message, nil
+	}
+	tmpl, err := template.New("commit message").Parse(c.config.MessageTemplate)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing commit message template")
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, commitAction); err != nil {
+		return "", errors.Wrap(err, "rendering commit message template")
+	}
+	return buf.String(), nil
 }
 
 // TagAction - struct holding tag information
 type TagAction struct {
-	Revision   string
-	Message    string
-	SigningKey string
+	Revision      string
+	Message       string
+	SigningKey    string
+	GPGPassphrase []byte // as for CommitAction
+	// State, if given, is recorded in the tag message as JSON
+	// (instead of Message), so it can be read back with
+	// Repo.GetSyncState.
+	State *SyncState
+}
+
+// SyncState is what's recorded in the sync tag about the sync it
+// marks.
+type SyncState struct {
+	Revision    string    `json:"revision"`
+	Time        time.Time `json:"time"`
+	FluxVersion string    `json:"fluxVersion,omitempty"`
+}
+
+// bootstrapMessage is the message of the commit Clone starts a branch
+// with, if it's allowed to.
+const bootstrapMessage = "Initial commit"
+
+// bootstrap creates the configured branch upstream, if it's not there
+// already, with an empty commit, and refreshes the repo so it can be
+// cloned.
+func (r *Repo) bootstrap(ctx context.Context, conf Config, transport transport, env []string) error {
+	ref := "refs/heads/" + conf.Branch
+	if ok, err := r.RefExists(ctx, ref); ok || err != nil {
+		return err
+	}
+	signingKey, err := resolveSigningKey(ctx, conf.SigningKey, env)
+	if err != nil {
+		return err
+	}
+	pushEnv, err := transport.env(ctx, OpPush)
+	if err != nil {
+		return err
+	}
+	identity := append(authorEnv(CommitAction{AuthorName: conf.UserName, AuthorEmail: conf.UserEmail}), env...)
+
+	unlock, err := r.rlock(ctx, "Clone")
+	if err != nil {
+		return err
+	}
+	rev, pushErr := emptyCommit(ctx, r.exec, r.dir, bootstrapMessage, signingKey, identity)
+	if pushErr == nil {
+		start := time.Now()
+		pushErr = execGitCmd(ctx, []string{"push", r.origin.URL, rev + ":" + ref}, gitCmdConfig{dir: r.dir, exec: r.exec, env: pushEnv})
+		observe(r.observer, OpPush, r.origin, start, pushErr)
+	}
+	unlock()
+	if err := r.Refresh(ctx); err != nil {
+		return err
+	}
+	// If the push failed because someone else got there first,
+	// that's fine.
+	if ok, _ := r.RefExists(ctx, ref); !ok && pushErr != nil {
+		return errors.Wrap(pushErr, "creating branch "+conf.Branch)
+	}
+	return nil
 }
 
 // Clone returns a local working clone of the sync'ed `*Repo`, using
 // the config given.
-func (r *Repo) Clone(ctx context.Context, conf Config) (*Checkout, error) {
+func (r *Repo) Clone(ctx context.Context, conf Config) (_ *Checkout, err error) {
 	if r.readonly {
 		return nil, ErrReadOnly
 	}
+	start := time.Now()
+	defer func() {
+		observe(r.observer, OpClone, r.Origin(), start, err)
+	}()
+	ctx, cancel := withTimeout(ctx, conf.CloneTimeout)
+	defer cancel()
 
 	upstream := r.Origin()
-	repoDir, err := r.workingClone(ctx, conf.Branch)
+	transport := r.transport
+	if conf.SSHKeyPath != "" {
+		transport.sshKeyPath = conf.SSHKeyPath
+	}
+	if conf.HTTPSUsername != "" || conf.HTTPSPassword != "" {
+		transport.httpsCredentials = HTTPSCredentials{Username: conf.HTTPSUsername, Password: conf.HTTPSPassword}
+	}
+	if conf.ProxyURL != "" {
+		transport.proxyURL = conf.ProxyURL
+	}
+	if conf.CABundlePath != "" {
+		transport.caBundlePath = conf.CABundlePath
+	}
+	if conf.InsecureSkipTLSVerify {
+		transport.insecureTLS = true
+		if conf.Warn != nil {
+			conf.Warn(ErrInsecureTLS)
+		}
+	}
+	if conf.KnownHostsPath != "" {
+		transport.knownHostsPath = conf.KnownHostsPath
+	}
+	if conf.HostKeyVerification != HostKeyDefault {
+		transport.hostKeys = conf.HostKeyVerification
+	}
+	if conf.Credentials != nil {
+		transport.credentials = conf.Credentials
+	}
+	gexec := r.exec.merge(gitExec{path: conf.GitExecutablePath, env: envList(conf.ExtraEnv)})
+	if conf.EnableLFS {
+		gexec.env = append(gexec.env, lfsSkipSmudge)
+	}
+	// The extra environment goes in env as well, so that commands
+	// other than git run for the checkout (i.e., gpg) get it.
+	unlock := r.rhold("Clone")
+	gpgHome := r.gpgHome
+	gitConfig := make(map[string]string, len(r.gitConfig))
+	for k, v := range r.gitConfig {
+		gitConfig[k] = v
+	}
+	unlock()
+	env := append(append(gexec.env, gpgEnv(gpgHome)...), committerEnv(conf.UserName, conf.UserEmail)...)
+	if conf.GPGProgram != "" {
+		env = append(env, gpgProgramVar+"="+conf.GPGProgram)
+	}
+
+	if conf.AllowBootstrap {
+		if err := r.bootstrap(ctx, conf, transport, env); err != nil {
+			return nil, err
+		}
+	}
+
+	repoDir, err := r.workingClone(ctx, conf.Branch, cloneOptions{
+		depth:    conf.CloneDepth,
+		sparse:   len(conf.SparsePaths) > 0,
+		maxBytes: conf.MaxRepoBytes,
+		exec:     &gexec,
+		remote:   conf.RemoteName,
+		filter:   conf.CloneFilter,
+		progress: conf.ProgressFunc,
+	})
 	if err != nil {
 		return nil, err
 	}
+	// However Clone fails, including by the context being cancelled,
+	// the clone is removed rather than left behind.
+	defer func() {
+		if err != nil {
+			removeTempDir(repoDir)
+		}
+	}()
+	if len(conf.SparsePaths) > 0 {
+		if err := sparseCheckout(ctx, gexec, repoDir, conf.SparsePaths); err != nil {
+			return nil, err
+		}
+	}
 
-	if err := config(ctx, repoDir, conf.UserName, conf.UserEmail); err != nil {
-		os.RemoveAll(repoDir)
+	if err := config(ctx, gexec, repoDir, conf.UserName, conf.UserEmail); err != nil {
+		return nil, err
+	}
+	if err := applyConfig(ctx, gexec, repoDir, gitConfig); err != nil {
 		return nil, err
 	}
+	if conf.AutoCRLF != "" || conf.EOL != "" || conf.NormalizeLineEndings {
+		if err := setLineEndings(ctx, gexec, repoDir, conf.AutoCRLF, conf.EOL, conf.NormalizeLineEndings); err != nil {
+			return nil, err
+		}
+	}
 
-	// We'll need the notes ref for pushing it, so make sure we have
-	// it. This assumes we're syncing it (otherwise we'll likely get conflicts)
-	realNotesRef, err := getNotesRef(ctx, repoDir, conf.NotesRef)
+	// We'll need the notes refs for pushing them, so make sure we have
+	// them. This assumes we're syncing them (otherwise we'll likely get conflicts)
+	realNotesRef, err := getNotesRef(ctx, gexec, repoDir, conf.NotesRef)
 	if err != nil {
-		os.RemoveAll(repoDir)
 		return nil, err
 	}
+	var extraNotesRefs []string
+	for _, ref := range conf.ExtraNotesRefs {
+		realRef, err := getNotesRef(ctx, gexec, repoDir, ref)
+		if err != nil {
+			return nil, err
+		}
+		extraNotesRefs = append(extraNotesRefs, realRef)
+	}
 
-	r.mu.RLock()
-	if err := fetch(ctx, repoDir, r.dir, realNotesRef+":"+realNotesRef); err != nil {
-		os.RemoveAll(repoDir)
-		r.mu.RUnlock()
+	co := &Checkout{
+		dir:            repoDir,
+		upstream:       upstream,
+		pushTo:         upstream,
+		realNotesRef:   realNotesRef,
+		extraNotesRefs: extraNotesRefs,
+		branches:       append([]string{conf.Branch}, conf.Branches...),
+		config:         conf,
+		env:            env,
+		exec:           gexec,
+		transport:      transport,
+		observer:       r.observer,
+		tagsMu:         &r.tagsMu,
+	}
+	if conf.PushRemote.URL != "" {
+		co.pushTo = conf.PushRemote
+	}
+
+	if err := co.ensureOnBranch(ctx); err != nil {
+		return nil, err
+	}
+	// Before validating, since manifest dirs may be in submodules
+	if err := co.updateSubmodules(ctx); err != nil {
+		return nil, err
+	}
+	if err := co.ValidateManifestDirs(); err != nil {
 		return nil, err
 	}
-	r.mu.RUnlock()
 
-	return &Checkout{
-		dir:          repoDir,
-		upstream:     upstream,
-		realNotesRef: realNotesRef,
-		config:       conf,
-	}, nil
+	unlock, err = r.rlock(ctx, "Clone")
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchExisting(ctx, gexec, repoDir, r.dir, nil, co.notesRefspecs()...); err != nil {
+		unlock()
+		return nil, err
+	}
+	// A shallow clone only has the branch it was cloned at, so fetch
+	// any others we're tracking.
+	if conf.CloneDepth > 0 && len(conf.Branches) > 0 {
+		var refspecs []string
+		for _, b := range conf.Branches {
+			refspecs = append(refspecs, "+refs/heads/"+b+":"+co.trackingRef(b))
+		}
+		if err := fetchShallow(ctx, gexec, repoDir, co.remoteName(), conf.CloneDepth, refspecs...); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	// A shallow clone only follows tags that point into its own
+	// history, so fetch the sync tag explicitly.
+	if conf.CloneDepth > 0 && conf.SyncTag != "" {
+		tagRef := "refs/tags/" + conf.SyncTag
+		if err := fetchShallow(ctx, gexec, repoDir, co.remoteName(), conf.CloneDepth, "+"+tagRef+":"+tagRef); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	unlock()
+
+	if conf.EnableLFS {
+		if err := co.lfsPull(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return co, nil
 }
 
-// Clean a Checkout up (remove the clone)
+// Clean a Checkout up (remove the clone). If the checkout came from
+// a CheckoutPool, it is returned to the pool instead.
 func (c *Checkout) Clean() {
+	if c.pool != nil {
+		c.pool.put(c)
+		return
+	}
+	c.remove()
+}
+
+func (c *Checkout) remove() {
 	if c.dir != "" {
-		os.RemoveAll(c.dir)
+		removeTempDir(c.dir)
 	}
 }
 
@@ -109,88 +870,1572 @@ func (c *Checkout) Dir() string {
 	return c.dir
 }
 
+// SetSparsePaths changes the directories the checkout is limited
+// to, as for Config.SparsePaths.
+func (c *Checkout) SetSparsePaths(ctx context.Context, paths []string) error {
+	if err := sparseCheckout(ctx, c.exec, c.dir, paths); err != nil {
+		return err
+	}
+	c.config.SparsePaths = paths
+	return nil
+}
+
+// ValidateManifestDirs checks that each of the configured paths
+// exists in the checkout and has at least one file in it, returning a
+// MissingManifestDirError or EmptyManifestDirError for the first that
+// doesn't. This is done when cloning, so that a mistyped path is
+// noticed straight away, rather than syncing nothing.
+func (c *Checkout) ValidateManifestDirs() error {
+	for _, p := range c.config.Paths {
+		path := filepath.Join(c.dir, p)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return MissingManifestDirError{Path: p, Sparse: len(c.config.SparsePaths) > 0}
+		} else if err != nil {
+			return err
+		}
+		resolved, err := resolveInRepo(c.dir, p)
+		if err != nil {
+			return err
+		}
+		empty, err := noFiles(filepath.Join(c.dir, resolved))
+		if err != nil {
+			return err
+		}
+		if empty {
+			return EmptyManifestDirError{Path: p}
+		}
+	}
+	return nil
+}
+
+// noFiles says whether there are no files at the path given, or under
+// it if it's a directory.
+func noFiles(path string) (bool, error) {
+	errFound := errors.New("found a file")
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // ManifestDirs returns the paths to the manifests files. It ensures
 // that at least one path is returned, so that it can be used with
-// `Manifest.LoadManifests`.
+// `Manifest.LoadManifests`. A path that is a symlink to somewhere
+// else in the checkout is given as where it points; one that points
+// outside the checkout is left as it is, and will be reported by
+// ValidateManifestDirs.
 func (c *Checkout) ManifestDirs() []string {
-	if len(c.config.Paths) == 0 {
-		return []string{c.dir}
-	}
-
-	paths := make([]string, len(c.config.Paths), len(c.config.Paths))
+	dirs := manifestDirs(c.dir, c.config.Paths)
 	for i, p := range c.config.Paths {
-		paths[i] = filepath.Join(c.dir, p)
+		if resolved, err := resolveInRepo(c.dir, p); err == nil {
+			dirs[i] = filepath.Join(c.dir, resolved)
+		}
 	}
-	return paths
+	return dirs
 }
 
-// CommitAndPush commits changes made in this checkout, along with any
-// extra data as a note, and pushes the commit and note to the remote repo.
-func (c *Checkout) CommitAndPush(ctx context.Context, commitAction CommitAction, note interface{}) error {
-	if !check(ctx, c.dir, c.config.Paths) {
-		return ErrNoChanges
+// ManifestFiles returns the absolute paths to all the files under
+// the manifest paths, except those ignored by the patterns in
+// IgnoreFile and Config.Ignore, those in hidden directories below
+// the manifest paths (e.g., `.git`), and those that `git archive`
+// would leave out, since they (or a directory they're in) have the
+// export-ignore attribute in .gitattributes.
+//
+// Symlinks are followed as long as they point somewhere within the
+// checkout; files reached that way are given by their real path, and
+// each file is given once, however many ways there are to reach
+// it. A symlink pointing outside the checkout results in a
+// SymlinkOutsideRepoError.
+func (c *Checkout) ManifestFiles(ctx context.Context) ([]string, error) {
+	return c.manifestFiles(ctx, c.ManifestDirs())
+}
+
+// ManifestFilesByDir returns the files under each of ManifestDirs,
+// keyed by the directory as given there, chosen as for
+// ManifestFiles; e.g., so that each directory can be applied in its
+// own way. A file in more than one of the directories (because they
+// overlap, or by way of symlinks) is given for each of them.
+func (c *Checkout) ManifestFilesByDir(ctx context.Context) (map[string][]string, error) {
+	byDir := map[string][]string{}
+	for _, dir := range c.ManifestDirs() {
+		files, err := c.manifestFiles(ctx, []string{dir})
+		if err != nil {
+			return nil, err
+		}
+		byDir[dir] = files
 	}
+	return byDir, nil
+}
 
-	commitAction.Message += c.config.SkipMessage
-	if commitAction.SigningKey == "" {
-		commitAction.SigningKey = c.config.SigningKey
+// manifestFiles gives the files under the directories given, as
+// described for ManifestFiles.
+func (c *Checkout) manifestFiles(ctx context.Context, roots []string) ([]string, error) {
+	patterns, err := readIgnoreFile(c.dir)
+	if err != nil {
+		return nil, err
 	}
+	ignore := parseIgnore(append(patterns, c.config.Ignore...))
 
-	if err := commit(ctx, c.dir, commitAction); err != nil {
-		return err
+	var (
+		files []string
+		seen  = map[string]bool{}
+		walk  func(root string) error
+		// A manifest path may itself be hidden (e.g., `.kube`); only
+		// hidden directories under it are skipped.
+		isRoot = map[string]bool{}
+	)
+	for _, root := range roots {
+		isRoot[root] = true
+	}
+	walk = func(root string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(c.dir, path)
+			if err != nil {
+				return err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				resolved, err := resolveInRepo(c.dir, rel)
+				if err != nil {
+					return err
+				}
+				if info, err = os.Stat(path); err != nil {
+					return err
+				}
+				rel, path = resolved, filepath.Join(c.dir, resolved)
+				if info.IsDir() {
+					return walk(path)
+				}
+			}
+			if seen[rel] {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			seen[rel] = true
+			rel = filepath.ToSlash(rel)
+			if info.IsDir() {
+				if rel != "." && ((!isRoot[path] && strings.HasPrefix(info.Name(), ".")) || ignore.ignored(rel, true)) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			// A checked out submodule has a .git file, pointing at
+			// its repo.
+			if rel != IgnoreFile && info.Name() != ".git" && !ignore.ignored(rel, false) {
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+	for _, root := range roots {
+		if err := walk(root); err != nil {
+			return nil, err
+		}
 	}
+	return c.withoutExportIgnored(ctx, files)
+}
 
-	if note != nil {
-		rev, err := c.HeadRevision(ctx)
+// withoutExportIgnored gives the files given (as absolute paths)
+// less those that git archive would leave out, because they or a
+// directory they're in have the export-ignore attribute.
+func (c *Checkout) withoutExportIgnored(ctx context.Context, files []string) ([]string, error) {
+	if len(files) == 0 {
+		return files, nil
+	}
+	// Attributes don't pass from a directory to what's in it, so
+	// each directory on the way to each file is checked too.
+	var paths []string
+	ancestors := make([][]string, len(files))
+	checked := map[string]bool{}
+	for i, file := range files {
+		rel, err := filepath.Rel(c.dir, file)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if err := addNote(ctx, c.dir, rev, c.config.NotesRef, note); err != nil {
-			return err
+		for ; rel != "."; rel = filepath.Dir(rel) {
+			p := filepath.ToSlash(rel)
+			ancestors[i] = append(ancestors[i], p)
+			if !checked[p] {
+				checked[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	ignored, err := exportIgnored(ctx, c.exec, c.dir, paths)
+	if err != nil {
+		return nil, err
+	}
+	var kept []string
+	for i, file := range files {
+		keep := true
+		for _, p := range ancestors[i] {
+			keep = keep && !ignored[p]
+		}
+		if keep {
+			kept = append(kept, file)
 		}
 	}
+	return kept, nil
+}
 
-	refs := []string{c.config.Branch}
-	ok, err := refExists(ctx, c.dir, c.realNotesRef)
-	if ok {
-		refs = append(refs, c.realNotesRef)
-	} else if err != nil {
-		return err
+// resolveInRepo follows any symlinks in path, which is relative to the
+// top of the checkout at dir, and returns where it ends up, also
+// relative to the top of the checkout. If that is outside the
+// checkout, it returns a SymlinkOutsideRepoError.
+func resolveInRepo(dir, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(dir, path))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", SymlinkOutsideRepoError{Path: filepath.ToSlash(path), Target: target}
 	}
+	return rel, nil
+}
 
-	if err := push(ctx, c.dir, c.upstream.URL, refs); err != nil {
-		return PushError(c.upstream.URL, err)
+func manifestDirs(dir string, subPaths []string) []string {
+	if len(subPaths) == 0 {
+		return []string{dir}
 	}
-	return nil
+
+	paths := make([]string, len(subPaths), len(subPaths))
+	for i, p := range subPaths {
+		paths[i] = filepath.Join(dir, p)
+	}
+	return paths
 }
 
-// GetNote gets a note for the revision specified, or nil if there is no such note.
-func (c *Checkout) GetNote(ctx context.Context, rev string, note interface{}) (bool, error) {
-	return getNote(ctx, c.dir, c.realNotesRef, rev, note)
+// The names for remotes in a checkout, if not given in the Config.
+const (
+	defaultRemoteName     = "origin"
+	defaultPushRemoteName = "push"
+)
+
+// PushResult is what CommitAndPush committed and pushed.
+type PushResult struct {
+	Revision string       // of the commit pushed, or the last of them, with PerFileCommits
+	Changes  []FileChange // the files changed in the commit, relative to the top of the repo
 }
 
-func (c *Checkout) HeadRevision(ctx context.Context) (string, error) {
-	return refRevision(ctx, c.dir, "HEAD")
+// CommitAndPush commits changes made in this checkout, along with any
+// extra data as a note, and pushes the commit and note to the remote
+// repo. It returns the revision pushed, and which files changed (with
+// deleted files included as such), e.g., so that only those need be
+// applied.
+func (c *Checkout) CommitAndPush(ctx context.Context, commitAction CommitAction, note interface{}) (PushResult, error) {
+	defer zero(commitAction.GPGPassphrase)
+	defer zero(commitAction.SigningKeyData)
+
+	if !commitAction.AllowEmpty && !c.hasChanges(ctx) {
+		return PushResult{}, ErrNoChanges
+	}
+	if c.config.PerFileCommits {
+		// The message is rendered for each file as it's committed
+		if commitAction.SigningKey == "" && commitAction.SigningKeyData == nil {
+			commitAction.SigningKey = c.config.SigningKey
+		}
+		return c.commitAndPush(ctx, commitAction, note, true)
+	}
+	prepared, err := c.prepareAction(ctx, commitAction)
+	if err != nil {
+		return PushResult{}, err
+	}
+	return c.commitAndPush(ctx, prepared, note, false)
 }
 
-func (c *Checkout) SyncRevision(ctx context.Context) (string, error) {
-	return refRevision(ctx, c.dir, "tags/"+c.config.SyncTag)
+type queuedCommit struct {
+	action CommitAction
+	note   interface{}
 }
 
-func (c *Checkout) MoveSyncTagAndPush(ctx context.Context, tagAction TagAction) error {
-	if tagAction.SigningKey == "" {
-		tagAction.SigningKey = c.config.SigningKey
+// QueueCommit is for making several changes, each with its own commit
+// action and note, as part of one piece of work. Ordinarily, it just
+// does CommitAndPush. If Config.SquashCommits is set, the changes are
+// instead left in the working tree, to be committed together by
+// PushQueued.
+func (c *Checkout) QueueCommit(ctx context.Context, commitAction CommitAction, note interface{}) error {
+	if !c.config.SquashCommits {
+		_, err := c.CommitAndPush(ctx, commitAction, note)
+		return err
 	}
-	return moveTagAndPush(ctx, c.dir, c.config.SyncTag, c.upstream.URL, tagAction)
+	c.queued = append(c.queued, queuedCommit{action: commitAction, note: note})
+	return nil
 }
 
-func (c *Checkout) VerifySyncTag(ctx context.Context) error {
-	return verifyTag(ctx, c.dir, c.config.SyncTag)
-}
+// PushQueued commits all the changes queued by QueueCommit, as a
+// single commit, and pushes it. The message has a line for each
+// change, using the first line of each message; the note is a slice
+// of all the notes given. If nothing was queued, it does nothing.
+func (c *Checkout) PushQueued(ctx context.Context) error {
+	queued := c.queued
+	c.queued = nil
+	defer func() {
+		for _, q := range queued {
+			zero(q.action.GPGPassphrase)
+			zero(q.action.SigningKeyData)
+		}
+	}()
+	if len(queued) == 0 {
+		return nil
+	}
 
-// ChangedFiles does a git diff listing changed files
-func (c *Checkout) ChangedFiles(ctx context.Context, ref string) ([]string, error) {
-	list, err := changed(ctx, c.dir, ref, c.config.Paths)
+	combined := CommitAction{
+		Author:       queued[0].action.Author,
+		AuthorName:   queued[0].action.AuthorName,
+		AuthorEmail:  queued[0].action.AuthorEmail,
+		CommitBranch: queued[0].action.CommitBranch,
+	}
+	// The combined commit is dated only if all the changes are, and
+	// then as the latest of them. Likewise, it's limited to paths
+	// only if all the changes are.
+	dated, restricted := true, true
+	var (
+		subjects []string
+		notes    []interface{}
+		message  string
+		seen     = map[Trailer]bool{}
+		options  = map[string]bool{}
+	)
+	for _, q := range queued {
+		action := q.action
+		if action.CommitBranch != combined.CommitBranch {
+			return fmt.Errorf("queued commits are for different branches (%q and %q)", combined.CommitBranch, action.CommitBranch)
+		}
+		if action.Author != combined.Author || action.AuthorName != combined.AuthorName || action.AuthorEmail != combined.AuthorEmail {
+			combined.Author, combined.AuthorName, combined.AuthorEmail = "", "", ""
+		}
+		if combined.SigningKey == "" {
+			combined.SigningKey = action.SigningKey
+		}
+		if combined.GPGPassphrase == nil {
+			combined.GPGPassphrase = action.GPGPassphrase
+		}
+		if combined.SigningKeyData == nil {
+			combined.SigningKeyData = action.SigningKeyData
+		}
+		combined.AllowEmpty = combined.AllowEmpty || action.AllowEmpty
+		if action.CommitDate.IsZero() {
+			dated = false
+		} else if action.CommitDate.After(combined.CommitDate) {
+			combined.CommitDate = action.CommitDate
+		}
+		if len(action.OnlyPaths) == 0 {
+			restricted = false
+		}
+		combined.OnlyPaths = append(combined.OnlyPaths, action.OnlyPaths...)
+		combined.Changes = append(combined.Changes, action.Changes...)
+		for _, t := range action.Trailers {
+			if !seen[t] {
+				seen[t] = true
+				combined.Trailers = append(combined.Trailers, t)
+			}
+		}
+		for _, o := range action.PushOptions {
+			if !options[o] {
+				options[o] = true
+				combined.PushOptions = append(combined.PushOptions, o)
+			}
+		}
+		rendered, err := c.renderMessage(action)
+		if err != nil {
+			return err
+		}
+		message = rendered
+		subjects = append(subjects, strings.SplitN(rendered, "\n", 2)[0])
+		if q.note != nil {
+			notes = append(notes, q.note)
+		}
+	}
+	if !dated {
+		combined.CommitDate = time.Time{}
+	}
+	if !restricted {
+		combined.OnlyPaths = nil
+	}
+	if !combined.AllowEmpty && !c.hasChanges(ctx) {
+		return ErrNoChanges
+	}
+	if len(queued) > 1 {
+		message = fmt.Sprintf("Squashed %d changes\n\n- %s", len(queued), strings.Join(subjects, "\n- "))
+	}
+	trailers, err := c.withSourceRevision(ctx, combined.Trailers)
+	if err != nil {
+		return err
+	}
+	combined.Message = c.finishMessage(message, trailers)
+	if combined.SigningKey == "" && combined.SigningKeyData == nil {
+		combined.SigningKey = c.config.SigningKey
+	}
+
+	var note interface{}
+	if len(notes) > 0 {
+		note = notes
+	}
+	_, err = c.commitAndPush(ctx, combined, note, false)
+	return err
+}
+
+// Commit commits the changes made in this checkout, along with any
+// extra data as a note, as CommitAndPush does, but doesn't push
+// them; that's left to Push, so several commits can be made (and,
+// e.g., checked) before they're pushed all at once. It returns the
+// revision of the commit.
+func (c *Checkout) Commit(ctx context.Context, commitAction CommitAction, note interface{}) (string, error) {
+	defer zero(commitAction.GPGPassphrase)
+	defer zero(commitAction.SigningKeyData)
+
+	if !commitAction.AllowEmpty && !c.hasChanges(ctx) {
+		return "", ErrNoChanges
+	}
+	prepared, err := c.prepareAction(ctx, commitAction)
+	if err != nil {
+		return "", err
+	}
+	restore, err := c.useSigningKeyData(ctx, &prepared)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+	if prepared.SigningKey, err = resolveSigningKey(ctx, prepared.SigningKey, c.env); err != nil {
+		return "", err
+	}
+	if err := c.checkSigningRequired(ctx, prepared.SigningKey); err != nil {
+		return "", err
+	}
+	rev, _, _, err := c.commitLocally(ctx, prepared, note, false)
+	return rev, err
+}
+
+// Push pushes the branches given (or, if none are given, the branch
+// the checkout is on) with everything committed to them since they
+// were last pushed, along with all the notes, in one atomic push; so
+// either all the refs are updated upstream, or none are. If the push
+// is rejected and PushRetries allows, the branches are rebased onto
+// those upstream, signing the commits with the SigningKey from the
+// Config, and their notes put back, before trying again.
+func (c *Checkout) Push(ctx context.Context, branches ...string) error {
+	if err := c.ensureOnBranch(ctx); err != nil {
+		return err
+	}
+	if len(branches) == 0 {
+		branches = []string{c.config.Branch}
+	}
+	signingKey, err := resolveSigningKey(ctx, c.config.SigningKey, c.env)
+	if err != nil {
+		return err
+	}
+	return c.push(ctx, branches, CommitAction{SigningKey: signingKey}, "--atomic")
+}
+
+// commitAndPush does the work of CommitAndPush, once the commit
+// action has been prepared (or, if perFile, is ready to be prepared
+// for each file).
+func (c *Checkout) commitAndPush(ctx context.Context, commitAction CommitAction, note interface{}, perFile bool) (_ PushResult, err error) {
+	if err := c.ensureOnBranch(ctx); err != nil {
+		return PushResult{}, err
+	}
+	restore, err := c.useSigningKeyData(ctx, &commitAction)
+	if err != nil {
+		return PushResult{}, err
+	}
+	defer restore()
+	if commitAction.SigningKey, err = resolveSigningKey(ctx, commitAction.SigningKey, c.env); err != nil {
+		return PushResult{}, err
+	}
+	if err := c.checkSigningRequired(ctx, commitAction.SigningKey); err != nil {
+		return PushResult{}, err
+	}
+	_, branch, changes, err := c.commitLocally(ctx, commitAction, note, perFile)
+	if err != nil {
+		return PushResult{}, err
+	}
+	if err := c.push(ctx, []string{branch}, commitAction); err != nil {
+		return PushResult{}, err
+	}
+	// The commit may have been rebased in pushing it
+	rev, err := refRevision(ctx, c.exec, c.dir, "refs/heads/"+branch)
+	if err != nil {
+		return PushResult{}, err
+	}
+	return PushResult{Revision: rev, Changes: changes}, nil
+}
+
+// checkSigningRequired returns a SigningRequiredError if the config
+// says to check, there's no signing key, and the git config says
+// commits must be signed.
+func (c *Checkout) checkSigningRequired(ctx context.Context, signingKey string) error {
+	if !c.config.CheckSigningConfig || signingKey != "" {
+		return nil
+	}
+	required, err := signingRequired(ctx, c.exec, c.dir)
+	if err != nil {
+		return err
+	}
+	if required {
+		return SigningRequiredError{Setting: "commit.gpgSign"}
+	}
+	return nil
+}
+
+// useSigningKeyData has the checkout sign with the key in the commit
+// action's SigningKeyData, if it has any, by using a keyring with
+// just that key (see importSigningKey); and if the commit action
+// doesn't say which key to use, makes it the key imported, so long
+// as there's only one. The func returned puts the checkout back as
+// it was, and removes the keyring.
+func (c *Checkout) useSigningKeyData(ctx context.Context, commitAction *CommitAction) (func(), error) {
+	if len(commitAction.SigningKeyData) == 0 {
+		return func() {}, nil
+	}
+	keyEnv, fingerprints, cleanup, err := importSigningKey(ctx, commitAction.SigningKeyData, c.env)
+	if err != nil {
+		return nil, err
+	}
+	if commitAction.SigningKey == "" {
+		if len(fingerprints) != 1 {
+			cleanup()
+			return nil, SigningKeyError{Key: "(from SigningKeyData)", Fingerprints: fingerprints}
+		}
+		commitAction.SigningKey = fingerprints[0]
+	}
+	env := c.env
+	c.env = append(append([]string{}, env...), keyEnv...)
+	return func() {
+		c.env = env
+		cleanup()
+	}, nil
+}
+
+// pendingNote is a note on a commit that hasn't been pushed yet,
+// which will need to be put back if the commit is rebased.
+type pendingNote struct {
+	rev     string
+	message string
+	note    interface{}
+}
+
+// commitLocally makes a commit as for CommitAndPush, on the branch
+// the commit action says, and records the note (if any) to be pushed
+// along with it. If perFile, it makes a commit for each file changed
+// instead, preparing the commit action for each. It returns the
+// revision (of the last commit), the branch, and the files changed.
+// The checkout is left on its own branch.
+func (c *Checkout) commitLocally(ctx context.Context, commitAction CommitAction, note interface{}, perFile bool) (_, _ string, _ []FileChange, err error) {
+	branch := c.config.Branch
+	if commitAction.CommitBranch != "" && commitAction.CommitBranch != branch {
+		branch = commitAction.CommitBranch
+		if err := checkoutBranchAtHead(ctx, c.exec, c.dir, branch); err != nil {
+			return "", "", nil, err
+		}
+		defer func() {
+			// This is done even if the context has expired, so
+			// the checkout is left on the branch it should be.
+			if cerr := checkout(context.Background(), c.exec, c.dir, c.config.Branch); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
+	}
+
+	if err := c.putBackLineEndings(ctx); err != nil {
+		return "", "", nil, err
+	}
+	if err := stage(ctx, c.exec, c.dir, c.config.Paths, c.config.StageMode, nil); err != nil {
+		return "", "", nil, err
+	}
+	if err := c.checkCommitSize(ctx); err != nil {
+		return "", "", nil, err
+	}
+	changes, err := stagedChanges(ctx, c.exec, c.dir)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if err := checkOnlyPaths(changes, commitAction.OnlyPaths); err != nil {
+		return "", "", nil, err
+	}
+	if c.config.PreCommit != nil {
+		if err := c.config.PreCommit(ctx, c.dir); err != nil {
+			// This is done even if the context has expired, so no
+			// half-made changes are left to be committed later.
+			if rerr := resetHard(context.Background(), c.exec, c.dir, "HEAD"); rerr != nil {
+				return "", "", nil, errors.Wrap(rerr, "resetting after pre-commit hook failed")
+			}
+			return "", "", nil, PreCommitError{Err: err}
+		}
+	}
+	if perFile && len(changes) > 0 {
+		for _, change := range changes {
+			action, err := c.fileAction(ctx, commitAction, change.Path)
+			if err != nil {
+				return "", "", nil, err
+			}
+			if err := c.commitNoted(ctx, branch, action, note, change.Path); err != nil {
+				return "", "", nil, err
+			}
+		}
+	} else {
+		if perFile {
+			// Nothing's changed, but an empty commit is allowed
+			if commitAction, err = c.prepareAction(ctx, commitAction); err != nil {
+				return "", "", nil, err
+			}
+		}
+		if err := c.commitNoted(ctx, branch, commitAction, note); err != nil {
+			return "", "", nil, err
+		}
+	}
+	if branch != c.config.Branch {
+		// If the branch is already upstream, build on it; this
+		// puts the notes back on the rebased commits.
+		if err := c.rebaseBranches(ctx, []string{branch}, commitAction); err != nil {
+			return "", "", nil, err
+		}
+	}
+	rev, err := c.HeadRevision(ctx)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return rev, branch, changes, nil
+}
+
+// commitNoted commits the changes (or only those to the paths given)
+// on the branch given, which the checkout is on, and adds the note,
+// if any, recording it to be put back should the commit be rebased.
+func (c *Checkout) commitNoted(ctx context.Context, branch string, commitAction CommitAction, note interface{}, paths ...string) error {
+	start := time.Now()
+	err := commit(ctx, c.exec, c.dir, commitAction, c.env, paths...)
+	observe(c.observer, OpCommit, c.upstream, start, err)
+	if err != nil || note == nil {
+		return err
+	}
+	rev, err := c.HeadRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if err := addNote(ctx, c.exec, c.dir, rev, c.config.NotesRef, note); err != nil {
+		return err
+	}
+	if c.pending == nil {
+		c.pending = map[string][]pendingNote{}
+	}
+	c.pending[branch] = append(c.pending[branch], pendingNote{rev: rev, message: commitAction.Message, note: note})
+	return nil
+}
+
+// fileAction prepares the commit action for committing just the file
+// given, with PerFileCommits.
+func (c *Checkout) fileAction(ctx context.Context, commitAction CommitAction, path string) (CommitAction, error) {
+	commitAction.File = path
+	if c.config.MessageTemplate == "" {
+		lines := strings.SplitN(commitAction.Message, "\n", 2)
+		lines[0] = strings.TrimSpace(lines[0] + " (" + path + ")")
+		commitAction.Message = strings.Join(lines, "\n")
+	}
+	return c.prepareAction(ctx, commitAction)
+}
+
+// push pushes the branches given, and the notes, retrying as
+// PushRetries allows; the commit action says how to sign and date
+// the commits when rebasing them. Any extra arguments are given to
+// git push.
+func (c *Checkout) push(ctx context.Context, branches []string, commitAction CommitAction, extra ...string) error {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := c.pushBranchesAndNotes(ctx, branches, c.pushOptions(commitAction), extra...)
+		observe(c.observer, OpPush, c.pushTo, start, err)
+		if err == nil {
+			return c.pushed(ctx, branches)
+		}
+		if errors.Cause(err) != errPushRejected || c.config.PushRetries == 0 {
+			return PushError(c.pushTo.URL, err)
+		}
+		if attempt >= c.config.PushRetries {
+			return PushRejectedError{Attempts: attempt + 1, Err: err}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pushRetryBackoff << uint(attempt)):
+		}
+
+		// Someone else got in first; bring our commits up to date
+		// with the upstream, and put the notes back on the rebased
+		// commits.
+		if err := c.rebaseBranches(ctx, branches, commitAction); err != nil {
+			return err
+		}
+	}
+}
+
+// pushed does what's needed once the branches given have been pushed
+// successfully.
+func (c *Checkout) pushed(ctx context.Context, branches []string) error {
+	if c.config.VerifyPush {
+		if err := c.verifyPushed(ctx, branches); err != nil {
+			return err
+		}
+	}
+	for _, branch := range branches {
+		rev, err := refRevision(ctx, c.exec, c.dir, "refs/heads/"+branch)
+		if err != nil {
+			return err
+		}
+		// So that CommitTree builds on this
+		if err := updateRef(ctx, c.exec, c.dir, c.pushedRef(branch), rev); err != nil {
+			return err
+		}
+		delete(c.pending, branch)
+		if c.config.PostPush != nil {
+			c.config.PostPush(ctx, c.dir, rev)
+		}
+	}
+	return nil
+}
+
+// Revert makes a commit undoing the commit given, as `git revert`
+// does, and pushes it along with the note, if any, as CommitAndPush;
+// e.g., to roll back a bad change while keeping it in the history. If
+// the commit action has no Message, it gets git's usual message for a
+// revert. If the commit's changes have already been undone, it
+// returns ErrNoChanges, and if they can't be undone cleanly because
+// of later changes, a RevertConflictError; either way, the checkout
+// is left as it was. Merge commits can't be reverted.
+func (c *Checkout) Revert(ctx context.Context, rev string, commitAction CommitAction, note interface{}) (PushResult, error) {
+	defer zero(commitAction.GPGPassphrase)
+	defer zero(commitAction.SigningKeyData)
+
+	if err := c.ensureOnBranch(ctx); err != nil {
+		return PushResult{}, err
+	}
+	if err := c.ensureRevision(ctx, rev); err != nil {
+		return PushResult{}, err
+	}
+	commits, err := onelinelog(ctx, c.exec, c.dir, rev, nil, "--max-count=1")
+	if err != nil {
+		return PushResult{}, err
+	}
+	if len(commits) == 0 {
+		return PushResult{}, RefNotFoundError{Ref: rev}
+	}
+	if commitAction.Message == "" {
+		commitAction.Message = fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.", commits[0].Message, commits[0].Revision)
+	}
+	if err := revert(ctx, c.exec, c.dir, commits[0].Revision); err != nil {
+		return PushResult{}, err
+	}
+	prepared, err := c.prepareAction(ctx, commitAction)
+	if err == nil {
+		var result PushResult
+		if result, err = c.commitAndPush(ctx, prepared, note, false); err != ErrNoChanges {
+			return result, err
+		}
+	}
+	if rerr := resetHard(context.Background(), c.exec, c.dir, "HEAD"); rerr != nil {
+		return PushResult{}, errors.Wrap(rerr, "resetting after revert failed")
+	}
+	return PushResult{}, err
+}
+
+// CommitAndOpenPR commits and pushes the changes to
+// commitAction.CommitBranch, as CommitAndPush does, then opens a pull
+// request from there into the tracked branch using the configured
+// PRCreator. The first line of the commit message is used as the
+// title, and the rest as the body. It returns the URL of the pull
+// request.
+func (c *Checkout) CommitAndOpenPR(ctx context.Context, commitAction CommitAction, note interface{}) (string, error) {
+	if c.config.PRCreator == nil {
+		return "", errors.New("no PRCreator configured for opening pull requests")
+	}
+	if commitAction.CommitBranch == "" || commitAction.CommitBranch == c.config.Branch {
+		return "", fmt.Errorf("a pull request needs a CommitBranch other than %s", c.config.Branch)
+	}
+	prepared, err := c.prepareAction(ctx, commitAction)
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.CommitAndPush(ctx, commitAction, note); err != nil {
+		return "", err
+	}
+	lines := strings.SplitN(prepared.Message, "\n", 2)
+	title, body := lines[0], ""
+	if len(lines) > 1 {
+		body = strings.TrimSpace(lines[1])
+	}
+	return c.config.PRCreator.OpenPR(ctx, c.config.Branch, commitAction.CommitBranch, title, body)
+}
+
+// prepareAction fills in the final commit message, and the signing
+// key if not given, from the config.
+func (c *Checkout) prepareAction(ctx context.Context, commitAction CommitAction) (CommitAction, error) {
+	message, err := c.renderMessage(commitAction)
+	if err != nil {
+		return commitAction, err
+	}
+	trailers, err := c.withSourceRevision(ctx, commitAction.Trailers)
+	if err != nil {
+		return commitAction, err
+	}
+	commitAction.Message = c.finishMessage(message, trailers)
+	if commitAction.SigningKey == "" && commitAction.SigningKeyData == nil {
+		commitAction.SigningKey = c.config.SigningKey
+	}
+	return commitAction, nil
+}
+
+// hasChanges says whether there are changes to commit under the
+// paths, once any that are only to line endings are put back (with
+// NormalizeLineEndings). If that can't be found out, it gives true,
+// and leaves committing to report the problem.
+func (c *Checkout) hasChanges(ctx context.Context) bool {
+	if err := c.putBackLineEndings(ctx); err != nil {
+		return true
+	}
+	return check(ctx, c.exec, c.dir, c.config.Paths, c.config.StageMode)
+}
+
+// putBackLineEndings restores, from HEAD, the files under the paths
+// that differ from it only in their line endings, if
+// NormalizeLineEndings is set.
+func (c *Checkout) putBackLineEndings(ctx context.Context) error {
+	if !c.config.NormalizeLineEndings {
+		return nil
+	}
+	files, err := lineEndingChanges(ctx, c.exec, c.dir, c.config.Paths)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	return checkoutPaths(ctx, c.exec, c.dir, "HEAD", files)
+}
+
+// checkCommitSize returns a CommitTooLargeError if what's about to
+// be committed breaks the limits in the config.
+func (c *Checkout) checkCommitSize(ctx context.Context) error {
+	maxFile, maxCommit := c.config.MaxFileBytes, c.config.MaxCommitBytes
+	if maxFile <= 0 && maxCommit <= 0 {
+		return nil
+	}
+	files, err := filesToCommit(ctx, c.exec, c.dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		if maxFile > 0 && f.size > maxFile {
+			return CommitTooLargeError{Path: f.path, Size: f.size, Limit: maxFile}
+		}
+		total += f.size
+	}
+	if maxCommit > 0 && total > maxCommit {
+		return CommitTooLargeError{Size: total, Limit: maxCommit}
+	}
+	return nil
+}
+
+// checkOnlyPaths makes sure that only files under the paths given
+// would be committed, if any are given.
+func checkOnlyPaths(changes []FileChange, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	var unexpected []string
+	for _, change := range changes {
+		if !underPaths(change.Path, paths) {
+			unexpected = append(unexpected, change.Path)
+		}
+	}
+	if len(unexpected) > 0 {
+		return UnexpectedChangesError{Paths: unexpected}
+	}
+	return nil
+}
+
+// underPaths says whether the file given is one of the paths given,
+// or in a directory among them.
+func underPaths(file string, paths []string) bool {
+	for _, p := range paths {
+		p = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(p)), "/")
+		if p == "." || file == p || strings.HasPrefix(file, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Status gives the changes in the checkout that haven't been
+// committed: modified, added and deleted files, and untracked files
+// that aren't ignored. Paths are relative to the top of the repo.
+func (c *Checkout) Status(ctx context.Context) ([]FileChange, error) {
+	return status(ctx, c.exec, c.dir)
+}
+
+// IsClean says whether the checkout has no uncommitted changes,
+// including untracked files, as given by Status.
+func (c *Checkout) IsClean(ctx context.Context) (bool, error) {
+	changes, err := status(ctx, c.exec, c.dir)
+	if err != nil {
+		return false, err
+	}
+	return len(changes) == 0, nil
+}
+
+// dryRunRef is where PrepareCommit keeps its commit while working out
+// the diff.
+const dryRunRef = "refs/flux/dry-run"
+
+// PrepareCommit is a dry run of CommitAndPush: it makes the commit
+// that would be made, and returns it along with the unified diff of
+// the commit, limited to the configured paths. The commit is then
+// discarded; nothing is pushed, the sync tag is not moved, and the
+// working tree, index and branch are left as they are. The commit is
+// not signed, and its Message is the full message rather than just
+// the subject.
+func (c *Checkout) PrepareCommit(ctx context.Context, commitAction CommitAction) (Commit, []byte, error) {
+	defer zero(commitAction.GPGPassphrase)
+
+	if !commitAction.AllowEmpty && !c.hasChanges(ctx) {
+		return Commit{}, nil, ErrNoChanges
+	}
+	commitAction, err := c.prepareAction(ctx, commitAction)
+	if err != nil {
+		return Commit{}, nil, err
+	}
+	if commitAction.SigningKey, err = resolveSigningKey(ctx, commitAction.SigningKey, c.env); err != nil {
+		return Commit{}, nil, err
+	}
+
+	rev, err := commitToRef(ctx, c.exec, c.dir, dryRunRef, c.config.Paths, c.config.StageMode, commitAction)
+	if err != nil {
+		return Commit{}, nil, err
+	}
+	defer deleteRef(ctx, c.exec, c.dir, dryRunRef)
+
+	commits, err := onelinelog(ctx, c.exec, c.dir, rev+"^!", nil)
+	if err != nil {
+		return Commit{}, nil, err
+	}
+	if len(commits) != 1 {
+		return Commit{}, nil, fmt.Errorf("expected a single commit for %s, got %d", rev, len(commits))
+	}
+	commit := commits[0]
+	commit.Message = commitAction.Message
+
+	patch, err := diff(ctx, c.exec, c.dir, "HEAD", rev, c.config.Paths)
+	if err != nil {
+		return Commit{}, nil, err
+	}
+	return commit, patch, nil
+}
+
+// ensureOnBranch checks that the configured branch is checked out,
+// and if HEAD is detached, either recreates the branch at HEAD or
+// returns a DetachedHeadError, according to the config.
+func (c *Checkout) ensureOnBranch(ctx context.Context) error {
+	if c.config.Branch == "" {
+		return nil
+	}
+	current, err := currentBranch(ctx, c.exec, c.dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current == c.config.Branch:
+		return nil
+	case current == "HEAD" && c.config.RecoverDetachedHead:
+		return checkoutBranchAtHead(ctx, c.exec, c.dir, c.config.Branch)
+	case current == "HEAD":
+		return DetachedHeadError{Branch: c.config.Branch}
+	default:
+		return fmt.Errorf("checkout is on branch %s, but should be on branch %s", current, c.config.Branch)
+	}
+}
+
+// SwitchBranch checks out another of the branches tracked by the
+// checkout (the first branch, or one of Config.Branches), at the
+// revision it has in the repo. Commits made after switching are
+// pushed to that branch.
+func (c *Checkout) SwitchBranch(ctx context.Context, branch string) error {
+	if !c.tracks(branch) {
+		return fmt.Errorf("branch %s is not tracked by this checkout", branch)
+	}
+	if err := checkoutBranchAt(ctx, c.exec, c.dir, branch, c.trackingRef(branch)); err != nil {
+		return err
+	}
+	c.config.Branch = branch
+	return nil
+}
+
+// remoteName gives what the checkout calls the remote it was cloned
+// from.
+func (c *Checkout) remoteName() string {
+	if c.config.RemoteName == "" {
+		return defaultRemoteName
+	}
+	return c.config.RemoteName
+}
+
+// trackingRef gives the ref for the branch as found in the remote
+// the checkout was cloned from.
+func (c *Checkout) trackingRef(branch string) string {
+	return "refs/remotes/" + c.remoteName() + "/" + branch
+}
+
+// pushedRef gives the ref for the branch as last fetched from, or
+// pushed to, wherever the checkout pushes; without a PushRemote,
+// that's the same as trackingRef.
+func (c *Checkout) pushedRef(branch string) string {
+	if c.config.PushRemote.URL == "" {
+		return c.trackingRef(branch)
+	}
+	name := c.config.PushRemoteName
+	if name == "" {
+		name = defaultPushRemoteName
+	}
+	return "refs/remotes/" + name + "/" + branch
+}
+
+// tracks says whether the branch given is one of those that can be
+// checked out.
+func (c *Checkout) tracks(branch string) bool {
+	for _, b := range c.branches {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+// renote puts back the notes on commits not yet pushed, after the
+// notes have been fetched afresh from upstream and the commits
+// (perhaps) rebased. Rebasing keeps the commits in order, but drops
+// any whose changes are already upstream; so the notes are matched
+// to the most recent commits on each branch by message, and those
+// for commits that were dropped are forgotten.
+func (c *Checkout) renote(ctx context.Context) error {
+	for branch, pending := range c.pending {
+		commits, err := logCommits(ctx, c.exec, c.dir, "||", "refs/heads/"+branch, nil, "--max-count="+strconv.Itoa(len(pending)), "--reverse")
+		if err != nil {
+			return err
+		}
+		var kept []pendingNote
+		i := 0
+		for _, commit := range commits {
+			for i < len(pending) && subject(pending[i].message) != subject(commit.Message) {
+				i++
+			}
+			if i == len(pending) {
+				break
+			}
+			p := pending[i]
+			p.rev = commit.Revision
+			if err := setNote(ctx, c.exec, c.dir, p.rev, c.config.NotesRef, p.note); err != nil {
+				return err
+			}
+			kept = append(kept, p)
+			i++
+		}
+		c.pending[branch] = kept
+	}
+	return nil
+}
+
+// subject gives the subject of a commit message as git does: the
+// first paragraph, on one line.
+func subject(message string) string {
+	return strings.Join(strings.Fields(strings.SplitN(strings.TrimSpace(message), "\n\n", 2)[0]), " ")
+}
+
+// verifyPushed checks that the branches given are upstream as they
+// are here, returning a DivergedAfterPushError if not.
+func (c *Checkout) verifyPushed(ctx context.Context, branches []string) error {
+	env, err := c.upstreamEnv(ctx, OpFetch)
+	if err != nil {
+		return err
+	}
+	for _, branch := range branches {
+		ref := "refs/heads/" + branch
+		pushed, err := refRevision(ctx, c.exec, c.dir, ref)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		remote, _, err := remoteRef(ctx, c.exec, c.dir, c.pushTo.URL, ref, env)
+		observe(c.observer, OpLsRemote, c.pushTo, start, err)
+		if err != nil {
+			return err
+		}
+		if remote != pushed {
+			return DivergedAfterPushError{Branch: branch, Pushed: pushed, Remote: remote}
+		}
+	}
+	return nil
+}
+
+// pushOptions gives the push options for pushing the commit action,
+// from the config and the commit action.
+func (c *Checkout) pushOptions(commitAction CommitAction) []string {
+	return append(append([]string{}, c.config.PushOptions...), commitAction.PushOptions...)
+}
+
+func (c *Checkout) pushBranchesAndNotes(ctx context.Context, branches, options []string, extra ...string) error {
+	ctx, cancel := withTimeout(ctx, c.config.PushTimeout)
+	defer cancel()
+	notesRefs, err := c.existingNotesRefs(ctx)
+	if err != nil {
+		return err
+	}
+	refs := append(append([]string{}, branches...), notesRefs...)
+	env, err := c.upstreamEnv(ctx, OpPush)
+	if err != nil {
+		return err
+	}
+	if len(options) > 0 && !c.noPushOptions {
+		args := append([]string{}, extra...)
+		for _, option := range options {
+			args = append(args, "--push-option="+option)
+		}
+		err := push(ctx, c.exec, c.dir, c.pushTo.URL, refs, env, args...)
+		if errors.Cause(err) != errPushOptionsUnsupported {
+			return err
+		}
+		// Don't bother trying again with this upstream
+		c.noPushOptions = true
+	}
+	return push(ctx, c.exec, c.dir, c.pushTo.URL, refs, env, extra...)
+}
+
+// PushNotes pushes all the notes refs, in a single push.
+func (c *Checkout) PushNotes(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, c.config.PushTimeout)
+	defer cancel()
+	refs, err := c.existingNotesRefs(ctx)
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	env, err := c.upstreamEnv(ctx, OpPush)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = push(ctx, c.exec, c.dir, c.pushTo.URL, refs, env)
+	observe(c.observer, OpPush, c.pushTo, start, err)
+	if err != nil {
+		return PushError(c.pushTo.URL, err)
+	}
+	return nil
+}
+
+// notesRefspecs gives the refspecs for fetching all the notes refs.
+func (c *Checkout) notesRefspecs() []string {
+	var refspecs []string
+	for _, ref := range append([]string{c.realNotesRef}, c.extraNotesRefs...) {
+		refspecs = append(refspecs, "+"+ref+":"+ref)
+	}
+	return refspecs
+}
+
+// existingNotesRefs gives those notes refs that have notes in them,
+// since there's no point pushing the others (and it would fail).
+func (c *Checkout) existingNotesRefs(ctx context.Context) ([]string, error) {
+	var refs []string
+	for _, ref := range append([]string{c.realNotesRef}, c.extraNotesRefs...) {
+		ok, err := refExists(ctx, c.exec, c.dir, ref)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// fetchUpstreamBranch fetches the branch given, and the notes, from
+// the upstream. It returns the ref the branch was fetched to, and
+// whether it exists upstream.
+func (c *Checkout) fetchUpstreamBranch(ctx context.Context, branch string) (string, bool, error) {
+	upstreamBranch := c.pushedRef(branch)
+	if err := c.fetchUpstream(ctx, branch); err != nil {
+		return upstreamBranch, false, err
+	}
+	ok, err := refExists(ctx, c.exec, c.dir, upstreamBranch)
+	return upstreamBranch, ok, err
+}
+
+// fetchUpstream fetches the branches given, and the notes, from the
+// upstream, with one fetch. The notes replace those in the checkout,
+// so renote should be used after.
+func (c *Checkout) fetchUpstream(ctx context.Context, branches ...string) error {
+	var refspecs []string
+	for _, branch := range branches {
+		upstreamBranch := c.pushedRef(branch)
+		// Forget what we knew of the branch, so that if it's been
+		// deleted upstream, we don't build on something stale.
+		if err := deleteRef(ctx, c.exec, c.dir, upstreamBranch); err != nil {
+			return err
+		}
+		refspecs = append(refspecs, "+refs/heads/"+branch+":"+upstreamBranch)
+	}
+	refspecs = append(refspecs, c.notesRefspecs()...)
+	env, err := c.upstreamEnv(ctx, OpFetch)
+	if err != nil {
+		return err
+	}
+	fetchCtx, cancel := withTimeout(ctx, c.config.FetchTimeout)
+	defer cancel()
+	return fetchExisting(fetchCtx, c.exec, c.dir, c.pushTo.URL, env, refspecs...)
+}
+
+// rebaseBranches fetches the branches given, and the notes, from the
+// upstream (rather than the mirror, which may be behind), and
+// rebases the local commits on each onto the upstream branch,
+// signing and dating them as for the commit action given. If a
+// branch isn't upstream, there's nothing to rebase onto, and its
+// commits are left as they are. The notes for commits not yet pushed
+// are put back, and the checkout is left on the branch it was on.
+func (c *Checkout) rebaseBranches(ctx context.Context, branches []string, commitAction CommitAction) (err error) {
+	if err := c.fetchUpstream(ctx, branches...); err != nil {
+		return err
+	}
+	current, err := currentBranch(ctx, c.exec, c.dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// This is done even if the context has expired, so the
+		// checkout is left on the branch it should be.
+		if cerr := checkout(context.Background(), c.exec, c.dir, current); cerr != nil && err == nil {
+			err = cerr
+		}
+		// What the rebase brought in is checked out as LFS
+		// pointers, as for lfsSkipSmudge.
+		if err == nil && c.config.EnableLFS {
+			err = c.lfsPull(ctx)
+		}
+	}()
+	rebaseEnv := append(committerDateEnv(commitAction.CommitDate), c.env...)
+	for _, branch := range branches {
+		upstreamBranch := c.pushedRef(branch)
+		if ok, err := refExists(ctx, c.exec, c.dir, upstreamBranch); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if err := checkout(ctx, c.exec, c.dir, branch); err != nil {
+			return err
+		}
+		if err := rebase(ctx, c.exec, c.dir, upstreamBranch, commitAction.SigningKey, commitAction.GPGPassphrase, rebaseEnv); err != nil {
+			return err
+		}
+	}
+	return c.renote(ctx)
+}
+
+// GetNote gets a note for the revision specified, or nil if there is no such note.
+func (c *Checkout) GetNote(ctx context.Context, rev string, note interface{}) (bool, error) {
+	return getNote(ctx, c.exec, c.dir, c.realNotesRef, rev, note)
+}
+
+// GetNoteRaw gets the content of the note for the revision specified,
+// exactly as it was written and without decoding it, e.g., for notes
+// that aren't JSON. It returns false if there is no such note.
+func (c *Checkout) GetNoteRaw(ctx context.Context, rev string) ([]byte, bool, error) {
+	return getNoteRaw(ctx, c.exec, c.dir, c.realNotesRef, rev)
+}
+
+// SetNoteRaw adds a note with the content given, as it is, for the
+// revision given, replacing any note already there. It is pushed with
+// the next CommitAndPush or PushNotes.
+func (c *Checkout) SetNoteRaw(ctx context.Context, rev string, content []byte) error {
+	return addNoteRaw(ctx, c.exec, c.dir, rev, c.realNotesRef, content, true)
+}
+
+// RemoveNote removes the note for the revision given, and pushes the
+// notes so it's gone upstream too. If there's no note for the
+// revision, there's nothing to do, and it returns nil.
+func (c *Checkout) RemoveNote(ctx context.Context, rev string) error {
+	_, ok, err := getNoteRaw(ctx, c.exec, c.dir, c.realNotesRef, rev)
+	if err != nil || !ok {
+		return err
+	}
+	if err := removeNote(ctx, c.exec, c.dir, c.realNotesRef, rev); err != nil {
+		return err
+	}
+	return c.PushNotes(ctx)
+}
+
+// GetNotes gets the notes for the revisions given, reading the notes
+// ref once rather than once per revision. Each note is decoded into a
+// fresh value from newNote, which should return a pointer. Revisions
+// without a note are absent from the result.
+func (c *Checkout) GetNotes(ctx context.Context, revs []string, newNote func() interface{}) (map[string]interface{}, error) {
+	return getNotes(ctx, c.exec, c.dir, c.realNotesRef, revs, newNote)
+}
+
+// GetNoteIn gets a note for the revision specified from the notes
+// ref given, rather than the configured NotesRef. It returns false if
+// there is no such note.
+func (c *Checkout) GetNoteIn(ctx context.Context, notesRef, rev string, note interface{}) (bool, error) {
+	return getNote(ctx, c.exec, c.dir, notesRef, rev, note)
+}
+
+// SetNoteIn adds a note for the revision given to the notes ref
+// given, replacing any note already there. It is pushed with the next
+// CommitAndPush or PushNotes, if the notes ref is among those
+// configured.
+func (c *Checkout) SetNoteIn(ctx context.Context, notesRef, rev string, note interface{}) error {
+	return setNote(ctx, c.exec, c.dir, rev, notesRef, note)
+}
+
+func (c *Checkout) HeadRevision(ctx context.Context) (string, error) {
+	return refRevision(ctx, c.exec, c.dir, "HEAD")
+}
+
+// SyncRevision gives the revision the sync tag points at, or a
+// RefNotFoundError if there is no sync tag.
+func (c *Checkout) SyncRevision(ctx context.Context) (string, error) {
+	return resolveRevision(ctx, c.exec, c.dir, "refs/tags/"+c.config.SyncTag)
+}
+
+func (c *Checkout) MoveSyncTagAndPush(ctx context.Context, tagAction TagAction) error {
+	defer zero(tagAction.GPGPassphrase)
+	ctx, cancel := withTimeout(ctx, c.config.PushTimeout)
+	defer cancel()
+	tagAction, err := c.prepareTagAction(ctx, tagAction)
+	if err != nil {
+		return err
+	}
+	env, err := c.upstreamEnv(ctx, OpPush)
+	if err != nil {
+		return err
+	}
+	c.tagsMu.Lock()
+	defer c.tagsMu.Unlock()
+	if err := c.checkSyncTagAdvance(ctx, tagAction.Revision); err != nil {
+		return err
+	}
+	start := time.Now()
+	err = moveTagAndPush(ctx, c.exec, c.dir, c.config.SyncTag, c.pushTo.URL, tagAction, env)
+	observe(c.observer, OpPush, c.pushTo, start, err)
+	return err
+}
+
+// PushWithSyncTag moves the sync tag as MoveSyncTagAndPush does, and
+// pushes it along with the branches given (or, if none are given,
+// the branch the checkout is on) and the notes, in one atomic push;
+// so either the branches and the tag are updated upstream, or none of
+// them are, and the tag isn't left marking commits that didn't get
+// there. If the upstream can't do atomic pushes, the branches and
+// notes are pushed first, then the tag, and Config.Warn is given
+// ErrAtomicPushUnsupported. Unlike Push, a rejected push isn't
+// retried, since rebasing the branches would leave the tag behind.
+func (c *Checkout) PushWithSyncTag(ctx context.Context, tagAction TagAction, branches ...string) error {
+	defer zero(tagAction.GPGPassphrase)
+	if err := c.ensureOnBranch(ctx); err != nil {
+		return err
+	}
+	if len(branches) == 0 {
+		branches = []string{c.config.Branch}
+	}
+	ctx, cancel := withTimeout(ctx, c.config.PushTimeout)
+	defer cancel()
+	tagAction, err := c.prepareTagAction(ctx, tagAction)
+	if err != nil {
+		return err
+	}
+	notesRefs, err := c.existingNotesRefs(ctx)
+	if err != nil {
+		return err
+	}
+	env, err := c.upstreamEnv(ctx, OpPush)
+	if err != nil {
+		return err
+	}
+
+	c.tagsMu.Lock()
+	defer c.tagsMu.Unlock()
+	if err := c.checkSyncTagAdvance(ctx, tagAction.Revision); err != nil {
+		return err
+	}
+	if err := moveTag(ctx, c.exec, c.dir, c.config.SyncTag, tagAction, env); err != nil {
+		return err
+	}
+	tagRef := "+refs/tags/" + c.config.SyncTag + ":refs/tags/" + c.config.SyncTag
+	refs := append(append(append([]string{}, branches...), notesRefs...), tagRef)
+	start := time.Now()
+	err = push(ctx, c.exec, c.dir, c.pushTo.URL, refs, env, "--atomic")
+	if errors.Cause(err) == errAtomicPushUnsupported {
+		if c.config.Warn != nil {
+			c.config.Warn(ErrAtomicPushUnsupported)
+		}
+		err = push(ctx, c.exec, c.dir, c.pushTo.URL, refs[:len(refs)-1], env)
+		if err == nil {
+			err = push(ctx, c.exec, c.dir, c.pushTo.URL, []string{tagRef}, env)
+		}
+	}
+	observe(c.observer, OpPush, c.pushTo, start, err)
+	if err != nil {
+		return PushError(c.pushTo.URL, err)
+	}
+	return c.pushed(ctx, branches)
+}
+
+// checkSyncTagAdvance returns a SyncTagRollbackError if the config
+// says the sync tag only moves forward, and the revision given isn't
+// descended from where it is. It's fine for the tag not to exist yet.
+func (c *Checkout) checkSyncTagAdvance(ctx context.Context, rev string) error {
+	if !c.config.SyncTagForwardOnly {
+		return nil
+	}
+	current, err := resolveRevision(ctx, c.exec, c.dir, "refs/tags/"+c.config.SyncTag)
+	if _, ok := err.(RefNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	forward, err := isAncestor(ctx, c.exec, c.dir, current, rev)
+	if err != nil {
+		return err
+	}
+	if !forward {
+		return SyncTagRollbackError{Tag: c.config.SyncTag, Current: current, Revision: rev}
+	}
+	return nil
+}
+
+// prepareTagAction fills in the tag action from the config, and its
+// State, if it has one.
+func (c *Checkout) prepareTagAction(ctx context.Context, tagAction TagAction) (TagAction, error) {
+	if tagAction.SigningKey == "" {
+		tagAction.SigningKey = c.config.SigningKey
+	}
+	signingKey, err := resolveSigningKey(ctx, tagAction.SigningKey, c.env)
+	if err != nil {
+		return tagAction, err
+	}
+	tagAction.SigningKey = signingKey
+	if tagAction.State != nil {
+		state := *tagAction.State
+		if state.Revision == "" {
+			state.Revision = tagAction.Revision
+		}
+		message, err := json.Marshal(state)
+		if err != nil {
+			return tagAction, err
+		}
+		tagAction.Message = string(message)
+	}
+	return tagAction, nil
+}
+
+// upstreamEnv gives the environment for a command that talks to the
+// upstream, getting the credentials for the operation afresh.
+func (c *Checkout) upstreamEnv(ctx context.Context, op Operation) ([]string, error) {
+	env, err := c.transport.env(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	return append(env, c.env...), nil
+}
+
+// lfsPull gets the Git LFS content for the checkout from the
+// upstream.
+func (c *Checkout) lfsPull(ctx context.Context) error {
+	env, err := c.upstreamEnv(ctx, OpFetch)
+	if err != nil {
+		return err
+	}
+	return lfsPull(ctx, c.exec, c.dir, c.upstream.URL, env)
+}
+
+// updateSubmodules checks out the submodules of the checkout as
+// Config.Submodules says, if any.
+func (c *Checkout) updateSubmodules(ctx context.Context) error {
+	var (
+		depth     int
+		recursive bool
+	)
+	switch c.config.Submodules {
+	case "", SubmodulesNone:
+		return nil
+	case SubmodulesShallow:
+		depth = 1
+	case SubmodulesRecursive:
+		recursive = true
+	default:
+		_, err := ParseSubmoduleMode(string(c.config.Submodules))
+		return err
+	}
+	env, err := c.upstreamEnv(ctx, OpFetch)
+	if err != nil {
+		return err
+	}
+	return submoduleUpdate(ctx, c.exec, c.dir, c.remoteName(), c.upstream.URL, depth, recursive, env)
+}
+
+func (c *Checkout) VerifySyncTag(ctx context.Context) error {
+	return verifyTag(ctx, c.exec, c.dir, c.config.SyncTag, c.env)
+}
+
+// withTimeout gives a context with the timeout given, or just a
+// cancellable context if the timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// ensureRevision makes sure the revision given is present in a
+// shallow checkout, deepening the clone if necessary.
+func (c *Checkout) ensureRevision(ctx context.Context, rev string) error {
+	if c.config.CloneDepth <= 0 {
+		return nil
+	}
+	if ok, err := refExists(ctx, c.exec, c.dir, rev); ok || err != nil {
+		return err
+	}
+	if shallow, err := isShallow(ctx, c.exec, c.dir); err != nil || !shallow {
+		return err
+	}
+	if err := unshallow(ctx, c.exec, c.dir, c.remoteName()); err != nil {
+		return err
+	}
+	if ok, err := refExists(ctx, c.exec, c.dir, rev); !ok || err != nil {
+		if err == nil {
+			err = ShallowCloneError{Revision: rev, Depth: c.config.CloneDepth}
+		}
+		return err
+	}
+	return nil
+}
+
+// ChangedFiles does a git diff listing changed files
+func (c *Checkout) ChangedFiles(ctx context.Context, ref string) ([]string, error) {
+	if err := c.ensureRevision(ctx, ref); err != nil {
+		return nil, err
+	}
+	list, err := changed(ctx, c.exec, c.dir, ref, c.config.Paths)
 	if err == nil {
 		for i, file := range list {
 			list[i] = filepath.Join(c.dir, file)
@@ -200,5 +2445,5 @@ func (c *Checkout) ChangedFiles(ctx context.Context, ref string) ([]string, erro
 }
 
 func (c *Checkout) NoteRevList(ctx context.Context) (map[string]struct{}, error) {
-	return noteRevList(ctx, c.dir, c.realNotesRef)
+	return noteRevList(ctx, c.exec, c.dir, c.realNotesRef)
 }
@@ -0,0 +1,117 @@
+package git
+
+import (
+	"context"
+)
+
+// Tree is a working tree of the repo at some revision, to read
+// manifests from. Both a Checkout and a Worktree are Trees, so that
+// code that only reads can be given either.
+type Tree interface {
+	Dir() string
+	ManifestDirs() []string
+	ManifestFiles(ctx context.Context) ([]string, error)
+	ManifestFilesByDir(ctx context.Context) (map[string][]string, error)
+	HeadRevision(ctx context.Context) (string, error)
+	ChangedFiles(ctx context.Context, ref string) ([]string, error)
+	Clean()
+}
+
+var (
+	_ Tree = &Checkout{}
+	_ Tree = &Worktree{}
+)
+
+// Worktree is a working tree at a particular revision, sharing the
+// object store of the repo it came from. This makes it much cheaper
+// to create than a clone. It can be read as a Checkout can, but
+// there's no committing or pushing from it.
+type Worktree struct {
+	repo *Repo
+	dir  string
+	// for reading the working tree, which Checkout already knows
+	// how to do; it's never committed from
+	tree *Checkout
+}
+
+// Dir returns the path to the working tree.
+func (w *Worktree) Dir() string {
+	return w.dir
+}
+
+// ManifestDirs returns the paths to the manifests files in the
+// working tree, as for `Checkout.ManifestDirs`.
+func (w *Worktree) ManifestDirs() []string {
+	return w.tree.ManifestDirs()
+}
+
+// ManifestFiles returns the files under the manifest paths, as for
+// `Checkout.ManifestFiles`.
+func (w *Worktree) ManifestFiles(ctx context.Context) ([]string, error) {
+	return w.tree.ManifestFiles(ctx)
+}
+
+// ManifestFilesByDir returns the files under each of ManifestDirs,
+// as for `Checkout.ManifestFilesByDir`.
+func (w *Worktree) ManifestFilesByDir(ctx context.Context) (map[string][]string, error) {
+	return w.tree.ManifestFilesByDir(ctx)
+}
+
+// HeadRevision gives the revision the working tree is at.
+func (w *Worktree) HeadRevision(ctx context.Context) (string, error) {
+	return w.tree.HeadRevision(ctx)
+}
+
+// ChangedFiles gives the files under the manifest paths that have
+// changed since the ref given, as for `Checkout.ChangedFiles`.
+func (w *Worktree) ChangedFiles(ctx context.Context, ref string) ([]string, error) {
+	return w.tree.ChangedFiles(ctx, ref)
+}
+
+// Clean removes the working tree, and its record in the repo.
+func (w *Worktree) Clean() {
+	if w.dir == "" {
+		return
+	}
+	unlock := w.repo.rhold("Worktree.Clean")
+	if w.repo.dir != "" {
+		w.repo.worktreeMu.Lock()
+		removeWorktree(context.Background(), w.repo.exec, w.repo.dir, w.dir)
+		w.repo.worktreeMu.Unlock()
+	}
+	unlock()
+	removeTempDir(w.dir)
+}
+
+// Worktree makes a working tree of the repo at the ref given. The
+// HEAD of the working tree is detached, so that there can be any
+// number of worktrees at the same branch. Of the config given, only
+// Paths and Ignore are used, for reading manifests as a Checkout
+// does.
+func (r *Repo) Worktree(ctx context.Context, ref string, conf Config) (*Worktree, error) {
+	unlock, err := r.rlock(ctx, "Worktree")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := r.errorIfNotReady(); err != nil {
+		return nil, err
+	}
+	dir, err := makeTempDir(worktreeDirPrefix)
+	if err != nil {
+		return nil, err
+	}
+	r.worktreeMu.Lock()
+	err = addWorktree(ctx, r.exec, r.dir, dir, ref)
+	r.worktreeMu.Unlock()
+	if err != nil {
+		removeTempDir(dir)
+		return nil, err
+	}
+	tree := &Checkout{
+		dir:    dir,
+		config: Config{Paths: conf.Paths, Ignore: conf.Ignore},
+		exec:   r.exec,
+	}
+	return &Worktree{repo: r, dir: dir, tree: tree}, nil
+}
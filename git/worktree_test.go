@@ -0,0 +1,132 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/flux/cluster/kubernetes/testfiles"
+)
+
+func TestWorktree(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"dev", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	refs := []string{"HEAD", "HEAD~1", "HEAD", "HEAD~2"}
+	worktrees := make([]*Worktree, len(refs))
+	errs := make([]error, len(refs))
+	var wg sync.WaitGroup
+	for i, ref := range refs {
+		wg.Add(1)
+		go func(i int, ref string) {
+			defer wg.Done()
+			worktrees[i], errs[i] = repo.Worktree(ctx, ref, Config{})
+		}(i, ref)
+	}
+	wg.Wait()
+
+	for i, ref := range refs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		expected, err := repo.Revision(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := refRevision(ctx, gitExec{}, worktrees[i].Dir(), "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head != expected {
+			t.Errorf("expected worktree for %s to be at %s, but it is at %s", ref, expected, head)
+		}
+	}
+
+	for _, w := range worktrees {
+		w.Clean()
+		if _, err := os.Stat(w.Dir()); !os.IsNotExist(err) {
+			t.Errorf("expected worktree %s to be removed", w.Dir())
+		}
+	}
+}
+
+func TestWorktree_Tree(t *testing.T) {
+	newDir, cleanup := testfiles.TempDir(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := createRepo(newDir, []string{"dev", "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepo(Remote{URL: newDir}, ReadOnly)
+	if err := repo.Ready(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Clean()
+
+	w, err := repo.Worktree(ctx, "HEAD", Config{Paths: []string{"prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Clean()
+
+	// It reads the same as a checkout would
+	var tree Tree = w
+	assert.Equal(t, []string{filepath.Join(w.Dir(), "prod")}, tree.ManifestDirs())
+	files, err := tree.ManifestFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("expected manifest files in the worktree")
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file, filepath.Join(w.Dir(), "prod")+string(filepath.Separator)) {
+			t.Errorf("expected only files under prod, got %s", file)
+		}
+	}
+	byDir, err := tree.ManifestFilesByDir(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string][]string{filepath.Join(w.Dir(), "prod"): files}, byDir)
+
+	head, err := tree.HeadRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := repo.Revision(ctx, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, expected, head)
+
+	// prod was added after HEAD~2, so everything in it has changed
+	changed, err := tree.ChangedFiles(ctx, "HEAD~2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(changed)
+	sort.Strings(files)
+	assert.Equal(t, files, changed)
+}
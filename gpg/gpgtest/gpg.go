@@ -16,6 +16,16 @@ import (
 // Since GPG uses /dev/random, this may block while waiting for entropy to
 // become available.
 func GPGKey(t *testing.T) (string, string, func()) {
+	return gpgKey(t, "")
+}
+
+// GPGKeyWithPassphrase is like GPGKey, but the private key is
+// protected by the passphrase given.
+func GPGKeyWithPassphrase(t *testing.T, passphrase string) (string, string, func()) {
+	return gpgKey(t, passphrase)
+}
+
+func gpgKey(t *testing.T, passphrase string) (string, string, func()) {
 	newDir, cleanup := testfiles.TempDir(t)
 
 	cmd := exec.Command("gpg", "--homedir", newDir, "--batch", "--gen-key")
@@ -31,7 +41,11 @@ func GPGKey(t *testing.T) (string, string, func()) {
 	io.WriteString(stdin, "Key-Usage: sign\n")
 	io.WriteString(stdin, "Name-Real: Weave Flux\n")
 	io.WriteString(stdin, "Name-Email: flux@weave.works\n")
-	io.WriteString(stdin, "%no-protection\n")
+	if passphrase == "" {
+		io.WriteString(stdin, "%no-protection\n")
+	} else {
+		io.WriteString(stdin, "Passphrase: "+passphrase+"\n")
+	}
 	stdin.Close()
 
 	if err := cmd.Run(); err != nil {
@@ -9,6 +9,10 @@ const (
 	LabelMethod  = "method"
 	LabelSuccess = "success"
 
+	// Labels for git metrics
+	LabelOperation = "operation"
+	LabelURL       = "url"
+
 	// Labels for release metrics
 	LabelAction      = "action"
 	LabelReleaseType = "release_type"
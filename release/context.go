@@ -1,6 +1,7 @@
 package release
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -37,7 +38,11 @@ func (rc *ReleaseContext) Registry() registry.Registry {
 }
 
 func (rc *ReleaseContext) LoadManifests() (map[string]resource.Resource, error) {
-	return rc.manifests.LoadManifests(rc.repo.Dir(), rc.repo.ManifestDirs())
+	files, err := rc.repo.ManifestFiles(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return rc.manifests.LoadManifests(rc.repo.Dir(), files)
 }
 
 func (rc *ReleaseContext) WriteUpdates(updates []*update.WorkloadUpdate) error {